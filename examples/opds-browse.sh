@@ -0,0 +1,80 @@
+#! /bin/sh
+# Browse an OPDS catalog (Komga, Kavita, LANraragi, etc) using zenity and open the selected
+# publication in the running instance of aw-man.
+# Downloads are written to aw-man's temporary directory and are deleted when it exits.
+# Requires curl, python3, zenity, nc, and that socket_dir be configured.
+
+# You may want to edit these.
+catalog="${OPDS_CATALOG:-http://localhost:25600/opds/v1.2/catalog}"
+# Credentials in the form user:password, if the catalog requires them.
+auth="${OPDS_AUTH:-}"
+
+set -e
+
+if [ -z "$AWMAN_SOCKET" ] || [ -z "$AWMAN_TEMP_DIR" ]; then
+  echo "Must be run from aw-man with socket_dir configured"
+  exit 1
+fi
+
+fetch() {
+  if [ -n "$auth" ]; then
+    curl -fsSL -u "$auth" "$@"
+  else
+    curl -fsSL "$@"
+  fi
+}
+
+# Prints two lines per entry: "nav:URL" or "get:URL", then the title.
+parse() {
+  python3 -c '
+import sys
+import xml.etree.ElementTree as ET
+from urllib.parse import urljoin
+
+base = sys.argv[1]
+ns = {"a": "http://www.w3.org/2005/Atom"}
+root = ET.parse(sys.stdin).getroot()
+
+for entry in root.findall("a:entry", ns):
+    title = " ".join((entry.findtext("a:title", "", ns) or "").split())
+    for link in entry.findall("a:link", ns):
+        rel, typ, href = link.get("rel", ""), link.get("type", ""), link.get("href")
+        if not href:
+            continue
+        if rel.startswith("http://opds-spec.org/acquisition"):
+            print("get:" + urljoin(base, href))
+            print(title)
+            break
+        if typ.startswith("application/atom+xml"):
+            print("nav:" + urljoin(base, href))
+            print(title)
+            break
+
+for link in root.findall("a:link", ns):
+    if link.get("rel") == "next" and link.get("href"):
+        print("nav:" + urljoin(base, link.get("href")))
+        print("Next page")
+' "$1"
+}
+
+url="$catalog"
+
+while true; do
+  choice=$(fetch "$url" | parse "$url" | zenity --list --title="OPDS" --width=800 --height=600 \
+    --column=URL --column=Title --hide-column=1 --print-column=1) || exit 0
+
+  case "$choice" in
+    nav:*)
+      url="${choice#nav:}"
+      ;;
+    get:*)
+      cd "$AWMAN_TEMP_DIR"
+      name=$(fetch -OJ -w '%{filename_effective}' "${choice#get:}")
+      echo "Open $AWMAN_TEMP_DIR/$name" | nc -U "$AWMAN_SOCKET"
+      exit 0
+      ;;
+    *)
+      exit 0
+      ;;
+  esac
+done
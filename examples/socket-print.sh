@@ -1,10 +1,10 @@
 #! /bin/sh
 # An example script for x11 that connects to the socket for the instance of aw-man that the
-# user clicks on. Requires that SocketDir be configured (and this script assumes /tmp/).
+# user clicks on. Requires that socket_dir be configured.
 
 set -e
 
 pid=$(xprop _NET_WM_PID | sed 's/_NET_WM_PID(CARDINAL) = //')
 
-echo "Status" | nc -U "/tmp/aw-man${pid}.sock" | jq
+aw-man remote --pid "$pid" Status | jq
 
@@ -0,0 +1,253 @@
+// Measures how quickly a single archive or directory can be listed, extracted, decoded, scaled,
+// and optionally upscaled with the current config, without opening any windows.
+//
+// Every stage runs to completion before the next one starts, so the numbers are throughput for
+// each stage in isolation. The real viewer overlaps them and will usually be faster overall.
+
+use std::ffi::OsStr;
+use std::fs::{self, File};
+use std::io::BufReader;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::AtomicBool;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use compress_tools::{ArchiveContents, ArchiveIterator};
+use rayon::prelude::*;
+use rayon::ThreadPoolBuilder;
+use tempfile::TempDir;
+
+use crate::com::{DisplayMode, Fit, Image, Res, WorkParams};
+use crate::config::{CONFIG, TARGET_RES};
+use crate::manager::files::{
+    is_archive_path, is_jxl, is_natively_supported_image, is_supported_page_extension, is_webp,
+};
+use crate::pools::{downscaling, loading, upscaling};
+use crate::{natsort, Result};
+
+// Upscaling is slow enough that a handful of pages gives a good enough estimate.
+const UPSCALE_PAGES: usize = 10;
+
+// Used when no target_resolution is configured, to still get a meaningful scaling number.
+const DEFAULT_TARGET: Res = Res { w: 1920, h: 1080 };
+
+struct Stage {
+    name: &'static str,
+    count: usize,
+    bytes: u64,
+    elapsed: Duration,
+}
+
+impl Stage {
+    fn time<T>(
+        name: &'static str,
+        f: impl FnOnce() -> Result<(T, usize, u64)>,
+    ) -> Result<(T, Self)> {
+        let start = Instant::now();
+        let (out, count, bytes) = f()?;
+        Ok((out, Self { name, count, bytes, elapsed: start.elapsed() }))
+    }
+
+    fn print(&self) {
+        let secs = self.elapsed.as_secs_f64();
+        let per_sec = if secs > 0.0 { self.count as f64 / secs } else { f64::INFINITY };
+        let mut line = format!(
+            "{:<12}{:>6} files in {:>9.1}ms  {:>8.1} files/s",
+            self.name,
+            self.count,
+            secs * 1000.0,
+            per_sec
+        );
+
+        if self.bytes > 0 && secs > 0.0 {
+            line += &format!("  {:>8.1} MiB/s", self.bytes as f64 / secs / 1024.0 / 1024.0);
+        }
+        println!("{}", line);
+    }
+}
+
+// Returns false so the caller exits instead of opening a window. Failures exit immediately with a
+// non-zero status, like remote commands.
+pub fn run(path: &Path, with_upscale: bool) -> bool {
+    if let Err(e) = bench(path, with_upscale) {
+        eprintln!("Benchmarking {:?} failed: {}", path, e);
+        std::process::exit(1);
+    }
+    false
+}
+
+fn bench(path: &Path, with_upscale: bool) -> Result<()> {
+    let mut builder = tempfile::Builder::new();
+    builder.prefix("aw-man-bench");
+    let temp_dir = CONFIG
+        .temp_directory
+        .as_ref()
+        .map_or_else(|| builder.tempdir(), |d| builder.tempdir_in(d))?;
+
+    println!("Benchmarking {:?}", path);
+    println!(
+        "loading_threads: {}, downscaling_threads: {}, upscaling_threads: {}",
+        CONFIG.loading_threads, CONFIG.downscaling_threads, CONFIG.upscaling_threads
+    );
+    println!();
+
+    let files = if is_archive_path(path) {
+        let (pages, stage) = Stage::time("List", || list_archive(path))?;
+        stage.print();
+        let (files, stage) = Stage::time("Extract", || extract(path, &pages, &temp_dir))?;
+        stage.print();
+        files
+    } else {
+        let (files, stage) = Stage::time("List", || list_directory(path))?;
+        stage.print();
+        files
+    };
+
+    let images: Vec<_> = files
+        .into_iter()
+        .filter(|f| is_natively_supported_image(f) || is_webp(f) || is_jxl(f))
+        .collect();
+
+    let target_res = if TARGET_RES.is_zero_area() { DEFAULT_TARGET } else { *TARGET_RES };
+    let params = WorkParams {
+        park_before_scale: false,
+        jump_downscaling_queue: false,
+        extract_early: false,
+        low_memory: false,
+        target_res: (target_res, Fit::Container, DisplayMode::Single).into(),
+        distance: 0,
+    };
+
+    let (decoded, stage) = Stage::time("Decode", || decode(&images, params))?;
+    stage.print();
+
+    let (_, stage) = Stage::time("Scale", || scale(decoded, params))?;
+    stage.print();
+
+    if with_upscale {
+        let (_, stage) = Stage::time("Upscale", || upscale(&images, &temp_dir))?;
+        stage.print();
+    }
+
+    temp_dir.close()?;
+    Ok(())
+}
+
+fn list_archive(path: &Path) -> Result<(Vec<String>, usize, u64)> {
+    let names = compress_tools::list_archive_files(BufReader::new(File::open(path)?))?;
+    let pages: Vec<_> = names.into_iter().filter(|n| is_supported_page_extension(n)).collect();
+    let n = pages.len();
+    Ok((pages, n, 0))
+}
+
+fn list_directory(path: &Path) -> Result<(Vec<PathBuf>, usize, u64)> {
+    let mut pages: Vec<_> = fs::read_dir(path)?
+        .filter_map(|e| e.ok().map(|e| e.path()))
+        .filter(|p| p.is_file() && is_supported_page_extension(p))
+        .collect();
+    pages.sort_by_cached_key(|p| natsort::key(p.file_name().unwrap_or_else(|| OsStr::new(""))));
+    let n = pages.len();
+    Ok((pages, n, 0))
+}
+
+fn extract(
+    source: &Path,
+    pages: &[String],
+    temp_dir: &TempDir,
+) -> Result<(Vec<PathBuf>, usize, u64)> {
+    let iter = ArchiveIterator::from_read(BufReader::new(File::open(source)?))?;
+
+    let mut out = Vec::with_capacity(pages.len());
+    let mut bytes = 0;
+    let mut relpath = String::default();
+    let mut data: Vec<u8> = Vec::with_capacity(1_048_576);
+
+    for cont in iter {
+        match cont {
+            ArchiveContents::StartOfEntry(s) => relpath = s,
+            ArchiveContents::DataChunk(d) => data.extend(d),
+            ArchiveContents::EndOfEntry => {
+                let current_file = std::mem::replace(&mut data, Vec::with_capacity(1_048_576));
+                if !pages.contains(&relpath) {
+                    continue;
+                }
+
+                let ext = Path::new(&relpath).extension().unwrap_or_default();
+                let dest = temp_dir.path().join(out.len().to_string()).with_extension(ext);
+                bytes += current_file.len() as u64;
+                fs::write(&dest, current_file)?;
+                out.push(dest);
+            }
+            ArchiveContents::Err(e) => return Err(Box::new(e)),
+        }
+    }
+
+    let n = out.len();
+    Ok((out, n, bytes))
+}
+
+fn decode(images: &[PathBuf], params: WorkParams) -> Result<(Vec<Image>, usize, u64)> {
+    let pool = ThreadPoolBuilder::new().num_threads(CONFIG.loading_threads.get()).build()?;
+
+    let decoded: Vec<_> = pool.install(|| {
+        images
+            .par_iter()
+            .filter_map(|p| {
+                let cancel = Arc::new(AtomicBool::new(false));
+                match loading::static_image::load_image(p.clone(), params, cancel) {
+                    Ok(uimg) => Some(uimg.0),
+                    Err(e) => {
+                        warn!("Failed to decode {:?}: {:?}", p, e);
+                        None
+                    }
+                }
+            })
+            .collect()
+    });
+
+    let bytes = images.iter().filter_map(|p| p.metadata().ok()).map(|m| m.len()).sum();
+    let n = decoded.len();
+    Ok((decoded, n, bytes))
+}
+
+fn scale(images: Vec<Image>, params: WorkParams) -> Result<((), usize, u64)> {
+    let pool = ThreadPoolBuilder::new().num_threads(CONFIG.downscaling_threads.get()).build()?;
+
+    let n = pool.install(|| {
+        images
+            .par_iter()
+            .map(|img| {
+                let res = img.res.fit_inside(params.target_res);
+                if res != img.res {
+                    drop(img.downscale(res, downscaling::filter(params)));
+                }
+            })
+            .count()
+    });
+
+    Ok(((), n, 0))
+}
+
+fn upscale(images: &[PathBuf], temp_dir: &TempDir) -> Result<((), usize, u64)> {
+    let pool = ThreadPoolBuilder::new().num_threads(CONFIG.upscaling_threads.get()).build()?;
+
+    let n = pool.install(|| {
+        images
+            .par_iter()
+            .take(UPSCALE_PAGES)
+            .enumerate()
+            .filter(|(i, p)| {
+                let dest = temp_dir.path().join(format!("upscaled-{}.png", i));
+                match upscaling::upscale_blocking(p.to_path_buf(), dest) {
+                    Ok(_) => true,
+                    Err(e) => {
+                        warn!("Failed to upscale {:?}: {:?}", p, e);
+                        false
+                    }
+                }
+            })
+            .count()
+    });
+
+    Ok(((), n, 0))
+}
@@ -9,6 +9,8 @@ use ahash::AHashMap;
 use derive_more::{Deref, From};
 use gl::types::GLenum;
 use image::{DynamicImage, GenericImageView};
+use rayon::iter::{IndexedParallelIterator, ParallelIterator};
+use rayon::slice::{ParallelSlice, ParallelSliceMut};
 
 use super::{DedupedVec, Res};
 use crate::resample;
@@ -170,14 +172,14 @@ impl From<DynamicImage> for Image {
                 return Self::from_grey_a_buffer(ga.into_vec(), res);
             }
             DynamicImage::ImageRgb8(rgb) => {
-                if rgb.chunks_exact(3).all(|c| c[0] == c[1] && c[1] == c[2]) {
-                    let g = rgb.into_vec().into_iter().step_by(3).collect();
+                if is_grey_rgb(&rgb) {
+                    let g = repack::<3, 1>(&rgb, [0]);
                     return Self::from_grey_buffer(g, res);
                 }
                 return Self::from_rgb_buffer(rgb.into_vec(), res);
             }
             DynamicImage::ImageRgb16(rgb) => {
-                if rgb.chunks_exact(3).all(|c| c[0] == c[1] && c[1] == c[2]) {
+                if is_grey_rgb(&rgb) {
                     let g = DynamicImage::ImageRgb16(rgb).into_luma8();
                     return Self::from_grey_buffer(g.into_vec(), res);
                 }
@@ -190,36 +192,57 @@ impl From<DynamicImage> for Image {
 
         let img = img.into_rgba8();
 
-        let is_grey = img.chunks_exact(4).all(|c| c[0] == c[1] && c[1] == c[2]);
-        let opaque = img.chunks_exact(4).all(|c| c[3] == 255);
+        let (is_grey, opaque) = scan_rgba(&img);
         match (is_grey, opaque) {
             (false, false) => Self::from_rgba_buffer(img.into_vec(), res),
-            (true, true) => {
-                let new_img = img.into_vec().into_iter().step_by(4).collect();
-                Self::from_grey_buffer(new_img, res)
-            }
-            (false, true) => {
-                let mut new_img = vec![0; img.as_raw().len() / 4 * 3];
-                new_img.chunks_exact_mut(3).zip(img.chunks_exact(4)).for_each(|(nc, oc)| {
-                    nc[0] = oc[0];
-                    nc[1] = oc[1];
-                    nc[2] = oc[2];
-                });
-                Self::from_rgb_buffer(new_img, res)
-            }
-            (true, false) => {
-                let mut new_img = vec![0; img.as_raw().len() / 2];
-                new_img.chunks_exact_mut(2).zip(img.chunks_exact(4)).for_each(|(nc, oc)| {
-                    nc[0] = oc[0];
-                    nc[1] = oc[3];
-                });
-                Self::from_grey_a_buffer(new_img, res)
-            }
+            (true, true) => Self::from_grey_buffer(repack::<4, 1>(&img, [0]), res),
+            (false, true) => Self::from_rgb_buffer(repack::<4, 3>(&img, [0, 1, 2]), res),
+            (true, false) => Self::from_grey_a_buffer(repack::<4, 2>(&img, [0, 3]), res),
         }
     }
 }
 
+// Large pages are checked and repacked in parallel, a chunk of pixels at a time, since doing it
+// byte by byte on a single thread can take tens of milliseconds.
+const CHUNK_PIXELS: usize = 1 << 16;
+
+// Returns whether every pixel is grey and whether every pixel is opaque, in a single pass.
+fn scan_rgba(data: &[u8]) -> (bool, bool) {
+    data.par_chunks(CHUNK_PIXELS * 4)
+        .map(|chunk| {
+            chunk.chunks_exact(4).fold((true, true), |(grey, opaque), c| {
+                (grey && c[0] == c[1] && c[1] == c[2], opaque && c[3] == 255)
+            })
+        })
+        .reduce(|| (true, true), |a, b| (a.0 && b.0, a.1 && b.1))
+}
+
+fn is_grey_rgb<T: PartialEq + Sync>(data: &[T]) -> bool {
+    data.par_chunks(CHUNK_PIXELS * 3)
+        .all(|chunk| chunk.chunks_exact(3).all(|c| c[0] == c[1] && c[1] == c[2]))
+}
+
+// Copies the selected channels out of each pixel of an M channel image into a new N channel image.
+fn repack<const M: usize, const N: usize>(data: &[u8], channels: [usize; N]) -> Vec<u8> {
+    let mut out = vec![0; data.len() / M * N];
+    out.par_chunks_mut(CHUNK_PIXELS * N)
+        .zip(data.par_chunks(CHUNK_PIXELS * M))
+        .for_each(|(o, i)| {
+            o.chunks_exact_mut(N).zip(i.chunks_exact(M)).for_each(|(nc, oc)| {
+                for (n, c) in nc.iter_mut().zip(channels) {
+                    *n = oc[c];
+                }
+            });
+        });
+    out
+}
+
 impl Image {
+    // Bytes of pixel data, which may be shared with other clones of this image.
+    pub fn memory_size(&self) -> usize {
+        self.data.len()
+    }
+
     pub fn as_ptr(&self) -> *const u8 {
         self.data.as_ptr()
     }
@@ -230,6 +253,36 @@ impl Image {
         std::ptr::addr_of!(self.data[y as usize * self.stride + x as usize * self.data.channels()])
     }
 
+    // The average sRGB colour of the outermost pixels, ignoring alpha.
+    pub fn border_colour(&self) -> Option<[f32; 3]> {
+        let (w, h) = (self.res.w as usize, self.res.h as usize);
+        if w == 0 || h == 0 {
+            return None;
+        }
+
+        let channels = self.data.channels();
+        let mut sum = [0_u64; 3];
+        let mut count = 0_u64;
+        let mut add = |x: usize, y: usize| {
+            let i = y * self.stride + x * channels;
+            let px = &self.data[i..i + channels];
+            let rgb = if channels >= 3 { [px[0], px[1], px[2]] } else { [px[0]; 3] };
+            sum.iter_mut().zip(rgb).for_each(|(s, c)| *s += c as u64);
+            count += 1;
+        };
+
+        for x in 0..w {
+            add(x, 0);
+            add(x, h - 1);
+        }
+        for y in 1..h.saturating_sub(1) {
+            add(0, y);
+            add(w - 1, y);
+        }
+
+        Some(sum.map(|s| s as f32 / count as f32 / 255.0))
+    }
+
     fn from_rgba_buffer(img: Vec<u8>, res: Res) -> Self {
         let stride = res.w as usize * 4;
         let data = Arc::new(ImageData::Rgba(img));
@@ -254,14 +307,14 @@ impl Image {
         Self { data, res, stride }
     }
 
-    pub fn downscale(&self, target_res: Res) -> Self {
+    pub fn downscale(&self, target_res: Res, filter: resample::FilterType) -> Self {
         match &*self.data.as_ref() {
             ImageData::Rgba(v) => {
                 let img = resample::resize_par_linear::<4>(
                     v,
                     self.res,
                     target_res,
-                    resample::FilterType::CatmullRom,
+                    filter,
                 );
                 Self::from_rgba_buffer(img, target_res)
             }
@@ -270,7 +323,7 @@ impl Image {
                     v,
                     self.res,
                     target_res,
-                    resample::FilterType::CatmullRom,
+                    filter,
                 );
                 Self::from_rgb_buffer(img, target_res)
             }
@@ -279,7 +332,7 @@ impl Image {
                     v,
                     self.res,
                     target_res,
-                    resample::FilterType::CatmullRom,
+                    filter,
                 );
                 Self::from_grey_a_buffer(img, target_res)
             }
@@ -288,7 +341,7 @@ impl Image {
                     v,
                     self.res,
                     target_res,
-                    resample::FilterType::CatmullRom,
+                    filter,
                 );
                 Self::from_grey_buffer(img, target_res)
             }
@@ -360,6 +413,10 @@ impl fmt::Debug for AnimatedImage {
 }
 
 impl AnimatedImage {
+    pub fn memory_size(&self) -> usize {
+        self.frames.0.iter_deduped().map(|f| f.0.memory_size()).sum()
+    }
+
     pub fn new(frames: Vec<(Image, Duration, u64)>) -> Self {
         assert!(!frames.is_empty());
 
@@ -438,6 +495,9 @@ impl AnimatedImage {
 // }
 //
 
+// Errors are drawn as a placeholder page of this size, portrait like most pages.
+pub const PLACEHOLDER_RES: Res = Res { w: 800, h: 1130 };
+
 #[derive(Debug, Default, PartialEq, Eq, Clone)]
 pub enum Displayable {
     Image(ImageWithRes),
@@ -455,7 +515,8 @@ impl Displayable {
         match self {
             Self::Image(ImageWithRes { original_res: res, .. }) | Self::Pending(res) => Some(*res),
             Self::Animation(a) => Some(a.frames()[0].0.res),
-            Self::Video(_) | Self::Error(_) | Self::Nothing => None,
+            Self::Error(_) => Some(PLACEHOLDER_RES),
+            Self::Video(_) | Self::Nothing => None,
         }
     }
 }
@@ -4,8 +4,10 @@
 
 use std::fmt;
 use std::ops::{Index, IndexMut};
+use std::path::PathBuf;
 
 use derive_more::{Deref, DerefMut, Display, From};
+use serde::{Deserialize, Serialize};
 use tokio::sync::oneshot;
 
 pub use self::displayable::*;
@@ -47,13 +49,33 @@ pub enum GuiContent {
     },
 }
 
+impl GuiContent {
+    // Every distinct error among the visible pages, in order.
+    pub fn errors(&self) -> Vec<&str> {
+        let visible = match self {
+            Self::Single(d) => std::slice::from_ref(d),
+            Self::Multiple { visible, .. } => visible.as_slice(),
+        };
+
+        let mut errors = Vec::new();
+        for d in visible {
+            if let Displayable::Error(e) = d {
+                if !errors.contains(&e.as_str()) {
+                    errors.push(e.as_str());
+                }
+            }
+        }
+        errors
+    }
+}
+
 impl Default for GuiContent {
     fn default() -> Self {
         Self::Single(Displayable::default())
     }
 }
 
-#[derive(Debug, Display, Default, Clone, Copy, PartialEq, Eq)]
+#[derive(Debug, Display, Default, Clone, Copy, PartialEq, Eq, Deserialize)]
 pub enum DisplayMode {
     #[default]
     Single,
@@ -77,13 +99,20 @@ impl DisplayMode {
             Self::Single | Self::VerticalStrip | Self::HorizontalStrip => false,
         }
     }
+
+    // Spreads are only split when showing one page at a time.
+    pub fn split_spreads(self) -> bool {
+        self == Self::Single && crate::config::CONFIG.split_spreads > 0.0
+    }
 }
 
 #[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
 pub struct Modes {
     pub manga: bool,
     pub upscaling: bool,
+    pub low_memory: bool,
     pub fit: Fit,
+    pub zoom: Zoom,
     pub display: DisplayMode,
 }
 
@@ -96,10 +125,20 @@ impl Modes {
         if self.manga {
             out.push('M');
         }
+        if self.low_memory {
+            out.push('L');
+        }
         out
     }
 }
 
+#[derive(Debug, PartialEq, Eq, Clone, Copy)]
+pub enum ZoomChange {
+    In,
+    Out,
+    Reset,
+}
+
 #[derive(Debug, PartialEq, Eq, Clone, Copy)]
 pub enum Direction {
     Absolute,
@@ -107,6 +146,22 @@ pub enum Direction {
     Backwards,
 }
 
+// A rectangle in the coordinates of the original, unscaled image.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Highlight {
+    pub x: u32,
+    pub y: u32,
+    pub w: u32,
+    pub h: u32,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct Annotation {
+    pub text: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub highlight: Option<Highlight>,
+}
+
 pub type CommandResponder = oneshot::Sender<serde_json::Value>;
 
 pub type MAWithResponse = (ManagerAction, GuiActionContext, Option<CommandResponder>);
@@ -115,15 +170,43 @@ pub type MAWithResponse = (ManagerAction, GuiActionContext, Option<CommandRespon
 pub enum ManagerAction {
     Resolution(Res),
     MovePages(Direction, usize),
+    RandomPage,
+    RetryPage,
+    TrashArchive,
     NextArchive,
     PreviousArchive,
+    FirstOfSeries,
+    LastOfSeries,
+    Open(PathBuf),
+    // Opens the path, or the current archive at the current page, in a new tab after the others.
+    NewTab(Option<PathBuf>),
+    SwitchTab(usize),
+    CloseTab,
     Status,
     ListPages,
-    Execute(String),
+    PageInfo,
+    ListSiblings,
+    ListRecent,
+    SetWallpaper,
+    // Writes the pages of the current archive to a new cbz file or into a directory.
+    ExportArchive(PathBuf),
+    // The command line, which may include arguments, and any extra arguments to pass after it.
+    Execute(String, Vec<String>),
     ToggleUpscaling,
+    UpscaleArchive,
+    ToggleComparison,
+    // Temporarily show the original version of the current page instead of the upscaled one.
+    ShowOriginal(bool),
     ToggleManga,
+    ToggleLowMemory,
+    ToggleSortByTime,
+    ToggleReverseSort,
     FitStrategy(Fit),
+    Zoom(ZoomChange),
     Display(DisplayMode),
+    Annotate(Annotation),
+    ClearAnnotations,
+    ListAnnotations,
 }
 
 #[derive(Debug, PartialEq, Eq, Copy, Clone)]
@@ -131,7 +214,11 @@ pub struct WorkParams {
     pub park_before_scale: bool,
     pub jump_downscaling_queue: bool,
     pub extract_early: bool,
+    // Trade quality for memory: scale down while loading and use a cheaper filter.
+    pub low_memory: bool,
     pub target_res: TargetRes,
+    // How many pages away from the current page this work is. Closer pages get threads first.
+    pub distance: usize,
 }
 
 // Represents the current displayable and its metadata.
@@ -142,8 +229,32 @@ pub struct GuiState {
     pub page_name: String,
     pub archive_len: usize,
     pub archive_name: String,
+    pub archive_path: PathBuf,
     pub modes: Modes,
     pub target_res: TargetRes,
+    // Only the annotations for the current page.
+    pub annotations: Vec<Annotation>,
+    // Why the archive or any visible page failed to load, if one did.
+    pub error: Option<String>,
+    pub progress: ReadingProgress,
+    // Whether the visible pages are the original and upscaled versions of the current page.
+    pub comparing: bool,
+}
+
+// How far through the archive, and through the series in manga mode, the current page is.
+#[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
+pub struct ReadingProgress {
+    pub archive: u8,
+    pub series: Option<u8>,
+}
+
+impl fmt::Display for ReadingProgress {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.series {
+            Some(series) => write!(f, "{}%, {}% of series", self.archive, series),
+            None => write!(f, "{}%", self.archive),
+        }
+    }
 }
 
 #[derive(Debug, Eq, PartialEq, Copy, Clone)]
@@ -188,6 +299,10 @@ impl From<ScrollMotionTarget> for GuiActionContext {
 pub enum GuiAction {
     State(GuiState, GuiActionContext),
     Action(String, CommandResponder),
+    // A short-lived message to display on top of the current page.
+    Osd(String),
+    // Another thread panicked and wrote a crash report.
+    Crashed(PathBuf),
     Quit,
 }
 
@@ -225,6 +340,10 @@ impl<T> DedupedVec<T> {
         self.indices.len()
     }
 
+    pub fn iter_deduped(&self) -> std::slice::Iter<T> {
+        self.deduped.iter()
+    }
+
     pub fn iter_deduped_mut(&mut self) -> std::slice::IterMut<T> {
         self.deduped.iter_mut()
     }
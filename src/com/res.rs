@@ -2,8 +2,10 @@ use std::fmt;
 
 use derive_more::Display;
 use image::DynamicImage;
+use serde::Deserialize;
 
 use super::DisplayMode;
+use crate::config::CONFIG;
 
 #[derive(Default, PartialEq, Eq, Copy, Clone)]
 pub struct Res {
@@ -49,29 +51,53 @@ impl Res {
         self.w == 0 && self.h == 0
     }
 
-    pub fn fit_inside(self, t: TargetRes) -> Self {
+    // Whether this is a wide double page spread that should be read one half at a time.
+    pub fn is_spread(self, t: TargetRes) -> bool {
+        t.split_spreads && self.h > 0 && self.w as f64 > self.h as f64 * CONFIG.split_spreads
+    }
+
+    // The scale at which this should be displayed, before any zoom. Never larger than 1.
+    fn fit_scale(self, t: TargetRes) -> f64 {
         let (w, h) = (self.w as f64, self.h as f64);
         let (tw, th) = if !t.half_width { (t.res.w, t.res.h) } else { (t.res.w / 2, t.res.h) };
+        // Each half of a spread is fitted as if it were its own page.
+        let tw = if self.is_spread(t) { tw.saturating_mul(2) } else { tw };
 
         let scale = match t.fit {
             Fit::Container => f64::min(tw as f64 / w, th as f64 / h),
             Fit::Height => th as f64 / h,
             Fit::Width => tw as f64 / w,
-            Fit::FullSize => return self,
+            Fit::FullSize => return 1.0,
         };
 
-        if scale <= 0.0 || scale >= 1.0 || !scale.is_finite() {
-            return self;
-        }
+        if scale <= 0.0 || scale >= 1.0 || !scale.is_finite() { 1.0 } else { scale }
+    }
 
+    fn scale(self, scale: f64) -> Self {
         Self {
-            w: (w * scale).round() as u32,
-            h: (h * scale).round() as u32,
+            w: (self.w as f64 * scale).round() as u32,
+            h: (self.h as f64 * scale).round() as u32,
         }
     }
+
+    // The resolution images should be scaled to. This never scales images up, even when zoomed in,
+    // since that is cheaper to do when drawing.
+    pub fn fit_inside(self, t: TargetRes) -> Self {
+        let scale = self.fit_scale(t) * t.zoom.scale();
+
+        if scale >= 1.0 { self } else { self.scale(scale) }
+    }
+
+    // The resolution images are displayed at, which can be larger than the image when zoomed in.
+    #[allow(clippy::float_cmp)]
+    pub fn display_inside(self, t: TargetRes) -> Self {
+        let scale = self.fit_scale(t) * t.zoom.scale();
+
+        if scale == 1.0 { self } else { self.scale(scale) }
+    }
 }
 
-#[derive(Debug, Display, Default, Clone, Copy, PartialEq, Eq)]
+#[derive(Debug, Display, Default, Clone, Copy, PartialEq, Eq, Deserialize)]
 pub enum Fit {
     #[default]
     Container,
@@ -80,31 +106,74 @@ pub enum Fit {
     FullSize,
 }
 
+// A manual zoom, as a percentage, applied on top of the fit mode.
+#[derive(Debug, Display, Clone, Copy, PartialEq, Eq)]
+#[display(fmt = "{}%", _0)]
+pub struct Zoom(u32);
+
+impl Default for Zoom {
+    fn default() -> Self {
+        Self(100)
+    }
+}
+
+impl Zoom {
+    const STEPS: [u32; 17] =
+        [10, 25, 33, 50, 67, 75, 90, 100, 110, 125, 150, 200, 250, 300, 400, 600, 800];
+
+    #[must_use]
+    pub fn zoom_in(self) -> Self {
+        Self::STEPS.iter().find(|s| **s > self.0).map_or(self, |s| Self(*s))
+    }
+
+    #[must_use]
+    pub fn zoom_out(self) -> Self {
+        Self::STEPS.iter().rev().find(|s| **s < self.0).map_or(self, |s| Self(*s))
+    }
+
+    fn scale(self) -> f64 {
+        f64::from(self.0) / 100.0
+    }
+}
+
 #[derive(Debug, Default, Clone, Copy, PartialEq, Eq)]
 pub struct TargetRes {
     pub res: Res,
     pub fit: Fit,
     // Whether to force pages to be half their size
     half_width: bool,
+    // Whether wide pages should be shown one half at a time
+    split_spreads: bool,
+    zoom: Zoom,
+}
+
+impl TargetRes {
+    #[must_use]
+    pub const fn zoomed(self, zoom: Zoom) -> Self {
+        Self { zoom, ..self }
+    }
 }
 
 impl From<(i32, i32, Fit, DisplayMode)> for TargetRes {
     fn from((w, h, fit, d): (i32, i32, Fit, DisplayMode)) -> Self {
         let half_width = d.half_width_pages();
-        Self { res: (w, h).into(), fit, half_width }
+        let split_spreads = d.split_spreads();
+        Self { res: (w, h).into(), fit, half_width, split_spreads, zoom: Zoom::default() }
     }
 }
 
 impl From<(u32, u32, Fit, DisplayMode)> for TargetRes {
     fn from((w, h, fit, d): (u32, u32, Fit, DisplayMode)) -> Self {
         let half_width = d.half_width_pages();
-        Self { res: (w, h).into(), fit, half_width }
+        let split_spreads = d.split_spreads();
+        Self { res: (w, h).into(), fit, half_width, split_spreads, zoom: Zoom::default() }
     }
 }
 
 impl From<(Res, Fit, DisplayMode)> for TargetRes {
     fn from((res, fit, d): (Res, Fit, DisplayMode)) -> Self {
         let half_width = d.half_width_pages();
-        Self { res, fit, half_width }
+        let split_spreads = d.split_spreads();
+        Self { res, fit, half_width, split_spreads, zoom: Zoom::default() }
     }
 }
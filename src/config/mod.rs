@@ -1,16 +1,18 @@
 use std::cmp::max;
 use std::convert::TryFrom;
 use std::fmt;
+use std::net::SocketAddr;
 use std::num::{NonZeroU32, NonZeroU64, NonZeroUsize};
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::str::FromStr;
 
-use clap::StructOpt;
+use clap::{StructOpt, Subcommand};
 use gtk::gdk;
 use once_cell::sync::Lazy;
+use regex::Regex;
 use serde::{de, Deserialize, Deserializer};
 
-use crate::com::Res;
+use crate::com::{DisplayMode, Fit, Res};
 use crate::manager::files::print_formats;
 
 #[derive(Debug, StructOpt)]
@@ -27,6 +29,45 @@ pub struct Opt {
     /// Start in upscaling mode. Not yet supported.
     pub upscale: bool,
 
+    #[structopt(long)]
+    /// Start in low memory mode, keeping as few images in memory as possible.
+    pub low_memory: bool,
+
+    #[structopt(long)]
+    /// Start by browsing the archives in the given directory, or the directory containing the
+    /// given file.
+    pub library: bool,
+
+    #[structopt(long)]
+    /// Don't resume from the last page read, even if resume is enabled.
+    pub no_resume: bool,
+
+    #[structopt(long)]
+    /// Open the most recently read archive or directory if no files are given.
+    pub open_recent: bool,
+
+    #[structopt(long)]
+    /// Start with the UI hidden, no window decorations, and a black background.
+    pub minimal: bool,
+
+    #[structopt(long)]
+    /// The monitor to use when going fullscreen, either a connector name like "DP-1" or an index
+    /// starting from 0. Overrides fullscreen_monitor in the config.
+    pub fullscreen_monitor: Option<String>,
+
+    #[structopt(long, parse(from_os_str))]
+    /// Read the archives and directories listed in this file, one per line, in order.
+    pub playlist: Option<PathBuf>,
+
+    #[structopt(long)]
+    /// Read archives and directories from stdin, one per line, and add them to the end of the
+    /// playlist as they arrive.
+    pub stdin_paths: bool,
+
+    #[structopt(long, parse(from_os_str))]
+    /// Run the commands in this file, or stdin if "-", as if they were sent over the socket.
+    pub script: Option<PathBuf>,
+
     #[structopt(long)]
     /// Print the supported file extensions and exit.
     show_supported: bool,
@@ -36,9 +77,48 @@ pub struct Opt {
 
     #[structopt(parse(from_os_str))]
     pub file_names: Vec<PathBuf>,
+
+    #[structopt(subcommand)]
+    pub command: Option<Command>,
 }
 
-#[derive(Debug, Deserialize)]
+#[derive(Debug, Subcommand)]
+pub enum Command {
+    /// Send a command to a running instance through its socket and print the response.
+    Remote {
+        #[structopt(long)]
+        /// The process ID of the instance. Required if more than one instance is running.
+        pid: Option<u32>,
+
+        #[structopt(long)]
+        /// Print the process IDs of all running instances instead of sending a command.
+        list: bool,
+
+        /// The command to send, such as Status or "Open /path/to/file.zip".
+        command: Vec<String>,
+    },
+    /// Search the reading history and print the archives and directories with all of the given
+    /// words in their paths, most recent first.
+    History {
+        #[structopt(long)]
+        /// Open the most recently read match instead of printing them.
+        open: bool,
+
+        query: Vec<String>,
+    },
+    /// Benchmark listing, extracting, decoding, and scaling the pages of an archive or directory
+    /// with the current config, without opening a window.
+    Bench {
+        #[structopt(long)]
+        /// Also benchmark upscaling the first few pages.
+        upscale: bool,
+
+        #[structopt(parse(from_os_str))]
+        path: PathBuf,
+    },
+}
+
+#[derive(Debug, Clone, Deserialize)]
 pub struct Shortcut {
     pub action: String,
     pub key: String,
@@ -60,6 +140,59 @@ pub struct ContextMenuEntry {
     pub group: Option<ContextMenuGroup>,
 }
 
+#[derive(Debug, Deserialize)]
+pub struct ArchivePassword {
+    pub pattern: String,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub password: Option<String>,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub command: Option<PathBuf>,
+}
+
+// Modes that can be overridden for a series, either from the config or a .aw-man.toml file.
+#[derive(Debug, Default, Clone, Deserialize)]
+pub struct ModeOverrides {
+    #[serde(default)]
+    pub manga: Option<bool>,
+    #[serde(default)]
+    pub upscale: Option<bool>,
+    #[serde(default)]
+    pub fit: Option<Fit>,
+    #[serde(default)]
+    pub display: Option<DisplayMode>,
+    #[serde(default)]
+    pub resume: Option<bool>,
+    #[serde(default)]
+    pub sort_rules: Option<Vec<String>>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct DirectoryOverride {
+    pub pattern: String,
+    #[serde(flatten)]
+    pub overrides: ModeOverrides,
+}
+
+#[derive(Debug, Default, Deserialize, Clone, Copy, PartialEq, Eq)]
+pub enum UpscalerKind {
+    #[default]
+    #[serde(rename = "waifu2x")]
+    Waifu2x,
+    #[serde(rename = "realesrgan")]
+    RealEsrgan,
+}
+
+#[derive(Debug, Default, Deserialize, Clone, Copy, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum DownscalingFilter {
+    Nearest,
+    Linear,
+    #[default]
+    CatmullRom,
+    Gaussian,
+    Lanczos3,
+}
+
 #[derive(Debug, Deserialize)]
 pub struct Config {
     pub target_resolution: String,
@@ -71,12 +204,52 @@ pub struct Config {
 
     pub preload_ahead: usize,
     pub preload_behind: usize,
+    #[serde(default)]
+    pub manga_preload_ahead: Option<usize>,
+    #[serde(default)]
+    pub manga_preload_behind: Option<usize>,
+    #[serde(default)]
+    pub upscaling_preload_ahead: Option<usize>,
+    #[serde(default)]
+    pub upscaling_preload_behind: Option<usize>,
+    #[serde(default)]
+    pub low_memory: bool,
+    #[serde(default)]
+    pub downscaling_filter: DownscalingFilter,
+    #[serde(default, deserialize_with = "zero_is_none")]
+    pub memory_budget: Option<NonZeroU64>,
+    #[serde(default)]
+    pub trim_memory: bool,
+    #[serde(default)]
+    pub autocrop_threshold: u8,
+    #[serde(default)]
+    pub split_spreads: f64,
+    #[serde(default)]
+    pub right_to_left_spreads: bool,
 
     #[serde(default, deserialize_with = "empty_string_is_none")]
     pub background_colour: Option<gdk::RGBA>,
+    #[serde(default)]
+    pub auto_background: bool,
 
     #[serde(default = "three_hundred")]
     pub scroll_amount: NonZeroU32,
+    #[serde(default = "one_hundred_sixty_six")]
+    pub scroll_duration: u64,
+    #[serde(default)]
+    pub kinetic_scrolling: bool,
+    #[serde(default, deserialize_with = "zero_is_none")]
+    pub swipe_threshold: Option<NonZeroU32>,
+    #[serde(default = "one_float")]
+    pub smooth_scroll_threshold: f64,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub scroll_left_action: Option<String>,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub scroll_right_action: Option<String>,
+    #[serde(default, deserialize_with = "zero_is_none")]
+    pub page_transition_duration: Option<NonZeroU64>,
+    #[serde(default = "one_hundred", deserialize_with = "zero_is_none")]
+    pub key_repeat_interval: Option<NonZeroU64>,
 
     #[serde(default, deserialize_with = "zero_is_none")]
     pub upscale_timeout: Option<NonZeroU64>,
@@ -84,22 +257,89 @@ pub struct Config {
     #[serde(default, deserialize_with = "zero_is_none")]
     pub idle_timeout: Option<NonZeroU64>,
 
+    #[serde(default, deserialize_with = "zero_is_none")]
+    pub hide_ui_timeout: Option<NonZeroU64>,
+
+    #[serde(default)]
+    pub skip_trash_confirmation: bool,
+
     #[serde(default)]
     pub shortcuts: Vec<Shortcut>,
     #[serde(default)]
     pub context_menu: Vec<ContextMenuEntry>,
 
+    #[serde(default)]
+    pub locale_collation: bool,
+    #[serde(default)]
+    pub volume_sorting: bool,
+    #[serde(default)]
+    pub sort_rules: Vec<String>,
+    #[serde(default)]
+    pub sort_by_modification_time: bool,
+    #[serde(default)]
+    pub reverse_sort: bool,
+    #[serde(default)]
+    pub directory_overrides: Vec<DirectoryOverride>,
+
     #[serde(default)]
     pub allow_external_extractors: bool,
+    #[serde(default)]
+    pub archive_passwords: Vec<ArchivePassword>,
 
+    #[serde(default)]
+    pub upscaler: UpscalerKind,
     #[serde(default, deserialize_with = "empty_path_is_none")]
     pub alternate_upscaler: Option<PathBuf>,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub realesrgan_binary: Option<PathBuf>,
+    #[serde(default = "realesr_animevideov3")]
+    pub realesrgan_model: String,
+    #[serde(default, deserialize_with = "zero_is_none")]
+    pub realesrgan_scale: Option<NonZeroU32>,
+    #[serde(default)]
+    pub realesrgan_tile_size: u32,
     #[serde(default)]
     pub force_rgba: bool,
     #[serde(default)]
+    pub color_management: bool,
+    #[serde(default)]
     pub prescale: usize,
     #[serde(default, deserialize_with = "empty_path_is_none")]
     pub socket_dir: Option<PathBuf>,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub state_directory: Option<PathBuf>,
+    #[serde(default)]
+    pub resume: bool,
+    #[serde(default)]
+    pub history: bool,
+    #[serde(default)]
+    pub remember_window: bool,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub fullscreen_monitor: Option<String>,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub web_server: Option<SocketAddr>,
+    #[serde(default)]
+    pub dbus: bool,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub wallpaper_command: Option<PathBuf>,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub page_change_command: Option<String>,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub archive_change_command: Option<String>,
+    #[serde(default, deserialize_with = "empty_string_is_none")]
+    pub archive_complete_command: Option<String>,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub heif_converter: Option<PathBuf>,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub raw_converter: Option<PathBuf>,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub conversion_cache: Option<PathBuf>,
+    #[serde(default = "one_thousand_twenty_four")]
+    pub conversion_cache_size: u64,
+    #[serde(default, deserialize_with = "empty_path_is_none")]
+    pub extraction_cache: Option<PathBuf>,
+    #[serde(default = "one_thousand_twenty_four")]
+    pub extraction_cache_size: u64,
 
     #[serde(default = "two")]
     pub extraction_threads: NonZeroUsize,
@@ -123,6 +363,26 @@ fn three_hundred() -> NonZeroU32 {
     NonZeroU32::new(300).unwrap()
 }
 
+fn one_hundred() -> Option<NonZeroU64> {
+    NonZeroU64::new(100)
+}
+
+const fn one_float() -> f64 {
+    1.0
+}
+
+const fn one_hundred_sixty_six() -> u64 {
+    166
+}
+
+const fn one_thousand_twenty_four() -> u64 {
+    1024
+}
+
+fn realesr_animevideov3() -> String {
+    "realesr-animevideov3".to_string()
+}
+
 fn half_threads() -> NonZeroUsize {
     NonZeroUsize::new(max(num_cpus::get() / 2, 2)).unwrap()
 }
@@ -177,6 +437,23 @@ where
 
 pub static OPTIONS: Lazy<Opt> = Lazy::new(Opt::parse);
 
+// The config file in use, for writing changes back. Matches where awconf looks for it.
+pub fn config_file() -> Option<PathBuf> {
+    if let Some(f) = &OPTIONS.awconf {
+        return Some(f.clone());
+    }
+
+    let home = std::env::var_os("HOME").map(PathBuf::from);
+    let config_dir = std::env::var_os("XDG_CONFIG_HOME")
+        .map(PathBuf::from)
+        .or_else(|| home.as_ref().map(|h| h.join(".config")));
+
+    [config_dir.map(|d| d.join("aw-man").join("aw-man.toml")), home.map(|h| h.join(".aw-man.toml"))]
+        .into_iter()
+        .flatten()
+        .find(|p| p.is_file())
+}
+
 pub static CONFIG: Lazy<Config> =
     Lazy::new(|| match awconf::load_config::<Config>("aw-man", &OPTIONS.awconf) {
         Ok(conf) => conf,
@@ -222,16 +499,92 @@ pub static MINIMUM_RES: Lazy<Res> = Lazy::new(|| {
     }
 });
 
+pub static SORT_RULES: Lazy<Vec<Regex>> = Lazy::new(|| {
+    CONFIG
+        .sort_rules
+        .iter()
+        .map(|s| match Regex::new(s) {
+            Ok(r) => r,
+            Err(e) => panic!("Invalid sort rule {:?}: {}", s, e),
+        })
+        .collect()
+});
+
 pub fn init() -> bool {
     Lazy::force(&OPTIONS);
     Lazy::force(&CONFIG);
     Lazy::force(&TARGET_RES);
     Lazy::force(&MINIMUM_RES);
+    Lazy::force(&SORT_RULES);
+    Lazy::force(&crate::unrar::PASSWORD_PATTERNS);
+    Lazy::force(&crate::manager::overrides::CONFIGURED);
+
+    if CONFIG.locale_collation {
+        crate::natsort::enable_collation();
+    }
+    if CONFIG.volume_sorting {
+        crate::natsort::enable_volume_numbers();
+    }
 
     if OPTIONS.show_supported {
         print_formats();
         return false;
     }
 
+    if let Some(Command::Bench { path, upscale }) = &OPTIONS.command {
+        return crate::bench::run(path, *upscale);
+    }
+
+    if let Some(file) = &OPTIONS.playlist {
+        match crate::manager::playlist::read_file(file) {
+            Ok(list) if list.is_empty() => {
+                eprintln!("Playlist {:?} is empty", file);
+                return false;
+            }
+            Ok(_) => {}
+            Err(e) => {
+                eprintln!("{}", e);
+                return false;
+            }
+        }
+    }
+
+    if OPTIONS.stdin_paths {
+        if OPTIONS.script.as_deref() == Some(Path::new("-")) {
+            eprintln!("--stdin-paths can't be used with a script read from stdin");
+            return false;
+        }
+
+        if crate::manager::playlist::STDIN_PATHS.is_none() {
+            eprintln!("No paths read from stdin");
+            return false;
+        }
+    }
+
+    if OPTIONS.open_recent
+        && OPTIONS.playlist.is_none()
+        && !OPTIONS.stdin_paths
+        && OPTIONS.file_names.is_empty()
+        && crate::manager::recent::most_recent().is_none()
+    {
+        eprintln!("No recent files to open, state_directory must be set to track them");
+        return false;
+    }
+
+    if let Some(Command::Remote { pid, list, command }) = &OPTIONS.command {
+        return crate::remote::run(*pid, *list, command);
+    }
+
+    if let Some(Command::History { open, query }) = &OPTIONS.command {
+        if !open {
+            return crate::manager::progress::print_history(query);
+        }
+
+        if crate::manager::progress::most_recent_match(query).is_none() {
+            eprintln!("Nothing in the history matches {:?}", query.join(" "));
+            return false;
+        }
+    }
+
     true
 }
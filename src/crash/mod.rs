@@ -0,0 +1,137 @@
+// Crash reports, written when any thread panics, to make bug reports for rare crashes actionable.
+
+use std::backtrace::Backtrace;
+use std::cell::RefCell;
+use std::collections::VecDeque;
+use std::fmt::Write;
+use std::panic::{self, PanicInfo};
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Mutex, MutexGuard, TryLockError};
+use std::time::{SystemTime, UNIX_EPOCH};
+use std::{fs, process, thread};
+
+use gtk::glib;
+use once_cell::sync::{Lazy, OnceCell};
+
+use crate::com::GuiAction;
+use crate::config::CONFIG;
+
+const HISTORY_LEN: usize = 50;
+
+static HISTORY: Lazy<Mutex<VecDeque<String>>> = Lazy::new(Mutex::default);
+static STATE: Lazy<Mutex<String>> = Lazy::new(Mutex::default);
+static GUI_SENDER: OnceCell<glib::Sender<GuiAction>> = OnceCell::new();
+// Only the first panic is interesting, the rest are usually fallout from it.
+static REPORTED: AtomicBool = AtomicBool::new(false);
+
+thread_local! {
+    // Detailed state that can only be gathered from the thread that owns it.
+    static THREAD_SNAPSHOT: RefCell<Option<Box<dyn Fn() -> String>>> = RefCell::default();
+}
+
+// Never block or panic inside the panic hook, the lock may be held by the panicking thread.
+fn try_lock<T>(m: &Mutex<T>) -> Option<MutexGuard<T>> {
+    match m.try_lock() {
+        Ok(g) => Some(g),
+        Err(TryLockError::Poisoned(p)) => Some(p.into_inner()),
+        Err(TryLockError::WouldBlock) => None,
+    }
+}
+
+pub fn record_command(cmd: &str) {
+    let mut h = HISTORY.lock().unwrap_or_else(|p| p.into_inner());
+    if h.len() >= HISTORY_LEN {
+        h.pop_front();
+    }
+    h.push_back(cmd.to_string());
+}
+
+// A short summary of the current state, cheap enough to update often.
+pub fn set_state(s: String) {
+    *STATE.lock().unwrap_or_else(|p| p.into_inner()) = s;
+}
+
+// Registers a function to describe this thread's state if this thread panics.
+pub fn set_thread_snapshot(f: impl Fn() -> String + 'static) {
+    THREAD_SNAPSHOT.with(|s| *s.borrow_mut() = Some(Box::new(f)));
+}
+
+fn report_dir() -> PathBuf {
+    CONFIG
+        .state_directory
+        .as_ref()
+        .map_or_else(std::env::temp_dir, |d| d.join("crash-reports"))
+}
+
+fn build_report(info: &PanicInfo) -> String {
+    let mut r = String::new();
+    let name = thread::current().name().unwrap_or("unnamed").to_string();
+
+    let _ = writeln!(r, "aw-man {} crashed in thread {}", env!("CARGO_PKG_VERSION"), name);
+    let _ = writeln!(r, "{}\n", info);
+    let _ = writeln!(r, "Backtrace:\n{}\n", Backtrace::force_capture());
+
+    let _ = writeln!(r, "Recent commands:");
+    match try_lock(&HISTORY) {
+        Some(h) => h.iter().for_each(|c| drop(writeln!(r, "  {}", c))),
+        None => r.push_str("  unavailable\n"),
+    }
+
+    let _ = writeln!(r, "\nState:");
+    match try_lock(&STATE) {
+        Some(s) => r.push_str(&s),
+        None => r.push_str("unavailable"),
+    }
+
+    let snapshot = THREAD_SNAPSHOT
+        .try_with(|s| s.try_borrow().ok().and_then(|s| s.as_ref().map(|f| f())))
+        .ok()
+        .flatten();
+    if let Some(s) = snapshot {
+        let _ = writeln!(r, "\n\nThread state:\n{}", s);
+    }
+
+    r
+}
+
+fn write_report(info: &PanicInfo) -> std::io::Result<PathBuf> {
+    let dir = report_dir();
+    fs::create_dir_all(&dir)?;
+
+    let secs = SystemTime::now().duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs());
+    let path = dir.join(format!("aw-man-crash-{}-{}.txt", secs, process::id()));
+
+    fs::write(&path, build_report(info))?;
+    Ok(path)
+}
+
+pub fn init(gui_sender: glib::Sender<GuiAction>) {
+    GUI_SENDER.set(gui_sender).expect("crash::init() called twice");
+
+    let default_hook = panic::take_hook();
+    panic::set_hook(Box::new(move |info| {
+        default_hook(info);
+
+        if REPORTED.swap(true, Ordering::Relaxed) {
+            return;
+        }
+
+        let path = match write_report(info) {
+            Ok(p) => p,
+            Err(e) => {
+                error!("Failed to write crash report: {:?}", e);
+                return;
+            }
+        };
+        error!("Wrote crash report to {:?}", path);
+
+        // A panic on the GUI thread can't be shown in the GUI, but the manager or any other
+        // thread can be.
+        if thread::current().name() != Some("main") {
+            if let Some(s) = GUI_SENDER.get() {
+                drop(s.send(GuiAction::Crashed(path)));
+            }
+        }
+    }));
+}
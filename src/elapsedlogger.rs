@@ -23,18 +23,55 @@ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 THE SOFTWARE.
 */
 
-use std::cmp::min;
+use std::cmp::{max, min};
+use std::str::FromStr;
 use std::sync::atomic::{AtomicUsize, Ordering};
-use std::{fmt, time};
+use std::{fmt, io, time};
 
-use env_logger::fmt::Color;
-use log::Level;
-use once_cell::sync::Lazy;
+use env_logger::fmt::{Color, Formatter};
+use log::{Level, LevelFilter, Log, Metadata, Record};
+use once_cell::sync::{Lazy, OnceCell};
 
 use crate::config;
 
 static START: Lazy<time::Instant> = Lazy::new(time::Instant::now);
 
+// When set, this overrides the level for aw-man's own logs, so verbose logging and the timing
+// information logged at trace level can be enabled without restarting.
+static OVERRIDE: AtomicUsize = AtomicUsize::new(0);
+static DEFAULT_MAX: OnceCell<LevelFilter> = OnceCell::new();
+
+struct Logger {
+    env: env_logger::Logger,
+    // Everything in aw-man, used only when overridden.
+    all: env_logger::Logger,
+}
+
+impl Logger {
+    fn overridden(&self, metadata: &Metadata) -> bool {
+        let o = OVERRIDE.load(Ordering::Relaxed);
+        o != 0 && metadata.target().starts_with("aw_man") && metadata.level() as usize <= o
+    }
+}
+
+impl Log for Logger {
+    fn enabled(&self, metadata: &Metadata) -> bool {
+        self.overridden(metadata) || self.env.enabled(metadata)
+    }
+
+    fn log(&self, record: &Record) {
+        if self.overridden(record.metadata()) {
+            self.all.log(record);
+        } else {
+            self.env.log(record);
+        }
+    }
+
+    fn flush(&self) {
+        self.env.flush();
+    }
+}
+
 pub fn init_logging() {
     Lazy::force(&START); // Inititalize the start time.
 
@@ -42,34 +79,87 @@ pub fn init_logging() {
         std::env::set_var("RUST_LOG", "Debug");
     }
 
-    env_logger::Builder::from_default_env()
-        .format(|f, record| {
-            use std::io::Write;
-            let target = record.target();
-            let target = target.strip_prefix("aw_man::").unwrap_or(target);
-            let target = shrink_target(target);
-            let max_width = max_target_width(target);
-
-            let mut style = f.style();
-            let level = match record.level() {
-                Level::Trace => style.set_color(Color::Magenta).value("TRACE"),
-                Level::Debug => style.set_color(Color::Blue).value("DEBUG"),
-                Level::Info => style.set_color(Color::Green).value("INFO "),
-                Level::Warn => style.set_color(Color::Yellow).value("WARN "),
-                Level::Error => style.set_color(Color::Red).value("ERROR"),
-            };
-
-            let mut style = f.style();
-            let target = style.set_bold(true).value(Padded { value: target, width: max_width });
-
-            let now = time::Instant::now();
-            let dur = now.duration_since(*START);
-            let seconds = dur.as_secs();
-            let ms = dur.as_millis() % 1000;
-
-            writeln!(f, " {:04}.{:03} {} {} > {}", seconds, ms, level, target, record.args(),)
-        })
-        .init();
+    let env = env_logger::Builder::from_default_env().format(format).build();
+    let all = env_logger::Builder::new()
+        .format(format)
+        .filter_module("aw_man", LevelFilter::Trace)
+        .build();
+
+    DEFAULT_MAX.set(env.filter()).expect("init_logging called twice");
+    log::set_max_level(env.filter());
+    log::set_boxed_logger(Box::new(Logger { env, all })).expect("Failed to initialize logging");
+}
+
+// Raises the level for aw-man's logs, or "default" to restore the level from startup.
+pub fn set_level(level: &str) -> Result<(), String> {
+    if level.eq_ignore_ascii_case("default") {
+        OVERRIDE.store(0, Ordering::Relaxed);
+        log::set_max_level(*DEFAULT_MAX.get().unwrap_or(&LevelFilter::Error));
+        return Ok(());
+    }
+
+    let filter = match LevelFilter::from_str(level) {
+        Ok(LevelFilter::Off) | Err(_) => return Err(format!("Invalid log level {}", level)),
+        Ok(f) => f,
+    };
+
+    OVERRIDE.store(filter as usize, Ordering::Relaxed);
+    log::set_max_level(max(filter, *DEFAULT_MAX.get().unwrap_or(&LevelFilter::Error)));
+    Ok(())
+}
+
+// SIGUSR2 toggles between debug logging and the default.
+#[cfg(target_family = "unix")]
+pub fn init_signals() {
+    use signal_hook::consts::SIGUSR2;
+    use signal_hook::iterator::Signals;
+
+    let mut signals = match Signals::new(&[SIGUSR2]) {
+        Ok(s) => s,
+        Err(e) => {
+            error!("Error registering SIGUSR2 handler: {:?}", e);
+            return;
+        }
+    };
+
+    crate::spawn_thread("log-signals", move || {
+        for _ in signals.forever() {
+            if OVERRIDE.load(Ordering::Relaxed) == 0 {
+                drop(set_level("debug"));
+                info!("Received SIGUSR2, enabled debug logging");
+            } else {
+                info!("Received SIGUSR2, restoring default logging");
+                drop(set_level("default"));
+            }
+        }
+    });
+}
+
+fn format(f: &mut Formatter, record: &Record) -> io::Result<()> {
+    use std::io::Write;
+    let target = record.target();
+    let target = target.strip_prefix("aw_man::").unwrap_or(target);
+    let target = shrink_target(target);
+    let max_width = max_target_width(target);
+
+    let mut style = f.style();
+    let level = match record.level() {
+        Level::Trace => style.set_color(Color::Magenta).value("TRACE"),
+        Level::Debug => style.set_color(Color::Blue).value("DEBUG"),
+        Level::Info => style.set_color(Color::Green).value("INFO "),
+        Level::Warn => style.set_color(Color::Yellow).value("WARN "),
+        Level::Error => style.set_color(Color::Red).value("ERROR"),
+    };
+
+    let mut style = f.style();
+    let target = style.set_bold(true).value(Padded { value: target, width: max_width });
+
+    let now = time::Instant::now();
+    let dur = now.duration_since(*START);
+    let seconds = dur.as_secs();
+    let ms = dur.as_millis() % 1000;
+
+    writeln!(f, " {:04}.{:03} {} {} > {}", seconds, ms, level, target, record.args(),)
 }
 
 struct Padded<T> {
@@ -0,0 +1,173 @@
+// A small D-Bus service so desktop widgets and extensions can show what's being read and turn
+// pages. Only one instance can own the name at a time, so the most recently started one wins.
+//
+// Methods only cover navigation. Anything more can be done through the socket.
+
+use std::cell::{Cell, RefCell};
+use std::collections::HashMap;
+use std::rc::Rc;
+
+use gtk::gio::{self, DBusConnection, DBusMethodInvocation};
+use gtk::glib::{ToVariant, Variant};
+
+use super::{Gui, GUI};
+
+const NAME: &str = "org.awused.awman";
+const PATH: &str = "/org/awused/awman";
+
+const INTROSPECTION: &str = r#"
+<node>
+  <interface name="org.awused.awman">
+    <method name="NextPage"/>
+    <method name="PreviousPage"/>
+    <method name="FirstPage"/>
+    <method name="LastPage"/>
+    <method name="NextArchive"/>
+    <method name="PreviousArchive"/>
+    <method name="Jump">
+      <arg type="u" name="page" direction="in"/>
+    </method>
+    <property name="Archive" type="s" access="read"/>
+    <property name="ArchiveName" type="s" access="read"/>
+    <property name="Page" type="u" access="read"/>
+    <property name="PageCount" type="u" access="read"/>
+  </interface>
+</node>
+"#;
+
+#[derive(Debug, Default)]
+pub(super) struct Dbus {
+    // The object is registered once per connection and stays registered if the name is lost, so
+    // it doesn't have to be registered again if the name comes back.
+    connection: RefCell<Option<DBusConnection>>,
+    owns_name: Cell<bool>,
+    // The last values sent in PropertiesChanged.
+    last: RefCell<HashMap<String, Variant>>,
+}
+
+fn with_gui<T>(f: impl FnOnce(&Rc<Gui>) -> T) -> Option<T> {
+    GUI.with(|g| g.get().map(f))
+}
+
+impl Gui {
+    fn dbus_properties(&self) -> HashMap<String, Variant> {
+        let s = self.state.borrow();
+        HashMap::from([
+            ("Archive".to_string(), s.archive_path.to_string_lossy().to_variant()),
+            ("ArchiveName".to_string(), s.archive_name.to_variant()),
+            ("Page".to_string(), (s.page_num as u32).to_variant()),
+            ("PageCount".to_string(), (s.archive_len as u32).to_variant()),
+        ])
+    }
+
+    pub(super) fn setup_dbus(&self) {
+        if !crate::config::CONFIG.dbus {
+            return;
+        }
+
+        gio::bus_own_name(
+            gio::BusType::Session,
+            NAME,
+            gio::BusNameOwnerFlags::ALLOW_REPLACEMENT | gio::BusNameOwnerFlags::REPLACE,
+            |conn, _| register(conn),
+            |_, name| {
+                debug!("Acquired D-Bus name {}", name);
+                with_gui(|g| {
+                    g.dbus.owns_name.set(true);
+                    g.dbus.last.take();
+                    g.update_dbus();
+                });
+            },
+            |_, name| {
+                info!("Lost D-Bus name {}", name);
+                with_gui(|g| g.dbus.owns_name.set(false));
+            },
+        );
+    }
+
+    // Emits PropertiesChanged for anything that changed since the last call.
+    pub(super) fn update_dbus(&self) {
+        if !self.dbus.owns_name.get() {
+            return;
+        }
+
+        let conn = match &*self.dbus.connection.borrow() {
+            Some(c) => c.clone(),
+            None => return,
+        };
+
+        let props = self.dbus_properties();
+        let mut last = self.dbus.last.borrow_mut();
+        let changed: HashMap<String, Variant> =
+            props.into_iter().filter(|(k, v)| last.get(k) != Some(v)).collect();
+        if changed.is_empty() {
+            return;
+        }
+        last.extend(changed.clone());
+
+        let params = (NAME, changed, Vec::<String>::new()).to_variant();
+        if let Err(e) = conn.emit_signal(
+            None,
+            PATH,
+            "org.freedesktop.DBus.Properties",
+            "PropertiesChanged",
+            Some(&params),
+        ) {
+            error!("Failed to emit D-Bus PropertiesChanged: {:?}", e);
+        }
+    }
+}
+
+fn register(conn: DBusConnection) {
+    let info = gio::DBusNodeInfo::for_xml(INTROSPECTION)
+        .ok()
+        .and_then(|n| n.lookup_interface(NAME))
+        .expect("Invalid D-Bus introspection data");
+
+    let r = conn.register_object(
+        PATH,
+        &info,
+        |_, _, _, _, method, params, invocation| method_call(method, &params, invocation),
+        |_, _, _, _, prop| {
+            with_gui(|g| g.dbus_properties().remove(prop))
+                .flatten()
+                .unwrap_or_else(|| "".to_variant())
+        },
+        |_, _, _, _, _, _| false,
+    );
+
+    match r {
+        Ok(_) => {
+            with_gui(|g| {
+                g.dbus.connection.replace(Some(conn));
+                g.update_dbus();
+            });
+        }
+        Err(e) => error!("Failed to register D-Bus object: {:?}", e),
+    }
+}
+
+fn method_call(method: &str, params: &Variant, invocation: DBusMethodInvocation) {
+    let cmd = match method {
+        "Jump" => match params.get::<(u32,)>() {
+            Some((page,)) => format!("Jump {}", page),
+            None => {
+                return invocation.return_dbus_error(
+                    "org.freedesktop.DBus.Error.InvalidArgs",
+                    "Jump requires a page number",
+                );
+            }
+        },
+        "NextPage" | "PreviousPage" | "FirstPage" | "LastPage" | "NextArchive"
+        | "PreviousArchive" => method.to_string(),
+        _ => {
+            return invocation.return_dbus_error(
+                "org.freedesktop.DBus.Error.UnknownMethod",
+                &format!("Unknown method {}", method),
+            );
+        }
+    };
+
+    with_gui(|g| g.run_command(&cmd, None));
+    invocation.return_value(None);
+}
@@ -0,0 +1,93 @@
+// Saves the window's size and whether it was maximized or fullscreen when it's closed, and restores
+// them on launch. GTK4 gives applications no control over window position, so that is left to the
+// window manager.
+
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use gtk::prelude::*;
+use serde::{Deserialize, Serialize};
+
+use super::Gui;
+use crate::config::{CONFIG, OPTIONS};
+use crate::write_atomically;
+
+const DEFAULT_WIDTH: i32 = 800;
+const DEFAULT_HEIGHT: i32 = 600;
+
+#[derive(Debug, Serialize, Deserialize)]
+struct Geometry {
+    width: i32,
+    height: i32,
+    maximized: bool,
+    fullscreen: bool,
+}
+
+fn geometry_path(state_dir: &Path) -> PathBuf {
+    state_dir.join("window.json")
+}
+
+fn load() -> Option<Geometry> {
+    if !CONFIG.remember_window {
+        return None;
+    }
+
+    let file = geometry_path(CONFIG.state_directory.as_ref()?);
+    let data = fs::read(&file).ok()?;
+    serde_json::from_slice(&data)
+        .map_err(|e| error!("Failed to parse window geometry {:?}: {:?}", file, e))
+        .ok()
+}
+
+fn save(state_dir: &Path, geometry: &Geometry) -> Result<(), String> {
+    fs::create_dir_all(state_dir)
+        .map_err(|e| format!("Failed to create state directory {:?}: {:?}", state_dir, e))?;
+
+    let file = geometry_path(state_dir);
+    let data = serde_json::to_vec(geometry)
+        .map_err(|e| format!("Failed to serialize window geometry: {:?}", e))?;
+    write_atomically(&file, &data)
+        .map_err(|e| format!("Failed to write window geometry {:?}: {:?}", file, e))
+}
+
+impl Gui {
+    pub(super) fn restore_geometry(&self) {
+        let g = match load() {
+            Some(g) if g.width > 0 && g.height > 0 => g,
+            _ => return self.window.set_default_size(DEFAULT_WIDTH, DEFAULT_HEIGHT),
+        };
+
+        self.window.set_default_size(g.width, g.height);
+        self.window.set_maximized(g.maximized);
+        // --minimal is usually for embedding or screenshots, where restoring fullscreen would be
+        // surprising.
+        if g.fullscreen && !OPTIONS.minimal {
+            self.fullscreen();
+        }
+    }
+
+    pub(super) fn save_geometry(&self) {
+        if !CONFIG.remember_window {
+            return;
+        }
+
+        let state_dir = match &CONFIG.state_directory {
+            Some(d) => d,
+            None => return,
+        };
+
+        // The default size tracks the size of the window while it's neither maximized nor
+        // fullscreen, which is what should be restored when those are turned off.
+        let (width, height) = self.window.default_size();
+        let geometry = Geometry {
+            width,
+            height,
+            maximized: self.window.is_maximized(),
+            fullscreen: self.window.is_fullscreen(),
+        };
+
+        if let Err(e) = save(state_dir, &geometry) {
+            error!("{}", e);
+        }
+    }
+}
@@ -1,19 +1,27 @@
 use std::cell::RefCell;
 use std::mem::ManuallyDrop;
+use std::path::{Path, PathBuf};
 use std::rc::Rc;
 use std::time::{Duration, Instant};
 
 use glium::backend::{Backend, Facade};
 use glium::debug::DebugCallbackBehavior;
 use glium::index::PrimitiveType;
-use glium::{implement_vertex, program, Frame, IndexBuffer, Program, Surface, VertexBuffer};
+use glium::texture::Texture2d;
+use glium::uniforms::MagnifySamplerFilter;
+use glium::{
+    implement_vertex, program, uniform, Blend, BlitTarget, DrawParameters, Frame, IndexBuffer,
+    Program, Surface, VertexBuffer,
+};
 use gtk::prelude::*;
 use gtk::subclass::prelude::*;
 use gtk::{gdk, glib};
+use once_cell::sync::Lazy;
 use once_cell::unsync::OnceCell;
 
 use super::renderable::{Animation, DisplayedContent, Renderable, StaticImage};
 use crate::com::{Displayable, GuiContent};
+use crate::config::CONFIG;
 use crate::gui::glium_area::renderable::AllocatedTextures;
 use crate::gui::{Gui, GUI};
 
@@ -25,6 +33,23 @@ pub(super) struct Vertex {
 
 implement_vertex!(Vertex, position, tex_coords);
 
+static TRANSITION_DURATION: Lazy<Option<Duration>> = Lazy::new(|| {
+    CONFIG.page_transition_duration.map(|d| Duration::from_millis(d.get()))
+});
+
+const IDENTITY: [[f32; 4]; 4] = [
+    [1.0, 0.0, 0.0, 0.0],
+    [0.0, 1.0, 0.0, 0.0],
+    [0.0, 0.0, 1.0, 0.0],
+    [0.0, 0.0, 0.0, 1.0],
+];
+
+// The previous page, fading out on top of the new one.
+struct Transition {
+    previous: Texture2d,
+    start: Instant,
+}
+
 #[inline]
 fn srgb_to_linear(s: f32) -> f32 {
     if s <= 0.04045 { s / 12.92 } else { f32::powf((s + 0.055) / 1.055, 2.4) }
@@ -42,6 +67,8 @@ fn linear_to_srgb(s: f32) -> f32 {
 pub(super) struct RenderContext {
     pub vertices: VertexBuffer<Vertex>,
     pub program: Program,
+    // Draws an already rendered frame with a given opacity, for transitions.
+    pub fade_program: Program,
     pub indices: IndexBuffer<u8>,
     pub context: Rc<glium::backend::Context>,
     pub bg: [f32; 4],
@@ -65,6 +92,12 @@ pub(super) struct Renderer {
     // GTK does something really screwy, so if we need to invalidate once we'll need to do it again
     // next draw.
     invalidated: bool,
+    // Copy of the last completed frame, only kept when transitions are enabled.
+    last_frame: Option<Texture2d>,
+    transition: Option<Transition>,
+    // The archive and page index of the single page in last_frame. Only a change in these starts
+    // a transition, not loading, upscaling, or rescaling the same page.
+    last_page: Option<(PathBuf, usize)>,
 }
 
 impl Facade for &Renderer {
@@ -85,6 +118,9 @@ impl Renderer {
             clear_bg: [0.0; 4],
             context: context.clone(),
             invalidated: false,
+            last_frame: None,
+            transition: None,
+            last_page: None,
         };
 
         let vertices = VertexBuffer::new(
@@ -129,6 +165,34 @@ impl Renderer {
         },)
         .unwrap();
 
+        let fade_program = program!(&rnd,
+        140 => {
+            vertex: "
+                #version 140
+                uniform mat4 matrix;
+                in vec2 position;
+                in vec2 tex_coords;
+                out vec2 v_tex_coords;
+                void main() {
+                    gl_Position = matrix * vec4(position, 0.0, 1.0);
+                    v_tex_coords = tex_coords;
+                }
+            ",
+
+            // The frame is already in its final form, so this is a direct copy.
+            fragment: "
+                #version 140
+                uniform sampler2D tex;
+                uniform float alpha;
+                in vec2 v_tex_coords;
+                out vec4 f_color;
+                void main() {
+                    f_color = vec4(texture(tex, v_tex_coords).rgb, alpha);
+                }
+            ",
+        },)
+        .unwrap();
+
         let indices =
             glium::IndexBuffer::new(&&rend, PrimitiveType::TriangleStrip, &[1, 2, 0, 3]).unwrap();
 
@@ -138,6 +202,7 @@ impl Renderer {
                     context,
                     vertices,
                     program,
+                    fade_program,
                     indices,
                     bg: Default::default(),
                 })
@@ -155,7 +220,7 @@ impl Renderer {
         rend
     }
 
-    fn update_displayed(&mut self, content: &GuiContent) {
+    fn update_displayed(&mut self, content: &GuiContent, page: (&Path, usize)) {
         use Displayable::*;
         use {DisplayedContent as DC, GuiContent as GC};
 
@@ -193,28 +258,33 @@ impl Renderer {
 
                     Renderable::Video(ManuallyDrop::new(vid))
                 }
-                Error(e) => {
-                    let error = gtk::Label::new(Some(e));
-
-                    error.set_halign(gtk::Align::Center);
-                    error.set_valign(gtk::Align::Center);
-
-                    error.set_hexpand(false);
-                    error.set_vexpand(false);
-
-                    error.set_wrap(true);
-                    error.set_max_width_chars(120);
-                    error.add_css_class("error-label");
-
-                    self.gui.overlay.add_overlay(&error);
-
-                    Renderable::Error(error)
-                }
+                Error(e) => Renderable::Error(
+                    e.clone(),
+                    StaticImage::new(super::placeholder::placeholder(e), at),
+                ),
                 Nothing => Renderable::Nothing,
                 Pending(res) => Renderable::Pending(*res),
             }
         };
 
+        // Strips scroll smoothly between pages, so only transition between single pages. Pages
+        // that are still loading don't replace the last frame, so the fade starts once the new
+        // page can be shown.
+        match content {
+            GC::Single(Pending(_) | Nothing) => {}
+            GC::Single(_) => {
+                let turned = matches!(&self.last_page, Some((p, i)) if (p.as_path(), *i) != page);
+                if TRANSITION_DURATION.is_some() && self.transition.is_none() && turned {
+                    self.transition = self
+                        .last_frame
+                        .take()
+                        .map(|previous| Transition { previous, start: Instant::now() });
+                }
+                self.last_page = Some((page.0.to_path_buf(), page.1));
+            }
+            GC::Multiple { .. } => self.last_page = None,
+        }
+
         let take_old_renderable = |d: &Displayable, old: &mut Vec<Renderable>| {
             for (i, o) in old.iter_mut().enumerate() {
                 if o.matches(d) {
@@ -276,7 +346,9 @@ impl Renderer {
     }
 
     fn drop_textures(&mut self) {
-        self.displayed.invalidate()
+        self.displayed.invalidate();
+        self.last_frame = None;
+        self.transition = None;
     }
 
     fn invalidate(&mut self) {
@@ -297,6 +369,75 @@ impl Renderer {
             [linear_to_srgb(bg[0]), linear_to_srgb(bg[1]), linear_to_srgb(bg[2]), bg[3]];
     }
 
+    fn draw_transition(&mut self, frame: &mut Frame, (w, h): (u32, u32)) {
+        let (t, duration) = match (&self.transition, *TRANSITION_DURATION) {
+            (Some(t), Some(d)) => (t, d),
+            _ => return,
+        };
+
+        let elapsed = t.start.elapsed();
+        if elapsed >= duration || t.previous.dimensions() != (w, h) {
+            self.transition = None;
+            return;
+        }
+
+        let r_ctx = self.render_context.get().unwrap();
+        let alpha = 1.0 - elapsed.as_secs_f32() / duration.as_secs_f32();
+        let uniforms = uniform! {
+            matrix: IDENTITY,
+            tex: t.previous.sampled().magnify_filter(MagnifySamplerFilter::Nearest),
+            alpha: alpha,
+        };
+
+        frame
+            .draw(
+                &r_ctx.vertices,
+                &r_ctx.indices,
+                &r_ctx.fade_program,
+                &uniforms,
+                &DrawParameters {
+                    blend: Blend::alpha_blending(),
+                    ..DrawParameters::default()
+                },
+            )
+            .unwrap();
+
+        // Keep drawing until the transition is complete.
+        self.backend.queue_draw();
+    }
+
+    fn save_frame(&mut self, frame: &Frame, (w, h): (u32, u32)) {
+        // Don't overwrite the previous page while it's still fading out or while the next one is
+        // loading.
+        if TRANSITION_DURATION.is_none()
+            || self.transition.is_some()
+            || matches!(
+                self.displayed,
+                DisplayedContent::Single(Renderable::Pending(_) | Renderable::Nothing)
+            )
+        {
+            return;
+        }
+
+        let tex = match self.last_frame.take() {
+            Some(t) if t.dimensions() == (w, h) => t,
+            _ => match Texture2d::empty(&self.context, w, h) {
+                Ok(t) => t,
+                Err(e) => {
+                    error!("Failed to allocate texture for page transitions: {:?}", e);
+                    return;
+                }
+            },
+        };
+
+        frame.blit_whole_color_to(
+            &tex.as_surface(),
+            &BlitTarget { left: 0, bottom: 0, width: w as i32, height: h as i32 },
+            MagnifySamplerFilter::Nearest,
+        );
+        self.last_frame = Some(tex);
+    }
+
     fn draw(&mut self) {
         let start = Instant::now();
         let context = self.context.clone();
@@ -317,7 +458,7 @@ impl Renderer {
             let mut render = |d: &mut Renderable| {
                 let layout = layouts.next().expect("Layout not defined for all displayed pages.");
                 match d {
-                    Renderable::Image(tc) => {
+                    Renderable::Image(tc) | Renderable::Error(_, tc) => {
                         drew_something =
                             tc.draw(r_ctx, &mut frame, layout, (w, h).into()) || drew_something;
                     }
@@ -326,10 +467,7 @@ impl Renderer {
                             Animation::draw(ac, r_ctx, &mut frame, layout, (w, h).into())
                                 || drew_something;
                     }
-                    Renderable::Video(_)
-                    | Renderable::Error(_)
-                    | Renderable::Pending(_)
-                    | Renderable::Nothing => {}
+                    Renderable::Video(_) | Renderable::Pending(_) | Renderable::Nothing => {}
                 }
             };
 
@@ -339,7 +477,17 @@ impl Renderer {
             }
         }
 
+        self.draw_transition(&mut frame, (w, h));
+        self.save_frame(&frame, (w, h));
+
         frame.finish().unwrap();
+
+        // Highlights need to follow the pages as they move.
+        if self.gui.state.try_borrow().map_or(false, |s| {
+            s.annotations.iter().any(|a| a.highlight.is_some())
+        }) {
+            self.gui.annotation_layer.queue_draw();
+        }
         if drew_something {
             let last_action = self.gui.last_action.take();
             if let Some(last_action) = last_action {
@@ -356,6 +504,7 @@ impl Renderer {
             }
 
             let dur = start.elapsed();
+            self.gui.frame_time.set(dur);
 
             if dur < Duration::from_millis(10) {
                 // Don't bother
@@ -440,8 +589,8 @@ impl GliumGLArea {
         self.renderer.borrow_mut().as_mut().unwrap().invalidate();
     }
 
-    pub fn update_displayed(&self, content: &GuiContent) {
-        self.renderer.borrow_mut().as_mut().unwrap().update_displayed(content);
+    pub fn update_displayed(&self, content: &GuiContent, page: (&Path, usize)) {
+        self.renderer.borrow_mut().as_mut().unwrap().update_displayed(content, page);
     }
 
     pub fn set_bg(&self, bg: gdk::RGBA) {
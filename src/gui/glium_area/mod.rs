@@ -1,4 +1,5 @@
 mod imp;
+mod placeholder;
 mod renderable;
 
 use std::ptr;
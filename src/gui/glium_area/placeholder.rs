@@ -0,0 +1,113 @@
+// Failed pages are drawn as a generated image with the error message, so they take up a page's
+// worth of space in strips and dual page mode and it's clear which page is broken.
+
+use gtk::cairo::{Context, FontSlant, FontWeight, Format, ImageSurface};
+use image::{DynamicImage, Rgb, RgbImage};
+
+use crate::com::{Image, ImageWithRes, Res, PLACEHOLDER_RES};
+
+const MARGIN: f64 = 48.0;
+const FONT_SIZE: f64 = 26.0;
+const LINE_HEIGHT: f64 = FONT_SIZE * 1.4;
+const BACKGROUND: [u8; 3] = [48, 48, 48];
+
+pub(super) fn placeholder(msg: &str) -> ImageWithRes {
+    let res = PLACEHOLDER_RES;
+    let img = draw(msg, res).unwrap_or_else(|e| {
+        error!("Failed to draw placeholder for failed page: {}", e);
+        RgbImage::from_pixel(res.w, res.h, Rgb(BACKGROUND))
+    });
+
+    ImageWithRes {
+        img: Image::from(DynamicImage::ImageRgb8(img)),
+        original_res: res,
+    }
+}
+
+fn draw(msg: &str, res: Res) -> Result<RgbImage, String> {
+    let mut surface = ImageSurface::create(Format::Rgb24, res.w as i32, res.h as i32)
+        .map_err(|e| format!("{:?}", e))?;
+
+    paint(&surface, msg, res).map_err(|e| format!("{:?}", e))?;
+    surface.flush();
+
+    let stride = surface.stride() as usize;
+    let data = surface.data().map_err(|e| format!("{:?}", e))?;
+
+    // Rgb24 pixels are native endian u32s of the form 0x00RRGGBB.
+    let mut img = RgbImage::new(res.w, res.h);
+    for (y, row) in img.rows_mut().enumerate() {
+        let src = &data[y * stride..y * stride + res.w as usize * 4];
+        for (px, s) in row.zip(src.chunks_exact(4)) {
+            let [_, r, g, b] = u32::from_ne_bytes([s[0], s[1], s[2], s[3]]).to_be_bytes();
+            *px = Rgb([r, g, b]);
+        }
+    }
+    Ok(img)
+}
+
+fn paint(surface: &ImageSurface, msg: &str, res: Res) -> Result<(), gtk::cairo::Error> {
+    let (w, h) = (res.w as f64, res.h as f64);
+    let cr = Context::new(surface)?;
+
+    let [r, g, b] = BACKGROUND.map(|c| c as f64 / 255.0);
+    cr.set_source_rgb(r, g, b);
+    cr.paint()?;
+
+    cr.set_source_rgb(0.6, 0.2, 0.2);
+    cr.set_line_width(6.0);
+    cr.rectangle(3.0, 3.0, w - 6.0, h - 6.0);
+    cr.stroke()?;
+
+    cr.select_font_face("sans-serif", FontSlant::Normal, FontWeight::Normal);
+    cr.set_font_size(FONT_SIZE);
+    cr.set_source_rgb(0.9, 0.9, 0.9);
+
+    let lines = wrap(&cr, msg, w - 2.0 * MARGIN)?;
+    let top = (h - lines.len() as f64 * LINE_HEIGHT) / 2.0;
+    let mut y = top.max(MARGIN) + FONT_SIZE;
+    for line in lines {
+        if y > h - MARGIN {
+            break;
+        }
+        cr.move_to(MARGIN, y);
+        cr.show_text(&line)?;
+        y += LINE_HEIGHT;
+    }
+    Ok(())
+}
+
+// Splits the message into lines that fit in width. Words too long for a line on their own, like
+// paths, are broken wherever they need to be.
+fn wrap(cr: &Context, text: &str, width: f64) -> Result<Vec<String>, gtk::cairo::Error> {
+    let fits = |s: &str| cr.text_extents(s).map(|e| e.x_advance <= width);
+    let mut lines = Vec::new();
+
+    for paragraph in text.lines() {
+        let mut line = String::new();
+
+        for word in paragraph.split(' ') {
+            let joined = if line.is_empty() { word.to_string() } else { line.clone() + " " + word };
+            if fits(&joined)? {
+                line = joined;
+                continue;
+            }
+
+            if !line.is_empty() {
+                lines.push(std::mem::take(&mut line));
+            }
+
+            for c in word.chars() {
+                line.push(c);
+                if line.chars().count() > 1 && !fits(&line)? {
+                    line.pop();
+                    lines.push(std::mem::replace(&mut line, c.to_string()));
+                }
+            }
+        }
+
+        lines.push(line);
+    }
+
+    Ok(lines)
+}
@@ -803,7 +803,8 @@ pub(in super::super) enum Renderable {
     Image(StaticImage),
     Animation(Rc<RefCell<Animation>>),
     Video(ManuallyDrop<gtk::Video>),
-    Error(gtk::Label),
+    // The error message and a placeholder image showing it.
+    Error(String, StaticImage),
 }
 
 impl Drop for Renderable {
@@ -840,9 +841,6 @@ impl Drop for Renderable {
                     }
                 });
             }
-            Self::Error(e) => {
-                e.parent().unwrap().dynamic_cast::<gtk::Overlay>().unwrap().remove_overlay(e)
-            }
             _ => (),
         }
     }
@@ -860,7 +858,7 @@ impl Renderable {
                     (true, true) | (false, false) => (),
                 }
             }
-            Self::Image(_) | Self::Pending(_) | Self::Error(_) | Self::Nothing => {}
+            Self::Image(_) | Self::Pending(_) | Self::Error(..) | Self::Nothing => {}
         }
     }
 
@@ -872,14 +870,14 @@ impl Renderable {
                 error!("Videos cannot be equal yet");
                 false
             }
-            (Self::Error(se), Displayable::Error(de)) => se.text().as_str() == de,
+            (Self::Error(se, _), Displayable::Error(de)) => se == de,
             (Self::Pending(sr), Displayable::Pending(dr)) => sr == dr,
             (Self::Nothing, Displayable::Nothing) => true,
             (
                 Self::Image(_)
                 | Self::Animation(_)
                 | Self::Video(_)
-                | Self::Error(_)
+                | Self::Error(..)
                 | Self::Pending(_)
                 | Self::Nothing,
                 _,
@@ -889,17 +887,17 @@ impl Renderable {
 
     fn invalidate(&mut self) {
         match self {
-            Self::Nothing | Self::Pending(_) | Self::Video(_) | Self::Error(_) => (),
-            Self::Image(i) => i.invalidate(),
+            Self::Nothing | Self::Pending(_) | Self::Video(_) => (),
+            Self::Image(i) | Self::Error(_, i) => i.invalidate(),
             Self::Animation(a) => a.borrow_mut().invalidate(),
         }
     }
 
     pub(super) fn take_textures(&mut self) -> AllocatedTextures {
         match self {
-            Self::Image(i) => i.take_textures(),
+            Self::Image(i) | Self::Error(_, i) => i.take_textures(),
             Self::Animation(a) => a.borrow_mut().take_textures(),
-            Self::Nothing | Self::Pending(_) | Self::Video(_) | Self::Error(_) => {
+            Self::Nothing | Self::Pending(_) | Self::Video(_) => {
                 AllocatedTextures::default()
             }
         }
@@ -0,0 +1,111 @@
+// An overlay with details about the current page, like its resolution and whether it's been
+// upscaled. Most of them come from the manager, so they're requested again whenever the state
+// changes while the overlay is visible.
+
+use std::rc::Rc;
+
+use gtk::glib;
+use gtk::prelude::*;
+use serde_json::Value;
+use tokio::sync::oneshot;
+
+use super::Gui;
+use crate::com::{Displayable, GuiActionContext, GuiContent, ManagerAction};
+
+impl Gui {
+    pub(super) fn toggle_page_info(self: &Rc<Self>) {
+        if self.page_info.is_visible() {
+            self.page_info.hide();
+            return;
+        }
+
+        self.page_info.show();
+        self.update_page_info();
+    }
+
+    pub(super) fn update_page_info(self: &Rc<Self>) {
+        if !self.page_info.is_visible() {
+            return;
+        }
+
+        let (s, r) = oneshot::channel();
+        self.manager_sender
+            .send((ManagerAction::PageInfo, GuiActionContext::default(), Some(s)))
+            .expect("Unexpected failed to send from Gui to Manager");
+
+        let g = self.clone();
+        glib::MainContext::default().spawn_local(async move {
+            let info = match r.await {
+                Ok(Value::Object(info)) => info,
+                _ => return,
+            };
+
+            if let Some(e) = info.get("error").and_then(Value::as_str) {
+                g.page_info.set_text(e);
+                return;
+            }
+
+            let field = |k: &str| info.get(k).and_then(Value::as_str).unwrap_or("unknown");
+            let mut text = format!("path       {}\nformat     {}", field("path"), field("format"));
+
+            if let Some(size) = info.get("size").and_then(Value::as_u64) {
+                text += &format!("\nsize       {}", human_size(size));
+            }
+
+            let original = info
+                .get("width")
+                .and_then(Value::as_u64)
+                .zip(info.get("height").and_then(Value::as_u64));
+            if let Some((w, h)) = original {
+                text += &format!("\nresolution {}x{}", w, h);
+            }
+
+            let upscaled = info.get("upscaled").and_then(Value::as_bool).unwrap_or_default();
+            if upscaled {
+                text += "\nupscaled   yes";
+            }
+
+            if let Some((w, h)) = g.displayed_res() {
+                let scaled = if original == Some((w, h)) { "" } else { " (scaled)" };
+                text += &format!("\ndisplayed  {}x{}{}", w, h, scaled);
+            }
+
+            g.page_info.set_text(&text);
+        });
+    }
+
+    // The resolution of the current page as it was loaded, before fitting it to the window.
+    fn displayed_res(&self) -> Option<(u64, u64)> {
+        let s = self.state.borrow();
+        let d = match &s.content {
+            GuiContent::Single(d) => d,
+            GuiContent::Multiple { current_index, visible, .. } => &visible[*current_index],
+        };
+
+        match d {
+            Displayable::Image(i) => Some((i.img.res.w.into(), i.img.res.h.into())),
+            Displayable::Animation(_)
+            | Displayable::Video(_)
+            | Displayable::Error(_)
+            | Displayable::Pending(_)
+            | Displayable::Nothing => None,
+        }
+    }
+}
+
+fn human_size(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["B", "KiB", "MiB", "GiB"];
+
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+
+    if unit == 0 {
+        format!("{} {}", bytes, UNITS[0])
+    } else {
+        format!("{:.1} {}", size, UNITS[unit])
+    }
+}
@@ -2,42 +2,64 @@
 
 use std::cell::Cell;
 use std::collections::hash_map::Entry;
+use std::path::PathBuf;
 use std::rc::Rc;
 use std::str::FromStr;
-use std::time::Instant;
+use std::time::{Duration, Instant};
 
 use ahash::AHashMap;
 use gtk::gdk::{Key, ModifierType, RGBA};
 use gtk::prelude::*;
+use gtk::{gio, glib};
 use once_cell::sync::Lazy;
 use regex::{self, Regex};
 use serde_json::Value;
+use tokio::sync::oneshot;
 
 use super::Gui;
-use crate::closing;
 use crate::com::{
-    CommandResponder, Direction, DisplayMode, Fit, GuiActionContext, GuiContent, LayoutCount,
-    ManagerAction, OffscreenContent, ScrollMotionTarget,
+    Annotation, CommandResponder, Direction, DisplayMode, Fit, GuiActionContext, GuiContent,
+    Highlight, LayoutCount, ManagerAction, OffscreenContent, ScrollMotionTarget, ZoomChange,
 };
-use crate::config::CONFIG;
+use crate::config::{Shortcut, CONFIG};
+use crate::manager::files::openable_extensions;
+use crate::manager::shell;
+use crate::{closing, crash, elapsedlogger};
 
 // These are only accessed from one thread but it's cleaner to use sync::Lazy
 static SET_BACKGROUND_RE: Lazy<Regex> =
     Lazy::new(|| Regex::new(r"^SetBackground ([^ ]+)$").unwrap());
 static JUMP_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^Jump (\+|-)?(\d+)$").unwrap());
 static EXECUTE_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^Execute (.+)$").unwrap());
+static OPEN_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^Open (.+)$").unwrap());
+static EXPORT_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^ExportArchive (.+)$").unwrap());
+static NEW_TAB_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^NewTab (.+)$").unwrap());
+static LOG_LEVEL_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^SetLogLevel (\w+)$").unwrap());
+static ANNOTATE_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^Annotate (.+)$").unwrap());
+static MONITOR_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^MoveToMonitor (.+)$").unwrap());
+static HIGHLIGHT_RE: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"^Highlight (\d+) (\d+) (\d+) (\d+)(?: (.+))?$").unwrap());
 
 #[derive(Debug, Hash, Eq, PartialEq)]
 pub(super) enum Dialogs {
     Background,
     Jump,
+    Annotate,
+    Prompt,
+    Open,
+    Export,
+    Recent,
+    Shortcuts,
+    Trash,
 }
 
+// Errors are sent as objects with an "error" field, the same as errors from the manager, so they
+// can be distinguished from informational responses.
 fn command_error<T: std::fmt::Display>(e: T, fin: Option<CommandResponder>) {
     let e = format!("{}", e);
     error!("{}", e);
     if let Some(s) = fin {
-        s.send(serde_json::Value::String(e))
+        s.send(serde_json::json!({ "error": e }))
             .expect("Oneshot channel unexpected failed to send.");
     }
 }
@@ -53,16 +75,24 @@ fn command_info<T: std::fmt::Display>(e: T, fin: Option<CommandResponder>) {
 
 impl Gui {
     pub(super) fn setup_interaction(self: &Rc<Self>) {
-        let scroll = gtk::EventControllerScroll::new(gtk::EventControllerScrollFlags::BOTH_AXES);
+        let flags = if CONFIG.kinetic_scrolling {
+            gtk::EventControllerScrollFlags::BOTH_AXES | gtk::EventControllerScrollFlags::KINETIC
+        } else {
+            gtk::EventControllerScrollFlags::BOTH_AXES
+        };
+        let scroll = gtk::EventControllerScroll::new(flags);
 
         let g = self.clone();
         scroll.connect_scroll_begin(move |_e| {
             g.pad_scrolling.set(true);
+            g.swipe_dx.set(0.0);
         });
 
         let g = self.clone();
         scroll.connect_scroll_end(move |_e| {
             g.pad_scrolling.set(false);
+            g.smooth_delta.take();
+            g.finish_swipe();
         });
 
         #[cfg(unix)]
@@ -91,16 +121,23 @@ impl Gui {
             }
 
             // GTK continuous scrolling start/end is weird.
-            // Detect when this is extremely likely to be a discrete device.
-            if g.pad_scrolling.get() && x.fract() == 0.0 && y.fract() == 0.0 {
+            // Detect when this is extremely likely to be a discrete device. Touchpads can send
+            // empty events, which say nothing either way.
+            let smooth = x.fract() != 0.0 || y.fract() != 0.0;
+            if g.pad_scrolling.get() && !smooth && (x != 0.0 || y != 0.0) {
                 warn!("Detected discrete scrolling while in touchpad scrolling mode.");
                 g.pad_scrolling.set(false);
             }
             // TODO -- could do inverse condition, but may be possible to remove entirely on
             // Wayland
 
-            if g.pad_scrolling.get() {
+            if g.pad_scrolling.get() && g.swiping() {
+                g.swipe_dx.set(g.swipe_dx.get() + x);
+                g.pad_scroll(0.0, y);
+            } else if g.pad_scrolling.get() {
                 g.pad_scroll(x, y);
+            } else if smooth || g.smooth_delta.get() != (0.0, 0.0) {
+                g.smooth_scroll(x, y);
             } else {
                 g.discrete_scroll(x, y);
             }
@@ -108,8 +145,24 @@ impl Gui {
         });
 
 
+        let g = self.clone();
+        scroll.connect_decelerate(move |_e, vx, vy| {
+            if g.swiping() {
+                g.kinetic_scroll(0.0, vy);
+            } else {
+                g.kinetic_scroll(vx, vy);
+            }
+        });
+
         self.overlay.add_controller(&scroll);
 
+        let motion = gtk::EventControllerMotion::new();
+        let g = self.clone();
+        motion.connect_motion(move |_e, _x, y| {
+            g.pointer_moved(y);
+        });
+        self.overlay.add_controller(&motion);
+
         let drag = gtk::GestureDrag::new();
         drag.set_propagation_phase(gtk::PropagationPhase::Capture);
 
@@ -129,20 +182,118 @@ impl Gui {
 
         let g = self.clone();
         key.connect_key_pressed(move |_e, a, _b, c| {
+            if a == Key::Escape && g.overview.is_visible() {
+                g.hide_overview();
+                return gtk::Inhibit(true);
+            }
+
+            if g.library.is_visible() {
+                if a == Key::BackSpace {
+                    g.library_up();
+                    return gtk::Inhibit(true);
+                }
+                if a == Key::Escape && g.can_hide_library() {
+                    g.hide_library();
+                    return gtk::Inhibit(true);
+                }
+            }
+
             if let Some(s) = g.shortcut_from_key(a, c) {
-                g.run_command(s, None);
+                if g.limit_repeat(a, &s) {
+                    return gtk::Inhibit(true);
+                }
+                g.run_shortcut(&s);
+                if s == "ShowOriginal" {
+                    g.original_key.set(Some(a));
+                }
             }
             gtk::Inhibit(false)
         });
 
+        let g = self.clone();
+        key.connect_key_released(move |_e, a, _b, _c| {
+            if matches!(g.held_key.get(), Some((k, _)) if k == a) {
+                g.held_key.set(None);
+            }
+
+            if g.original_key.get() == Some(a) {
+                g.original_key.set(None);
+                g.manager_sender
+                    .send((ManagerAction::ShowOriginal(false), GuiActionContext::default(), None))
+                    .expect("Unexpected failed to send from Gui to Manager");
+            }
+        });
+
         self.window.add_controller(&key);
+
+        // GtkWindow moves focus on Control+Tab before shortcuts see it, so Tab shortcuts, usually
+        // for switching tabs, are handled first.
+        let tab_key = gtk::EventControllerKey::new();
+        tab_key.set_propagation_phase(gtk::PropagationPhase::Capture);
+
+        let g = self.clone();
+        tab_key.connect_key_pressed(move |_e, a, _b, c| {
+            if a != Key::Tab && a != Key::ISO_Left_Tab {
+                return gtk::Inhibit(false);
+            }
+
+            match g.shortcut_from_key(a, c) {
+                Some(s) => {
+                    g.run_shortcut(&s);
+                    gtk::Inhibit(true)
+                }
+                None => gtk::Inhibit(false),
+            }
+        });
+
+        self.window.add_controller(&tab_key);
+    }
+
+    // Key repeat is usually much faster than pages can be shown, so holding a key that turns pages
+    // would queue up pages that keep turning after it's released. Returns true if this press
+    // should be dropped.
+    fn limit_repeat(self: &Rc<Self>, k: Key, cmd: &str) -> bool {
+        let interval = match CONFIG.key_repeat_interval {
+            Some(i) => Duration::from_millis(i.get()),
+            None => return false,
+        };
+
+        if !is_page_turn(cmd) {
+            self.held_key.set(None);
+            return false;
+        }
+
+        let now = Instant::now();
+        match self.held_key.get() {
+            Some((held, last)) if held == k && now.saturating_duration_since(last) < interval => {
+                true
+            }
+            _ => {
+                self.held_key.set(Some((k, now)));
+                false
+            }
+        }
+    }
+
+    fn finish_swipe(self: &Rc<Self>) {
+        let threshold = match CONFIG.swipe_threshold {
+            Some(t) => f64::from(t.get()),
+            None => return,
+        };
+
+        let dx = self.swipe_dx.take() * f64::from(CONFIG.scroll_amount.get());
+        if dx >= threshold {
+            self.run_command("NextPage", None);
+        } else if dx <= -threshold {
+            self.run_command("PreviousPage", None);
+        }
     }
 
-    fn shortcut_from_key<'a>(self: &'a Rc<Self>, k: Key, mods: ModifierType) -> Option<&'a String> {
+    fn shortcut_from_key(self: &Rc<Self>, k: Key, mods: ModifierType) -> Option<String> {
         let mods = mods & !ModifierType::LOCK_MASK;
         let upper = k.to_upper();
 
-        self.shortcuts.get(&mods)?.get(&upper)
+        self.shortcuts.borrow().get(&mods)?.get(&upper).cloned()
     }
 
     fn simple_sends(self: &Rc<Self>, s: &str) -> Option<(ManagerAction, GuiActionContext)> {
@@ -154,6 +305,7 @@ impl Gui {
             "NextPage" => {
                 let state = self.state.borrow();
                 let pages = match state.modes.display {
+                    _ if state.comparing => 1,
                     DisplayMode::DualPage | DisplayMode::DualPageReversed => match &state.content {
                         GuiContent::Single(_) => unreachable!(),
                         GuiContent::Multiple { next: OffscreenContent::Nothing, .. } => 0,
@@ -168,6 +320,7 @@ impl Gui {
             "PreviousPage" => {
                 let state = self.state.borrow();
                 let pages = match state.modes.display {
+                    _ if state.comparing => 1,
                     DisplayMode::DualPage | DisplayMode::DualPageReversed => match state.content {
                         GuiContent::Single(_) => unreachable!(),
                         GuiContent::Multiple { prev: OffscreenContent::Nothing, .. } => 0,
@@ -183,20 +336,49 @@ impl Gui {
                 };
                 Some((MovePages(Backwards, pages), Start.into()))
             }
-            "FirstPage" => Some((MovePages(Absolute, 0), Start.into())),
-            "LastPage" => {
+            "FirstPage" | "FirstArchivePage" => Some((MovePages(Absolute, 0), Start.into())),
+            "LastPage" | "LastArchivePage" => {
                 Some((MovePages(Absolute, self.state.borrow().archive_len), Start.into()))
             }
+            "RandomPage" => Some((RandomPage, Start.into())),
+            "RetryPage" => Some((RetryPage, GuiActionContext::default())),
             "NextArchive" => Some((NextArchive, Start.into())),
             "PreviousArchive" => Some((PreviousArchive, Start.into())),
+            "FirstOfSeries" => Some((FirstOfSeries, Start.into())),
+            "LastOfSeries" => Some((LastOfSeries, Start.into())),
             "ToggleUpscaling" => Some((ToggleUpscaling, GuiActionContext::default())),
+            "UpscaleArchive" => Some((UpscaleArchive, GuiActionContext::default())),
+            "ToggleComparison" => Some((ToggleComparison, GuiActionContext::default())),
+            "ShowOriginal" => Some((ShowOriginal(true), GuiActionContext::default())),
+            "HideOriginal" => Some((ShowOriginal(false), GuiActionContext::default())),
             "ToggleMangaMode" => Some((ToggleManga, GuiActionContext::default())),
+            "ToggleLowMemory" => Some((ToggleLowMemory, GuiActionContext::default())),
+            "ToggleSortByTime" => Some((ToggleSortByTime, GuiActionContext::default())),
+            "ToggleReverseSort" => Some((ToggleReverseSort, GuiActionContext::default())),
             "Status" => Some((Status, GuiActionContext::default())),
             "ListPages" => Some((ListPages, GuiActionContext::default())),
+            "PageInfo" => Some((PageInfo, GuiActionContext::default())),
+            "ListSiblings" => Some((ListSiblings, GuiActionContext::default())),
+            "ListRecent" => Some((ListRecent, GuiActionContext::default())),
+            "SetWallpaper" => Some((SetWallpaper, GuiActionContext::default())),
+            "ListAnnotations" => Some((ListAnnotations, GuiActionContext::default())),
+            "ClearAnnotations" => Some((ClearAnnotations, GuiActionContext::default())),
             "FitToContainer" => Some((FitStrategy(Fit::Container), GuiActionContext::default())),
             "FitToWidth" => Some((FitStrategy(Fit::Width), GuiActionContext::default())),
             "FitToHeight" => Some((FitStrategy(Fit::Height), GuiActionContext::default())),
             "FullSize" => Some((FitStrategy(Fit::FullSize), GuiActionContext::default())),
+            "ZoomIn" => Some((Zoom(ZoomChange::In), GuiActionContext::default())),
+            "ZoomOut" => Some((Zoom(ZoomChange::Out), GuiActionContext::default())),
+            "ZoomReset" => Some((Zoom(ZoomChange::Reset), GuiActionContext::default())),
+            "CycleFitMode" => {
+                let fit = match self.state.borrow().modes.fit {
+                    Fit::Container => Fit::Width,
+                    Fit::Width => Fit::Height,
+                    Fit::Height => Fit::FullSize,
+                    Fit::FullSize => Fit::Container,
+                };
+                Some((FitStrategy(fit), GuiActionContext::default()))
+            }
             "VerticalStrip" => {
                 Some((Display(DisplayMode::VerticalStrip), GuiActionContext::default()))
             }
@@ -342,10 +524,442 @@ impl Gui {
             .insert(Dialogs::Jump, dialog.upcast::<gtk::Window>());
     }
 
+    fn annotate_dialog(self: &Rc<Self>, fin: Option<CommandResponder>) {
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Annotate) {
+            command_info("Annotate dialog already open", fin);
+            d.present();
+            return;
+        }
+
+        let dialog = gtk::Dialog::builder().transient_for(&self.window).build();
+        dialog.set_title(Some("Annotate"));
+
+        let entry = gtk::Entry::new();
+        entry.set_width_chars(40);
+
+        let g = self.clone();
+        let d = dialog.clone();
+        let fin = Cell::from(fin);
+        entry.connect_activate(move |e| {
+            let text = e.text();
+            if !text.trim().is_empty() {
+                g.run_command(&("Annotate ".to_string() + text.trim()), fin.take());
+            }
+            d.close();
+        });
+
+        dialog.content_area().append(&entry);
+
+        let g = self.clone();
+        dialog.run_async(move |d, _r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Annotate);
+            d.content_area().remove(&entry);
+            d.destroy();
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Annotate, dialog.upcast::<gtk::Window>());
+    }
+
+    fn open_dialog(self: &Rc<Self>, fin: Option<CommandResponder>) {
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Open) {
+            command_info("Open dialog already open", fin);
+            d.present();
+            return;
+        }
+
+        let dialog = gtk::FileChooserDialog::new(
+            Some("Open"),
+            Some(&self.window),
+            gtk::FileChooserAction::Open,
+            &[("Cancel", gtk::ResponseType::Cancel), ("Open", gtk::ResponseType::Accept)],
+        );
+
+        let filter = gtk::FileFilter::new();
+        filter.set_name(Some("Supported files"));
+        for ext in openable_extensions() {
+            // Patterns are case sensitive, so match each letter in either case.
+            let pattern: String = ext
+                .chars()
+                .map(|c| format!("[{}{}]", c.to_ascii_lowercase(), c.to_ascii_uppercase()))
+                .collect();
+            filter.add_pattern(&format!("*.{}", pattern));
+        }
+        dialog.add_filter(&filter);
+
+        let all = gtk::FileFilter::new();
+        all.set_name(Some("All files"));
+        all.add_pattern("*");
+        dialog.add_filter(&all);
+
+        let current = self.state.borrow().archive_path.clone();
+        if let Some(dir) = current.parent().filter(|d| d.is_dir()) {
+            drop(dialog.set_current_folder(Some(&gio::File::for_path(dir))));
+        }
+
+        self.close_on_quit(&dialog);
+
+        let g = self.clone();
+        dialog.run_async(move |d, r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Open);
+            let path = d.file().and_then(|f| f.path());
+            d.destroy();
+
+            match path {
+                Some(path) if r == gtk::ResponseType::Accept => {
+                    g.manager_sender
+                        .send((ManagerAction::Open(path), ScrollMotionTarget::Start.into(), fin))
+                        .expect("Unexpected failed to send from Gui to Manager");
+                }
+                _ => drop(fin),
+            }
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Open, dialog.upcast::<gtk::Window>());
+    }
+
+    fn export_dialog(self: &Rc<Self>, fin: Option<CommandResponder>) {
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Export) {
+            command_info("Export dialog already open", fin);
+            d.present();
+            return;
+        }
+
+        let dialog = gtk::FileChooserDialog::new(
+            Some("Export"),
+            Some(&self.window),
+            gtk::FileChooserAction::Save,
+            &[("Cancel", gtk::ResponseType::Cancel), ("Export", gtk::ResponseType::Accept)],
+        );
+
+        let current = self.state.borrow().archive_path.clone();
+        if let Some(dir) = current.parent().filter(|d| d.is_dir()) {
+            drop(dialog.set_current_folder(Some(&gio::File::for_path(dir))));
+        }
+        if let Some(stem) = current.file_stem() {
+            dialog.set_current_name(&format!("{}.cbz", stem.to_string_lossy()));
+        }
+
+        self.close_on_quit(&dialog);
+
+        let g = self.clone();
+        dialog.run_async(move |d, r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Export);
+            let path = d.file().and_then(|f| f.path());
+            d.destroy();
+
+            match path {
+                Some(path) if r == gtk::ResponseType::Accept => {
+                    let action = ManagerAction::ExportArchive(path);
+                    g.manager_sender
+                        .send((action, GuiActionContext::default(), fin))
+                        .expect("Unexpected failed to send from Gui to Manager");
+                }
+                _ => drop(fin),
+            }
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Export, dialog.upcast::<gtk::Window>());
+    }
+
+    // A quick switcher for recently read archives. Type to filter, Enter or a click to open.
+    fn recent_dialog(self: &Rc<Self>, fin: Option<CommandResponder>) {
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Recent) {
+            command_info("Recent files dialog already open", fin);
+            d.present();
+            return;
+        }
+
+        let (s, r) = oneshot::channel();
+        self.manager_sender
+            .send((ManagerAction::ListRecent, GuiActionContext::default(), Some(s)))
+            .expect("Unexpected failed to send from Gui to Manager");
+
+        let g = self.clone();
+        glib::MainContext::default().spawn_local(async move {
+            let recent: Vec<PathBuf> = match r.await {
+                Ok(Value::Array(a)) => {
+                    a.into_iter().filter_map(|v| v.as_str().map(PathBuf::from)).collect()
+                }
+                _ => Vec::new(),
+            };
+
+            if recent.is_empty() {
+                return command_error("No recent files, is state_directory set?", fin);
+            }
+            g.show_recent_dialog(recent, fin);
+        });
+    }
+
+    fn show_recent_dialog(self: &Rc<Self>, recent: Vec<PathBuf>, fin: Option<CommandResponder>) {
+        // Another request may have opened one while the list was being read.
+        if self.open_dialogs.borrow().contains_key(&Dialogs::Recent) {
+            return drop(fin);
+        }
+
+        let dialog = gtk::Dialog::builder().transient_for(&self.window).build();
+        dialog.set_title(Some("Open Recent"));
+        dialog.set_default_size(600, 400);
+
+        let entry = gtk::SearchEntry::new();
+        let list = gtk::ListBox::new();
+        list.set_selection_mode(gtk::SelectionMode::Browse);
+
+        for p in &recent {
+            let label = gtk::Label::new(Some(&p.to_string_lossy()));
+            label.set_halign(gtk::Align::Start);
+            label.set_ellipsize(gtk::pango::EllipsizeMode::Start);
+            list.append(&label);
+        }
+        list.select_row(list.row_at_index(0).as_ref());
+
+        let recent = Rc::new(recent);
+        let r = recent.clone();
+        let e = entry.clone();
+        list.set_filter_func(move |row| {
+            let filter = e.text().to_lowercase();
+            r.get(row.index().max(0) as usize)
+                .map_or(false, |p| p.to_string_lossy().to_lowercase().contains(&filter))
+        });
+
+        let l = list.clone();
+        entry.connect_search_changed(move |_| {
+            l.invalidate_filter();
+            let first = (0..).map_while(|i| l.row_at_index(i)).find(|r| r.is_child_visible());
+            l.select_row(first.as_ref());
+        });
+
+        let l = list.clone();
+        entry.connect_activate(move |_| {
+            if let Some(row) = l.selected_row() {
+                row.activate();
+            }
+        });
+
+        let g = self.clone();
+        let d = dialog.clone();
+        let fin = Cell::from(fin);
+        list.connect_row_activated(move |_, row| {
+            if let Some(path) = recent.get(row.index().max(0) as usize) {
+                g.manager_sender
+                    .send((
+                        ManagerAction::Open(path.clone()),
+                        ScrollMotionTarget::Start.into(),
+                        fin.take(),
+                    ))
+                    .expect("Unexpected failed to send from Gui to Manager");
+            }
+            d.close();
+        });
+
+        let scroll = gtk::ScrolledWindow::new();
+        scroll.set_child(Some(&list));
+        scroll.set_vexpand(true);
+
+        dialog.content_area().append(&entry);
+        dialog.content_area().append(&scroll);
+        self.close_on_quit(&dialog);
+
+        let g = self.clone();
+        dialog.run_async(move |d, _r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Recent);
+            d.destroy();
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Recent, dialog.upcast::<gtk::Window>());
+    }
+
+    fn trash_dialog(self: &Rc<Self>, fin: Option<CommandResponder>) {
+        let send = |g: &Rc<Self>, fin| {
+            g.manager_sender
+                .send((ManagerAction::TrashArchive, ScrollMotionTarget::Start.into(), fin))
+                .expect("Unexpected failed to send from Gui to Manager");
+        };
+
+        if CONFIG.skip_trash_confirmation {
+            return send(self, fin);
+        }
+
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Trash) {
+            command_info("Trash dialog already open", fin);
+            d.present();
+            return;
+        }
+
+        let name = self.state.borrow().archive_name.clone();
+        let dialog = gtk::MessageDialog::builder()
+            .transient_for(&self.window)
+            .modal(true)
+            .message_type(gtk::MessageType::Question)
+            .buttons(gtk::ButtonsType::OkCancel)
+            .text("Move to trash?")
+            .secondary_text(&format!("{} will be moved to the trash.", name))
+            .build();
+        self.close_on_quit(&dialog);
+
+        let g = self.clone();
+        let fin = Cell::from(fin);
+        dialog.run_async(move |d, r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Trash);
+            if r == gtk::ResponseType::Ok {
+                send(&g, fin.take());
+            } else {
+                command_info("Cancelled moving archive to trash", fin.take());
+            }
+            d.destroy();
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Trash, dialog.upcast::<gtk::Window>());
+    }
+
+    // Asks for the final argument of an action, like "Jump ?", when it is run.
+    // Executables receive the value as their only argument.
+    fn prompt_dialog(self: &Rc<Self>, action: &str, fin: Option<CommandResponder>) {
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Prompt) {
+            command_info("Prompt dialog already open", fin);
+            d.present();
+            return;
+        }
+
+        let dialog = gtk::Dialog::builder().transient_for(&self.window).build();
+        dialog.set_title(Some(action));
+
+        let entry = gtk::Entry::new();
+        entry.set_width_chars(40);
+
+        let g = self.clone();
+        let d = dialog.clone();
+        let action = action.to_string();
+        let fin = Cell::from(fin);
+        entry.connect_activate(move |e| {
+            let text = e.text().trim().to_string();
+            if text.is_empty() {
+                return d.close();
+            }
+
+            if let Some(c) = EXECUTE_RE.captures(&action) {
+                let exe = c.get(1).expect("Invalid capture").as_str().to_string();
+                g.manager_sender
+                    .send((
+                        ManagerAction::Execute(exe, vec![text]),
+                        GuiActionContext::default(),
+                        fin.take(),
+                    ))
+                    .expect("Unexpected failed to send from Gui to Manager");
+            } else {
+                g.run_command(&format!("{} {}", action, text), fin.take());
+            }
+            d.close();
+        });
+
+        dialog.content_area().append(&entry);
+
+        let g = self.clone();
+        dialog.run_async(move |d, _r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Prompt);
+            d.content_area().remove(&entry);
+            d.destroy();
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Prompt, dialog.upcast::<gtk::Window>());
+    }
+
+    // Shortcuts, unlike commands sent over the socket or from scripts, can chain several actions
+    // separated by semicolons. Semicolons inside quoted arguments don't split actions.
+    pub(super) fn run_shortcut(self: &Rc<Self>, action: &str) {
+        match shell::split_actions(action).as_slice() {
+            [] => {}
+            [a] => self.run_command(a, None),
+            actions => self.run_macro(actions.iter().map(|a| a.to_string()).collect()),
+        }
+    }
+
+    // Runs each action in order, waiting for each to complete.
+    // The first failure stops the rest and is shown on screen.
+    fn run_macro(self: &Rc<Self>, actions: Vec<String>) {
+        let g = self.clone();
+        glib::MainContext::default().spawn_local(async move {
+            for a in actions {
+                let (s, r) = oneshot::channel();
+                g.run_command(&a, Some(s));
+
+                // A dropped responder means the action completed without anything to say.
+                let resp = match r.await {
+                    Ok(v) => v,
+                    Err(_) => continue,
+                };
+
+                if let Some(e) = resp.get("error") {
+                    let e = e.as_str().map_or_else(|| e.to_string(), str::to_string);
+                    g.show_osd(&format!("{} failed: {}", a, e));
+                    return;
+                }
+            }
+        });
+    }
+
     pub(super) fn run_command(self: &Rc<Self>, cmd: &str, fin: Option<CommandResponder>) {
         trace!("Started running command {}", cmd);
+        crash::record_command(cmd);
+
+        if let Some(prefix) = cmd.strip_suffix(" ?") {
+            return self.prompt_dialog(prefix.trim_end(), fin);
+        }
         self.last_action.set(Some(Instant::now()));
 
+        match cmd {
+            "NextPage" if self.turn_spread(true) => return,
+            "PreviousPage" if self.turn_spread(false) => return,
+            _ => {}
+        }
+
         if let Some((gtm, actx)) = self.simple_sends(cmd) {
             self.manager_sender
                 .send((gtm, actx, fin))
@@ -359,6 +973,7 @@ impl Gui {
                 return self.window.close();
             }
             "ToggleUI" => {
+                self.ui_auto_hidden.set(false);
                 if self.bottom_bar.is_visible() {
                     self.bottom_bar.hide();
                 } else {
@@ -368,8 +983,35 @@ impl Gui {
             }
             "SetBackground" => return self.background_picker(fin),
             "Jump" => return self.jump_dialog(fin),
+            "Open" => return self.open_dialog(fin),
+            "OpenRecent" => return self.recent_dialog(fin),
+            "ExportArchive" => return self.export_dialog(fin),
+            "EditShortcuts" => return self.shortcut_editor(),
+            "TrashArchive" => return self.trash_dialog(fin),
+            "Annotate" => return self.annotate_dialog(fin),
+            "ToggleHud" => return self.toggle_hud(),
+            "TogglePageInfo" => return self.toggle_page_info(),
+            "ToggleSidebar" => return self.toggle_sidebar(),
+            "ToggleOverview" => return self.toggle_overview(),
+            "ToggleLibrary" => return self.toggle_library(),
+            "NewTab" => return self.new_tab(None),
+            "CloseTab" => return self.close_tab(),
+            "NextTab" => return self.cycle_tabs(true),
+            "PreviousTab" => return self.cycle_tabs(false),
+            "ToggleAnnotations" => {
+                let visible = !self.annotation_layer.is_visible();
+                self.annotation_layer.set_visible(visible);
+                self.annotations.set_visible(visible && !self.annotations.text().is_empty());
+                return;
+            }
             "ToggleFullscreen" => {
-                return self.window.set_fullscreened(!self.window.is_fullscreen());
+                if self.window.is_fullscreen() {
+                    self.window.unfullscreen();
+                } else {
+                    self.fullscreen();
+                }
+                // Start the timer to hide the UI even if the pointer never moves.
+                return self.pointer_moved(0.0);
             }
             "TogglePlaying" => {
                 self.animation_playing.set(!self.animation_playing.get());
@@ -392,6 +1034,11 @@ impl Gui {
                 }
                 Err(e) => command_error(format!("{:?}", e), fin),
             }
+        } else if let Some(c) = MONITOR_RE.captures(cmd) {
+            let name = c.get(1).expect("Invalid capture").as_str();
+            if let Err(e) = self.move_to_monitor(name) {
+                command_error(e, fin)
+            }
         } else if let Some(c) = JUMP_RE.captures(cmd) {
             let num_res = c.get(2).expect("Invalid capture").as_str().parse::<usize>();
 
@@ -417,43 +1064,67 @@ impl Gui {
             self.manager_sender
                 .send((ManagerAction::MovePages(direction, num), actx, fin))
                 .expect("Unexpected failed to send from Gui to Manager");
+        } else if let Some(c) = ANNOTATE_RE.captures(cmd) {
+            let text = c.get(1).expect("Invalid capture").as_str().to_string();
+            let a = Annotation { text, highlight: None };
+            self.manager_sender
+                .send((ManagerAction::Annotate(a), GuiActionContext::default(), fin))
+                .expect("Unexpected failed to send from Gui to Manager");
+        } else if let Some(c) = HIGHLIGHT_RE.captures(cmd) {
+            let mut dims = [0; 4];
+            for (i, d) in dims.iter_mut().enumerate() {
+                *d = match c.get(i + 1).expect("Invalid capture").as_str().parse::<u32>() {
+                    Ok(n) => n,
+                    Err(e) => return command_error(e, fin),
+                };
+            }
+
+            let [x, y, w, h] = dims;
+            let text = c.get(5).map_or_else(String::new, |m| m.as_str().to_string());
+            let a = Annotation { text, highlight: Some(Highlight { x, y, w, h }) };
+            self.manager_sender
+                .send((ManagerAction::Annotate(a), GuiActionContext::default(), fin))
+                .expect("Unexpected failed to send from Gui to Manager");
+        } else if let Some(c) = OPEN_RE.captures(cmd) {
+            let path = c.get(1).expect("Invalid capture").as_str().into();
+            self.manager_sender
+                .send((ManagerAction::Open(path), ScrollMotionTarget::Start.into(), fin))
+                .expect("Unexpected failed to send from Gui to Manager");
+        } else if let Some(c) = EXPORT_RE.captures(cmd) {
+            let path = c.get(1).expect("Invalid capture").as_str().into();
+            self.manager_sender
+                .send((ManagerAction::ExportArchive(path), GuiActionContext::default(), fin))
+                .expect("Unexpected failed to send from Gui to Manager");
+        } else if let Some(c) = NEW_TAB_RE.captures(cmd) {
+            let path = c.get(1).expect("Invalid capture").as_str().into();
+            self.new_tab(Some(path));
+        } else if let Some(c) = LOG_LEVEL_RE.captures(cmd) {
+            let level = c.get(1).expect("Invalid capture").as_str();
+            match elapsedlogger::set_level(level) {
+                Ok(_) => command_info(format!("Set log level to {}", level), fin),
+                Err(e) => command_error(e, fin),
+            }
         } else if let Some(c) = EXECUTE_RE.captures(cmd) {
             let exe = c.get(1).expect("Invalid capture").as_str().to_string();
             self.manager_sender
-                .send((ManagerAction::Execute(exe), GuiActionContext::default(), fin))
+                .send((ManagerAction::Execute(exe, Vec::new()), GuiActionContext::default(), fin))
                 .expect("Unexpected failed to send from Gui to Manager");
         } else {
             let e = format!("Unrecognized command {:?}", cmd);
             warn!("{}", e);
             if let Some(fin) = fin {
-                drop(fin.send(Value::String(e)));
+                drop(fin.send(serde_json::json!({ "error": e })));
             }
         }
     }
 
-    pub(super) fn parse_shortcuts() -> AHashMap<ModifierType, AHashMap<Key, String>> {
+    pub(super) fn parse_shortcuts(
+        list: &[Shortcut],
+    ) -> AHashMap<ModifierType, AHashMap<Key, String>> {
         let mut shortcuts = AHashMap::new();
 
-        for s in &CONFIG.shortcuts {
-            let mut modifiers: ModifierType = ModifierType::from_bits(0).unwrap();
-            if let Some(m) = &s.modifiers {
-                let m = m.to_lowercase();
-                if m.contains("control") {
-                    modifiers |= ModifierType::CONTROL_MASK;
-                }
-                if m.contains("alt") {
-                    modifiers |= ModifierType::ALT_MASK;
-                }
-                if m.contains("shift") {
-                    modifiers |= ModifierType::SHIFT_MASK;
-                }
-                if m.contains("super") {
-                    modifiers |= ModifierType::SUPER_MASK;
-                }
-                if m.contains("command") {
-                    modifiers |= ModifierType::META_MASK;
-                }
-            };
+        for s in list {
+            let modifiers = parse_modifiers(s.modifiers.as_deref());
 
             let inner = match shortcuts.entry(modifiers) {
                 Entry::Occupied(inner) => inner.into_mut(),
@@ -467,3 +1138,31 @@ impl Gui {
         shortcuts
     }
 }
+
+fn is_page_turn(cmd: &str) -> bool {
+    matches!(cmd, "NextPage" | "PreviousPage" | "NextArchive" | "PreviousArchive")
+        || JUMP_RE.is_match(cmd)
+}
+
+pub(super) fn parse_modifiers(m: Option<&str>) -> ModifierType {
+    let mut modifiers: ModifierType = ModifierType::from_bits(0).unwrap();
+    if let Some(m) = m {
+        let m = m.to_lowercase();
+        if m.contains("control") {
+            modifiers |= ModifierType::CONTROL_MASK;
+        }
+        if m.contains("alt") {
+            modifiers |= ModifierType::ALT_MASK;
+        }
+        if m.contains("shift") {
+            modifiers |= ModifierType::SHIFT_MASK;
+        }
+        if m.contains("super") {
+            modifiers |= ModifierType::SUPER_MASK;
+        }
+        if m.contains("command") {
+            modifiers |= ModifierType::META_MASK;
+        }
+    };
+    modifiers
+}
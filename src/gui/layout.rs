@@ -17,11 +17,17 @@ use crate::config::CONFIG;
 
 static SCROLL_AMOUNT: Lazy<i32> = Lazy::new(|| CONFIG.scroll_amount.get() as i32);
 
-static SCROLL_DURATION: Duration = Duration::from_millis(166);
+static SCROLL_DURATION: Lazy<Duration> =
+    Lazy::new(|| Duration::from_millis(CONFIG.scroll_duration));
+
+// Time constant for the exponential decay of kinetic scrolling.
+static KINETIC_TIME_CONSTANT: f64 = 0.325;
+// Kinetic scrolling stops below this speed, in pixels per second.
+static KINETIC_MIN_VELOCITY: f64 = 20.0;
 
 pub static APPROX_SCROLL_STEP: Lazy<i32> = Lazy::new(|| {
     // This could try to determine the actual framerate, but it is unlikely to matter much.
-    let frames = SCROLL_DURATION.as_millis() as f64 / 16.667;
+    let frames = f64::max(SCROLL_DURATION.as_millis() as f64 / 16.667, 1.0);
     (*SCROLL_AMOUNT as f64 / frames).ceil() as i32
 });
 
@@ -44,12 +50,20 @@ enum Motion {
         // Store the previous one (truncated towards zero) to convert them into a series of diffs.
         offset: (i32, i32),
     },
+    Kinetic {
+        // In pixels per second.
+        velocity: (f64, f64),
+        // Fractional pixels not yet applied.
+        remainder: (f64, f64),
+        step: Instant,
+        tick_id: ManuallyDrop<TickCallbackId>,
+    },
 }
 
 // impl Drop, cancel smooth scroll callback
 impl Drop for Motion {
     fn drop(&mut self) {
-        if let Self::Smooth { tick_id, .. } = self {
+        if let Self::Smooth { tick_id, .. } | Self::Kinetic { tick_id, .. } = self {
             // We're dropping it, so this is safe
             unsafe {
                 ManuallyDrop::take(tick_id).remove();
@@ -91,16 +105,16 @@ impl LayoutContents {
         };
 
         match self {
-            Self::Single(r) => from_fitted(r.fit_inside(target_res)),
+            Self::Single(r) => from_fitted(r.display_inside(target_res)),
             Self::Multiple { current_index, visible, .. } => match mode {
                 DisplayMode::Single => unreachable!(),
                 DisplayMode::VerticalStrip => {
-                    let first = visible[*current_index].fit_inside(target_res);
+                    let first = visible[*current_index].display_inside(target_res);
                     let mut max_x = first.w;
                     let mut sum_y = first.h;
 
                     for v in &visible[(current_index + 1)..] {
-                        let t = v.fit_inside(target_res);
+                        let t = v.display_inside(target_res);
 
                         max_x = max(max_x, t.w);
                         sum_y += t.h;
@@ -116,8 +130,10 @@ impl LayoutContents {
                         .into();
 
                     // We don't consider completely off-screen elements.
-                    let top: u32 =
-                        visible[0..*current_index].iter().map(|v| v.fit_inside(target_res).h).sum();
+                    let top: u32 = visible[0..*current_index]
+                        .iter()
+                        .map(|v| v.display_inside(target_res).h)
+                        .sum();
                     let top = -(top as i32);
 
                     let true_bounds = Rect {
@@ -131,12 +147,12 @@ impl LayoutContents {
                     (fitted, pagination_bounds, true_bounds)
                 }
                 DisplayMode::HorizontalStrip => {
-                    let first = visible[*current_index].fit_inside(target_res);
+                    let first = visible[*current_index].display_inside(target_res);
                     let mut sum_x = first.w;
                     let mut max_y = first.h;
 
                     for v in &visible[(current_index + 1)..] {
-                        let t = v.fit_inside(target_res);
+                        let t = v.display_inside(target_res);
 
                         sum_x += t.w;
                         max_y = max(max_y, t.h);
@@ -152,8 +168,10 @@ impl LayoutContents {
                         .into();
 
                     // We don't consider completely off-screen elements.
-                    let left: u32 =
-                        visible[0..*current_index].iter().map(|v| v.fit_inside(target_res).w).sum();
+                    let left: u32 = visible[0..*current_index]
+                        .iter()
+                        .map(|v| v.display_inside(target_res).w)
+                        .sum();
                     let left = -(left as i32);
 
                     let true_bounds = Rect {
@@ -167,10 +185,10 @@ impl LayoutContents {
                     (fitted, pagination_bounds, true_bounds)
                 }
                 DisplayMode::DualPage | DisplayMode::DualPageReversed => match visible[..] {
-                    [single] => from_fitted(single.fit_inside(target_res)),
+                    [single] => from_fitted(single.display_inside(target_res)),
                     [first, second] => {
-                        let first = first.fit_inside(target_res);
-                        let second = second.fit_inside(target_res);
+                        let first = first.display_inside(target_res);
+                        let second = second.display_inside(target_res);
                         from_fitted((first.w + second.w, max(first.h, second.h)).into())
                     }
                     _ => unreachable!(),
@@ -191,17 +209,17 @@ impl LayoutContents {
 
     fn first_res(&self, target_res: TargetRes, mode: DisplayMode) -> Res {
         match self {
-            Self::Single(r) => r.fit_inside(target_res),
+            Self::Single(r) => r.display_inside(target_res),
             Self::Multiple { current_index, visible, .. } => match mode {
                 DisplayMode::Single => unreachable!(),
                 DisplayMode::VerticalStrip | DisplayMode::HorizontalStrip => {
-                    visible[*current_index].fit_inside(target_res)
+                    visible[*current_index].display_inside(target_res)
                 }
                 DisplayMode::DualPage | DisplayMode::DualPageReversed => match visible[..] {
-                    [single] => single.fit_inside(target_res),
+                    [single] => single.display_inside(target_res),
                     [first, second] => {
-                        let first = first.fit_inside(target_res);
-                        let second = second.fit_inside(target_res);
+                        let first = first.display_inside(target_res);
+                        let second = second.display_inside(target_res);
                         (first.w + second.w, max(first.h, second.h)).into()
                     }
                     _ => unreachable!(),
@@ -337,13 +355,16 @@ impl LayoutManager {
 
         match pos {
             ScrollMotionTarget::Start => {
-                self.x = 0;
+                // Right to left spreads start on their right half.
+                let rtl = self.showing_spread() && CONFIG.right_to_left_spreads;
+                self.x = if rtl { self.page_bounds.w as i32 } else { 0 };
                 self.y = 0;
                 self.saved_positions = (0.0, 0.0);
             }
             ScrollMotionTarget::End => {
                 let end = self.contents.first_element_end_position(self.target_res, self.mode);
-                self.x = end.0 as i32;
+                let rtl = self.showing_spread() && CONFIG.right_to_left_spreads;
+                self.x = if rtl { 0 } else { end.0 as i32 };
                 self.y = end.1 as i32;
 
                 // This seems weird, but it's probably closer to my intention most of the time.
@@ -380,7 +401,7 @@ impl LayoutManager {
                 }
 
                 match &mut self.motion {
-                    Motion::Stationary | Motion::Dragging { .. } => {}
+                    Motion::Stationary | Motion::Dragging { .. } | Motion::Kinetic { .. } => {}
                     Motion::Smooth { x, y, .. } => {
                         x.0 += dx;
                         x.1 += dx;
@@ -392,6 +413,39 @@ impl LayoutManager {
         }
     }
 
+    // Whether there's anything off screen to scroll to horizontally.
+    const fn pans_horizontally(&self) -> bool {
+        self.true_bounds.right > self.true_bounds.left
+    }
+
+    // Whether the only visible page is a spread being shown one half at a time.
+    fn showing_spread(&self) -> bool {
+        match self.contents {
+            LayoutContents::Single(r) => r.is_spread(self.target_res) && self.page_bounds.w > 0,
+            LayoutContents::Multiple { .. } => false,
+        }
+    }
+
+    // Moves to the other half of a spread, if there is one in that direction.
+    fn turn_spread(&mut self, forwards: bool) -> bool {
+        if !self.showing_spread() {
+            return false;
+        }
+
+        let target = if forwards != CONFIG.right_to_left_spreads {
+            self.page_bounds.w as i32
+        } else {
+            0
+        };
+        if self.x == target {
+            return false;
+        }
+
+        self.motion = Motion::Stationary;
+        self.x = target;
+        true
+    }
+
     fn zero(&mut self) {
         self.update_contents(
             LayoutContents::Single((0, 0).into()),
@@ -538,6 +592,74 @@ impl LayoutManager {
         self.apply_delta(dx, dy).2
     }
 
+    // Velocities are in the same units as pad scrolling, per second.
+    fn start_kinetic(&mut self, vx: f64, vy: f64) {
+        let velocity = (vx * *SCROLL_AMOUNT as f64, vy * *SCROLL_AMOUNT as f64);
+        if velocity.0.abs() < KINETIC_MIN_VELOCITY && velocity.1.abs() < KINETIC_MIN_VELOCITY {
+            return;
+        }
+
+        // Replace any existing motion first so that its tick callback is removed.
+        self.motion = Motion::Stationary;
+        let tick_id = ManuallyDrop::new((self.add_tick_callback)());
+
+        self.motion = Motion::Kinetic {
+            velocity,
+            remainder: (0.0, 0.0),
+            step: Instant::now(),
+            tick_id,
+        };
+    }
+
+    fn kinetic_step(&mut self) -> ScrollResult {
+        let now = Instant::now();
+
+        let (dx, dy, velocity) = if let Motion::Kinetic {
+            ref mut velocity,
+            ref mut remainder,
+            ref mut step,
+            ..
+        } = self.motion
+        {
+            let dt = (now - *step).as_secs_f64();
+            *step = now;
+
+            // Integrate the exponentially decaying velocity over the elapsed time.
+            let decay = (-dt / KINETIC_TIME_CONSTANT).exp();
+            let travel = KINETIC_TIME_CONSTANT * (1.0 - decay);
+            let fx = velocity.0 * travel + remainder.0;
+            let fy = velocity.1 * travel + remainder.1;
+
+            velocity.0 *= decay;
+            velocity.1 *= decay;
+            *remainder = (fx.fract(), fy.fract());
+
+            (fx.trunc() as i32, fy.trunc() as i32, *velocity)
+        } else {
+            unreachable!();
+        };
+
+        let (rx, ry, p) = self.apply_delta(dx, dy);
+
+        // Stop when slow enough or when we've run into an edge.
+        let stuck = (dx != 0 || dy != 0) && rx == dx && ry == dy;
+        if stuck
+            || (velocity.0.abs() < KINETIC_MIN_VELOCITY && velocity.1.abs() < KINETIC_MIN_VELOCITY)
+        {
+            self.motion = Motion::Stationary;
+        }
+
+        p
+    }
+
+    fn tick_step(&mut self) -> ScrollResult {
+        match self.motion {
+            Motion::Smooth { .. } => self.smooth_step(),
+            Motion::Kinetic { .. } => self.kinetic_step(),
+            Motion::Stationary | Motion::Dragging { .. } => ScrollResult::NoOp,
+        }
+    }
+
     pub(super) fn start_drag(&mut self) {
         self.motion = Motion::Dragging { offset: (0, 0) };
     }
@@ -637,7 +759,7 @@ impl LayoutManager {
 
             let ty = match self.motion {
                 Motion::Smooth { y: (_, ty), .. } => ty,
-                Motion::Stationary | Motion::Dragging { .. } => self.y,
+                Motion::Stationary | Motion::Dragging { .. } | Motion::Kinetic { .. } => self.y,
             };
 
             if ty <= 0 && self.true_bounds.top == 0 {
@@ -656,7 +778,7 @@ impl LayoutManager {
 
             let tx = match self.motion {
                 Motion::Smooth { x: (_, tx), .. } => tx,
-                Motion::Stationary | Motion::Dragging { .. } => self.x,
+                Motion::Stationary | Motion::Dragging { .. } | Motion::Kinetic { .. } => self.x,
             };
 
             if tx <= 0 && self.true_bounds.left == 0 {
@@ -718,7 +840,7 @@ impl<'a> Iterator for LayoutIterator<'a> {
     fn next(&mut self) -> Option<Self::Item> {
         let layout = match &self.state.contents {
             LayoutContents::Single(r) => {
-                let res = r.fit_inside(self.state.target_res);
+                let res = r.display_inside(self.state.target_res);
                 if self.index == 0 {
                     (self.upper_left.0, self.upper_left.1, res)
                 } else {
@@ -727,7 +849,7 @@ impl<'a> Iterator for LayoutIterator<'a> {
             }
             LayoutContents::Multiple { visible, .. } => {
                 let v = visible.get(self.index)?;
-                let res = v.fit_inside(self.state.target_res);
+                let res = v.display_inside(self.state.target_res);
                 let (mut ofx, mut ofy) = (
                     self.upper_left.0 + self.current_offset.0,
                     self.upper_left.1 + self.current_offset.1,
@@ -774,6 +896,18 @@ impl Gui {
         self.update_edge_indicator(&sb);
     }
 
+    // Returns true if this moved between the halves of a spread instead of needing a new page.
+    pub(super) fn turn_spread(self: &Rc<Self>, forwards: bool) -> bool {
+        let mut sb = self.layout_manager.borrow_mut();
+        if !sb.turn_spread(forwards) {
+            return false;
+        }
+
+        self.update_edge_indicator(&sb);
+        self.canvas.queue_draw();
+        true
+    }
+
     pub(super) fn zero_scroll(self: &Rc<Self>) {
         let mut sb = self.layout_manager.borrow_mut();
         sb.zero();
@@ -874,10 +1008,43 @@ impl Gui {
         } else if y < 0.0 {
             self.scroll_up(None);
         } else if x > 0.0 {
-            self.scroll_right(None);
+            match &CONFIG.scroll_right_action {
+                Some(action) => self.run_shortcut(action),
+                None => self.scroll_right(None),
+            }
         } else if x < 0.0 {
-            self.scroll_left(None);
+            match &CONFIG.scroll_left_action {
+                Some(action) => self.run_shortcut(action),
+                None => self.scroll_left(None),
+            }
+        }
+    }
+
+    // Smooth scrolling outside of a touchpad gesture, which GTK doesn't always report the start of,
+    // is added up until it's worth a whole scroll. Otherwise every small event in a swipe would
+    // scroll, or turn the page, on its own.
+    pub(super) fn smooth_scroll(self: &Rc<Self>, x: f64, y: f64) {
+        let (mut dx, mut dy) = self.smooth_delta.get();
+        // Changing direction starts over.
+        if dx * x < 0.0 {
+            dx = 0.0;
+        }
+        if dy * y < 0.0 {
+            dy = 0.0;
         }
+        dx += x;
+        dy += y;
+
+        let threshold = CONFIG.smooth_scroll_threshold;
+        if dy.abs() >= threshold {
+            self.discrete_scroll(0.0, dy);
+            (dx, dy) = (0.0, 0.0);
+        } else if dx.abs() >= threshold {
+            self.discrete_scroll(dx, 0.0);
+            (dx, dy) = (0.0, 0.0);
+        }
+
+        self.smooth_delta.set((dx, dy));
     }
 
     fn do_continuous_pagination(self: &Rc<Self>, p: Pagination) {
@@ -902,6 +1069,15 @@ impl Gui {
         self.canvas.queue_draw();
     }
 
+    // Horizontal touchpad motion only turns pages when it can't be used to pan instead.
+    pub(super) fn swiping(self: &Rc<Self>) -> bool {
+        CONFIG.swipe_threshold.is_some() && !self.layout_manager.borrow().pans_horizontally()
+    }
+
+    pub(super) fn kinetic_scroll(self: &Rc<Self>, vx: f64, vy: f64) {
+        self.layout_manager.borrow_mut().start_kinetic(vx, vy);
+    }
+
     pub(super) fn drag_update(self: &Rc<Self>, x: f64, y: f64) {
         let mut sb = self.layout_manager.borrow_mut();
         match sb.apply_drag_update(x, y) {
@@ -924,7 +1100,7 @@ impl Gui {
     }
 
     fn tick_callback(self: &Rc<Self>) -> Continue {
-        match self.layout_manager.borrow_mut().smooth_step() {
+        match self.layout_manager.borrow_mut().tick_step() {
             ScrollResult::NoOp => return Continue(true),
             ScrollResult::Applied => (),
             ScrollResult::Pagination(p) => self.do_continuous_pagination(p),
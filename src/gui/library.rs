@@ -0,0 +1,295 @@
+// A browsable grid of the archives and directories inside a directory, with their covers, so
+// aw-man can be pointed at a whole library instead of a single chapter.
+
+use std::cell::RefCell;
+use std::ffi::OsStr;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::rc::Rc;
+
+use ahash::AHashMap;
+use gtk::prelude::*;
+use gtk::{gdk, glib, Align};
+use image::RgbaImage;
+
+use super::sidebar::{cover, texture, THUMBNAIL_HEIGHT, THUMBNAIL_WIDTH};
+use super::Gui;
+use crate::com::{ManagerAction, ScrollMotionTarget};
+use crate::config::OPTIONS;
+use crate::manager::files::{
+    is_archive_path, is_natively_supported_image, is_supported_page_extension,
+};
+use crate::{closing, natsort, spawn_thread};
+
+#[derive(Debug)]
+pub(super) struct Library {
+    scroll: gtk::ScrolledWindow,
+    title: gtk::Label,
+    grid: gtk::FlowBox,
+    // The directory currently shown.
+    dir: RefCell<Option<PathBuf>>,
+    entries: RefCell<Vec<(PathBuf, gtk::Picture)>>,
+    thumbnails: RefCell<AHashMap<PathBuf, Option<gdk::Texture>>>,
+}
+
+impl Library {
+    pub(super) fn new() -> Self {
+        Self {
+            scroll: gtk::ScrolledWindow::new(),
+            title: gtk::Label::new(None),
+            grid: gtk::FlowBox::new(),
+            dir: RefCell::default(),
+            entries: RefCell::default(),
+            thumbnails: RefCell::default(),
+        }
+    }
+
+    pub(super) fn widget(&self) -> &gtk::ScrolledWindow {
+        &self.scroll
+    }
+
+    pub(super) fn is_visible(&self) -> bool {
+        self.scroll.is_visible()
+    }
+}
+
+fn name_key(p: &Path) -> natsort::ParsedString {
+    natsort::key(p.file_name().unwrap_or_else(|| OsStr::new("")))
+}
+
+fn is_hidden(p: &Path) -> bool {
+    p.file_name().map_or(false, |n| n.to_string_lossy().starts_with('.'))
+}
+
+// Archives and subdirectories, in natural order.
+fn list(dir: &Path) -> Vec<PathBuf> {
+    let mut entries: Vec<_> = match fs::read_dir(dir) {
+        Ok(rd) => rd
+            .filter_map(|e| e.ok().map(|e| e.path()))
+            .filter(|p| !is_hidden(p) && (p.is_dir() || is_archive_path(p)))
+            .collect(),
+        Err(e) => {
+            error!("Failed to read library directory {:?}: {:?}", dir, e);
+            Vec::new()
+        }
+    };
+
+    entries.sort_by_cached_key(|p| name_key(p));
+    entries
+}
+
+// A directory is treated as a library if it contains archives or directories but no images.
+pub(super) fn is_library(dir: &Path) -> bool {
+    let rd = match fs::read_dir(dir) {
+        Ok(rd) => rd,
+        Err(_) => return false,
+    };
+
+    let mut found = false;
+    for p in rd.filter_map(|e| e.ok().map(|e| e.path())) {
+        if is_hidden(&p) {
+            continue;
+        }
+
+        if p.is_file() && is_supported_page_extension(&p) {
+            return false;
+        }
+        found |= p.is_dir() || is_archive_path(&p);
+    }
+    found
+}
+
+// Directories use the cover of their first archive, or their first image.
+fn entry_cover(path: &Path) -> Option<RgbaImage> {
+    if !path.is_dir() {
+        return cover(path);
+    }
+
+    let first = fs::read_dir(path)
+        .ok()?
+        .filter_map(|e| e.ok().map(|e| e.path()))
+        .filter(|p| !is_hidden(p) && (is_archive_path(p) || is_supported_page_extension(p)))
+        .min_by_key(|p| name_key(p))?;
+
+    if is_archive_path(&first) {
+        return cover(&first);
+    }
+
+    if !is_natively_supported_image(&first) {
+        return None;
+    }
+    let img = image::open(&first).ok()?;
+    Some(img.thumbnail(THUMBNAIL_WIDTH, THUMBNAIL_HEIGHT).into_rgba8())
+}
+
+impl Gui {
+    pub(super) fn setup_library(self: &Rc<Self>) {
+        let lib = &self.library;
+        lib.grid.set_valign(Align::Start);
+        lib.grid.set_homogeneous(true);
+        lib.grid.set_max_children_per_line(100);
+        lib.grid.set_selection_mode(gtk::SelectionMode::Single);
+        lib.grid.set_activate_on_single_click(true);
+
+        lib.title.set_halign(Align::Start);
+        lib.title.add_css_class("library-title");
+
+        let vbox = gtk::Box::new(gtk::Orientation::Vertical, 0);
+        vbox.append(&lib.title);
+        vbox.append(&lib.grid);
+
+        lib.scroll.set_child(Some(&vbox));
+        lib.scroll.set_hscrollbar_policy(gtk::PolicyType::Never);
+        lib.scroll.add_css_class("background");
+        lib.scroll.add_css_class("library");
+        lib.scroll.hide();
+
+        let g = self.clone();
+        lib.grid.connect_child_activated(move |_, child| {
+            let path = g.library.entries.borrow().get(child.index() as usize).map(|e| e.0.clone());
+            if let Some(path) = path {
+                g.open_library_entry(path);
+            }
+        });
+
+        // Start in the library if given a directory full of archives, or when explicitly asked.
+        if let [path] = &OPTIONS.file_names[..] {
+            let path = match path.canonicalize() {
+                Ok(p) => p,
+                Err(_) => return,
+            };
+
+            if path.is_dir() && (OPTIONS.library || is_library(&path)) {
+                self.show_library(path);
+            } else if OPTIONS.library {
+                if let Some(parent) = path.parent() {
+                    self.show_library(parent.to_path_buf());
+                }
+            }
+        }
+    }
+
+    pub(super) fn toggle_library(self: &Rc<Self>) {
+        if self.library.is_visible() {
+            return self.hide_library();
+        }
+
+        let current = self.state.borrow().archive_path.clone();
+        let dir = if is_library(&current) {
+            Some(current)
+        } else {
+            current.parent().map(Path::to_path_buf)
+        };
+
+        if let Some(dir) = dir {
+            self.show_library(dir);
+        }
+    }
+
+    pub(super) fn hide_library(&self) {
+        self.library.scroll.hide();
+    }
+
+    // Returns false if there is nothing open behind the library to go back to.
+    pub(super) fn can_hide_library(&self) -> bool {
+        let s = self.state.borrow();
+        !s.archive_path.as_os_str().is_empty()
+            && self.library.dir.borrow().as_ref() != Some(&s.archive_path)
+    }
+
+    pub(super) fn library_up(self: &Rc<Self>) {
+        let dir = self.library.dir.borrow().clone();
+        if let Some(parent) = dir.as_deref().and_then(Path::parent) {
+            self.show_library(parent.to_path_buf());
+        }
+    }
+
+    fn open_library_entry(self: &Rc<Self>, path: PathBuf) {
+        if path.is_dir() && is_library(&path) {
+            return self.show_library(path);
+        }
+
+        self.manager_sender
+            .send((ManagerAction::Open(path), ScrollMotionTarget::Start.into(), None))
+            .expect("Unexpected failed to send from Gui to Manager");
+        self.hide_library();
+    }
+
+    fn show_library(self: &Rc<Self>, dir: PathBuf) {
+        let lib = &self.library;
+        while let Some(child) = lib.grid.child_at_index(0) {
+            lib.grid.remove(&child);
+        }
+
+        lib.title.set_text(&dir.to_string_lossy());
+
+        let current = self.state.borrow().archive_path.clone();
+        let mut entries = Vec::new();
+        let mut missing = Vec::new();
+        let mut focus = None;
+
+        for p in list(&dir) {
+            let picture = gtk::Picture::new();
+            picture.set_size_request(THUMBNAIL_WIDTH as i32, THUMBNAIL_HEIGHT as i32);
+            match lib.thumbnails.borrow().get(&p) {
+                Some(Some(t)) => picture.set_paintable(Some(t)),
+                Some(None) => {}
+                None => missing.push(p.clone()),
+            }
+
+            let mut name = p.file_name().map_or_else(String::new, |n| n.to_string_lossy().into());
+            if p.is_dir() {
+                name.push('/');
+            }
+            let label = gtk::Label::new(Some(&name));
+            label.set_wrap(true);
+            label.set_max_width_chars(20);
+
+            let vbox = gtk::Box::new(gtk::Orientation::Vertical, 4);
+            vbox.append(&picture);
+            vbox.append(&label);
+            lib.grid.insert(&vbox, -1);
+
+            if current.starts_with(&p) {
+                focus = Some(entries.len());
+            }
+            entries.push((p, picture));
+        }
+
+        lib.entries.replace(entries);
+        lib.dir.replace(Some(dir));
+        lib.scroll.show();
+
+        if let Some(child) = lib.grid.child_at_index(focus.unwrap_or_default() as i32) {
+            lib.grid.select_child(&child);
+            child.grab_focus();
+        }
+
+        if missing.is_empty() {
+            return;
+        }
+
+        let (sender, receiver) = glib::MainContext::channel(glib::PRIORITY_DEFAULT_IDLE);
+        let g = self.clone();
+        receiver.attach(None, move |(path, img): (PathBuf, Option<RgbaImage>)| {
+            let t = img.map(texture);
+            if let Some((_, pic)) = g.library.entries.borrow().iter().find(|(p, _)| *p == path) {
+                pic.set_paintable(t.as_ref());
+            }
+            g.library.thumbnails.borrow_mut().insert(path, t);
+            glib::Continue(true)
+        });
+
+        spawn_thread("library", move || {
+            for p in missing {
+                if closing::closed() {
+                    return;
+                }
+                let img = entry_cover(&p);
+                if sender.send((p, img)).is_err() {
+                    return;
+                }
+            }
+        });
+    }
+}
@@ -93,7 +93,7 @@ impl GuiMenu {
         let g = gui.clone();
         command.connect_activate(move |_a, v| {
             let action = v.unwrap().str().unwrap();
-            g.run_command(action, None);
+            g.run_shortcut(action);
         });
 
         let s = Self { manga, upscaling, fit, display, command };
@@ -1,11 +1,22 @@
+mod dbus;
+mod geometry;
 mod glium_area;
+mod info;
 mod input;
 mod layout;
+mod library;
 mod menu;
+mod monitors;
+mod overview;
+mod shortcuts;
+mod sidebar;
+mod slider;
+mod tabs;
 
 use std::cell::{Cell, RefCell};
+use std::path::Path;
 use std::rc::Rc;
-use std::time::Instant;
+use std::time::{Duration, Instant};
 
 use ahash::AHashMap;
 use flume::Sender;
@@ -17,7 +28,13 @@ use once_cell::unsync::OnceCell;
 
 use self::layout::{LayoutContents, LayoutManager};
 use super::com::*;
-use crate::{closing, config};
+use crate::{closing, config, pools};
+
+// How long messages are displayed on screen before they're hidden.
+static OSD_DURATION: Duration = Duration::from_secs(4);
+static HUD_INTERVAL: Duration = Duration::from_millis(500);
+// How close, in pixels, the pointer needs to be to the bottom to show an automatically hidden UI.
+const AUTO_SHOW_UI_DISTANCE: i32 = 100;
 
 pub static WINDOW_ID: once_cell::sync::OnceCell<String> = once_cell::sync::OnceCell::new();
 
@@ -39,22 +56,55 @@ pub struct Gui {
     zoom_level: gtk::Label,
     edge_indicator: gtk::Label,
     bottom_bar: gtk::Box,
+    page_slider: slider::PageSlider,
+    annotations: gtk::Label,
+    annotation_layer: gtk::DrawingArea,
+    osd: gtk::Label,
+    error_banner: gtk::Label,
+    osd_timeout: RefCell<Option<glib::SourceId>>,
+    hud: gtk::Label,
+    hud_updates: RefCell<Option<glib::SourceId>>,
+    page_info: gtk::Label,
+    // Whether the UI was hidden automatically, rather than by ToggleUI.
+    ui_auto_hidden: Cell<bool>,
+    hide_ui_timeout: RefCell<Option<glib::SourceId>>,
+    frame_time: Cell<Duration>,
     label_updates: RefCell<Option<glib::SourceId>>,
 
+    sidebar: sidebar::Sidebar,
+    overview: overview::Overview,
+    library: library::Library,
+    dbus: dbus::Dbus,
+    tab_strip: gtk::Box,
+    tabs: RefCell<Vec<tabs::Tab>>,
+    active_tab: Cell<usize>,
+    // Tab actions that the manager hasn't handled yet.
+    opening_tabs: Cell<usize>,
+
     state: RefCell<GuiState>,
     bg: Cell<gdk::RGBA>,
 
     layout_manager: RefCell<LayoutManager>,
     // Called "pad" scrolling to differentiate it with continuous scrolling between pages.
     pad_scrolling: Cell<bool>,
+    // Accumulated horizontal movement for touchpad swipes.
+    swipe_dx: Cell<f64>,
+    // Smooth scrolling that arrived outside of a touchpad gesture, not yet enough for a scroll.
+    smooth_delta: Cell<(f64, f64)>,
     drop_next_scroll: Cell<bool>,
     animation_playing: Cell<bool>,
 
     last_action: Cell<Option<Instant>>,
+    // The key currently held down and when it last turned the page, for limiting key repeat.
+    held_key: Cell<Option<(gdk::Key, Instant)>>,
+    // The key held down for ShowOriginal.
+    original_key: Cell<Option<gdk::Key>>,
     first_content_paint: OnceCell<()>,
     open_dialogs: RefCell<AHashMap<input::Dialogs, gtk::Window>>,
 
-    shortcuts: AHashMap<ModifierType, AHashMap<gdk::Key, String>>,
+    shortcuts: RefCell<AHashMap<ModifierType, AHashMap<gdk::Key, String>>>,
+    // The shortcuts as configured, or as changed in the shortcut editor.
+    bindings: RefCell<Vec<config::Shortcut>>,
 
     manager_sender: Rc<Sender<MAWithResponse>>,
 }
@@ -113,21 +163,51 @@ impl Gui {
             zoom_level: gtk::Label::new(Some("100%")),
             edge_indicator: gtk::Label::new(None),
             bottom_bar: gtk::Box::new(gtk::Orientation::Horizontal, 15),
+            page_slider: slider::PageSlider::new(),
+            annotations: gtk::Label::new(None),
+            annotation_layer: gtk::DrawingArea::new(),
+            osd: gtk::Label::new(None),
+            error_banner: gtk::Label::new(None),
+            osd_timeout: RefCell::default(),
+            hud: gtk::Label::new(None),
+            hud_updates: RefCell::default(),
+            page_info: gtk::Label::new(None),
+            ui_auto_hidden: Cell::default(),
+            hide_ui_timeout: RefCell::default(),
+            frame_time: Cell::default(),
             label_updates: RefCell::default(),
 
+            sidebar: sidebar::Sidebar::new(),
+            overview: overview::Overview::new(),
+            library: library::Library::new(),
+            dbus: dbus::Dbus::default(),
+            tab_strip: gtk::Box::new(gtk::Orientation::Horizontal, 0),
+            tabs: RefCell::default(),
+            active_tab: Cell::default(),
+            opening_tabs: Cell::default(),
+
             state: RefCell::default(),
-            bg: Cell::new(config::CONFIG.background_colour.unwrap_or(gdk::RGBA::BLACK)),
+            bg: Cell::new(if config::OPTIONS.minimal {
+                gdk::RGBA::BLACK
+            } else {
+                config::CONFIG.background_colour.unwrap_or(gdk::RGBA::BLACK)
+            }),
 
             layout_manager: RefCell::new(LayoutManager::new(weak.clone())),
             pad_scrolling: Cell::default(),
+            swipe_dx: Cell::default(),
+            smooth_delta: Cell::default(),
             drop_next_scroll: Cell::default(),
             animation_playing: Cell::new(true),
 
             last_action: Cell::default(),
+            held_key: Cell::default(),
+            original_key: Cell::default(),
             first_content_paint: OnceCell::default(),
             open_dialogs: RefCell::default(),
 
-            shortcuts: Self::parse_shortcuts(),
+            shortcuts: RefCell::new(Self::parse_shortcuts(&config::CONFIG.shortcuts)),
+            bindings: RefCell::new(config::CONFIG.shortcuts.clone()),
 
             manager_sender,
         });
@@ -168,6 +248,12 @@ impl Gui {
     fn setup(self: &Rc<Self>) {
         self.layout();
         self.setup_interaction();
+        self.setup_tabs();
+        self.setup_sidebar();
+        self.setup_overview();
+        self.setup_library();
+        self.setup_dbus();
+        self.setup_page_slider();
 
 
         let g = self.clone();
@@ -178,7 +264,8 @@ impl Gui {
             assert!(width >= 0 && height >= 0, "Can't have negative width or height");
 
             let s = g.state.borrow();
-            let t_res = (width, height, s.modes.fit, s.modes.display).into();
+            let t_res = TargetRes::from((width, height, s.modes.fit, s.modes.display))
+                .zoomed(s.modes.zoom);
             g.update_scroll_container(t_res);
 
             g.manager_sender
@@ -191,9 +278,20 @@ impl Gui {
 
     fn layout(self: &Rc<Self>) {
         self.window.remove_css_class("background");
-        self.window.set_default_size(800, 600);
+        self.restore_geometry();
         self.window.set_title(Some("aw-man"));
 
+        let g = self.clone();
+        self.window.connect_close_request(move |_| {
+            g.save_geometry();
+            gtk::Inhibit(false)
+        });
+
+        if config::OPTIONS.minimal {
+            self.window.set_decorated(false);
+            self.bottom_bar.hide();
+        }
+
         // TODO -- three separate indicators?
         self.mode.set_width_chars(3);
         self.mode.set_xalign(1.0);
@@ -203,6 +301,55 @@ impl Gui {
 
         self.overlay.set_child(Some(&self.canvas));
 
+        self.annotation_layer.set_can_target(false);
+        let g = self.clone();
+        self.annotation_layer.set_draw_func(move |_, cr, _, _| g.draw_highlights(cr));
+        self.overlay.add_overlay(&self.annotation_layer);
+
+        self.annotations.set_halign(Align::Start);
+        self.annotations.set_valign(Align::Start);
+        self.annotations.set_wrap(true);
+        self.annotations.set_max_width_chars(60);
+        self.annotations.set_can_target(false);
+        self.annotations.add_css_class("annotation-label");
+        self.annotations.hide();
+        self.overlay.add_overlay(&self.annotations);
+
+        self.osd.set_halign(Align::Center);
+        self.osd.set_valign(Align::Start);
+        self.osd.set_can_target(false);
+        self.osd.add_css_class("osd");
+        self.osd.add_css_class("osd-label");
+        self.osd.hide();
+        self.overlay.add_overlay(&self.osd);
+
+        self.hud.set_halign(Align::End);
+        self.hud.set_valign(Align::Start);
+        self.hud.set_can_target(false);
+        self.hud.add_css_class("osd");
+        self.hud.add_css_class("hud-label");
+        self.hud.hide();
+        self.overlay.add_overlay(&self.hud);
+
+        self.page_info.set_halign(Align::Start);
+        self.page_info.set_valign(Align::Start);
+        self.page_info.set_can_target(false);
+        self.page_info.add_css_class("osd");
+        self.page_info.add_css_class("hud-label");
+        self.page_info.hide();
+        self.overlay.add_overlay(&self.page_info);
+
+        self.error_banner.set_halign(Align::Fill);
+        self.error_banner.set_valign(Align::End);
+        self.error_banner.set_wrap(true);
+        self.error_banner.set_selectable(true);
+        self.error_banner.add_css_class("error-banner");
+        self.error_banner.hide();
+        self.overlay.add_overlay(&self.error_banner);
+
+        self.overlay.add_overlay(self.overview.widget());
+        self.overlay.add_overlay(self.library.widget());
+
         self.bottom_bar.add_css_class("background");
         self.bottom_bar.add_css_class("bottom-bar");
 
@@ -213,8 +360,8 @@ impl Gui {
         self.bottom_bar.prepend(&gtk::Label::new(Some("|")));
         self.bottom_bar.prepend(&self.progress);
 
-        // TODO -- replace with center controls ?
-        self.edge_indicator.set_hexpand(true);
+        // Center -- the slider takes up any free space.
+        self.bottom_bar.append(self.page_slider.widget());
         self.edge_indicator.set_halign(Align::End);
 
         // Right side - left to right
@@ -225,7 +372,12 @@ impl Gui {
 
         let vbox = gtk::Box::new(gtk::Orientation::Vertical, 0);
 
-        vbox.prepend(&self.overlay);
+        let hbox = gtk::Box::new(gtk::Orientation::Horizontal, 0);
+        hbox.append(self.sidebar.widget());
+        hbox.append(&self.overlay);
+
+        vbox.append(&self.tab_strip);
+        vbox.append(&hbox);
         vbox.append(&self.bottom_bar);
 
         self.window.set_child(Some(&vbox));
@@ -236,9 +388,10 @@ impl Gui {
 
         match gu {
             State(s, actx) => {
+                let title = format!("{} ({}%) - aw-man", s.archive_name, s.progress.archive);
                 match self.window.title() {
-                    Some(t) if t.as_str().strip_suffix(" - aw-man") == Some(&s.archive_name) => {}
-                    _ => self.window.set_title(Some(&(s.archive_name.clone() + " - aw-man"))),
+                    Some(t) if t.as_str() == title => {}
+                    _ => self.window.set_title(Some(&title)),
                 };
 
                 // TODO -- determine true visible pages. Like "1-3/20" or even "19/20 - 3/10"
@@ -256,11 +409,23 @@ impl Gui {
                 let old_id =
                     self.label_updates.replace(Some(glib::idle_add_local_once(move || {
                         let new_s = g.state.borrow();
-                        g.progress.set_text(&format!("{} / {}", new_s.page_num, new_s.archive_len));
+                        g.progress.set_text(&format!(
+                            "{} / {} ({})",
+                            new_s.page_num, new_s.archive_len, new_s.progress
+                        ));
                         g.archive_name.set_text(&new_s.archive_name);
                         g.page_name.set_text(&new_s.page_name);
                         g.mode.set_text(&new_s.modes.gui_str());
+                        g.update_annotations(&new_s.annotations);
+                        g.update_error_banner(new_s.error.as_deref());
                         g.update_zoom_level();
+                        g.update_page_slider();
+                        drop(new_s);
+                        g.update_page_info();
+                        g.update_active_tab();
+                        g.update_sidebar();
+                        g.update_overview();
+                        g.update_dbus();
                         g.label_updates.take().unwrap();
                     })));
 
@@ -272,6 +437,8 @@ impl Gui {
             Action(a, fin) => {
                 self.run_command(&a, Some(fin));
             }
+            Osd(msg) => self.show_osd(&msg),
+            Crashed(path) => self.show_crash_dialog(&path),
             Quit => {
                 self.window.close();
                 closing::close();
@@ -330,11 +497,220 @@ impl Gui {
             }
         }
 
-        self.canvas.inner().update_displayed(&new_s.content);
+        self.canvas
+            .inner()
+            .update_displayed(&new_s.content, (new_s.archive_path.as_path(), new_s.page_num));
+        self.update_auto_background(&new_s.content);
 
         self.canvas.queue_draw();
     }
 
+    // Matches the background to the edges of the current page, so pages with cream or grey paper
+    // don't sit on a jarring black field. Pages that aren't loaded yet keep the previous colour.
+    fn update_auto_background(&self, content: &GuiContent) {
+        if !config::CONFIG.auto_background || config::OPTIONS.minimal {
+            return;
+        }
+
+        let d = match content {
+            GuiContent::Single(d) => Some(d),
+            GuiContent::Multiple { current_index, visible, .. } => visible.get(*current_index),
+        };
+
+        let colour = match d {
+            Some(Displayable::Image(iwr)) => iwr.img.border_colour(),
+            Some(Displayable::Animation(a)) => a.frames()[0].0.border_colour(),
+            Some(
+                Displayable::Video(_)
+                | Displayable::Error(_)
+                | Displayable::Pending(_)
+                | Displayable::Nothing,
+            )
+            | None => None,
+        };
+
+        if let Some([r, g, b]) = colour {
+            let rgba = gdk::RGBA::new(r, g, b, 1.0);
+            self.bg.set(rgba);
+            self.canvas.inner().set_bg(rgba);
+        }
+    }
+
+    pub(super) fn show_osd(self: &Rc<Self>, msg: &str) {
+        self.osd.set_text(msg);
+        self.osd.show();
+
+        let g = self.clone();
+        let old_id = self.osd_timeout.replace(Some(glib::timeout_add_local_once(
+            OSD_DURATION,
+            move || {
+                g.osd.hide();
+                g.osd_timeout.take().unwrap();
+            },
+        )));
+
+        if let Some(id) = old_id {
+            id.remove();
+        }
+    }
+
+    // Restarts the timer to hide the UI and shows the UI if it was automatically hidden and the
+    // pointer is near the bottom.
+    pub(super) fn pointer_moved(self: &Rc<Self>, y: f64) {
+        let timeout = match config::CONFIG.hide_ui_timeout {
+            Some(t) => Duration::from_secs(t.get()),
+            None => return,
+        };
+
+        let near_bottom = y >= f64::from(self.overlay.height() - AUTO_SHOW_UI_DISTANCE);
+        if self.ui_auto_hidden.get() && near_bottom {
+            self.ui_auto_hidden.set(false);
+            self.bottom_bar.show();
+        }
+
+        let g = self.clone();
+        let old_id = self.hide_ui_timeout.replace(Some(glib::timeout_add_local_once(
+            timeout,
+            move || {
+                g.hide_ui_timeout.take().unwrap();
+                if g.window.is_fullscreen() && g.bottom_bar.is_visible() {
+                    g.ui_auto_hidden.set(true);
+                    g.bottom_bar.hide();
+                }
+            },
+        )));
+
+        if let Some(id) = old_id {
+            id.remove();
+        }
+    }
+
+    pub(super) fn toggle_hud(self: &Rc<Self>) {
+        if let Some(id) = self.hud_updates.take() {
+            id.remove();
+            self.hud.hide();
+            return;
+        }
+
+        self.update_hud();
+        self.hud.show();
+
+        let g = self.clone();
+        self.hud_updates.replace(Some(glib::timeout_add_local(HUD_INTERVAL, move || {
+            g.update_hud();
+            glib::Continue(true)
+        })));
+    }
+
+    fn update_hud(&self) {
+        let memory = pools::stats::resident_memory()
+            .map_or_else(|| "unknown".to_string(), |m| format!("{}MiB", m / 1024 / 1024));
+
+        self.hud.set_text(&format!(
+            "frame    {:.1?}\ndecode   {:.1?}\nscale    {:.1?}\nextract  {}\nmemory   {}",
+            self.frame_time.get(),
+            pools::stats::DECODE.last(),
+            pools::stats::SCALE.last(),
+            pools::stats::extraction_queue(),
+            memory
+        ));
+    }
+
+    // The main window will be closed immediately after this, so the dialog is attached to the
+    // application instead to keep it running until the user has seen the report.
+    fn show_crash_dialog(self: &Rc<Self>, path: &Path) {
+        let dialog = gtk::MessageDialog::builder()
+            .title("aw-man crashed")
+            .message_type(gtk::MessageType::Error)
+            .buttons(gtk::ButtonsType::Close)
+            .text("aw-man crashed unexpectedly")
+            .secondary_text(&format!("A crash report was written to {}", path.display()))
+            .secondary_use_markup(false)
+            .build();
+        dialog.set_application(self.window.application().as_ref());
+
+        dialog.connect_response(|d, _| d.destroy());
+        dialog.show();
+    }
+
+    fn update_annotations(self: &Rc<Self>, annotations: &[Annotation]) {
+        let text = annotations
+            .iter()
+            .map(|a| a.text.as_str())
+            .filter(|t| !t.is_empty())
+            .collect::<Vec<_>>()
+            .join("\n");
+
+        if text != self.annotations.text().as_str() {
+            self.annotations.set_text(&text);
+        }
+        self.annotations.set_visible(!text.is_empty() && self.annotation_layer.is_visible());
+        self.annotation_layer.queue_draw();
+    }
+
+    fn update_error_banner(&self, error: Option<&str>) {
+        match error {
+            Some(e) => {
+                if e != self.error_banner.text().as_str() {
+                    self.error_banner.set_text(e);
+                }
+                self.error_banner.show();
+            }
+            None => self.error_banner.hide(),
+        }
+    }
+
+    // Highlights are drawn on top of the current page using the same layout as the renderer.
+    fn draw_highlights(self: &Rc<Self>, cr: &gtk::cairo::Context) {
+        use Displayable::*;
+        use GuiContent::*;
+
+        let db = self.state.borrow();
+        if db.annotations.iter().all(|a| a.highlight.is_none()) {
+            return;
+        }
+
+        let (current, index) = match &db.content {
+            Single(r) => (r, 0),
+            Multiple { visible, current_index, .. } => (&visible[*current_index], *current_index),
+        };
+
+        let original = match current {
+            Image(img) => img.original_res,
+            Animation(ac) => ac.frames()[0].0.res,
+            Error(_) | Nothing | Pending(_) | Video(_) => return,
+        };
+
+        let layout = match self.layout_manager.borrow().layout_iter().nth(index) {
+            Some(layout) => layout,
+            None => return,
+        };
+
+        if original.w == 0 || original.h == 0 {
+            return;
+        }
+
+        // Layouts are in device pixels, cairo works in logical pixels.
+        let device_scale = self.canvas.scale_factor() as f64;
+        let scale = layout.2.w as f64 / original.w as f64 / device_scale;
+        let (ofx, ofy) = (layout.0 as f64 / device_scale, layout.1 as f64 / device_scale);
+
+        for h in db.annotations.iter().filter_map(|a| a.highlight) {
+            cr.rectangle(
+                ofx + h.x as f64 * scale,
+                ofy + h.y as f64 * scale,
+                h.w as f64 * scale,
+                h.h as f64 * scale,
+            );
+        }
+
+        cr.set_source_rgba(1.0, 0.9, 0.0, 0.25);
+        drop(cr.fill_preserve());
+        cr.set_source_rgba(1.0, 0.9, 0.0, 0.9);
+        cr.set_line_width(2.0);
+        drop(cr.stroke());
+    }
+
     fn update_zoom_level(self: &Rc<Self>) {
         let zoom = self.get_zoom_level();
 
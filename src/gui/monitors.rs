@@ -0,0 +1,48 @@
+// Chooses which monitor the window is fullscreened on. GTK4 can't otherwise move windows between
+// monitors, so fullscreen is the only placement applications get.
+
+use gtk::gdk;
+use gtk::prelude::*;
+
+use super::Gui;
+use crate::config::{CONFIG, OPTIONS};
+
+// Monitors are found by connector name, like "DP-1", or by their index starting from 0.
+fn find_monitor(name: &str) -> Option<gdk::Monitor> {
+    let monitors = gdk::Display::default()?.monitors();
+    let monitors: Vec<_> = (0..monitors.n_items())
+        .filter_map(|i| monitors.item(i)?.downcast::<gdk::Monitor>().ok())
+        .collect();
+
+    if let Some(m) = monitors.iter().find(|m| m.connector().map_or(false, |c| c == name)) {
+        return Some(m.clone());
+    }
+
+    name.parse::<usize>().ok().and_then(|i| monitors.get(i).cloned())
+}
+
+impl Gui {
+    // Fullscreens on the monitor from --fullscreen-monitor or fullscreen_monitor if it's set and
+    // connected, otherwise wherever the window manager chooses.
+    pub(super) fn fullscreen(&self) {
+        let name = OPTIONS.fullscreen_monitor.as_ref().or(CONFIG.fullscreen_monitor.as_ref());
+        let monitor = name.and_then(|name| {
+            let m = find_monitor(name);
+            if m.is_none() {
+                warn!("Could not find fullscreen monitor {:?}", name);
+            }
+            m
+        });
+
+        match monitor {
+            Some(m) => self.window.fullscreen_on_monitor(&m),
+            None => self.window.fullscreen(),
+        }
+    }
+
+    pub(super) fn move_to_monitor(&self, name: &str) -> Result<(), String> {
+        let monitor = find_monitor(name).ok_or_else(|| format!("Could not find monitor {name:?}"))?;
+        self.window.fullscreen_on_monitor(&monitor);
+        Ok(())
+    }
+}
@@ -0,0 +1,298 @@
+// A grid of thumbnails of every page in the current archive, for finding a page visually.
+// Pages are only thumbnailed once they've been extracted, so the grid fills in as extraction runs.
+
+use std::cell::{Cell, RefCell};
+use std::path::{Path, PathBuf};
+use std::rc::Rc;
+use std::time::Duration;
+
+use gtk::prelude::*;
+use gtk::{glib, Align};
+use image::RgbaImage;
+use serde_json::Value;
+use tokio::sync::oneshot;
+
+use super::sidebar::texture;
+use super::Gui;
+use crate::com::{Direction, GuiActionContext, ManagerAction, ScrollMotionTarget};
+use crate::manager::files::is_natively_supported_image;
+use crate::{closing, spawn_thread};
+
+const THUMBNAIL_WIDTH: u32 = 160;
+const THUMBNAIL_HEIGHT: u32 = 240;
+
+// How often to check for newly extracted pages while some are still missing.
+const REFRESH_INTERVAL: Duration = Duration::from_millis(500);
+
+#[derive(Debug)]
+enum PageFile {
+    // Still being extracted or scanned, so the manager might have a file for it later.
+    Pending(Option<PathBuf>),
+    Ready(PathBuf),
+    Failed(String),
+}
+
+impl PageFile {
+    fn from_info(v: &Value) -> Self {
+        let path = v.get("abs_path").and_then(Value::as_str).map(PathBuf::from);
+        match (v.get("state").and_then(Value::as_str), path) {
+            (Some("failed"), _) => {
+                let e = v.get("error").and_then(Value::as_str).unwrap_or("Failed to load");
+                Self::Failed(e.to_string())
+            }
+            (Some("extracting" | "scanning"), p) => Self::Pending(p),
+            (_, Some(p)) => Self::Ready(p),
+            (_, None) => Self::Pending(None),
+        }
+    }
+}
+
+#[derive(Debug)]
+pub(super) struct Overview {
+    scroll: gtk::ScrolledWindow,
+    grid: gtk::FlowBox,
+    // The archive the grid was built for.
+    archive: RefCell<Option<PathBuf>>,
+    pictures: RefCell<Vec<gtk::Picture>>,
+    // Whether each page has been sent off to be thumbnailed.
+    requested: RefCell<Vec<bool>>,
+    // Incremented whenever the grid is rebuilt so late thumbnails for an old archive are dropped.
+    generation: Cell<usize>,
+    // Set when the overview is shown so the current page is focused once the grid is ready.
+    focus_current: Cell<bool>,
+    refresh_timeout: RefCell<Option<glib::SourceId>>,
+}
+
+impl Overview {
+    pub(super) fn new() -> Self {
+        Self {
+            scroll: gtk::ScrolledWindow::new(),
+            grid: gtk::FlowBox::new(),
+            archive: RefCell::default(),
+            pictures: RefCell::default(),
+            requested: RefCell::default(),
+            generation: Cell::default(),
+            focus_current: Cell::default(),
+            refresh_timeout: RefCell::default(),
+        }
+    }
+
+    pub(super) fn widget(&self) -> &gtk::ScrolledWindow {
+        &self.scroll
+    }
+
+    pub(super) fn is_visible(&self) -> bool {
+        self.scroll.is_visible()
+    }
+}
+
+fn thumbnail(path: &Path) -> Option<RgbaImage> {
+    if !is_natively_supported_image(path) {
+        return None;
+    }
+
+    let img = image::open(path).ok()?;
+    Some(img.thumbnail(THUMBNAIL_WIDTH, THUMBNAIL_HEIGHT).into_rgba8())
+}
+
+impl Gui {
+    pub(super) fn setup_overview(self: &Rc<Self>) {
+        let ov = &self.overview;
+        ov.grid.set_valign(Align::Start);
+        ov.grid.set_homogeneous(true);
+        ov.grid.set_max_children_per_line(100);
+        ov.grid.set_selection_mode(gtk::SelectionMode::Single);
+        ov.grid.set_activate_on_single_click(true);
+
+        ov.scroll.set_child(Some(&ov.grid));
+        ov.scroll.set_hscrollbar_policy(gtk::PolicyType::Never);
+        ov.scroll.add_css_class("background");
+        ov.scroll.add_css_class("overview");
+        ov.scroll.hide();
+
+        let g = self.clone();
+        ov.grid.connect_child_activated(move |_, child| {
+            let page = child.index().max(0) as usize;
+            g.manager_sender
+                .send((
+                    ManagerAction::MovePages(Direction::Absolute, page),
+                    ScrollMotionTarget::Start.into(),
+                    None,
+                ))
+                .expect("Unexpected failed to send from Gui to Manager");
+            g.hide_overview();
+        });
+    }
+
+    pub(super) fn toggle_overview(self: &Rc<Self>) {
+        if self.overview.is_visible() {
+            return self.hide_overview();
+        }
+
+        self.overview.scroll.show();
+        self.overview.focus_current.set(true);
+        self.refresh_overview();
+    }
+
+    pub(super) fn hide_overview(&self) {
+        self.overview.scroll.hide();
+        if let Some(id) = self.overview.refresh_timeout.take() {
+            id.remove();
+        }
+    }
+
+    // Rebuilds the grid if the manager has moved on to another archive.
+    pub(super) fn update_overview(self: &Rc<Self>) {
+        if !self.overview.is_visible() {
+            return;
+        }
+
+        let current = self.state.borrow().archive_path.clone();
+        if self.overview.archive.borrow().as_ref() != Some(&current) {
+            self.overview.focus_current.set(true);
+            self.refresh_overview();
+        }
+    }
+
+    fn refresh_overview(self: &Rc<Self>) {
+        let (s, r) = oneshot::channel();
+        self.manager_sender
+            .send((ManagerAction::ListPages, GuiActionContext::default(), Some(s)))
+            .expect("Unexpected failed to send from Gui to Manager");
+
+        let g = self.clone();
+        glib::MainContext::default().spawn_local(async move {
+            let pages: Vec<PageFile> = match r.await {
+                Ok(Value::Array(a)) => a.iter().map(PageFile::from_info).collect(),
+                _ => return,
+            };
+
+            if g.overview.is_visible() {
+                g.populate_overview(pages);
+            }
+        });
+    }
+
+    fn rebuild_overview(&self, len: usize) {
+        let ov = &self.overview;
+        while let Some(child) = ov.grid.child_at_index(0) {
+            ov.grid.remove(&child);
+        }
+
+        let mut pictures = Vec::with_capacity(len);
+        for i in 0..len {
+            let picture = gtk::Picture::new();
+            picture.set_size_request(THUMBNAIL_WIDTH as i32, THUMBNAIL_HEIGHT as i32);
+
+            let vbox = gtk::Box::new(gtk::Orientation::Vertical, 4);
+            vbox.append(&picture);
+            vbox.append(&gtk::Label::new(Some(&(i + 1).to_string())));
+            ov.grid.insert(&vbox, -1);
+
+            pictures.push(picture);
+        }
+
+        ov.pictures.replace(pictures);
+        ov.requested.replace(vec![false; len]);
+        ov.archive.replace(Some(self.state.borrow().archive_path.clone()));
+        ov.generation.set(ov.generation.get().wrapping_add(1));
+    }
+
+    fn mark_overview_failed(&self, i: usize, error: &str) {
+        let pictures = self.overview.pictures.borrow();
+        if let Some(cell) = pictures.get(i).and_then(WidgetExt::parent) {
+            cell.add_css_class("failed-page");
+            cell.set_tooltip_text(Some(error));
+        }
+    }
+
+    fn populate_overview(self: &Rc<Self>, pages: Vec<PageFile>) {
+        let ov = &self.overview;
+        let current = self.state.borrow().archive_path.clone();
+        if ov.archive.borrow().as_ref() != Some(&current)
+            || ov.pictures.borrow().len() != pages.len()
+        {
+            self.rebuild_overview(pages.len());
+        }
+
+        if ov.focus_current.take() {
+            let page = self.state.borrow().page_num.saturating_sub(1);
+            if let Some(child) = ov.grid.child_at_index(page as i32) {
+                ov.grid.select_child(&child);
+                child.grab_focus();
+            }
+        }
+
+        let mut requested = ov.requested.borrow_mut();
+        let mut missing = Vec::new();
+        let mut pending = false;
+        for (i, p) in pages.into_iter().enumerate() {
+            let path = match p {
+                PageFile::Pending(p) => {
+                    pending = true;
+                    p
+                }
+                PageFile::Ready(p) => Some(p),
+                PageFile::Failed(e) => {
+                    if !requested[i] {
+                        requested[i] = true;
+                        self.mark_overview_failed(i, &e);
+                    }
+                    None
+                }
+            };
+
+            match path {
+                Some(p) if !requested[i] => {
+                    requested[i] = true;
+                    missing.push((i, p));
+                }
+                _ => {}
+            }
+        }
+        drop(requested);
+
+        // Failed pages will never have a file, so only wait on pages the manager is still working
+        // on.
+        if pending {
+            let g = self.clone();
+            let id = glib::timeout_add_local_once(REFRESH_INTERVAL, move || {
+                g.overview.refresh_timeout.take();
+                g.refresh_overview();
+            });
+            if let Some(old_id) = ov.refresh_timeout.replace(Some(id)) {
+                old_id.remove();
+            }
+        }
+
+        if missing.is_empty() {
+            return;
+        }
+
+        let generation = ov.generation.get();
+        let (sender, receiver) = glib::MainContext::channel(glib::PRIORITY_DEFAULT_IDLE);
+        let g = self.clone();
+        receiver.attach(None, move |(i, img): (usize, Option<RgbaImage>)| {
+            if g.overview.generation.get() != generation {
+                return glib::Continue(false);
+            }
+
+            if let (Some(pic), Some(img)) = (g.overview.pictures.borrow().get(i), img) {
+                pic.set_paintable(Some(&texture(img)));
+            }
+            glib::Continue(true)
+        });
+
+        spawn_thread("overview", move || {
+            for (i, p) in missing {
+                if closing::closed() {
+                    return;
+                }
+                let img = thumbnail(&p);
+                if sender.send((i, img)).is_err() {
+                    return;
+                }
+            }
+        });
+    }
+}
@@ -0,0 +1,446 @@
+// An editor for keyboard shortcuts. Bindings are changed by pressing the new key, take effect
+// immediately, and can be written back to the shortcuts array in the config file.
+//
+// Only the shortcuts array is rewritten, so comments and formatting elsewhere in the config file
+// are preserved. Comments inside the array are lost.
+
+use std::cell::Cell;
+use std::fs;
+use std::rc::Rc;
+
+use gtk::gdk::{Key, ModifierType};
+use gtk::prelude::*;
+
+use super::input::{parse_modifiers, Dialogs};
+use super::Gui;
+use crate::config::{config_file, Shortcut};
+use crate::write_atomically;
+
+// Built-in actions offered when adding a shortcut. Any other command, like "Jump +10" or
+// "Execute /path/to/script.sh", can still be typed in. Actions that need an argument and have no
+// dialog to ask for one, like MoveToMonitor, aren't offered since they'd do nothing on their own.
+const ACTIONS: &[&str] = &[
+    "NextPage",
+    "PreviousPage",
+    "FirstPage",
+    "LastPage",
+    "FirstOfSeries",
+    "LastOfSeries",
+    "RandomPage",
+    "RetryPage",
+    "TrashArchive",
+    "NextArchive",
+    "PreviousArchive",
+    "ScrollDown",
+    "ScrollUp",
+    "ScrollRight",
+    "ScrollLeft",
+    "FitToContainer",
+    "FitToWidth",
+    "FitToHeight",
+    "FullSize",
+    "CycleFitMode",
+    "ZoomIn",
+    "ZoomOut",
+    "ZoomReset",
+    "SinglePage",
+    "VerticalStrip",
+    "HorizontalStrip",
+    "DualPage",
+    "DualPageReversed",
+    "ToggleUI",
+    "ToggleHud",
+    "TogglePageInfo",
+    "ToggleFullscreen",
+    "ToggleMangaMode",
+    "ToggleUpscaling",
+    "UpscaleArchive",
+    "ToggleComparison",
+    "ShowOriginal",
+    "ToggleLowMemory",
+    "ToggleSortByTime",
+    "ToggleReverseSort",
+    "TogglePlaying",
+    "ToggleSidebar",
+    "ToggleOverview",
+    "ToggleLibrary",
+    "ToggleAnnotations",
+    "SetBackground",
+    "Jump",
+    "Open",
+    "OpenRecent",
+    "ExportArchive",
+    "Annotate",
+    "ClearAnnotations",
+    "SetWallpaper",
+    "NewTab",
+    "CloseTab",
+    "NextTab",
+    "PreviousTab",
+    "EditShortcuts",
+    "Quit",
+];
+
+// Pressing only these never completes a binding.
+const MODIFIER_KEYS: &[&str] = &[
+    "Shift_L",
+    "Shift_R",
+    "Control_L",
+    "Control_R",
+    "Alt_L",
+    "Alt_R",
+    "Meta_L",
+    "Meta_R",
+    "Super_L",
+    "Super_R",
+    "ISO_Level3_Shift",
+];
+
+// The same names, in the same order, accepted by the modifiers field in the config.
+fn modifier_string(mods: ModifierType) -> Option<String> {
+    let names = [
+        (ModifierType::CONTROL_MASK, "Control"),
+        (ModifierType::ALT_MASK, "Alt"),
+        (ModifierType::SHIFT_MASK, "Shift"),
+        (ModifierType::SUPER_MASK, "Super"),
+        (ModifierType::META_MASK, "Command"),
+    ];
+
+    let s: Vec<_> = names.iter().filter(|(m, _)| mods.contains(*m)).map(|(_, n)| *n).collect();
+    if s.is_empty() { None } else { Some(s.join(",")) }
+}
+
+fn describe(s: &Shortcut) -> String {
+    match &s.modifiers {
+        Some(m) => format!("{}+{}", m.replace(',', "+"), s.key),
+        None => s.key.clone(),
+    }
+}
+
+fn toml_string(s: &str) -> String {
+    let mut out = String::with_capacity(s.len() + 2);
+    out.push('"');
+    for c in s.chars() {
+        match c {
+            '"' => out.push_str("\\\""),
+            '\\' => out.push_str("\\\\"),
+            '\n' => out.push_str("\\n"),
+            '\t' => out.push_str("\\t"),
+            c if c.is_control() => out.push_str(&format!("\\u{:04X}", c as u32)),
+            c => out.push(c),
+        }
+    }
+    out.push('"');
+    out
+}
+
+fn shortcuts_block(shortcuts: &[Shortcut]) -> String {
+    let mut block = "shortcuts = [\n".to_string();
+    for s in shortcuts {
+        block.push_str(&format!("  {{key = {}", toml_string(&s.key)));
+        if let Some(m) = &s.modifiers {
+            block.push_str(&format!(", modifiers = {}", toml_string(m)));
+        }
+        block.push_str(&format!(", action = {}}},\n", toml_string(&s.action)));
+    }
+    block.push(']');
+    block
+}
+
+// Replaces the top level shortcuts array in `config` with `block`, or adds it at the top, before
+// any tables, if there wasn't one.
+fn replace_shortcuts(config: &str, block: &str) -> String {
+    let lines: Vec<&str> = config.lines().collect();
+
+    let is_start = |l: &str| {
+        l.strip_prefix("shortcuts")
+            .map(str::trim_start)
+            .and_then(|l| l.strip_prefix('='))
+            .map_or(false, |l| l.trim_start().starts_with('['))
+    };
+
+    let start = match lines.iter().position(|l| is_start(l)) {
+        Some(s) => s,
+        None => return format!("{}\n\n{}", block, config),
+    };
+
+    let end = if lines[start].trim_end().ends_with(']') {
+        Some(start)
+    } else {
+        (start + 1..lines.len()).find(|i| lines[*i].trim_start().starts_with(']'))
+    };
+
+    let end = match end {
+        Some(e) => e,
+        // Unterminated, which the config loader would have rejected anyway.
+        None => return format!("{}\n\n{}", block, config),
+    };
+
+    let mut out: Vec<&str> = lines[..start].to_vec();
+    out.push(block);
+    out.extend(&lines[end + 1..]);
+
+    let mut out = out.join("\n");
+    if config.ends_with('\n') {
+        out.push('\n');
+    }
+    out
+}
+
+fn save(shortcuts: &[Shortcut]) -> Result<String, String> {
+    let file = config_file().ok_or("Could not find the config file, pass it with --awconf")?;
+    let config = fs::read_to_string(&file)
+        .map_err(|e| format!("Failed to read config file {:?}: {:?}", file, e))?;
+
+    let new = replace_shortcuts(&config, &shortcuts_block(shortcuts));
+
+    write_atomically(&file, new.as_bytes())
+        .map_err(|e| format!("Failed to write config file {:?}: {:?}", file, e))?;
+
+    Ok(format!("Saved shortcuts to {:?}", file))
+}
+
+impl Gui {
+    fn set_bindings(&self, bindings: Vec<Shortcut>) {
+        self.shortcuts.replace(Self::parse_shortcuts(&bindings));
+        self.bindings.replace(bindings);
+    }
+
+    fn fill_shortcut_list(
+        self: &Rc<Self>,
+        list: &gtk::ListBox,
+        capturing: &Rc<Cell<Option<usize>>>,
+        status: &gtk::Label,
+    ) {
+        while let Some(row) = list.row_at_index(0) {
+            list.remove(&row);
+        }
+
+        for (i, s) in self.bindings.borrow().iter().enumerate() {
+            let key = gtk::Button::with_label(&describe(s));
+            key.set_size_request(160, -1);
+            let name = gtk::Label::new(Some(&s.action));
+            name.set_halign(gtk::Align::Start);
+            name.set_hexpand(true);
+            let remove = gtk::Button::from_icon_name("list-remove-symbolic");
+
+            let c = capturing.clone();
+            let st = status.clone();
+            key.connect_clicked(move |b| {
+                c.set(Some(i));
+                b.set_label("Press a key…");
+                st.set_text("Press the new key, or Escape to cancel.");
+            });
+
+            let g = self.clone();
+            let (l, c, st) = (list.clone(), capturing.clone(), status.clone());
+            remove.connect_clicked(move |_| {
+                let mut bindings = g.bindings.borrow().clone();
+                if i < bindings.len() {
+                    let removed = bindings.remove(i);
+                    st.set_text(&format!("Removed {}.", describe(&removed)));
+                    g.set_bindings(bindings);
+                }
+                c.set(None);
+                g.fill_shortcut_list(&l, &c, &st);
+            });
+
+            let row = gtk::Box::new(gtk::Orientation::Horizontal, 6);
+            row.append(&key);
+            row.append(&name);
+            row.append(&remove);
+            list.append(&row);
+        }
+    }
+
+    pub(super) fn shortcut_editor(self: &Rc<Self>) {
+        if let Some(d) = self.open_dialogs.borrow().get(&Dialogs::Shortcuts) {
+            d.present();
+            return;
+        }
+
+        let dialog = gtk::Dialog::builder().transient_for(&self.window).build();
+        dialog.set_title(Some("Shortcuts"));
+        dialog.set_default_size(600, 500);
+
+        let list = gtk::ListBox::new();
+        list.set_selection_mode(gtk::SelectionMode::None);
+        let scroll = gtk::ScrolledWindow::new();
+        scroll.set_child(Some(&list));
+        scroll.set_vexpand(true);
+
+        let status = gtk::Label::new(Some("Click a shortcut to rebind it."));
+        status.set_halign(gtk::Align::Start);
+
+        let action = gtk::ComboBoxText::with_entry();
+        for a in ACTIONS {
+            action.append_text(a);
+        }
+        action.set_hexpand(true);
+        let add = gtk::Button::with_label("Add");
+        let save_button = gtk::Button::with_label("Save to config");
+
+        let controls = gtk::Box::new(gtk::Orientation::Horizontal, 6);
+        controls.append(&action);
+        controls.append(&add);
+        controls.append(&save_button);
+
+        let content = dialog.content_area();
+        content.set_spacing(6);
+        content.append(&scroll);
+        content.append(&status);
+        content.append(&controls);
+
+        // The binding waiting for a key press. Past the end of the list means a new binding for
+        // the action in the combo box.
+        let capturing: Rc<Cell<Option<usize>>> = Rc::default();
+        self.fill_shortcut_list(&list, &capturing, &status);
+
+        let c = capturing.clone();
+        let st = status.clone();
+        let g = self.clone();
+        let a = action.clone();
+        add.connect_clicked(move |_| {
+            let action = a.active_text().map(|t| t.trim().to_string()).unwrap_or_default();
+            if action.is_empty() {
+                return st.set_text("Pick or type an action first.");
+            }
+            c.set(Some(g.bindings.borrow().len()));
+            st.set_text(&format!("Press the key for {}, or Escape to cancel.", action));
+        });
+
+        let st = status.clone();
+        let g = self.clone();
+        save_button.connect_clicked(move |_| match save(&g.bindings.borrow()) {
+            Ok(msg) => {
+                info!("{}", msg);
+                st.set_text(&msg);
+            }
+            Err(e) => {
+                error!("{}", e);
+                st.set_text(&e);
+            }
+        });
+
+        let key = gtk::EventControllerKey::new();
+        key.set_propagation_phase(gtk::PropagationPhase::Capture);
+        let g = self.clone();
+        key.connect_key_pressed(move |_, k, _, mods| {
+            let i = match capturing.get() {
+                Some(i) => i,
+                None => return gtk::Inhibit(false),
+            };
+
+            let name = match k.to_upper().name() {
+                Some(n) => n.to_string(),
+                None => return gtk::Inhibit(true),
+            };
+            if MODIFIER_KEYS.contains(&name.as_str()) {
+                return gtk::Inhibit(true);
+            }
+
+            capturing.set(None);
+            let mods = mods & !ModifierType::LOCK_MASK;
+            if k == Key::Escape && mods.is_empty() {
+                status.set_text("Cancelled.");
+                g.fill_shortcut_list(&list, &capturing, &status);
+                return gtk::Inhibit(true);
+            }
+
+            let mut bindings = g.bindings.borrow().clone();
+            let new = Shortcut {
+                action: match bindings.get(i) {
+                    Some(s) => s.action.clone(),
+                    None => action.active_text().map(|t| t.trim().to_string()).unwrap_or_default(),
+                },
+                key: name,
+                modifiers: modifier_string(mods),
+            };
+            let mut msg = format!("Bound {} to {}.", describe(&new), new.action);
+
+            // A key can only do one thing, so whatever it was bound to before is replaced.
+            let conflict = bindings.iter().position(|s| {
+                Key::from_name(&s.key).map(|k| k.to_upper()) == Some(k.to_upper())
+                    && parse_modifiers(s.modifiers.as_deref()) == mods
+            });
+            let mut i = i;
+            if let Some(c) = conflict.filter(|c| *c != i) {
+                msg += &format!(" It was bound to {}.", bindings[c].action);
+                bindings.remove(c);
+                if c < i {
+                    i -= 1;
+                }
+            }
+
+            if i < bindings.len() {
+                bindings[i] = new;
+            } else {
+                bindings.push(new);
+            }
+
+            g.set_bindings(bindings);
+            status.set_text(&msg);
+            g.fill_shortcut_list(&list, &capturing, &status);
+            gtk::Inhibit(true)
+        });
+        dialog.add_controller(&key);
+
+        let g = self.clone();
+        dialog.run_async(move |d, _r| {
+            g.open_dialogs.borrow_mut().remove(&Dialogs::Shortcuts);
+            d.destroy();
+        });
+
+        let g = self.clone();
+        dialog.connect_destroy(move |_| {
+            // Nested hacks to avoid dropping two scroll events in a row.
+            g.drop_next_scroll.set(false);
+        });
+
+        self.open_dialogs
+            .borrow_mut()
+            .insert(Dialogs::Shortcuts, dialog.upcast::<gtk::Window>());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn shortcut(key: &str, modifiers: Option<&str>, action: &str) -> Shortcut {
+        Shortcut {
+            action: action.to_string(),
+            key: key.to_string(),
+            modifiers: modifiers.map(str::to_string),
+        }
+    }
+
+    #[test]
+    fn blocks() {
+        let block = shortcuts_block(&[
+            shortcut("J", None, "Jump"),
+            shortcut("O", Some("Control"), "Execute \"a b\" C:\\x"),
+        ]);
+        assert_eq!(
+            block,
+            "shortcuts = [\n  {key = \"J\", action = \"Jump\"},\n  {key = \"O\", modifiers = \
+             \"Control\", action = \"Execute \\\"a b\\\" C:\\\\x\"},\n]"
+        );
+    }
+
+    #[test]
+    fn replacing() {
+        let block = "shortcuts = []";
+
+        let config = "# top\na = 1\n\nshortcuts = [\n  {key = \"J\", action = \"Jump\"}, # ]\n]\n\
+                      b = 2\n";
+        assert_eq!(replace_shortcuts(config, block), "# top\na = 1\n\nshortcuts = []\nb = 2\n");
+
+        let config = "a = 1\nshortcuts = [{key = \"J\", action = \"Jump\"}]\nb = 2";
+        assert_eq!(replace_shortcuts(config, block), "a = 1\nshortcuts = []\nb = 2");
+
+        // Commented out examples aren't replaced.
+        let config = "# shortcuts = [\n# ]\n";
+        assert_eq!(replace_shortcuts(config, block), "shortcuts = []\n\n# shortcuts = [\n# ]\n");
+    }
+}
@@ -0,0 +1,255 @@
+// A list of the other archives in the same directory, with a thumbnail of each cover and how much
+// of each has been read.
+
+use std::cell::RefCell;
+use std::ffi::OsStr;
+use std::fs::File;
+use std::io::BufReader;
+use std::path::{Path, PathBuf};
+use std::rc::Rc;
+
+use ahash::AHashMap;
+use gtk::prelude::*;
+use gtk::{gdk, glib};
+use image::RgbaImage;
+use serde_json::Value;
+use tokio::sync::oneshot;
+
+use super::Gui;
+use crate::com::{GuiActionContext, ManagerAction, ScrollMotionTarget};
+use crate::manager::files::{is_natively_supported_image, is_supported_page_extension};
+use crate::manager::progress;
+use crate::{closing, natsort, spawn_thread};
+
+pub(super) const THUMBNAIL_WIDTH: u32 = 120;
+pub(super) const THUMBNAIL_HEIGHT: u32 = 180;
+
+#[derive(Debug)]
+pub(super) struct Sidebar {
+    scroll: gtk::ScrolledWindow,
+    list: gtk::ListBox,
+    // The directory currently listed.
+    dir: RefCell<Option<PathBuf>>,
+    rows: RefCell<Vec<Row>>,
+    // Covers are cheap enough to keep for the whole session, and archives rarely change.
+    thumbnails: RefCell<AHashMap<PathBuf, Option<gdk::Texture>>>,
+}
+
+#[derive(Debug)]
+struct Row {
+    path: PathBuf,
+    picture: gtk::Picture,
+    status: gtk::Label,
+}
+
+// Read statuses change as archives are read, so unlike covers they're looked up every time the
+// list is rebuilt.
+enum Update {
+    Status(PathBuf, Option<String>),
+    Cover(PathBuf, Option<RgbaImage>),
+}
+
+impl Sidebar {
+    pub(super) fn new() -> Self {
+        Self {
+            scroll: gtk::ScrolledWindow::new(),
+            list: gtk::ListBox::new(),
+            dir: RefCell::default(),
+            rows: RefCell::default(),
+            thumbnails: RefCell::default(),
+        }
+    }
+
+    pub(super) fn widget(&self) -> &gtk::ScrolledWindow {
+        &self.scroll
+    }
+}
+
+// Reads the first page of an archive, in sorted order, and shrinks it down.
+pub(super) fn cover(path: &Path) -> Option<RgbaImage> {
+    let names = compress_tools::list_archive_files(BufReader::new(File::open(path).ok()?)).ok()?;
+    let first = names
+        .into_iter()
+        .filter(|n| is_supported_page_extension(n))
+        .min_by_key(|n| natsort::key(OsStr::new(n)))?;
+
+    if !is_natively_supported_image(&first) {
+        return None;
+    }
+
+    let mut data = Vec::new();
+    let file = BufReader::new(File::open(path).ok()?);
+    compress_tools::uncompress_archive_file(file, &mut data, &first).ok()?;
+
+    let img = image::load_from_memory(&data).ok()?;
+    Some(img.thumbnail(THUMBNAIL_WIDTH, THUMBNAIL_HEIGHT).into_rgba8())
+}
+
+pub(super) fn texture(img: RgbaImage) -> gdk::Texture {
+    let (w, h) = img.dimensions();
+    let bytes = glib::Bytes::from_owned(img.into_raw());
+    gdk::MemoryTexture::new(
+        w as i32,
+        h as i32,
+        gdk::MemoryFormat::R8g8b8a8,
+        &bytes,
+        w as usize * 4,
+    )
+    .upcast()
+}
+
+impl Gui {
+    pub(super) fn setup_sidebar(self: &Rc<Self>) {
+        let sb = &self.sidebar;
+        sb.scroll.set_child(Some(&sb.list));
+        sb.scroll.set_hscrollbar_policy(gtk::PolicyType::Never);
+        sb.scroll.set_propagate_natural_width(true);
+        sb.scroll.add_css_class("background");
+        sb.scroll.add_css_class("sidebar");
+        sb.scroll.hide();
+
+        let g = self.clone();
+        sb.list.connect_row_activated(move |_, row| {
+            let path = g.sidebar.rows.borrow().get(row.index() as usize).map(|r| r.path.clone());
+            if let Some(path) = path {
+                g.manager_sender
+                    .send((ManagerAction::Open(path), ScrollMotionTarget::Start.into(), None))
+                    .expect("Unexpected failed to send from Gui to Manager");
+            }
+        });
+    }
+
+    pub(super) fn toggle_sidebar(self: &Rc<Self>) {
+        if self.sidebar.scroll.is_visible() {
+            return self.sidebar.scroll.hide();
+        }
+
+        self.sidebar.scroll.show();
+        self.sidebar.dir.take();
+        self.update_sidebar();
+    }
+
+    // Marks the current archive, refreshing the whole list if it's from another directory.
+    pub(super) fn update_sidebar(self: &Rc<Self>) {
+        if !self.sidebar.scroll.is_visible() {
+            return;
+        }
+
+        let current = self.state.borrow().archive_path.clone();
+        let dir = current.parent().map(Path::to_path_buf);
+        if *self.sidebar.dir.borrow() != dir {
+            self.sidebar.dir.replace(dir);
+            return self.refresh_sidebar();
+        }
+
+        let rows = self.sidebar.rows.borrow();
+        for (i, r) in rows.iter().enumerate() {
+            if let Some(row) = self.sidebar.list.row_at_index(i as i32) {
+                if r.path == current {
+                    row.add_css_class("current-archive");
+                } else {
+                    row.remove_css_class("current-archive");
+                }
+            }
+        }
+    }
+
+    fn refresh_sidebar(self: &Rc<Self>) {
+        let (s, r) = oneshot::channel();
+        self.manager_sender
+            .send((ManagerAction::ListSiblings, GuiActionContext::default(), Some(s)))
+            .expect("Unexpected failed to send from Gui to Manager");
+
+        let g = self.clone();
+        glib::MainContext::default().spawn_local(async move {
+            let paths: Vec<PathBuf> = match r.await {
+                Ok(Value::Array(a)) => {
+                    a.into_iter().filter_map(|v| v.as_str().map(PathBuf::from)).collect()
+                }
+                _ => return,
+            };
+            g.populate_sidebar(paths);
+        });
+    }
+
+    fn populate_sidebar(self: &Rc<Self>, paths: Vec<PathBuf>) {
+        let sb = &self.sidebar;
+        while let Some(row) = sb.list.row_at_index(0) {
+            sb.list.remove(&row);
+        }
+
+        let mut rows = Vec::with_capacity(paths.len());
+        let mut missing = Vec::new();
+
+        for p in paths {
+            let picture = gtk::Picture::new();
+            picture.set_size_request(THUMBNAIL_WIDTH as i32, THUMBNAIL_HEIGHT as i32);
+            match sb.thumbnails.borrow().get(&p) {
+                Some(Some(t)) => picture.set_paintable(Some(t)),
+                Some(None) => {}
+                None => missing.push(p.clone()),
+            }
+
+            let name = p.file_name().map_or_else(String::new, |n| n.to_string_lossy().into());
+            let label = gtk::Label::new(Some(&name));
+            label.set_wrap(true);
+            label.set_max_width_chars(20);
+
+            let status = gtk::Label::new(None);
+            status.add_css_class("read-status");
+            status.hide();
+
+            let vbox = gtk::Box::new(gtk::Orientation::Vertical, 4);
+            vbox.append(&picture);
+            vbox.append(&label);
+            vbox.append(&status);
+            sb.list.append(&vbox);
+
+            rows.push(Row { path: p, picture, status });
+        }
+
+        let statuses: Vec<_> = rows.iter().map(|r| r.path.clone()).collect();
+        sb.rows.replace(rows);
+        self.update_sidebar();
+
+        let (sender, receiver) = glib::MainContext::channel(glib::PRIORITY_DEFAULT_IDLE);
+        let g = self.clone();
+        receiver.attach(None, move |update| {
+            let rows = g.sidebar.rows.borrow();
+            match update {
+                Update::Status(path, status) => {
+                    if let (Some(r), Some(s)) = (rows.iter().find(|r| r.path == path), status) {
+                        r.status.set_text(&s);
+                        r.status.show();
+                    }
+                }
+                Update::Cover(path, img) => {
+                    let t = img.map(texture);
+                    if let Some(r) = rows.iter().find(|r| r.path == path) {
+                        r.picture.set_paintable(t.as_ref());
+                    }
+                    g.sidebar.thumbnails.borrow_mut().insert(path, t);
+                }
+            }
+            glib::Continue(true)
+        });
+
+        spawn_thread("thumbnails", move || {
+            // Statuses are quick to read, so show all of them before starting on the covers.
+            let statuses = statuses.into_iter().map(|p| {
+                let s = progress::read_status(&p);
+                Update::Status(p, s)
+            });
+            let covers = missing.into_iter().map(|p| {
+                let img = cover(&p);
+                Update::Cover(p, img)
+            });
+
+            for u in statuses.chain(covers) {
+                if closing::closed() || sender.send(u).is_err() {
+                    return;
+                }
+            }
+        });
+    }
+}
@@ -0,0 +1,77 @@
+// A slider in the bottom bar for scrubbing through long archives. Dragging it jumps straight to
+// the page under the handle.
+
+use std::cell::Cell;
+use std::rc::Rc;
+
+use gtk::prelude::*;
+
+use super::Gui;
+use crate::com::{Direction, ManagerAction, ScrollMotionTarget};
+
+#[derive(Debug)]
+pub(super) struct PageSlider {
+    scale: gtk::Scale,
+    // The last page requested by the slider, so a drag doesn't send the same jump repeatedly.
+    last_sent: Cell<usize>,
+}
+
+impl PageSlider {
+    pub(super) fn new() -> Self {
+        let scale = gtk::Scale::with_range(gtk::Orientation::Horizontal, 1.0, 2.0, 1.0);
+        Self { scale, last_sent: Cell::default() }
+    }
+
+    pub(super) fn widget(&self) -> &gtk::Scale {
+        &self.scale
+    }
+}
+
+impl Gui {
+    pub(super) fn setup_page_slider(self: &Rc<Self>) {
+        let scale = &self.page_slider.scale;
+        scale.set_hexpand(true);
+        scale.set_digits(0);
+        scale.set_draw_value(false);
+        scale.set_round_digits(0);
+        // Keep keyboard focus on the window so shortcuts still work after using the slider.
+        scale.set_focusable(false);
+        scale.add_css_class("page-slider");
+        scale.hide();
+
+        let g = self.clone();
+        // Only emitted for changes made by the user, not by update_page_slider.
+        scale.connect_change_value(move |scale, _, value| {
+            let (min, max) = (scale.adjustment().lower(), scale.adjustment().upper());
+            let page = value.round().clamp(min, max) as usize;
+
+            if page != g.page_slider.last_sent.replace(page) && page != g.state.borrow().page_num {
+                g.manager_sender
+                    .send((
+                        ManagerAction::MovePages(Direction::Absolute, page.saturating_sub(1)),
+                        ScrollMotionTarget::Start.into(),
+                        None,
+                    ))
+                    .expect("Unexpected failed to send from Gui to Manager");
+            }
+            gtk::Inhibit(false)
+        });
+    }
+
+    pub(super) fn update_page_slider(&self) {
+        let scale = &self.page_slider.scale;
+        let s = self.state.borrow();
+
+        if s.archive_len <= 1 {
+            scale.hide();
+            return;
+        }
+
+        scale.set_range(1.0, s.archive_len as f64);
+        if scale.value().round() as usize != s.page_num {
+            scale.set_value(s.page_num as f64);
+        }
+        self.page_slider.last_sent.set(s.page_num);
+        scale.show();
+    }
+}
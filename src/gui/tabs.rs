@@ -0,0 +1,137 @@
+// The manager keeps every tab's archives and place in them, so the Gui only tracks which tab is
+// active and labels each one with the name of its archive. Tabs are numbered the same way in both.
+
+use std::path::PathBuf;
+use std::rc::Rc;
+
+use gtk::glib;
+use gtk::prelude::*;
+use serde_json::Value;
+use tokio::sync::oneshot;
+
+use super::Gui;
+use crate::com::{GuiActionContext, ManagerAction};
+
+#[derive(Debug)]
+pub(super) struct Tab {
+    button: gtk::Button,
+}
+
+impl Gui {
+    pub(super) fn setup_tabs(self: &Rc<Self>) {
+        self.tab_strip.add_css_class("background");
+        self.tab_strip.add_css_class("tab-strip");
+        self.tab_strip.hide();
+
+        self.push_tab();
+    }
+
+    fn push_tab(self: &Rc<Self>) -> usize {
+        let button = gtk::Button::new();
+        button.set_has_frame(false);
+
+        let g = self.clone();
+        button.connect_clicked(move |b| {
+            let i = g.tabs.borrow().iter().position(|t| &t.button == b);
+            if let Some(i) = i {
+                g.switch_tab(i);
+            }
+        });
+
+        self.tab_strip.append(&button);
+        let mut tabs = self.tabs.borrow_mut();
+        tabs.push(Tab { button });
+        self.tab_strip.set_visible(tabs.len() > 1);
+        tabs.len() - 1
+    }
+
+    // Keeps the label of the active tab in sync with whatever the manager is showing.
+    pub(super) fn update_active_tab(&self) {
+        // Anything that arrives before the manager has switched tabs is for the old one.
+        if self.opening_tabs.get() > 0 {
+            return;
+        }
+
+        let s = self.state.borrow();
+        let tabs = self.tabs.borrow();
+        if let Some(tab) = tabs.get(self.active_tab.get()) {
+            tab.button.set_label(&s.archive_name);
+        }
+
+        for (i, t) in tabs.iter().enumerate() {
+            if i == self.active_tab.get() {
+                t.button.add_css_class("active-tab");
+            } else {
+                t.button.remove_css_class("active-tab");
+            }
+        }
+    }
+
+    // Sends a tab action to the manager, calling after with the response once it's been handled.
+    fn send_tab_action(
+        self: &Rc<Self>,
+        action: ManagerAction,
+        after: impl FnOnce(&Rc<Self>, Option<Value>) + 'static,
+    ) {
+        let (s, r) = oneshot::channel();
+        self.opening_tabs.set(self.opening_tabs.get() + 1);
+
+        self.manager_sender
+            .send((action, GuiActionContext::default(), Some(s)))
+            .expect("Unexpected failed to send from Gui to Manager");
+
+        let g = self.clone();
+        glib::MainContext::default().spawn_local(async move {
+            let resp = r.await.ok();
+            after(&g, resp);
+            g.opening_tabs.set(g.opening_tabs.get() - 1);
+            g.update_active_tab();
+        });
+    }
+
+    fn switch_tab(self: &Rc<Self>, i: usize) {
+        if i == self.active_tab.get() {
+            return;
+        }
+        self.active_tab.set(i);
+        self.send_tab_action(ManagerAction::SwitchTab(i), |_, _| {});
+    }
+
+    // Opens a new tab showing the given archive, or the current page if there is none.
+    pub(super) fn new_tab(self: &Rc<Self>, path: Option<PathBuf>) {
+        self.send_tab_action(ManagerAction::NewTab(path), |g, resp| match resp {
+            Some(Value::Object(m)) if m.contains_key("error") => {
+                g.show_osd(m["error"].as_str().unwrap_or_default());
+            }
+            _ => {
+                let i = g.push_tab();
+                g.active_tab.set(i);
+            }
+        });
+    }
+
+    pub(super) fn close_tab(self: &Rc<Self>) {
+        let mut tabs = self.tabs.borrow_mut();
+        if tabs.len() <= 1 {
+            return;
+        }
+
+        let t = tabs.remove(self.active_tab.get());
+        self.tab_strip.remove(&t.button);
+        self.tab_strip.set_visible(tabs.len() > 1);
+        self.active_tab.set(self.active_tab.get().min(tabs.len() - 1));
+        drop(tabs);
+
+        self.send_tab_action(ManagerAction::CloseTab, |_, _| {});
+    }
+
+    pub(super) fn cycle_tabs(self: &Rc<Self>, forwards: bool) {
+        let len = self.tabs.borrow().len();
+        let i = if forwards {
+            (self.active_tab.get() + 1) % len
+        } else {
+            (self.active_tab.get() + len - 1) % len
+        };
+        self.switch_tab(i);
+    }
+}
@@ -8,8 +8,11 @@ extern crate log;
 #[global_allocator]
 static GLOBAL: tikv_jemallocator::Jemalloc = tikv_jemallocator::Jemalloc;
 
+use std::fs;
 use std::future::Future;
+use std::io::{self, Write};
 use std::panic::{catch_unwind, AssertUnwindSafe};
+use std::path::Path;
 use std::pin::Pin;
 use std::thread::{self, JoinHandle};
 
@@ -19,17 +22,22 @@ use self::com::MAWithResponse;
 
 mod elapsedlogger;
 
+mod bench;
 mod closing;
 mod com;
 mod config;
+mod crash;
 mod gui;
 mod manager;
 mod natsort;
 mod pools;
+mod remote;
 #[allow(unused)]
 mod resample;
+mod script;
 mod socket;
 mod unrar;
+mod web;
 
 fn spawn_thread<F, T>(name: &str, f: F) -> JoinHandle<T>
 where
@@ -42,6 +50,30 @@ where
         .unwrap_or_else(|_| panic!("Error spawning thread {}", name))
 }
 
+// Writes to a temporary file and renames it over the original so a crash can't leave a truncated
+// file behind. Symlinks are resolved first so the file they point to is replaced, not the link.
+// The temporary file gets a unique name in the same directory, so concurrent writers can't clobber
+// each other's partial files and the rename never crosses filesystems.
+fn write_atomically(path: &Path, data: &[u8]) -> io::Result<()> {
+    let path = match path.canonicalize() {
+        Ok(p) => p,
+        Err(e) if e.kind() == io::ErrorKind::NotFound => path.to_path_buf(),
+        Err(e) => return Err(e),
+    };
+
+    let dir = match path.parent() {
+        Some(d) if !d.as_os_str().is_empty() => d,
+        _ => Path::new("."),
+    };
+
+    let mut tmp = tempfile::NamedTempFile::new_in(dir)?;
+    tmp.write_all(data)?;
+    if let Ok(m) = fs::metadata(&path) {
+        fs::set_permissions(tmp.path(), m.permissions())?;
+    }
+    tmp.persist(&path).map(drop).map_err(|e| e.error)
+}
+
 type Result<T> = std::result::Result<T, Box<dyn std::error::Error>>;
 type Fut<T> = Pin<Box<dyn Future<Output = T>>>;
 
@@ -60,6 +92,8 @@ fn main() {
     }
 
     elapsedlogger::init_logging();
+    #[cfg(target_family = "unix")]
+    elapsedlogger::init_signals();
     if !config::init() {
         return;
     }
@@ -71,8 +105,11 @@ fn main() {
     let (gui_sender, gui_receiver) = glib::MainContext::channel(glib::PRIORITY_HIGH);
 
     closing::init(gui_sender.clone());
+    crash::init(gui_sender.clone());
 
     let sock_handle = socket::init(&gui_sender);
+    let web_handle = web::init(&gui_sender);
+    let script_handle = script::init(&gui_sender);
     let man_handle = manager::run_manager(manager_receiver, gui_sender);
 
     if let Err(e) = catch_unwind(AssertUnwindSafe(|| gui::run(manager_sender, gui_receiver))) {
@@ -105,4 +142,24 @@ fn main() {
             closing::close();
         }
     }
+
+    if let Some(h) = web_handle {
+        if let Err(e) = catch_unwind(AssertUnwindSafe(|| {
+            drop(h.join());
+        })) {
+            error!("Joining web server thread panicked unexpectedly: {:?}", e);
+
+            closing::close();
+        }
+    }
+
+    if let Some(h) = script_handle {
+        if let Err(e) = catch_unwind(AssertUnwindSafe(|| {
+            drop(h.join());
+        })) {
+            error!("Joining script thread panicked unexpectedly: {:?}", e);
+
+            closing::close();
+        }
+    }
 }
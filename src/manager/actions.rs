@@ -1,7 +1,14 @@
 use std::cmp::Ordering;
+use std::collections::hash_map::RandomState;
 use std::ffi::OsString;
+use std::hash::{BuildHasher, Hasher};
+use std::io;
+use std::path::{Path, PathBuf};
 use std::process;
+use std::time::{SystemTime, UNIX_EPOCH};
 
+use gtk::{gio, glib};
+use gtk::prelude::FileExt;
 use serde_json::Value;
 use tokio::{pin, select};
 
@@ -10,17 +17,26 @@ use super::indices::PageIndices;
 use super::{get_range, Manager};
 use crate::closing;
 use crate::com::Direction::{Absolute, Backwards, Forwards};
-use crate::com::{CommandResponder, Direction};
+use crate::com::{Annotation, CommandResponder, Direction, GuiAction, Modes};
+use crate::config::CONFIG;
 use crate::gui::WINDOW_ID;
 use crate::manager::archive::Archive;
+use crate::manager::files::{is_archive_path, is_supported_page_extension};
 use crate::manager::indices::AI;
-use crate::manager::{find_next, ManagerWork};
+use crate::manager::{find_next, progress, recent, shell, sorting, ManagerWork};
+use crate::pools::{cbz, trim};
 use crate::socket::SOCKET_PATH;
 
 pub(super) enum Action {
     Status,
     ListPages,
-    Execute(String),
+    PageInfo,
+    ListSiblings,
+    ListRecent,
+    ListAnnotations,
+    SetWallpaper,
+    ExportArchive(PathBuf),
+    Execute(String, Vec<String>),
 }
 
 impl Manager {
@@ -48,6 +64,99 @@ impl Manager {
         }
     }
 
+    // Jumps to a random page in the current archive other than the current one. Everything is
+    // preloaded relative to the new page, so moving on from there is sequential again.
+    pub(super) fn move_random_page(&mut self) {
+        let pc = self.current.archive().page_count();
+        if pc < 2 {
+            return;
+        }
+
+        let current = self.current.p().map_or(0, |p| p.0);
+        // rand is only a dev dependency, and randomly seeded hashers are good enough for this.
+        let mut p = (RandomState::new().build_hasher().finish() % (pc as u64 - 1)) as usize;
+        if p >= current {
+            p += 1;
+        }
+        self.set_current_page(self.current.move_clamped_in_archive(Absolute, p));
+    }
+
+    // Redoes all the work for the current page if it failed, or reopens the archive if it couldn't
+    // be opened at all.
+    pub(super) fn retry_page(&mut self) {
+        let archive = self.current.archive();
+        if archive.is_broken() {
+            let path = archive.path().to_path_buf();
+            drop(archive);
+            return self.open_archive(path, true);
+        }
+
+        let retried = match self.current.p() {
+            Some(p) => archive.retry_page(p, self.modes.upscaling),
+            None => false,
+        };
+        drop(archive);
+
+        if retried {
+            self.reset_indices();
+        } else {
+            Self::send_gui(&self.gui_sender, GuiAction::Osd("Nothing to retry".to_string()));
+        }
+    }
+
+    // Picks up pages added to or removed from the current directory, staying on the same page if
+    // it still exists.
+    pub(super) fn refresh_directory(&mut self) {
+        let mut archive = self.current.archive_mut();
+        let rel_path = self.current.p().map(|p| archive.page_rel_path(p));
+
+        let removed = match archive.refresh(self.modes.upscaling) {
+            Some(removed) => removed,
+            None => return,
+        };
+
+        tokio::task::spawn_local(async move {
+            for p in removed {
+                p.join().await;
+            }
+        });
+
+        let len = archive.page_count();
+        let p = match rel_path.and_then(|r| archive.find_page(&r)) {
+            Some(p) => Some(p),
+            // The current page was removed, so stay as close to where it was as possible.
+            None if len > 0 => Some(self.current.p().map_or(0, |p| p.0.min(len - 1))),
+            None => None,
+        };
+        drop(archive);
+
+        self.current = PageIndices::new(self.current.a().0, p, self.archives.clone());
+        self.reset_indices();
+    }
+
+    // Opens chapters that were downloaded after the last one was opened. Chapters that were still
+    // being written when they were opened will have failed, so they're opened again.
+    pub(super) fn refresh_series(&mut self) {
+        let mut changed = false;
+        loop {
+            let mut archives = self.archives.borrow_mut();
+            if self.current.a().0 + 1 == archives.len() || !archives.back().unwrap().is_broken() {
+                break;
+            }
+
+            let a = archives.pop_back().expect("Archive list out of sync");
+            debug!("Closing broken archive {:?}", a);
+            tokio::task::spawn_local(a.join());
+            changed = true;
+        }
+
+        let alen = self.archives.borrow().len();
+        self.maybe_open_new_archives();
+        if changed || self.archives.borrow().len() != alen {
+            self.reset_indices();
+        }
+    }
+
     pub(super) fn move_next_archive(&mut self) {
         let a = self.current.a();
         let alen = self.archives.borrow().len();
@@ -60,6 +169,37 @@ impl Manager {
         self.set_current_page(PageIndices::new(new_a, new_p, self.archives.clone()))
     }
 
+    // Moves to the first or last page of the first or last chapter in manga mode, or of the current
+    // archive otherwise. The chapters in between are skipped rather than opened one by one.
+    pub(super) fn move_series_end(&mut self, d: Direction) {
+        let archive = self.current.archive();
+        let ord = if d == Forwards { Ordering::Greater } else { Ordering::Less };
+        let end = if let Some(end) = self.playlist.end(archive.path(), ord) {
+            self.modes.manga.then(|| end.clone())
+        } else if self.modes.manga && archive.allow_multiple_archives() {
+            let trashing = self.trashing.borrow();
+            let mut siblings = find_next::siblings(archive.path())
+                .into_iter()
+                .filter(|s| !trashing.contains(s));
+            match d {
+                Absolute => unreachable!(),
+                Forwards => siblings.last(),
+                Backwards => siblings.next(),
+            }
+        } else {
+            None
+        };
+        let end = end.filter(|e| e != archive.path());
+        drop(archive);
+
+        if let Some(end) = end {
+            self.open_archive(end, false);
+        }
+
+        let p = if d == Forwards { usize::MAX } else { 0 };
+        self.set_current_page(self.current.move_clamped_in_archive(Absolute, p));
+    }
+
     pub(super) fn move_previous_archive(&mut self) {
         let a = self.current.a();
         if a == AI(0) && self.open_next_archive(Backwards, SortKeyCache::Empty).is_none() {
@@ -74,6 +214,150 @@ impl Manager {
         self.set_current_page(PageIndices::new(new_a, new_p, self.archives.clone()))
     }
 
+    // Replaces everything that is currently open with a new archive, starting from the saved
+    // page if resume is true.
+    pub(super) fn open_archive(&mut self, path: PathBuf, resume: bool) {
+        for a in self.replace_archives(path, resume) {
+            debug!("Closing archive {:?}", a);
+            tokio::task::spawn_local(a.join());
+        }
+    }
+
+    // Paths from commands and scripts are checked first, so a typo doesn't replace everything that
+    // was open with a broken archive.
+    pub(super) fn open_path(&mut self, path: PathBuf, resp: Option<CommandResponder>) {
+        if !path.exists() {
+            return respond_error(format!("{:?} does not exist", path), resp);
+        }
+
+        if !path.is_dir() && !is_archive_path(&path) && !is_supported_page_extension(&path) {
+            let e = format!("{:?} is not a supported archive, directory, or file", path);
+            return respond_error(e, resp);
+        }
+
+        self.open_archive(path, true);
+    }
+
+    pub(super) fn toggle_sort_by_time(&mut self) {
+        let msg = if sorting::toggle_by_time() {
+            "Sorting by modification time"
+        } else {
+            "Sorting by name"
+        };
+        Self::send_gui(&self.gui_sender, GuiAction::Osd(msg.to_string()));
+        self.reopen_archive();
+    }
+
+    pub(super) fn toggle_reverse_sort(&mut self) {
+        let msg = if sorting::toggle_reversed() {
+            "Sorting in reverse"
+        } else {
+            "Sorting normally"
+        };
+        Self::send_gui(&self.gui_sender, GuiAction::Osd(msg.to_string()));
+        self.reopen_archive();
+    }
+
+    // Reopens the current archive so a new sort order takes effect, staying on the same page.
+    // Sets of files keep the order they were opened in.
+    fn reopen_archive(&mut self) {
+        let archive = self.current.archive();
+        if archive.is_fileset() {
+            return;
+        }
+        let path = archive.path().to_path_buf();
+        let rel_path = self.current.p().map(|p| archive.page_rel_path(p));
+        drop(archive);
+
+        self.open_archive(path, false);
+
+        let p = rel_path.and_then(|r| self.current.archive().find_page(&r));
+        if p.is_some() {
+            self.set_current_page(PageIndices::new(self.current.a().0, p, self.archives.clone()));
+        }
+    }
+
+    // Opens path in place of every open archive, returning the old archives for the caller to
+    // close.
+    fn replace_archives(&mut self, path: PathBuf, resume: bool) -> Vec<Archive> {
+        let (a, p) = Archive::open(path.clone(), &self.temp_dir);
+        let p = if resume { progress::resume(&path, &a, p, false, &self.gui_sender) } else { p };
+
+        let old: Vec<_> = self.archives.borrow_mut().drain(..).collect();
+        self.archives.borrow_mut().push_back(a);
+        self.current = PageIndices::new(0, p, self.archives.clone());
+        self.reset_indices();
+        self.maybe_open_new_archives();
+        old
+    }
+
+    // Moves the current archive to the trash and opens the next one, or the previous one if it
+    // was the last.
+    pub(super) fn trash_archive(&mut self, resp: Option<CommandResponder>) {
+        let archive = self.current.archive();
+        if archive.is_fileset() {
+            return respond_error("Can't trash a set of individual files".to_string(), resp);
+        }
+        let path = archive.path().to_path_buf();
+        drop(archive);
+
+        let next = find_next::for_path(&path, Ordering::Greater, SortKeyCache::Empty)
+            .or_else(|| find_next::for_path(&path, Ordering::Less, SortKeyCache::Empty));
+        let next = match next {
+            Some((next, _)) => next,
+            None => {
+                let e = format!("No other archive to open after trashing {:?}", path);
+                return respond_error(e, resp);
+            }
+        };
+
+        self.trashing.borrow_mut().push(path.clone());
+        let old = self.replace_archives(next, true);
+        let gui_sender = self.gui_sender.clone();
+        let trashing = self.trashing.clone();
+
+        tokio::task::spawn_local(async move {
+            // Wait until nothing is still reading from it.
+            for a in old {
+                a.join().await;
+            }
+
+            let p = path.clone();
+            let trashed = tokio::task::spawn_blocking(move || {
+                gio::File::for_path(&p).trash(gio::Cancellable::NONE).map_err(|e| e.to_string())
+            })
+            .await
+            .unwrap_or_else(|e| Err(e.to_string()));
+            trashing.borrow_mut().retain(|t| *t != path);
+
+            match trashed {
+                Ok(_) => {
+                    info!("Moved {:?} to the trash", path);
+                    let name = path.file_name().unwrap_or(path.as_os_str()).to_string_lossy();
+                    Self::send_gui(&gui_sender, GuiAction::Osd(format!("Trashed {}", name)));
+                }
+                Err(e) => respond_error(format!("Failed to trash {:?}: {}", path, e), resp),
+            }
+        });
+    }
+
+    // Queues every page of the current archive for upscaling, turning upscaling on if needed.
+    pub(super) fn upscale_archive(&mut self) {
+        let archive = self.current.archive();
+        let msg = format!("Upscaling all {} pages of {}", archive.page_count(), archive.name());
+        self.upscale_archive = Some(archive.path().to_path_buf());
+        drop(archive);
+
+        info!("{}", msg);
+        Self::send_gui(&self.gui_sender, GuiAction::Osd(msg));
+
+        if !self.modes.upscaling {
+            self.modes.upscaling = true;
+            self.maybe_open_new_archives();
+        }
+        self.reset_indices();
+    }
+
     fn set_current_page(&mut self, pi: PageIndices) {
         if self.current == pi {
             self.reset_indices();
@@ -82,10 +366,28 @@ impl Manager {
         let oldc = self.current.clone();
         self.current = pi;
         self.reset_indices();
+        if self.modes.manga && oldc.a() != self.current.a() {
+            self.check_chapter_gap(&oldc);
+        }
         self.cleanup_after_move(oldc);
     }
 
+    // Warn about missing chapters so they aren't silently skipped.
+    fn check_chapter_gap(&self, oldc: &PageIndices) {
+        let old = find_next::chapter_number(oldc.archive().path());
+        let new = find_next::chapter_number(self.current.archive().path());
+
+        if let (Some(old), Some(new)) = (old, new) {
+            if (new.floor() - old.floor()).abs() > 1.0 {
+                let msg = format!("Gap: Ch. {} → Ch. {}", old, new);
+                warn!("{}", msg);
+                Self::send_gui(&self.gui_sender, GuiAction::Osd(msg));
+            }
+        }
+    }
+
     pub(super) fn reset_indices(&mut self) {
+        self.over_budget = false;
         self.finalize = Some(self.current.clone());
         self.downscale = Some(self.current.clone());
         self.load = Some(self.current.clone());
@@ -101,13 +403,16 @@ impl Manager {
         };
 
         let a = ai.archive();
-        if !a.allow_multiple_archives() {
+        if !a.allow_multiple_archives() && !self.playlist.contains(a.path()) {
             return None;
         }
 
         let path = a.path();
 
-        let (next, cache) = find_next::for_path(path, ord, cache)?;
+        let (mut next, mut cache) = self.next_path(path, ord, cache)?;
+        while self.trashing.borrow().contains(&next) {
+            (next, cache) = self.next_path(&next, ord, cache)?;
+        }
         drop(a);
 
         let (a, _) = Archive::open(next, &self.temp_dir);
@@ -123,17 +428,72 @@ impl Manager {
         Some(cache)
     }
 
+    // Archives in the playlist are followed by the next entry in the playlist, not by their
+    // siblings.
+    fn next_path(
+        &mut self,
+        path: &Path,
+        ord: Ordering,
+        cache: SortKeyCache,
+    ) -> Option<(PathBuf, SortKeyCache)> {
+        match self.playlist.next(path, ord) {
+            Some(next) => next.map(|n| (n.clone(), cache)),
+            None => find_next::for_path(path, ord, cache),
+        }
+    }
+
     pub(super) fn cleanup_after_move(&mut self, oldc: PageIndices) {
-        let load_range = get_range(ManagerWork::Load);
+        let load_range = get_range(ManagerWork::Load, self.modes);
         let unloaditer = oldc.diff_range_with_new(&self.current, &load_range);
 
         for pi in unloaditer.into_iter().flatten() {
             pi.unload();
         }
 
+        if let Some(p) = self.current.p() {
+            let archive = self.current.archive();
+            self.progress.record(&archive, p);
+        }
+
+        if self.modes.low_memory {
+            self.idle_unload();
+        }
+
         // TODO -- cleanup upscales too, subject to a wider range.
         self.maybe_open_new_archives();
         self.cleanup_unused_archives();
+        trim::schedule();
+    }
+
+    // Pages are shown upscaled under the same rule whether they're the current page or not.
+    fn mark_upscaled(&self, info: &mut Value) {
+        let upscaled = self.upscaled_current() && info.get("upscaled_path").is_some();
+        info.as_object_mut().unwrap().insert("upscaled".to_string(), upscaled.into());
+    }
+
+    // The preload window depends on the modes, so pages preloaded under the old modes that are
+    // outside the new window are unloaded when they change.
+    pub(super) fn cleanup_after_mode_change(&mut self, old: Modes) {
+        let old_range = get_range(ManagerWork::Load, old);
+        let new_range = get_range(ManagerWork::Load, self.modes);
+
+        let behind = (new_range.start().unsigned_abs(), old_range.start().unsigned_abs());
+        let ahead = (new_range.end().unsigned_abs(), old_range.end().unsigned_abs());
+        for (d, (kept, preloaded)) in [(Backwards, behind), (Forwards, ahead)] {
+            let mut unload = self.current.try_move_pages(d, kept + 1);
+            for _ in kept..preloaded {
+                match unload.take() {
+                    Some(pi) => {
+                        pi.unload();
+                        unload = pi.try_move_pages(d, 1);
+                    }
+                    None => break,
+                }
+            }
+        }
+
+        self.cleanup_unused_archives();
+        trim::schedule();
     }
 
     pub(super) fn maybe_open_new_archives(&mut self) {
@@ -146,9 +506,9 @@ impl Manager {
         self.maybe_send_gui_state();
 
         let load_range = if self.modes.upscaling {
-            get_range(ManagerWork::Upscale)
+            get_range(ManagerWork::Upscale, self.modes)
         } else {
-            get_range(ManagerWork::Load)
+            get_range(ManagerWork::Load, self.modes)
         };
 
         if self.current.try_move_pages(Forwards, load_range.end().unsigned_abs()).is_none() {
@@ -165,9 +525,9 @@ impl Manager {
 
     fn cleanup_unused_archives(&mut self) {
         let load_range = if self.modes.upscaling {
-            get_range(ManagerWork::Upscale)
+            get_range(ManagerWork::Upscale, self.modes)
         } else {
-            get_range(ManagerWork::Load)
+            get_range(ManagerWork::Load, self.modes)
         };
 
         let mut start_a =
@@ -220,9 +580,10 @@ impl Manager {
         .for_each(PageIndices::decrement_archive)
     }
 
-    fn get_env(&self) -> Vec<(String, OsString)> {
+    pub(super) fn get_env(&self) -> Vec<(String, OsString)> {
         let mut env = self.current.archive().get_env(self.current.p());
         env.push(("AWMAN_PID".into(), process::id().to_string().into()));
+        env.push(("AWMAN_TEMP_DIR".into(), self.temp_dir.path().into()));
         env.push((
             "AWMAN_DISPLAY_MODE".into(),
             self.modes.display.to_string().to_lowercase().into(),
@@ -230,6 +591,13 @@ impl Manager {
         env.push(("AWMAN_FIT_MODE".into(), self.modes.fit.to_string().to_lowercase().into()));
         env.push(("AWMAN_MANGA_MODE".into(), self.modes.manga.to_string().into()));
         env.push(("AWMAN_UPSCALING_ENABLED".into(), self.modes.upscaling.to_string().into()));
+        env.push(("AWMAN_LOW_MEMORY".into(), self.modes.low_memory.to_string().into()));
+
+        let progress = self.reading_progress();
+        env.push(("AWMAN_PROGRESS".into(), progress.archive.to_string().into()));
+        if let Some(series) = progress.series {
+            env.push(("AWMAN_SERIES_PROGRESS".into(), series.to_string().into()));
+        }
 
         if let Some(wid) = WINDOW_ID.get() {
             env.push(("AWMAN_WINDOW".into(), wid.into()))
@@ -242,6 +610,30 @@ impl Manager {
         env
     }
 
+    pub(super) fn annotate(&self, a: Annotation, resp: Option<CommandResponder>) {
+        let archive = self.current.archive();
+        let r = match self.current.p() {
+            Some(p) => self.annotations.add(archive.path(), archive.page_rel_path(p), a),
+            None => Err("No current page to annotate".to_string()),
+        };
+
+        if let Err(e) = r {
+            respond_error(e, resp);
+        }
+    }
+
+    pub(super) fn clear_annotations(&self, resp: Option<CommandResponder>) {
+        let archive = self.current.archive();
+        let r = match self.current.p() {
+            Some(p) => self.annotations.clear(archive.path(), &archive.page_rel_path(p)),
+            None => Err("No current page to clear annotations from".to_string()),
+        };
+
+        if let Err(e) = r {
+            respond_error(e, resp);
+        }
+    }
+
     pub(super) fn handle_command(&self, action: Action, resp: Option<CommandResponder>) {
         match action {
             Action::Status => {
@@ -260,7 +652,8 @@ impl Manager {
             }
             Action::ListPages => {
                 if let Some(resp) = resp {
-                    let list = self.current.archive().list_pages();
+                    let mut list = self.current.archive().list_pages();
+                    list.iter_mut().for_each(|info| self.mark_upscaled(info));
                     if let Err(e) = resp.send(Value::Array(list)) {
                         error!("Unexpected error sending page list to receiver: {:?}", e);
                     }
@@ -268,19 +661,280 @@ impl Manager {
                     warn!("Received Status command but had no way to respond.");
                 }
             }
-            Action::Execute(cmd) => {
-                tokio::task::spawn_local(execute(cmd, self.get_env(), resp));
+            Action::PageInfo => {
+                let p = match self.current.p() {
+                    Some(p) => p,
+                    None => return respond_error("No current page".to_string(), resp),
+                };
+
+                if let Some(resp) = resp {
+                    let mut info = self.current.archive().page_info(p);
+                    self.mark_upscaled(&mut info);
+                    if let Err(e) = resp.send(info) {
+                        error!("Unexpected error sending page info to receiver: {:?}", e);
+                    }
+                } else {
+                    warn!("Received PageInfo command but had no way to respond.");
+                }
+            }
+            Action::ListSiblings => {
+                if let Some(resp) = resp {
+                    let list = find_next::siblings(self.current.archive().path())
+                        .into_iter()
+                        .map(|p| p.to_string_lossy().into())
+                        .collect();
+                    if let Err(e) = resp.send(Value::Array(list)) {
+                        error!("Unexpected error sending sibling list to receiver: {:?}", e);
+                    }
+                } else {
+                    warn!("Received ListSiblings command but had no way to respond.");
+                }
+            }
+            Action::ListRecent => {
+                if let Some(resp) = resp {
+                    let list = recent::list()
+                        .into_iter()
+                        .map(|p| p.to_string_lossy().into())
+                        .collect();
+                    if let Err(e) = resp.send(Value::Array(list)) {
+                        error!("Unexpected error sending recent list to receiver: {:?}", e);
+                    }
+                } else {
+                    warn!("Received ListRecent command but had no way to respond.");
+                }
+            }
+            Action::ListAnnotations => {
+                if let Some(resp) = resp {
+                    let list = self.annotations.list(self.current.archive().path());
+                    if let Err(e) = resp.send(list) {
+                        error!("Unexpected error sending annotations to receiver: {:?}", e);
+                    }
+                } else {
+                    warn!("Received ListAnnotations command but had no way to respond.");
+                }
+            }
+            Action::SetWallpaper => {
+                let env = self.get_env();
+                let find = |k: &str| env.iter().find(|(ek, _)| ek == k).map(|(_, v)| v.into());
+                let file: Option<PathBuf> = if self.modes.upscaling {
+                    find("AWMAN_UPSCALED_FILE").or_else(|| find("AWMAN_CURRENT_FILE"))
+                } else {
+                    find("AWMAN_CURRENT_FILE")
+                };
+
+                let file = match file {
+                    Some(f) => f,
+                    None => return respond_error("The current page isn't ready yet".into(), resp),
+                };
+
+                // Anything in the temp directory is deleted on exit, so it needs to be copied.
+                let temporary = file.starts_with(self.temp_dir.path());
+                tokio::task::spawn_local(set_wallpaper(file, temporary, resp));
+            }
+            Action::ExportArchive(dest) => {
+                let archive = self.current.archive();
+                if archive.is_broken() {
+                    return respond_error(format!("Can't export {}", archive.name()), resp);
+                }
+
+                let (files, extracted) = match archive.export_files(self.modes.upscaling) {
+                    Ok(f) => f,
+                    Err(e) => return respond_error(e, resp),
+                };
+
+                let dest = if dest.is_dir() {
+                    let name: OsString = if archive.is_directory() {
+                        archive.name().into()
+                    } else {
+                        archive.path().file_stem().unwrap_or_default().to_owned()
+                    };
+                    let mut name = PathBuf::from(name);
+                    name.set_extension("cbz");
+                    dest.join(name)
+                } else {
+                    dest
+                };
+                drop(archive);
+
+                tokio::task::spawn_local(async move {
+                    extracted.await;
+                    export_archive(files, dest, resp).await;
+                });
+            }
+            Action::Execute(cmd, args) => {
+                let env = self.get_env();
+                match command_line(&cmd, args, &env) {
+                    Ok((exe, args)) => {
+                        tokio::task::spawn_local(execute(exe, args, env, resp));
+                    }
+                    Err(e) => respond_error(e, resp),
+                }
+            }
+        }
+    }
+}
+
+// Wallpaper setters that can be found from the environment, for when none is configured.
+fn wallpaper_commands(path: &Path) -> Result<Vec<(OsString, Vec<OsString>)>, String> {
+    if let Some(cmd) = &CONFIG.wallpaper_command {
+        return Ok(vec![(cmd.into(), vec![path.into()])]);
+    }
+
+    if cfg!(target_family = "windows") {
+        return Err("Set wallpaper_command to set wallpapers on Windows".into());
+    }
+
+    if std::env::var_os("SWAYSOCK").is_some() {
+        let args = ["output", "*", "bg"].into_iter().map(OsString::from);
+        let args = args.chain([path.into(), "fit".into()]).collect();
+        return Ok(vec![("swaymsg".into(), args)]);
+    }
+
+    let desktop = std::env::var("XDG_CURRENT_DESKTOP").unwrap_or_default().to_lowercase();
+    if desktop.contains("gnome") || desktop.contains("unity") {
+        let uri = glib::filename_to_uri(path, None)
+            .map_err(|e| format!("Failed to convert {:?} to a URI: {}", path, e))?;
+        return Ok(["picture-uri", "picture-uri-dark"]
+            .into_iter()
+            .map(|key| {
+                let args = ["set", "org.gnome.desktop.background", key, uri.as_str()];
+                ("gsettings".into(), args.into_iter().map(Into::into).collect())
+            })
+            .collect());
+    }
+
+    Ok(vec![("feh".into(), vec!["--bg-max".into(), path.into()])])
+}
+
+async fn set_wallpaper(file: PathBuf, temporary: bool, resp: Option<CommandResponder>) {
+    let path = if temporary {
+        let dir = match &CONFIG.state_directory {
+            Some(d) => d.join("wallpapers"),
+            None => {
+                return respond_error(
+                    "state_directory must be set to use pages from archives as wallpapers".into(),
+                    resp,
+                );
+            }
+        };
+
+        // Most desktops won't notice a change if the file name stays the same.
+        drop(tokio::fs::remove_dir_all(&dir).await);
+        let ext = file.extension().unwrap_or_default().to_string_lossy();
+        let secs = SystemTime::now().duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs());
+        let path = dir.join(format!("wallpaper-{}.{}", secs, ext));
+
+        let copied = async {
+            tokio::fs::create_dir_all(&dir).await?;
+            tokio::fs::copy(&file, &path).await
+        };
+        if let Err(e) = copied.await {
+            return respond_error(format!("Failed to copy {:?} for wallpaper: {:?}", file, e), resp);
+        }
+        path
+    } else {
+        file
+    };
+
+    let commands = match wallpaper_commands(&path) {
+        Ok(c) => c,
+        Err(e) => return respond_error(e, resp),
+    };
+
+    for (cmd, args) in commands {
+        match tokio::process::Command::new(&cmd).args(args).output().await {
+            Ok(output) if output.status.success() => {}
+            Ok(output) => {
+                return respond_error(
+                    format!(
+                        "Setting wallpaper with {:?} failed: {}",
+                        cmd,
+                        String::from_utf8_lossy(&output.stderr).trim()
+                    ),
+                    resp,
+                );
+            }
+            Err(e) => {
+                return respond_error(format!("Failed to run {:?}: {:?}", cmd, e), resp);
+            }
+        }
+    }
+
+    info!("Set wallpaper to {:?}", path);
+}
+
+async fn export_archive(
+    files: Vec<(PathBuf, PathBuf)>,
+    dest: PathBuf,
+    resp: Option<CommandResponder>,
+) {
+    let d = dest.clone();
+    let n = files.len();
+    let written = tokio::task::spawn_blocking(move || cbz::write(&files, &d)).await;
+
+    match written {
+        Ok(Ok(())) => {
+            info!("Exported {} pages to {:?}", n, dest);
+            if let Some(resp) = resp {
+                drop(resp.send(serde_json::json!({ "path": dest.to_string_lossy() })));
+            }
+        }
+        Ok(Err(e)) => {
+            // Don't leave a truncated archive behind, but never remove a file that was already
+            // there.
+            if e.kind() != io::ErrorKind::AlreadyExists {
+                drop(tokio::fs::remove_file(&dest).await);
             }
+            respond_error(format!("Failed to export to {:?}: {}", dest, e), resp);
         }
+        Err(e) => respond_error(format!("Failed to export to {:?}: {:?}", dest, e), resp),
     }
 }
 
+pub(super) fn respond_error(e: String, resp: Option<CommandResponder>) {
+    error!("{}", e);
+    if let Some(resp) = resp {
+        let mut m = serde_json::Map::new();
+        m.insert("error".into(), e.into());
+        drop(resp.send(Value::Object(m)));
+    }
+}
+
+// Splits an Execute command into the executable and its arguments, with substitutions applied.
+// Any extra arguments, like the text entered in a prompt, are passed after the parsed ones.
+pub(super) fn command_line(
+    cmd: &str,
+    extra: Vec<String>,
+    env: &[(String, OsString)],
+) -> Result<(String, Vec<OsString>), String> {
+    // A path to an existing executable is run as-is, even if it contains spaces or quotes.
+    if Path::new(cmd).is_file() {
+        return Ok((cmd.to_string(), extra.into_iter().map(OsString::from).collect()));
+    }
+
+    let mut words = shell::split(cmd)?.into_iter();
+    let exe = match words.next() {
+        Some(exe) if !exe.is_empty() => exe,
+        _ => return Err(format!("No executable in {:?}", cmd)),
+    };
+
+    let mut args = words.map(|w| shell::substitute(&w, env)).collect::<Result<Vec<_>, _>>()?;
+    args.extend(extra.into_iter().map(OsString::from));
+    Ok((exe, args))
+}
+
 #[cfg(target_family = "windows")]
 const CREATE_NO_WINDOW: u32 = 0x08000000;
 
-async fn execute(cmdstr: String, env: Vec<(String, OsString)>, resp: Option<CommandResponder>) {
+pub(super) async fn execute(
+    cmdstr: String,
+    args: Vec<OsString>,
+    env: Vec<(String, OsString)>,
+    resp: Option<CommandResponder>,
+) {
     let mut m = serde_json::Map::new();
     let mut cmd = tokio::process::Command::new(cmdstr.clone());
+    cmd.args(args);
 
     #[cfg(target_family = "windows")]
     cmd.creation_flags(CREATE_NO_WINDOW);
@@ -0,0 +1,139 @@
+// Annotations are stored as one sidecar JSON file per archive in the state directory.
+// The files are named after a hash of the archive's absolute path so that they survive the
+// archive being reopened, but not moved.
+
+use std::cell::RefCell;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use ahash::AHashMap;
+use serde::{Deserialize, Serialize};
+use serde_json::Value;
+
+use crate::com::Annotation;
+use crate::config::CONFIG;
+use crate::write_atomically;
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+struct ArchiveAnnotations {
+    archive: PathBuf,
+    // Keyed by the path of the page relative to the root of the archive.
+    pages: BTreeMap<String, Vec<Annotation>>,
+}
+
+#[derive(Debug, Default)]
+pub(super) struct Annotations {
+    // Lazily loaded, since this is read every time the Gui state is built.
+    cache: RefCell<AHashMap<PathBuf, ArchiveAnnotations>>,
+}
+
+// FNV-1a, used because it is stable across runs and platforms, unlike the hashers in std.
+pub(super) fn path_hash(path: &Path) -> u64 {
+    path.to_string_lossy().bytes().fold(0xcbf2_9ce4_8422_2325, |h, b| {
+        (h ^ u64::from(b)).wrapping_mul(0x0000_0100_0000_01b3)
+    })
+}
+
+fn sidecar_path(state_dir: &Path, archive: &Path) -> PathBuf {
+    state_dir.join("annotations").join(format!("{:016x}.json", path_hash(archive)))
+}
+
+fn load(state_dir: &Path, archive: &Path) -> ArchiveAnnotations {
+    let empty = || ArchiveAnnotations {
+        archive: archive.to_path_buf(),
+        pages: BTreeMap::new(),
+    };
+
+    let sidecar = sidecar_path(state_dir, archive);
+    let data = match fs::read(&sidecar) {
+        Ok(data) => data,
+        Err(_) => return empty(),
+    };
+
+    match serde_json::from_slice::<ArchiveAnnotations>(&data) {
+        Ok(a) if a.archive == archive => a,
+        Ok(a) => {
+            error!("Annotation file {:?} belongs to {:?}, not {:?}", sidecar, a.archive, archive);
+            empty()
+        }
+        Err(e) => {
+            error!("Failed to parse annotation file {:?}: {:?}", sidecar, e);
+            empty()
+        }
+    }
+}
+
+fn save(state_dir: &Path, annotations: &ArchiveAnnotations) -> Result<(), String> {
+    let sidecar = sidecar_path(state_dir, &annotations.archive);
+    let dir = sidecar.parent().expect("Impossible");
+    fs::create_dir_all(dir)
+        .map_err(|e| format!("Failed to create annotation directory {:?}: {:?}", dir, e))?;
+
+    let data = serde_json::to_vec_pretty(annotations)
+        .map_err(|e| format!("Failed to serialize annotations: {:?}", e))?;
+
+    write_atomically(&sidecar, &data)
+        .map_err(|e| format!("Failed to write annotation file {:?}: {:?}", sidecar, e))
+}
+
+impl Annotations {
+    pub(super) fn get(&self, archive: &Path, page: &str) -> Vec<Annotation> {
+        let state_dir = match &CONFIG.state_directory {
+            Some(d) => d,
+            None => return Vec::new(),
+        };
+
+        let mut cache = self.cache.borrow_mut();
+        let aa = cache
+            .entry(archive.to_path_buf())
+            .or_insert_with(|| load(state_dir, archive));
+
+        aa.pages.get(page).cloned().unwrap_or_default()
+    }
+
+    pub(super) fn add(&self, archive: &Path, page: String, a: Annotation) -> Result<(), String> {
+        self.modify(archive, |aa| aa.pages.entry(page).or_default().push(a))
+    }
+
+    pub(super) fn clear(&self, archive: &Path, page: &str) -> Result<(), String> {
+        self.modify(archive, |aa| {
+            aa.pages.remove(page);
+        })
+    }
+
+    pub(super) fn list(&self, archive: &Path) -> Value {
+        let state_dir = match &CONFIG.state_directory {
+            Some(d) => d,
+            None => return Value::Object(serde_json::Map::new()),
+        };
+
+        let mut cache = self.cache.borrow_mut();
+        let aa = cache
+            .entry(archive.to_path_buf())
+            .or_insert_with(|| load(state_dir, archive));
+
+        serde_json::to_value(&aa.pages).unwrap_or_else(|e| {
+            error!("Failed to serialize annotations: {:?}", e);
+            Value::Null
+        })
+    }
+
+    fn modify<F>(&self, archive: &Path, f: F) -> Result<(), String>
+    where
+        F: FnOnce(&mut ArchiveAnnotations),
+    {
+        let state_dir = CONFIG
+            .state_directory
+            .as_ref()
+            .ok_or("Annotations require state_directory to be set")?;
+
+        let mut cache = self.cache.borrow_mut();
+        let aa = cache
+            .entry(archive.to_path_buf())
+            .or_insert_with(|| load(state_dir, archive));
+
+        f(aa);
+        save(state_dir, aa)
+    }
+}
@@ -0,0 +1,178 @@
+// A persistent cache of extracted pages, so moving back and forth between chapters doesn't extract
+// them again every time. Each archive gets its own directory keyed by its path, size, and
+// modification time, and whole archives are evicted, least recently used first.
+
+use std::collections::hash_map::Entry;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use ahash::AHashMap;
+use once_cell::sync::Lazy;
+
+use crate::config::CONFIG;
+use crate::pools::conversions::fnv64;
+use crate::spawn_thread;
+
+// Rewritten every time the archive is opened or closed, so its modification time orders evictions.
+const SOURCE: &str = "source";
+
+// Archives used this recently are never evicted. Another instance sharing the cache can't tell
+// this one which archives it has open, so this keeps their directories from being deleted while
+// they're being read.
+const GRACE_PERIOD: Duration = Duration::from_secs(60 * 60);
+
+// Only one thread should be evicting at once.
+static EVICTION: Lazy<Mutex<()>> = Lazy::new(Mutex::default);
+
+// Directories of archives open in this process, counted since the same archive can be open in
+// more than one tab.
+static OPEN: Lazy<Mutex<AHashMap<PathBuf, usize>>> = Lazy::new(Mutex::default);
+
+// A cache directory for an open archive. It won't be evicted until this is dropped.
+pub(super) struct CacheDir(PathBuf);
+
+impl CacheDir {
+    pub(super) fn path(&self) -> &Path {
+        &self.0
+    }
+}
+
+impl Drop for CacheDir {
+    fn drop(&mut self) {
+        let mut open = OPEN.lock().expect("Poisoned");
+        if let Entry::Occupied(mut e) = open.entry(self.0.clone()) {
+            *e.get_mut() -= 1;
+            if *e.get() == 0 {
+                e.remove();
+            }
+        }
+        drop(open);
+
+        // The grace period starts again from when the archive was last read.
+        touch_source(&self.0, None);
+    }
+}
+
+fn touch_source(dir: &Path, source: Option<&Path>) -> bool {
+    let written = match source {
+        Some(source) => fs::write(dir.join(SOURCE), source.to_string_lossy().as_bytes()),
+        None => fs::read(dir.join(SOURCE)).and_then(|s| fs::write(dir.join(SOURCE), s)),
+    };
+
+    if let Err(e) = written {
+        error!("Failed to update extraction cache directory {:?}: {:?}", dir, e);
+        return false;
+    }
+    true
+}
+
+// Returns the directory to extract the archive into, if the cache is enabled.
+pub(super) fn open(path: &Path) -> Option<CacheDir> {
+    let root = CONFIG.extraction_cache.as_ref()?;
+
+    let meta = match fs::metadata(path) {
+        Ok(m) => m,
+        Err(e) => {
+            error!("Failed to stat {:?} for the extraction cache: {:?}", path, e);
+            return None;
+        }
+    };
+    let modified = meta
+        .modified()
+        .ok()
+        .and_then(|m| m.duration_since(UNIX_EPOCH).ok())
+        .map_or(0, |d| d.as_nanos());
+
+    let key = fnv64(path.to_string_lossy().as_bytes());
+    let dir = root.join(format!("{:016x}-{:x}-{:x}", key, meta.len(), modified));
+
+    // Registered before it's created so a concurrent eviction can't remove it in between.
+    *OPEN.lock().expect("Poisoned").entry(dir.clone()).or_default() += 1;
+    let dir = CacheDir(dir);
+
+    if let Err(e) = fs::create_dir_all(dir.path()) {
+        error!("Failed to create extraction cache directory {:?}: {:?}", dir.path(), e);
+        return None;
+    }
+    if !touch_source(dir.path(), Some(path)) {
+        return None;
+    }
+
+    spawn_thread("cache-eviction", evict);
+    Some(dir)
+}
+
+// Pages are named after their paths, not their positions, since the sort order can change.
+pub(super) fn page_path(dir: &Path, rel_path: &Path, ext: &str) -> PathBuf {
+    dir.join(format!("{:016x}.{}", fnv64(rel_path.to_string_lossy().as_bytes()), ext))
+}
+
+// Removes the least recently used archives until the cache fits within extraction_cache_size.
+// Archives that are open or were used within the grace period are left alone, even if that keeps
+// the cache over its limit.
+fn evict() {
+    let root = match &CONFIG.extraction_cache {
+        Some(r) => r,
+        None => return,
+    };
+    let limit = CONFIG.extraction_cache_size.saturating_mul(1024 * 1024);
+
+    let _guard = match EVICTION.try_lock() {
+        Ok(g) => g,
+        // Someone else is already evicting.
+        Err(_) => return,
+    };
+
+    let entries = match fs::read_dir(root) {
+        Ok(e) => e,
+        Err(e) => return error!("Failed to read extraction cache {:?}: {:?}", root, e),
+    };
+
+    let mut archives: Vec<(SystemTime, u64, PathBuf)> = entries
+        .filter_map(|e| {
+            let dir = e.ok()?.path();
+            if !dir.is_dir() {
+                return None;
+            }
+
+            // A directory another instance only just created may not have a source file yet.
+            let used = fs::metadata(dir.join(SOURCE))
+                .or_else(|_| fs::metadata(&dir))
+                .and_then(|m| m.modified());
+            let size = fs::read_dir(&dir)
+                .ok()?
+                .filter_map(|f| f.ok()?.metadata().ok())
+                .map(|m| m.len())
+                .sum();
+            Some((used.unwrap_or(UNIX_EPOCH), size, dir))
+        })
+        .collect();
+
+    let mut total: u64 = archives.iter().map(|a| a.1).sum();
+    if total <= limit {
+        return;
+    }
+
+    let recent = SystemTime::now() - GRACE_PERIOD;
+
+    archives.sort_unstable();
+    for (used, size, dir) in archives {
+        if total <= limit || used > recent {
+            break;
+        }
+
+        // Held until the directory is gone so it can't be reopened while it's being removed.
+        let open = OPEN.lock().expect("Poisoned");
+        if open.contains_key(&dir) {
+            continue;
+        }
+
+        match fs::remove_dir_all(&dir) {
+            Ok(_) => total -= size,
+            Err(e) => error!("Failed to evict cached archive {:?}: {:?}", dir, e),
+        }
+    }
+    debug!("Evicted old archives, extraction cache is now {} bytes", total);
+}
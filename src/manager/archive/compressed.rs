@@ -10,13 +10,14 @@ use futures_util::FutureExt;
 use tempfile::TempDir;
 use tokio::sync::oneshot;
 
-use super::Archive;
-use crate::config::CONFIG;
+use super::{cache, Archive};
 use crate::manager::archive::page::{ExtractFuture, Page};
 use crate::manager::archive::{
     remove_common_path_prefix, ExtractionStatus, PageExtraction, PendingExtraction,
 };
 use crate::manager::files::is_supported_page_extension;
+use crate::manager::sorting;
+use crate::pools::loading;
 use crate::{natsort, unrar};
 
 pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (PathBuf, String)> {
@@ -31,12 +32,16 @@ pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (
 
 
     let pages = read_files_in_archive(&path)?;
+    let cache_dir = cache::open(&path);
 
     // Try to find any common path-based prefix and remove them.
     let (mut pages, _) = remove_common_path_prefix(pages);
 
     // Sort by natural order
     pages.sort_by_cached_key(|(_, name)| natsort::key(OsStr::new(name)));
+    if sorting::reversed() {
+        pages.reverse();
+    }
 
     let mut ext_map = AHashMap::new();
 
@@ -44,15 +49,13 @@ pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (
         .into_iter()
         .enumerate()
         .map(|(index, (rel_path, name))| {
-            let (page, completion) =
-                build_new_page(rel_path.clone(), name, index, &temp_dir, &jump_sender);
-
-            let ext_path = page.borrow().get_absolute_file_path().to_path_buf();
+            let cache_dir = cache_dir.as_ref().map(cache::CacheDir::path);
+            let (page, extraction) =
+                build_new_page(rel_path.clone(), name, index, &temp_dir, cache_dir, &jump_sender);
 
-            ext_map.insert(
-                rel_path.to_string_lossy().to_string(),
-                PageExtraction { ext_path, completion },
-            );
+            if let Some(extraction) = extraction {
+                ext_map.insert(rel_path.to_string_lossy().to_string(), extraction);
+            }
             page
         })
         .collect();
@@ -73,8 +76,10 @@ pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (
         name: archive_name,
         path,
         kind: super::Kind::Compressed(ExtractionStatus::Unextracted(Some(pe))),
+        next_index: pages.len(),
         pages,
         temp_dir: Some(temp_dir),
+        _cache_dir: cache_dir,
     })
 }
 
@@ -83,13 +88,23 @@ fn build_new_page(
     name: String,
     index: usize,
     temp_dir: &Rc<TempDir>,
+    cache_dir: Option<&Path>,
     jump_queue: &Rc<flume::Sender<String>>,
-) -> (RefCell<Page>, oneshot::Sender<Result<(), String>>) {
+) -> (RefCell<Page>, Option<PageExtraction>) {
     let ext = rel_path
         .extension()
         .expect("Path with supported extension has no extension")
         .to_string_lossy();
-    let ext_path = temp_dir.path().join(format!("{}.{}", index, ext));
+
+    let ext_path = match cache_dir {
+        Some(dir) => cache::page_path(dir, &rel_path, &ext),
+        None => temp_dir.path().join(format!("{}.{}", index, ext)),
+    };
+
+    if cache_dir.is_some() && ext_path.is_file() {
+        let page = Page::new_cached(ext_path, rel_path, name, index, temp_dir.clone(), None);
+        return (RefCell::new(page), None);
+    }
 
     let (s, r) = oneshot::channel();
 
@@ -101,38 +116,46 @@ fn build_new_page(
         })
         .boxed();
 
+    let (data, data_receiver) = if loading::can_scan_data(&rel_path) {
+        let (ds, dr) = oneshot::channel();
+        (Some(ds), Some(dr))
+    } else {
+        (None, None)
+    };
+
     let ext_fut = ExtractFuture {
         fut,
         jump_queue: Some(jump_queue.clone()),
+        data: data_receiver,
+    };
+
+    let extraction = PageExtraction {
+        ext_path: ext_path.clone(),
+        completion: s,
+        data,
     };
 
-    (
-        RefCell::new(Page::new_extracted(
-            ext_path,
-            rel_path,
-            name,
-            index,
-            temp_dir.clone(),
-            ext_fut,
-        )),
-        s,
-    )
+    let page = if cache_dir.is_some() {
+        Page::new_cached(ext_path, rel_path, name, index, temp_dir.clone(), Some(ext_fut))
+    } else {
+        Page::new_extracted(ext_path, rel_path, name, index, temp_dir.clone(), ext_fut)
+    };
+
+    (RefCell::new(page), Some(extraction))
 }
 
 fn read_files_in_archive(path: &Path) -> std::result::Result<Vec<PathBuf>, (PathBuf, String)> {
-    if let Some(ext) = path.extension() {
-        let ext = ext.to_ascii_lowercase();
-
-        if (ext == "rar" || ext == "cbr") && CONFIG.allow_external_extractors && *unrar::HAS_UNRAR {
-            return unrar::read_files(path)
-                .map(|vec| {
-                    vec.into_iter()
-                        .map(|(s, _)| s)
-                        .filter(|name| is_supported_page_extension(&name))
-                        .map(Into::into)
-                        .collect()
-                })
-                .map_err(|e| (path.to_owned(), e.to_string()));
+    if unrar::can_use(path) {
+        match unrar::read_files(path) {
+            Ok(files) => {
+                return Ok(files
+                    .into_iter()
+                    .map(|(s, _)| s)
+                    .filter(|name| is_supported_page_extension(&name))
+                    .map(Into::into)
+                    .collect());
+            }
+            Err(e) => warn!("unrar failed to list {:?}, falling back to libarchive: {}", path, e),
         }
     }
 
@@ -150,7 +173,12 @@ fn read_files_in_archive(path: &Path) -> std::result::Result<Vec<PathBuf>, (Path
     let files = match compress_tools::list_archive_files(source) {
         Ok(names) => names,
         Err(e) => {
-            let s = format!("Failed to open archive {:?}: {:?}", path, e);
+            let s = format!(
+                "Failed to open archive {:?}: {:?}.{}",
+                path,
+                e,
+                unrar::libarchive_failure_hint(path)
+            );
             error!("{}", s);
             return Err((path.to_owned(), s));
         }
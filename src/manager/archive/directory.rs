@@ -1,9 +1,10 @@
 use std::cell::RefCell;
 use std::fs;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::rc::Rc;
-use std::time::Instant;
+use std::time::{Instant, SystemTime};
 
+use ahash::AHashMap;
 use rayon::iter::{IntoParallelIterator, ParallelBridge, ParallelIterator};
 use rayon::slice::ParallelSliceMut;
 use tempfile::TempDir;
@@ -11,58 +12,50 @@ use tempfile::TempDir;
 use super::page::Page;
 use super::Archive;
 use crate::manager::files::is_supported_page_extension;
+use crate::manager::sorting;
 use crate::natsort::ParsedString;
 
-pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (PathBuf, String)> {
+// Returns the absolute path, relative path, and name of every page in the directory, in order.
+fn read_pages(path: &Path) -> Result<Vec<(PathBuf, PathBuf, String)>, String> {
     // TODO -- maybe support recursion, but it will naturally be slower.
     // Probably save time by only statting files without an extension.
-    let start = Instant::now();
+    let files = fs::read_dir(path).map_err(|e| {
+        let s = format!("Failed to read files from directory {:?}: {:?}", path, e);
+        error!("{}", s);
+        s
+    })?;
 
     // Use a small temporary pool for sorting and converting. Making it too large increases
     // fragmentation for little benefit.
     let pool = rayon::ThreadPoolBuilder::new().num_threads(8).build().unwrap();
 
-    trace!("Started reading directory {:?}", path);
-
-    let files = fs::read_dir(&path);
-    let files = match files {
-        Ok(fs) => fs,
-        Err(e) => {
-            let s = format!("Failed to read files from directory {:?}: {:?}", path, e);
-            error!("{}", s);
-            return Err((path, s));
-        }
-    };
-
-    let temp_dir = Rc::from(temp_dir);
-
-    let name = path
-        .file_name()
-        .map_or_else(|| "".to_string(), |p| p.to_string_lossy().to_string());
-
-    let pages: Vec<_> = pool.install(|| {
-        let mut pages: Vec<(PathBuf, ParsedString)> = files
+    let pages = pool.install(|| {
+        let mut pages: Vec<(PathBuf, ParsedString, Option<SystemTime>)> = files
             .par_bridge()
             .filter_map(|rd| {
                 let de = rd.ok()?;
 
-                let filepath = de.path();
-                let filepath = filepath.strip_prefix(&path).ok()?;
+                let abs_path = de.path();
+                let filepath = abs_path.strip_prefix(path).ok()?;
 
                 // Especially in a large directory we don't want to waste time sniffing mime types.
                 if is_supported_page_extension(filepath) {
-                    Some((filepath.to_owned(), de.file_name().into()))
+                    let modified = sorting::modified(&abs_path);
+                    Some((filepath.to_owned(), de.file_name().into(), modified))
                 } else {
                     None
                 }
             })
             .collect();
 
-        pages.par_sort_by(|(_, a), (_, b)| a.cmp(b));
+        pages.par_sort_by(|(_, a, am), (_, b, bm)| am.cmp(bm).then_with(|| a.cmp(b)));
+        if sorting::reversed() {
+            pages.reverse();
+        }
 
         pages
             .into_par_iter()
-            .map(|(rel_path, name)| {
+            .map(|(rel_path, name, _)| {
                 (
                     path.join(&rel_path),
                     rel_path,
@@ -72,7 +65,26 @@ pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (
             .collect()
     });
 
-    let pages = pages
+    drop(pool);
+    Ok(pages)
+}
+
+pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (PathBuf, String)> {
+    let start = Instant::now();
+    trace!("Started reading directory {:?}", path);
+
+    let pages = match read_pages(&path) {
+        Ok(pages) => pages,
+        Err(s) => return Err((path, s)),
+    };
+
+    let temp_dir = Rc::from(temp_dir);
+
+    let name = path
+        .file_name()
+        .map_or_else(|| "".to_string(), |p| p.to_string_lossy().to_string());
+
+    let pages: Vec<_> = pages
         .into_iter()
         .enumerate()
         .map(|(i, (abs_path, rel_path, name))| {
@@ -80,14 +92,60 @@ pub(super) fn new_archive(path: PathBuf, temp_dir: TempDir) -> Result<Archive, (
         })
         .collect();
 
-    drop(pool);
     trace!("Finished reading directory {:?} {:?}", path, start.elapsed());
 
     Ok(Archive {
         name,
         path,
         kind: super::Kind::Directory,
+        next_index: pages.len(),
         pages,
         temp_dir: Some(temp_dir),
+        _cache_dir: None,
     })
 }
+
+// Rereads the directory, keeping the pages that are still there and adding new ones in order.
+// Returns the removed pages, or None if nothing changed.
+pub(super) fn refresh(archive: &mut Archive) -> Option<Vec<Page>> {
+    let files = read_pages(&archive.path).ok()?;
+    let temp_dir = archive.temp_dir.clone()?;
+
+    let unchanged = files.len() == archive.pages.len()
+        && files
+            .iter()
+            .zip(&archive.pages)
+            .all(|((_, rel_path, _), p)| p.borrow().get_rel_path() == rel_path);
+    if unchanged {
+        return None;
+    }
+
+    let mut old: AHashMap<PathBuf, RefCell<Page>> = archive
+        .pages
+        .drain(..)
+        .map(|p| (p.borrow().get_rel_path().clone(), p))
+        .collect();
+
+    let mut added = 0;
+    archive.pages = files
+        .into_iter()
+        .map(|(abs_path, rel_path, name)| {
+            old.remove(&rel_path).unwrap_or_else(|| {
+                // Temporary files are named after indices, so they can never be reused.
+                let index = archive.next_index;
+                archive.next_index += 1;
+                added += 1;
+                RefCell::new(Page::new_original(abs_path, rel_path, name, index, temp_dir.clone()))
+            })
+        })
+        .collect();
+
+    debug!(
+        "Refreshed directory {:?}: {} pages, {} added, {} removed",
+        archive.path,
+        archive.pages.len(),
+        added,
+        old.len()
+    );
+    Some(old.into_values().map(RefCell::into_inner).collect())
+}
@@ -36,7 +36,9 @@ pub(super) fn new_fileset(paths: Vec<PathBuf>, temp_dir: TempDir) -> Archive {
         name: archive_name,
         path: prefix.unwrap_or_default(),
         kind: super::Kind::FileSet,
+        next_index: pages.len(),
         pages,
         temp_dir: Some(temp_dir),
+        _cache_dir: None,
     }
 }
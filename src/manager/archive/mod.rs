@@ -17,8 +17,10 @@ use super::files::is_supported_page_extension;
 use crate::com::{Displayable, WorkParams};
 use crate::manager::indices::PI;
 use crate::natsort;
+use crate::Fut;
 use crate::pools::extracting::{self, OngoingExtraction};
 
+mod cache;
 mod compressed;
 mod directory;
 mod fileset;
@@ -80,6 +82,11 @@ impl Work {
         self.params().map_or(false, |lp| lp.extract_early)
     }
 
+    // Scans that aren't needed for loading a page are the most speculative work there is.
+    fn distance(&self) -> usize {
+        self.params().map_or(usize::MAX, |lp| lp.distance)
+    }
+
     const fn load_during_scan(&self) -> bool {
         !self.upscale()
     }
@@ -88,6 +95,9 @@ impl Work {
 pub struct PageExtraction {
     pub ext_path: PathBuf,
     pub completion: oneshot::Sender<Result<(), String>>,
+    // Receives the contents of pages that are extracted early so they can be decoded from memory
+    // while they're written out. Only set for formats that can be.
+    pub data: Option<oneshot::Sender<Vec<u8>>>,
 }
 
 pub struct PendingExtraction {
@@ -127,7 +137,11 @@ pub struct Archive {
     path: PathBuf,
     kind: Kind,
     pages: Vec<RefCell<Page>>,
+    // Page indices name temporary files, so pages added later need fresh ones.
+    next_index: usize,
     temp_dir: Option<Rc<TempDir>>,
+    // Keeps the extraction cache directory from being evicted while the archive is open.
+    _cache_dir: Option<cache::CacheDir>,
 }
 
 fn new_broken(path: PathBuf, error: String) -> Archive {
@@ -141,7 +155,9 @@ fn new_broken(path: PathBuf, error: String) -> Archive {
         path,
         kind: Kind::Broken(error),
         pages: Vec::default(),
+        next_index: 0,
         temp_dir: None,
+        _cache_dir: None,
     }
 }
 
@@ -284,10 +300,28 @@ impl Archive {
         }
     }
 
+    // Filesets are arbitrary collections of images, so there's nothing meaningful to resume.
+    pub(super) const fn remembers_progress(&self) -> bool {
+        match self.kind {
+            Kind::Compressed(_) | Kind::Directory => true,
+            Kind::Broken(_) | Kind::FileSet => false,
+        }
+    }
+
+    pub(super) fn find_page(&self, rel_path: &str) -> Option<usize> {
+        self.pages
+            .iter()
+            .position(|p| p.borrow().get_rel_path().to_string_lossy() == rel_path)
+    }
+
     pub(super) fn path(&self) -> &Path {
         &self.path
     }
 
+    pub(super) fn page_rel_path(&self, p: PI) -> String {
+        self.get_page(p).borrow().get_rel_path().to_string_lossy().to_string()
+    }
+
     pub(super) fn get_displayable(&self, p: Option<PI>, upscaling: bool) -> (Displayable, String) {
         if let Kind::Broken(e) = &self.kind {
             return (Displayable::Error(e.clone()), "".to_string());
@@ -308,6 +342,37 @@ impl Archive {
         }
     }
 
+    pub(super) const fn is_fileset(&self) -> bool {
+        matches!(self.kind, Kind::FileSet)
+    }
+
+    pub(super) const fn is_broken(&self) -> bool {
+        matches!(self.kind, Kind::Broken(_))
+    }
+
+    pub(super) const fn is_directory(&self) -> bool {
+        matches!(self.kind, Kind::Directory)
+    }
+
+    // Rereads a directory from disk. Returns the pages that were removed, which must be joined,
+    // or None if nothing changed.
+    pub(super) fn refresh(&mut self, upscaling: bool) -> Option<Vec<Page>> {
+        if !self.is_directory() {
+            return None;
+        }
+
+        // Pages that failed may have been read while they were still being written.
+        let retried =
+            self.pages.iter().filter(|p| p.borrow_mut().retry(&self.path, upscaling)).count() > 0;
+
+        directory::refresh(self).or_else(|| retried.then(Vec::new))
+    }
+
+    // Resets the page if it failed so it'll be extracted and loaded again.
+    pub(super) fn retry_page(&self, p: PI, upscaling: bool) -> bool {
+        self.get_page(p).borrow_mut().retry(&self.path, upscaling)
+    }
+
     pub(super) fn has_work(&self, p: PI, work: Work) -> bool {
         match self.kind {
             Kind::Compressed(Unextracted(_) | Extracting(_)) | Kind::Directory | Kind::FileSet => {}
@@ -338,6 +403,18 @@ impl Archive {
         self.get_page(p).borrow_mut().unload()
     }
 
+    // Returns the bytes held by a page and when it was last used, unless it's busy.
+    pub(super) fn memory_usage(&self, p: PI) -> Option<(usize, u64)> {
+        let page = self.get_page(p).try_borrow().ok()?;
+        Some((page.memory_size(), page.last_used()))
+    }
+
+    pub(super) fn touch(&self, p: PI, now: u64) {
+        if let Ok(mut page) = self.get_page(p).try_borrow_mut() {
+            page.touch(now);
+        }
+    }
+
     fn get_page(&self, p: PI) -> &RefCell<Page> {
         self.pages.get(p.0).unwrap_or_else(|| {
             panic!("Tried to get non-existent page {:?} in archive {:?}", p, self)
@@ -377,8 +454,13 @@ impl Archive {
     }
 
     pub(super) fn get_env(&self, p: Option<PI>) -> Vec<(String, OsString)> {
-        let mut env =
-            if let Some(p) = p { self.get_page(p).borrow().get_env() } else { Vec::new() };
+        let mut env = if let Some(p) = p {
+            let mut env = self.get_page(p).borrow().get_env();
+            env.push(("AWMAN_PAGE_NUMBER".into(), (p.0 + 1).to_string().into()));
+            env
+        } else {
+            Vec::new()
+        };
 
         env.push(("AWMAN_ARCHIVE".into(), self.path.clone().into()));
 
@@ -393,8 +475,70 @@ impl Archive {
         env
     }
 
+    // Used for crash reports, so this must never panic.
+    pub(super) fn debug_pages(&self) -> String {
+        self.pages
+            .iter()
+            .enumerate()
+            .map(|(i, p)| match p.try_borrow() {
+                Ok(p) => format!("  {} {:?}\n", i, p),
+                Err(_) => format!("  {} borrowed\n", i),
+            })
+            .collect()
+    }
+
+    pub(super) fn page_info(&self, p: PI) -> Value {
+        self.page_info_inner(p, true)
+    }
+
+    fn page_info_inner(&self, p: PI, with_size: bool) -> Value {
+        let mut info = self.get_page(p).borrow().page_info(with_size);
+        // One-indexed like page numbers everywhere else.
+        info["index"] = (p.0 + 1).into();
+        info
+    }
+
+    // Every page's file and name, in order, upscaled where available if requested, and a future
+    // that resolves once any pages still being extracted have been written out.
+    pub(super) fn export_files(
+        &self,
+        upscaled: bool,
+    ) -> Result<(Vec<(PathBuf, PathBuf)>, Fut<()>), String> {
+        let extracted: Fut<()> = match &self.kind {
+            Kind::Compressed(Unextracted(_)) => {
+                return Err(format!("{} hasn't started extracting yet", self.name));
+            }
+            Kind::Compressed(Extracting(ext)) => Box::pin(ext.finished()),
+            Kind::Directory | Kind::FileSet | Kind::Broken(_) => Box::pin(future::ready(())),
+        };
+
+        let names: AHashSet<PathBuf> =
+            self.pages.iter().map(|p| p.borrow().get_rel_path().clone()).collect();
+
+        let files = self
+            .pages
+            .iter()
+            .map(|p| {
+                let p = p.borrow();
+                let (file, mut name) = p.export_file(upscaled);
+                // An upscaled 001.jpg would replace 001.png, so keep the original extension too.
+                if name != *p.get_rel_path() && names.contains(&name) {
+                    let mut n = p.get_rel_path().clone().into_os_string();
+                    if let Some(ext) = name.extension() {
+                        n.push(".");
+                        n.push(ext);
+                    }
+                    name = n.into();
+                }
+                (file, name)
+            })
+            .collect();
+
+        Ok((files, extracted))
+    }
+
     pub(super) fn list_pages(&self) -> Vec<Value> {
-        self.pages.iter().map(|p| p.borrow().page_info()).collect()
+        (0..self.pages.len()).map(|i| self.page_info_inner(PI(i), false)).collect()
     }
 }
 
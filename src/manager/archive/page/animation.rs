@@ -45,6 +45,10 @@ impl Animation {
         }
     }
 
+    pub(super) const fn original_res(&self) -> Res {
+        self.original_res
+    }
+
     pub(super) fn get_displayable(&self) -> Displayable {
         match &self.state {
             Unloaded | Loading(_) => Displayable::Pending(self.original_res),
@@ -96,6 +100,10 @@ impl Animation {
                 self.state = Loaded(ai);
                 trace!("Finished loading {:?}", self);
             }
+            Err(e) if e == loading::PREEMPTED => {
+                self.state = Unloaded;
+                trace!("Load preempted for {:?}", self);
+            }
             Err(e) => self.state = Failed(e),
         }
     }
@@ -113,6 +121,13 @@ impl Animation {
         }
     }
 
+    pub(super) fn memory_size(&self) -> usize {
+        match &self.state {
+            Loaded(ai) => ai.memory_size(),
+            Unloaded | Loading(_) | Failed(_) => 0,
+        }
+    }
+
     pub(super) fn unload(&mut self) {
         match &mut self.state {
             Unloaded | Failed(_) => (),
@@ -1,7 +1,7 @@
 use std::ffi::OsString;
 use std::fmt::{self, Debug};
 use std::future;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::rc::Rc;
 
 use futures_util::FutureExt;
@@ -14,6 +14,7 @@ use State::*;
 use self::scanned::ScannedPage;
 use super::Work;
 use crate::com::Displayable;
+use crate::pools::extracting;
 use crate::pools::loading::{self, ScanFuture};
 use crate::Fut;
 
@@ -26,6 +27,8 @@ mod video;
 pub struct ExtractFuture {
     pub fut: Fut<Result<(), String>>,
     pub jump_queue: Option<Rc<flume::Sender<String>>>,
+    // Receives the contents of the page if it's extracted early.
+    pub data: Option<tokio::sync::oneshot::Receiver<Vec<u8>>>,
 }
 
 // A Page represents a single "page" in the archive, even if that page is animated or a video.
@@ -61,6 +64,8 @@ enum Origin {
     Extracted(Rc<PathBuf>),
     // Contains the absolute path of the file.
     Original(Rc<PathBuf>),
+    // Contains the absolute path of the file in the extraction cache, which outlives the archive.
+    Cached(Rc<PathBuf>),
 }
 
 pub(super) struct Page {
@@ -70,6 +75,9 @@ pub(super) struct Page {
     state: State,
     index: usize,
     temp_dir: Rc<TempDir>,
+    // When this page was last visited or first seen loaded, for evicting under memory_budget.
+    // Zero when nothing is loaded.
+    last_used: u64,
 }
 
 impl Page {
@@ -87,6 +95,27 @@ impl Page {
             state: Unscanned,
             index,
             temp_dir,
+            last_used: 0,
+        }
+    }
+
+    // Pages in the extraction cache may still need to be extracted into it.
+    pub fn new_cached(
+        cached_path: PathBuf,
+        rel_path: PathBuf,
+        name: String,
+        index: usize,
+        temp_dir: Rc<TempDir>,
+        extract_future: Option<ExtractFuture>,
+    ) -> Self {
+        Self {
+            name,
+            origin: Origin::Cached(Rc::from(cached_path)),
+            rel_path,
+            state: extract_future.map_or(Unscanned, Extracting),
+            index,
+            temp_dir,
+            last_used: 0,
         }
     }
 
@@ -105,6 +134,7 @@ impl Page {
             state: Extracting(extract_future),
             index,
             temp_dir,
+            last_used: 0,
         }
     }
 
@@ -115,6 +145,12 @@ impl Page {
             Failed(e) => Displayable::Error(e.clone()),
         };
 
+        // Name the page, since the error is drawn in its place and may not be the current page.
+        let d = match d {
+            Displayable::Error(e) => Displayable::Error(format!("{}: {}", self.name, e)),
+            d => d,
+        };
+
         (d, self.name.clone())
     }
 
@@ -135,21 +171,37 @@ impl Page {
 
         match &mut self.state {
             Extracting(f) => {
-                let b = (&mut f.fut).await;
+                let data = match f.data.take() {
+                    Some(data) => select! {
+                        biased;
+                        b = &mut f.fut => Err(b),
+                        d = data => Ok(d.ok()),
+                    },
+                    None => Ok(None),
+                };
+
+                let b = match data {
+                    Ok(Some(data)) => {
+                        return self.start_scanning_data(data, work);
+                    }
+                    Ok(None) => (&mut f.fut).await,
+                    Err(b) => b,
+                };
+
                 match b {
                     Ok(_) => {
                         self.state = Unscanned;
                         // Since waiting for extraction isn't one of the tracked units of work, we
                         // know for a fact we can try to scan the file now.
-                        self.start_scanning(work.load_during_scan()).await
+                        self.start_scanning(work).await
                     }
                     Err(e) => {
                         error!("Failed to extract page {:?}: {}", self, e);
-                        self.state = Failed("Failed to extract page.".to_string());
+                        self.state = Failed(format!("Failed to extract page: {}", e));
                     }
                 }
             }
-            Unscanned => self.start_scanning(work.load_during_scan()).await,
+            Unscanned => self.start_scanning(work).await,
             Scanning(f) => {
                 assert_ne!(work, Work::Scan);
 
@@ -170,7 +222,7 @@ impl Page {
         }
     }
 
-    async fn start_scanning(&mut self, load: bool) {
+    async fn start_scanning(&mut self, work: Work) {
         let p = self.get_absolute_file_path();
         // This clone could be prevented with an Arc but this otherwise enforces that these paths
         // have a single strong owner.
@@ -178,11 +230,28 @@ impl Page {
         // Could delay this until it's really necessary but not worth it.
         let converted_path = self.temp_dir.path().join(format!("{}c.png", self.index));
 
-        let f = loading::scan(p, converted_path, load).await;
+        let f = loading::scan(p, converted_path, work.load_during_scan(), work.distance()).await;
         self.state = Scanning(f);
         trace!("Started scanning {:?}", self);
     }
 
+    // Decodes the page from memory while it's still being written out, instead of waiting to read
+    // it back from disk.
+    fn start_scanning_data(&mut self, data: Vec<u8>, work: Work) {
+        let written = match std::mem::replace(&mut self.state, Unscanned) {
+            Extracting(f) => f.fut,
+            Unscanned | Scanning(_) | Scanned(_) | Failed(_) => unreachable!(),
+        };
+
+        let p = (**self.get_absolute_file_path()).clone();
+        let converted_path = self.temp_dir.path().join(format!("{}c.png", self.index));
+
+        let load = work.load_during_scan();
+        self.state =
+            Scanning(loading::scan_data(p, data, converted_path, load, work.distance(), written));
+        trace!("Started scanning {:?} from memory", self);
+    }
+
     pub async fn join(self) {
         let written = match self.state {
             Extracting(f) => f.fut.await.is_ok(),
@@ -207,7 +276,62 @@ impl Page {
         }
     }
 
+    pub(super) fn memory_size(&self) -> usize {
+        match &self.state {
+            Scanned(s) => s.memory_size(),
+            Extracting(_) | Unscanned | Scanning(_) | Failed(_) => 0,
+        }
+    }
+
+    pub(super) const fn last_used(&self) -> u64 {
+        self.last_used
+    }
+
+    pub(super) fn touch(&mut self, now: u64) {
+        self.last_used = now;
+    }
+
+    // Resets a page that failed to extract, scan, load, or upscale so all of its work is redone.
+    // Returns false if the page hadn't failed.
+    pub(super) fn retry(&mut self, source: &Path, upscaling: bool) -> bool {
+        let failed = match &self.state {
+            Failed(_) => true,
+            Scanned(s) => matches!(s.get_displayable(upscaling), Displayable::Error(_)),
+            Extracting(_) | Unscanned | Scanning(_) => false,
+        };
+        if !failed {
+            return false;
+        }
+
+        self.last_used = 0;
+        let fut = match std::mem::replace(&mut self.state, Unscanned) {
+            // The old page owns the converted and upscaled files, so they need to be cleaned up
+            // before they're written again.
+            Scanned(s) => async move {
+                s.join().await;
+                Ok(())
+            }
+            .boxed_local(),
+            Failed(_) => match &self.origin {
+                Origin::Extracted(p) | Origin::Cached(p) if !p.exists() => {
+                    extracting::extract_again(
+                        source.to_path_buf(),
+                        self.rel_path.to_string_lossy().to_string(),
+                        (**p).clone(),
+                    )
+                }
+                Origin::Extracted(_) | Origin::Cached(_) | Origin::Original(_) => return true,
+            },
+            Extracting(_) | Unscanned | Scanning(_) => unreachable!(),
+        };
+
+        // Extracting is the only state that waits on arbitrary work before scanning.
+        self.state = Extracting(ExtractFuture { fut, jump_queue: None, data: None });
+        true
+    }
+
     pub fn unload(&mut self) {
+        self.last_used = 0;
         match &mut self.state {
             Extracting(_) | Unscanned | Failed(_) => (),
             Scanning(i) => {
@@ -222,7 +346,7 @@ impl Page {
 
     pub(super) const fn get_absolute_file_path(&self) -> &Rc<PathBuf> {
         match &self.origin {
-            Origin::Extracted(p) | Origin::Original(p) => p,
+            Origin::Extracted(p) | Origin::Original(p) | Origin::Cached(p) => p,
         }
     }
 
@@ -230,11 +354,25 @@ impl Page {
         &self.rel_path
     }
 
+    // The file to put in an exported archive for this page and its name there. Upscaled files keep
+    // the page's name but use their own extension. Pages that are still extracting will be written
+    // to the same file, so it's only safe to read once extraction has finished.
+    pub(super) fn export_file(&self, upscaled: bool) -> (PathBuf, PathBuf) {
+        if let (true, Scanned(s)) = (upscaled, &self.state) {
+            if let Some(u) = s.upscaled_file() {
+                let mut name = self.rel_path.clone();
+                if let Some(ext) = u.extension() {
+                    name.set_extension(ext);
+                }
+                return ((**u).clone(), name);
+            }
+        }
+
+        ((**self.get_absolute_file_path()).clone(), self.rel_path.clone())
+    }
+
     pub(super) fn get_env(&self) -> Vec<(String, OsString)> {
-        let mut e = vec![
-            ("AWMAN_PAGE_NUMBER".into(), (self.index + 1).to_string().into()),
-            ("AWMAN_RELATIVE_FILE_PATH".into(), self.rel_path.clone().into()),
-        ];
+        let mut e = vec![("AWMAN_RELATIVE_FILE_PATH".into(), self.rel_path.clone().into())];
 
         match self.state {
             Extracting(_) | Failed(_) => (),
@@ -244,25 +382,63 @@ impl Page {
             )),
         }
 
+        if let Scanned(s) = &self.state {
+            if let Some(u) = s.upscaled_file() {
+                e.push(("AWMAN_UPSCALED_FILE".into(), u.as_os_str().to_owned()));
+            }
+        }
+
         e
     }
 
-    pub(super) fn page_info(&self) -> Value {
-        // TODO
+    // Looking up the file size touches the disk, so it's only done for a single page at a time.
+    pub(super) fn page_info(&self, with_size: bool) -> Value {
+        let state = match self.state {
+            Extracting(_) => "extracting",
+            Unscanned => "extracted",
+            Scanning(_) => "scanning",
+            Scanned(_) => "scanned",
+            Failed(_) => "failed",
+        };
+
         let mut val = json!({
+            "name": self.name,
             "path": self.rel_path.to_string_lossy(),
+            "state": state,
         });
+        let obj = val.as_object_mut().unwrap();
+
+        if let Failed(e) = &self.state {
+            obj.insert("error".to_string(), e.clone().into());
+        }
+
+        if let Some(ext) = self.rel_path.extension() {
+            obj.insert("format".to_string(), ext.to_string_lossy().to_lowercase().into());
+        }
 
         match self.state {
             Extracting(_) | Failed(_) => (),
             Unscanned | Scanning(_) | Scanned(_) => {
-                val.as_object_mut().unwrap().insert(
-                    "abs_path".to_string(),
-                    Value::String(self.get_absolute_file_path().to_string_lossy().to_string()),
-                );
+                let abs_path = self.get_absolute_file_path();
+                obj.insert("abs_path".to_string(), abs_path.to_string_lossy().into());
+                if with_size {
+                    if let Ok(m) = std::fs::metadata(&**abs_path) {
+                        obj.insert("size".to_string(), m.len().into());
+                    }
+                }
             }
         };
 
+        if let Scanned(s) = &self.state {
+            if let Some(res) = s.original_res() {
+                obj.insert("width".to_string(), res.w.into());
+                obj.insert("height".to_string(), res.h.into());
+            }
+            if let Some(u) = s.upscaled_file() {
+                obj.insert("upscaled_path".to_string(), u.to_string_lossy().into());
+            }
+        }
+
         val
     }
 }
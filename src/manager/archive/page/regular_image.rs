@@ -2,6 +2,7 @@ use core::fmt;
 use std::path::PathBuf;
 use std::rc::Weak;
 
+use tokio::select;
 use State::*;
 
 use crate::com::{Displayable, Image, ImageWithRes, Res, WorkParams};
@@ -15,6 +16,10 @@ use crate::Fut;
 enum State {
     Unloaded,
     Loading(LoadFuture<UnscaledImage, WorkParams>),
+    // Waiting on both the full load and a fast, low resolution preview.
+    Previewing(LoadFuture<UnscaledImage, WorkParams>, LoadFuture<Option<Image>, WorkParams>),
+    // Unlike Reloading, the preview is never good enough to be kept.
+    Preview(LoadFuture<UnscaledImage, WorkParams>, Image),
     Reloading(LoadFuture<UnscaledImage, WorkParams>, Image),
     Scaling(DownscaleFuture<Image, WorkParams>, UnscaledImage),
     Loaded(UnscaledImage),
@@ -56,10 +61,15 @@ impl RegularImage {
         }
     }
 
+    pub(super) const fn original_res(&self) -> Res {
+        self.original_res
+    }
+
     pub(super) fn get_displayable(&self) -> Displayable {
         match &self.state {
-            Unloaded | Loading(_) => Displayable::Pending(self.original_res),
+            Unloaded | Loading(_) | Previewing(..) => Displayable::Pending(self.original_res),
             Reloading(_, img)
+            | Preview(_, img)
             | Loaded(UnscaledImage(img))
             | Scaling(_, UnscaledImage(img))
             | Scaled(img) => {
@@ -81,7 +91,7 @@ impl RegularImage {
 
         match &self.state {
             Unloaded => true,
-            Loading(_) | Reloading(..) => {
+            Loading(_) | Reloading(..) | Previewing(..) | Preview(..) => {
                 // TODO -- change this when "downscaling"/premultiplying isn't required.
                 work.downscale()
                 // In theory the scaled image from "Reloading" could satisfy this, in practice it's
@@ -143,12 +153,42 @@ impl RegularImage {
         let s_fut;
         match &mut self.state {
             Unloaded => {
+                // Start the preview first so it isn't stuck behind the full load.
+                let pf = loading::static_image::preview(&path, t_params);
                 let lf = loading::static_image::load(path, t_params).await;
-                self.state = Loading(lf);
+                self.state = match pf {
+                    Some(pf) => Previewing(lf, pf),
+                    None => Loading(lf),
+                };
                 trace!("Started loading {:?}", self);
                 return;
             }
-            Loading(lf) => {
+            Previewing(lf, pf) => {
+                let low_memory = lf.params().low_memory;
+                let preview = select! {
+                    biased;
+                    r = &mut lf.fut => {
+                        chain_last_load(&mut self.last_load, pf.cancel());
+                        self.finish_load(r, low_memory);
+                        return;
+                    }
+                    r = &mut pf.fut => r,
+                };
+
+                let lf = match std::mem::replace(&mut self.state, Unloaded) {
+                    Previewing(lf, _) => lf,
+                    _ => unreachable!(),
+                };
+
+                // Errors have already been logged and the full load may still succeed.
+                self.state = match preview {
+                    Ok(Some(img)) => Preview(lf, img),
+                    Ok(None) | Err(_) => Loading(lf),
+                };
+                trace!("Finished preview for {:?}", self);
+                return;
+            }
+            Loading(lf) | Preview(lf, _) => {
                 l_fut = Some(lf);
                 s_fut = None;
             }
@@ -201,13 +241,11 @@ impl RegularImage {
         }
 
         match (l_fut, s_fut) {
-            (Some(lf), None) => match (&mut lf.fut).await {
-                Ok(uimg) => {
-                    self.state = Loaded(uimg);
-                    trace!("Finished loading {:?}", self);
-                }
-                Err(e) => self.state = Failed(e),
-            },
+            (Some(lf), None) => {
+                let low_memory = lf.params().low_memory;
+                let r = (&mut lf.fut).await;
+                self.finish_load(r, low_memory);
+            }
             (None, Some(sf)) => match (&mut sf.fut).await {
                 Ok(simg) => {
                     self.state = Scaled(simg);
@@ -219,11 +257,38 @@ impl RegularImage {
         }
     }
 
+    fn finish_load(&mut self, r: Result<UnscaledImage, String>, low_memory: bool) {
+        match r {
+            // Low memory loads are scaled as they're loaded and the original is never kept, so
+            // they can only be replaced by loading the file again.
+            Ok(UnscaledImage(img)) if low_memory && img.res != self.original_res => {
+                self.state = Scaled(img);
+                trace!("Finished loading {:?}", self);
+            }
+            Ok(uimg) => {
+                self.state = Loaded(uimg);
+                trace!("Finished loading {:?}", self);
+            }
+            Err(e) if e == loading::PREEMPTED => {
+                self.state = match &self.state {
+                    Reloading(_, simg) => Scaled(simg.clone()),
+                    _ => Unloaded,
+                };
+                trace!("Load preempted for {:?}", self);
+            }
+            Err(e) => self.state = Failed(e),
+        }
+    }
+
     pub(super) async fn join(self) {
         match self.state {
             Unloaded | Loaded(_) | Failed(_) | Scaled(_) => (),
-            Loading(mut lf) | Reloading(mut lf, _) => {
+            Loading(mut lf) | Reloading(mut lf, _) | Preview(mut lf, _) => {
+                lf.cancel().await;
+            }
+            Previewing(mut lf, mut pf) => {
                 lf.cancel().await;
+                pf.cancel().await;
             }
             Scaling(mut sf, _) => sf.cancel().await,
         }
@@ -233,6 +298,17 @@ impl RegularImage {
         }
     }
 
+    pub(super) fn memory_size(&self) -> usize {
+        match &self.state {
+            Unloaded | Loading(_) | Previewing(..) | Failed(_) => 0,
+            Reloading(_, img)
+            | Preview(_, img)
+            | Loaded(UnscaledImage(img))
+            | Scaling(_, UnscaledImage(img))
+            | Scaled(img) => img.memory_size(),
+        }
+    }
+
     pub(super) fn unload(&mut self) {
         match &mut self.state {
             Unloaded | Failed(_) => (),
@@ -245,8 +321,14 @@ impl RegularImage {
                 self.state = Unloaded;
                 trace!("Unloaded {:?}", self);
             }
-            Reloading(lf, _) => {
+            Reloading(lf, _) | Preview(lf, _) => {
+                chain_last_load(&mut self.last_load, lf.cancel());
+                self.state = Unloaded;
+                trace!("Unloaded {:?}", self);
+            }
+            Previewing(lf, pf) => {
                 chain_last_load(&mut self.last_load, lf.cancel());
+                chain_last_load(&mut self.last_load, pf.cancel());
                 self.state = Unloaded;
                 trace!("Unloaded {:?}", self);
             }
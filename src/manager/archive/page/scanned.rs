@@ -98,6 +98,21 @@ impl ScannedPage {
         Self { kind, converted_file }
     }
 
+    pub(super) const fn original_res(&self) -> Option<Res> {
+        match &self.kind {
+            Image(r, _) | UnupscaledImage(r) => Some(r.original_res()),
+            Animation(a) => Some(a.original_res()),
+            Video(_) | Invalid(_) => None,
+        }
+    }
+
+    pub(super) fn upscaled_file(&self) -> Option<&Rc<PathBuf>> {
+        match &self.kind {
+            Image(_, u) => u.upscaled_file(),
+            UnupscaledImage(_) | Animation(_) | Video(_) | Invalid(_) => None,
+        }
+    }
+
     pub(super) fn get_displayable(&self, upscaling: bool) -> Displayable {
         match &self.kind {
             Image(r, u) => {
@@ -176,6 +191,15 @@ impl ScannedPage {
         }
     }
 
+    pub(super) fn memory_size(&self) -> usize {
+        match &self.kind {
+            Image(r, u) => r.memory_size() + u.memory_size(),
+            UnupscaledImage(r) => r.memory_size(),
+            Animation(a) => a.memory_size(),
+            Video(_) | Invalid(_) => 0,
+        }
+    }
+
     pub(super) fn unload(&mut self) {
         match &mut self.kind {
             Image(r, u) => {
@@ -68,6 +68,14 @@ impl UpscaledImage {
         }
     }
 
+    // The upscaled file, once it has been written.
+    pub(super) fn upscaled_file(&self) -> Option<&Rc<PathBuf>> {
+        match self.state {
+            Upscaled(_) => Some(&self.path),
+            Unupscaled | Upscaling(_) | Failed(_) => None,
+        }
+    }
+
     pub(super) fn get_displayable(&self) -> Displayable {
         match &self.state {
             Unupscaled | Upscaling(_) => Displayable::Nothing,
@@ -177,6 +185,13 @@ impl UpscaledImage {
         }
     }
 
+    pub(super) fn memory_size(&self) -> usize {
+        match &self.state {
+            Upscaled(r) => r.memory_size(),
+            Unupscaled | Upscaling(_) | Failed(_) => 0,
+        }
+    }
+
     pub(super) fn unload(&mut self) {
         if let Upscaled(r) = &mut self.state {
             r.unload();
@@ -6,8 +6,14 @@ use once_cell::sync::Lazy;
 
 // Might be able to reconsider once the heif and jxl loaders fix their severe memory leaks, maybe
 // that will stop the segfaults.
-// static BANNED_PIXBUF_EXTENSIONS: [&str; 4] = ["heic", "heif", "avif", "jxl"];
-static BANNED_PIXBUF_EXTENSIONS: [&str; 1] = ["jxl"];
+static BANNED_PIXBUF_EXTENSIONS: [&str; 4] = ["heic", "heif", "avif", "jxl"];
+
+// Converted by an external program instead, so a crash in libheif can't take down aw-man.
+static SUBPROCESS_EXTENSIONS: [&str; 3] = ["heic", "heif", "avif"];
+
+// Camera RAW formats, developed by LibRaw in another process.
+static RAW_EXTENSIONS: [&str; 10] =
+    ["arw", "cr2", "cr3", "dng", "nef", "orf", "pef", "raf", "rw2", "srw"];
 
 static PIXBUF_EXTENSIONS: Lazy<Vec<String>> = Lazy::new(|| {
     Pixbuf::formats()
@@ -19,7 +25,7 @@ static PIXBUF_EXTENSIONS: Lazy<Vec<String>> = Lazy::new(|| {
                 return false;
             }
 
-            for x in BANNED_PIXBUF_EXTENSIONS {
+            for x in BANNED_PIXBUF_EXTENSIONS.iter().chain(&RAW_EXTENSIONS) {
                 if e == x {
                     return false;
                 }
@@ -62,6 +68,12 @@ pub fn is_supported_page_extension<P: AsRef<Path>>(path: P) -> bool {
         return true;
     }
 
+    for s in SUBPROCESS_EXTENSIONS.iter().chain(&RAW_EXTENSIONS) {
+        if e.eq_ignore_ascii_case(s) {
+            return true;
+        }
+    }
+
     for v in VIDEO_EXTENSIONS {
         if e.eq_ignore_ascii_case(v) {
             return true;
@@ -87,6 +99,15 @@ pub fn is_png<P: AsRef<Path>>(path: P) -> bool {
     e.eq_ignore_ascii_case("png") || e.eq_ignore_ascii_case("apng")
 }
 
+pub fn is_jpeg<P: AsRef<Path>>(path: P) -> bool {
+    let e = match path.as_ref().extension() {
+        Some(e) => e.to_string_lossy(),
+        None => return false,
+    };
+
+    e.eq_ignore_ascii_case("jpg") || e.eq_ignore_ascii_case("jpeg")
+}
+
 pub fn is_webp<P: AsRef<Path>>(path: P) -> bool {
     match path.as_ref().extension() {
         Some(e) => e.to_string_lossy().eq_ignore_ascii_case("webp"),
@@ -146,9 +167,40 @@ pub fn is_pixbuf_extension<P: AsRef<Path>>(path: P) -> bool {
     false
 }
 
+pub fn is_subprocess_extension<P: AsRef<Path>>(path: P) -> bool {
+    let e = match path.as_ref().extension() {
+        Some(e) => e.to_string_lossy(),
+        None => return false,
+    };
+
+    for s in SUBPROCESS_EXTENSIONS {
+        if e.eq_ignore_ascii_case(s) {
+            return true;
+        }
+    }
+    false
+}
+
+pub fn is_raw_extension<P: AsRef<Path>>(path: P) -> bool {
+    let e = match path.as_ref().extension() {
+        Some(e) => e.to_string_lossy(),
+        None => return false,
+    };
+
+    for r in RAW_EXTENSIONS {
+        if e.eq_ignore_ascii_case(r) {
+            return true;
+        }
+    }
+    false
+}
+
 // Probing each archive would be unreasonably slow.
-const ARCHIVE_FORMATS: [&str; 13] = [
-    "zip", "cbz", "rar", "cbr", "7z", "cb7z", "tar", "pax", "gz", "bz2", "zst", "lz4", "xz",
+// 7z archives, including solid ones, are read natively by libarchive.
+// Compressed tarballs like .tar.gz are matched by their final extension.
+const ARCHIVE_FORMATS: [&str; 16] = [
+    "zip", "cbz", "rar", "cbr", "7z", "cb7", "cb7z", "tar", "cbt", "tgz", "pax", "gz", "bz2", "zst",
+    "lz4", "xz",
 ];
 
 pub fn is_archive_path<P: AsRef<Path>>(path: P) -> bool {
@@ -165,7 +217,8 @@ pub fn is_archive_path<P: AsRef<Path>>(path: P) -> bool {
     false
 }
 
-pub fn print_formats() {
+// Every supported still image extension, without duplicates.
+pub fn image_extensions() -> Vec<&'static str> {
     let mut formats: Vec<_> = IMAGE_CRATE_EXTENSIONS.to_vec();
 
     for e in PIXBUF_EXTENSIONS.iter() {
@@ -182,7 +235,25 @@ pub fn print_formats() {
         formats.push("jxl");
     }
 
-    println!("Supported image formats: {:?}", formats.as_slice());
+    for s in SUBPROCESS_EXTENSIONS.into_iter().chain(RAW_EXTENSIONS) {
+        if !formats.contains(&s) {
+            formats.push(s);
+        }
+    }
+
+    formats
+}
+
+// Every extension that can be opened directly, archives first.
+pub fn openable_extensions() -> Vec<&'static str> {
+    let mut formats = ARCHIVE_FORMATS.to_vec();
+    formats.extend(image_extensions());
+    formats.extend(VIDEO_EXTENSIONS);
+    formats
+}
+
+pub fn print_formats() {
+    println!("Supported image formats: {:?}", image_extensions().as_slice());
     println!("Supported animated image formats: {:?}", ["gif", "png", "apng"]);
     println!("Supported video formats: {:?}", VIDEO_EXTENSIONS);
     println!("Supported archive formats: {:?}", ARCHIVE_FORMATS);
@@ -3,12 +3,15 @@ use std::collections::BinaryHeap;
 use std::ffi::OsString;
 use std::fs;
 use std::path::{Path, PathBuf};
+use std::time::SystemTime;
 
 use once_cell::sync::Lazy;
 use rayon::iter::{ParallelBridge, ParallelIterator};
 use regex::Regex;
 
+use crate::config::SORT_RULES;
 use crate::manager::files::is_archive_path;
+use crate::manager::{overrides, sorting};
 use crate::natsort;
 
 
@@ -20,16 +23,28 @@ static MANGA_RE: Lazy<Regex> = Lazy::new(|| {
 });
 
 pub(super) struct SortKey {
-    chapter: Option<f64>,
+    modified: Option<SystemTime>,
+    numbers: Option<Vec<f64>>,
     nkey: natsort::ParsedString,
 }
 
 impl Ord for SortKey {
     fn cmp(&self, other: &Self) -> Ordering {
-        // Could potentially do something more involved with volume numbers, but not yet a problem.
-        match (self.chapter, other.chapter) {
-            (Some(sc), Some(oc)) => sc.total_cmp(&oc),
-            // Put archives with no known chapter after those with chapters.
+        let ord = self.modified.cmp(&other.modified).then_with(|| self.cmp_names(other));
+        if sorting::reversed() { ord.reverse() } else { ord }
+    }
+}
+
+impl SortKey {
+    fn cmp_names(&self, other: &Self) -> Ordering {
+        match (&self.numbers, &other.numbers) {
+            (Some(sn), Some(on)) => sn
+                .iter()
+                .zip(on)
+                .map(|(s, o)| s.total_cmp(o))
+                .find(|o| o.is_ne())
+                .unwrap_or_else(|| sn.len().cmp(&on.len())),
+            // Put archives matching no rule after those that do.
             (Some(_), None) => Ordering::Less,
             (None, Some(_)) => Ordering::Greater,
             (None, None) => Ordering::Equal,
@@ -52,20 +67,31 @@ impl PartialEq for SortKey {
 
 impl Eq for SortKey {}
 
-// Only called when parent() exists, so file_name() also exists
-#[allow(clippy::fallible_impl_from)]
-impl From<PathBuf> for SortKey {
-    fn from(path: PathBuf) -> Self {
-        let mut chapter = None;
-        if let Some(cap) = MANGA_RE.captures(&path.file_name().unwrap().to_string_lossy()) {
-            let d = cap[3].parse::<f64>();
-            if let Ok(d) = d {
-                chapter = Some(d);
-            }
-        }
+pub(super) fn chapter_number(path: &Path) -> Option<f64> {
+    let cap = MANGA_RE.captures(&path.file_name()?.to_string_lossy())?;
+    cap[3].parse::<f64>().ok()
+}
+
+// The numbers captured by the first matching sort rule, falling back to the chapter number.
+// Sort rules overridden for the series replace the configured ones entirely. They're resolved once
+// for the archive being navigated from, so every sibling is compared using the same rules and the
+// overrides aren't looked up again for each file in the directory.
+fn sort_numbers(path: &Path, rules: &[Regex]) -> Option<Vec<f64>> {
+    let name = path.file_name()?.to_string_lossy();
+    if let Some(cap) = rules.iter().find_map(|r| r.captures(&name)) {
+        return Some(cap.iter().skip(1).flatten().filter_map(|m| m.as_str().parse().ok()).collect());
+    }
+
+    chapter_number(path).map(|c| vec![c])
+}
+
+impl SortKey {
+    fn new(path: PathBuf, rules: &[Regex]) -> Self {
+        let modified = sorting::modified(&path);
+        let numbers = sort_numbers(&path, rules);
         let nkey = OsString::from(path).into();
 
-        Self { chapter, nkey }
+        Self { modified, numbers, nkey }
     }
 }
 
@@ -102,6 +128,32 @@ impl SortKeyCache {
     }
 }
 
+// All archives in the same directory, in the order they would be opened.
+pub(super) fn siblings(path: &Path) -> Vec<PathBuf> {
+    let parent = match path.parent() {
+        Some(p) => p,
+        None => return Vec::new(),
+    };
+
+    let series_rules = overrides::sort_rules(path);
+    let rules = series_rules.as_deref().unwrap_or(&*SORT_RULES);
+    let mut keys: Vec<SortKey> = match fs::read_dir(parent) {
+        Ok(rd) => rd
+            .filter_map(|de| {
+                let depath = de.ok()?.path();
+                is_archive_path(&depath).then(|| SortKey::new(depath, rules))
+            })
+            .collect(),
+        Err(e) => {
+            error!("Failed to read directory {:?}: {:?}", parent, e);
+            return Vec::new();
+        }
+    };
+
+    keys.sort();
+    keys.into_iter().map(|k| k.nkey.into_original().into()).collect()
+}
+
 pub(super) fn for_path<P: AsRef<Path>>(
     path: P,
     ord: Ordering,
@@ -117,7 +169,9 @@ pub(super) fn for_path<P: AsRef<Path>>(
 
     let parent = path.parent()?;
 
-    let start_key = path.to_owned().into();
+    let series_rules = overrides::sort_rules(path);
+    let rules = series_rules.as_deref().unwrap_or(&*SORT_RULES);
+    let start_key = SortKey::new(path.to_owned(), rules);
 
     let mut unsorted: Vec<_> = fs::read_dir(parent)
         .ok()?
@@ -128,7 +182,7 @@ pub(super) fn for_path<P: AsRef<Path>>(
                 return None;
             }
 
-            let key: SortKey = depath.into();
+            let key = SortKey::new(depath, rules);
 
             if key.cmp(&start_key) != ord {
                 return None;
@@ -0,0 +1,89 @@
+// Runs page_change_command, archive_change_command, and archive_complete_command, so external
+// tools can follow along without binding a key to an Execute action.
+
+use std::path::PathBuf;
+
+use super::actions::{command_line, execute};
+use super::indices::PI;
+use super::Manager;
+use crate::com::GuiContent;
+use crate::config::CONFIG;
+
+#[derive(Debug, Default)]
+pub(super) struct Hooks {
+    // The last archive and page the hooks ran for.
+    archive: Option<PathBuf>,
+    page: Option<(PathBuf, Option<PI>)>,
+    // The last archive that was read to the end.
+    completed: Option<PathBuf>,
+}
+
+impl Manager {
+    // Runs the hooks if the current page or archive changed since the last call.
+    pub(super) fn run_hooks(&mut self) {
+        if CONFIG.page_change_command.is_none()
+            && CONFIG.archive_change_command.is_none()
+            && CONFIG.archive_complete_command.is_none()
+        {
+            return;
+        }
+
+        let archive = self.current.archive();
+        let path = archive.path().to_path_buf();
+        let page = (path.clone(), self.current.p());
+        let last_page = page.1.map_or(false, |p| p.0 + self.pages_shown() >= archive.page_count());
+        drop(archive);
+
+        let archive_changed = self.hooks.archive.as_ref() != Some(&path);
+        let page_changed = self.hooks.page.as_ref() != Some(&page);
+        // The last page can come into view later, once the pages before it are loaded.
+        let completed = last_page && self.hooks.completed.as_ref() != Some(&path);
+        if !archive_changed && !page_changed && !completed {
+            return;
+        }
+
+        if completed {
+            self.hooks.completed = Some(path.clone());
+        }
+
+        self.hooks.archive = Some(path);
+        self.hooks.page = Some(page);
+
+        if archive_changed {
+            self.run_hook(CONFIG.archive_change_command.as_deref());
+        }
+        if page_changed {
+            self.run_hook(CONFIG.page_change_command.as_deref());
+        }
+        if completed {
+            self.run_hook(CONFIG.archive_complete_command.as_deref());
+        }
+    }
+
+    // The number of pages being shown starting from the current page. In the dual page and strip
+    // modes the last page can be visible without being the current page.
+    fn pages_shown(&self) -> usize {
+        match &self.old_state.content {
+            GuiContent::Multiple { current_index, visible, .. } if !self.comparing() => {
+                visible.len() - current_index
+            }
+            GuiContent::Single(_) | GuiContent::Multiple { .. } => 1,
+        }
+    }
+
+    fn run_hook(&self, cmd: Option<&str>) {
+        let cmd = match cmd {
+            Some(c) => c,
+            None => return,
+        };
+
+        let env = self.get_env();
+        match command_line(cmd, Vec::new(), &env) {
+            Ok((exe, args)) => {
+                // execute logs any failures itself.
+                tokio::task::spawn_local(execute(exe, args, env, None));
+            }
+            Err(e) => error!("Failed to run hook {:?}: {}", cmd, e),
+        }
+    }
+}
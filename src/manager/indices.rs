@@ -127,6 +127,17 @@ impl PageIndices {
         }
     }
 
+    // The number of pages between two indices, counting across archive boundaries.
+    pub(super) fn distance(&self, other: &Self) -> usize {
+        let archives = self.archives.borrow();
+        let position = |pi: &Self| {
+            archives[..pi.a().0].iter().map(Archive::page_count).sum::<usize>()
+                + pi.p().map_or(0, |p| p.0)
+        };
+
+        position(self).abs_diff(position(other))
+    }
+
     fn add(&self, x: usize) -> Option<Self> {
         // p is, temporarily, not guaranteed to be a PI
         let (mut a, mut p) = match self.indices {
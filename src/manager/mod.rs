@@ -1,5 +1,5 @@
-use std::cell::RefCell;
-use std::cmp::max;
+use std::cell::{Cell, RefCell};
+use std::cmp::{max, min};
 use std::collections::VecDeque;
 use std::future::Future;
 use std::ops::RangeInclusive;
@@ -11,22 +11,43 @@ use std::time::{Duration, Instant};
 use archive::{Archive, Work};
 use flume::Receiver;
 use gtk::glib;
-use indices::PageIndices;
+use indices::{PageIndices, AI, PI};
 use tempfile::TempDir;
 use tokio::select;
 use tokio::task::LocalSet;
 
-use self::files::is_natively_supported_image;
+use self::annotations::Annotations;
+use self::files::{is_archive_path, is_natively_supported_image};
+use self::hooks::Hooks;
+use self::overrides::AppliedOverrides;
+use self::playlist::Playlist;
+use self::progress::Progress;
+use self::recent::Recent;
+use self::tabs::Tabs;
+use self::watcher::Watcher;
+use self::zoom::PageZooms;
 use crate::com::*;
-use crate::config::{CONFIG, OPTIONS};
+use crate::config::{Command, CONFIG, OPTIONS};
 use crate::manager::actions::Action;
-use crate::{closing, spawn_thread};
+use crate::pools::trim;
+use crate::{closing, crash, spawn_thread};
 
 mod actions;
+mod annotations;
 pub mod archive;
 pub mod files;
 mod find_next;
+mod hooks;
 mod indices;
+pub mod overrides;
+pub mod playlist;
+pub mod progress;
+pub mod recent;
+pub mod shell;
+mod sorting;
+mod tabs;
+mod watcher;
+mod zoom;
 
 #[derive(Debug, Eq, PartialEq, Clone, Copy)]
 enum ManagerWork {
@@ -94,15 +115,31 @@ type Archives = Rc<RefCell<VecDeque<Archive>>>;
 #[derive(Debug)]
 struct Manager {
     archives: Archives,
+    // The other tabs, which keep their own archives open.
+    tabs: Tabs,
     temp_dir: TempDir,
     gui_sender: glib::Sender<GuiAction>,
 
     target_res: Res,
     modes: Modes,
+    // Showing the original and upscaled versions of the current page side by side.
+    comparing: bool,
+    // Showing the original version of the current page instead of the upscaled version.
+    showing_original: bool,
 
     old_state: GuiState,
     action_context: GuiActionContext,
 
+    annotations: Annotations,
+    progress: Progress,
+    hooks: Hooks,
+    overrides: AppliedOverrides,
+    zooms: PageZooms,
+    recent: Recent,
+    playlist: Playlist,
+    // The current archive, and its position and the number of archives in its directory.
+    series_position: Option<(PathBuf, Option<(usize, usize)>)>,
+
     current: PageIndices,
     // The next pages to finalize, downscale, load, upscale, or scan. May not be extracted yet.
     finalize: Option<PageIndices>,
@@ -110,6 +147,22 @@ struct Manager {
     load: Option<PageIndices>,
     upscale: Option<PageIndices>,
     scan: Option<PageIndices>,
+    // Every page of this archive is upscaled once the preload range is done, not just the
+    // pages near the current one.
+    upscale_archive: Option<PathBuf>,
+    // Archives waiting to be moved to the trash, which must not be opened again in manga mode.
+    trashing: Rc<RefCell<Vec<PathBuf>>>,
+    // Watches the current archive for new or removed pages when it's a directory.
+    watcher: Option<Watcher>,
+    series_watcher: Option<Watcher>,
+
+    // Incremented on every pass through the main loop, used to order pages for eviction.
+    clock: u64,
+    // Set when loaded pages exceeded memory_budget, which stops preloading until the next move.
+    over_budget: bool,
+    // Set when work finished since the last check against memory_budget, since that's the only
+    // time more memory can be in use.
+    work_finished: Cell<bool>,
 
     downscale_delay: DownscaleDelay,
 }
@@ -147,7 +200,9 @@ impl Manager {
         let modes = Modes {
             manga: OPTIONS.manga,
             upscaling: OPTIONS.upscale,
+            low_memory: OPTIONS.low_memory || CONFIG.low_memory,
             fit: Fit::Container,
+            zoom: Zoom::default(),
             display: DisplayMode::default(),
         };
         let mut gui_state: GuiState = GuiState::default();
@@ -161,7 +216,7 @@ impl Manager {
                     // This is a practical tradeoff to display something as fast as possible, since
                     // most images do not have transparency and large images with transparency will
                     // be damaged by cairo's downscaling anyway.
-                    let img = Image::from(img);
+                    let img = Image::from(crate::pools::autocrop::autocrop(img));
                     let iwr = ImageWithRes { original_res: img.res, img };
                     gui_state.content = GuiContent::Single(Displayable::Image(iwr));
                     Self::send_gui(
@@ -172,10 +227,56 @@ impl Manager {
             }
         };
 
-        let (a, p) = match &OPTIONS.file_names[..] {
+        // Checked by config::init, so this can't be empty unless the file was just removed.
+        let history_open = matches!(OPTIONS.command, Some(Command::History { .. }));
+        let recent: Vec<_> = if let Some(Command::History { query, .. }) = &OPTIONS.command {
+            progress::most_recent_match(query).into_iter().collect()
+        } else if OPTIONS.open_recent && OPTIONS.file_names.is_empty() {
+            recent::most_recent().into_iter().collect()
+        } else {
+            Vec::new()
+        };
+
+        // Also checked by config::init. Anything on the command line goes after the playlist
+        // file, and paths from stdin go after both.
+        let explicit = OPTIONS.playlist.is_some() || OPTIONS.stdin_paths;
+        let mut listed = Vec::new();
+        if let Some(file) = &OPTIONS.playlist {
+            listed.extend(playlist::read_file(file).unwrap_or_default());
+        }
+        if explicit {
+            listed.extend(OPTIONS.file_names.iter().cloned());
+        }
+        if let Some((first, _)) = &*playlist::STDIN_PATHS {
+            listed.push(first.clone());
+        }
+
+        let files = if !listed.is_empty() {
+            &listed[..]
+        } else if recent.is_empty() {
+            &OPTIONS.file_names[..]
+        } else {
+            &recent[..]
+        };
+        let as_playlist = |first: &PathBuf| {
+            explicit || files.len() > 1 && (first.is_dir() || is_archive_path(first))
+        };
+        let from_history = listed.is_empty() && !recent.is_empty() && history_open;
+
+        let mut playlist = Playlist::default();
+        let (a, p) = match files {
+            // Several archives or directories are read in the order they were given.
+            files @ [first, ..] if as_playlist(first) => {
+                playlist = Playlist::new(files);
+                let (a, p) = Archive::open(first.clone(), &temp_dir);
+                let p = progress::resume(first, &a, p, from_history, &gui_sender);
+                (a, p)
+            }
             [file] => {
                 try_early_open(file);
-                Archive::open(file.clone(), &temp_dir)
+                let (a, p) = Archive::open(file.clone(), &temp_dir);
+                let p = progress::resume(file, &a, p, from_history, &gui_sender);
+                (a, p)
             }
             files @ [first, ..] => {
                 try_early_open(first);
@@ -192,20 +293,40 @@ impl Manager {
 
         let mut m = Self {
             archives,
+            tabs: Tabs::default(),
             temp_dir,
             gui_sender,
 
             target_res: (0, 0).into(),
             modes,
+            comparing: false,
+            showing_original: false,
             old_state: gui_state,
             action_context: GuiActionContext::default(),
 
+            annotations: Annotations::default(),
+            progress: Progress::default(),
+            hooks: Hooks::default(),
+            overrides: AppliedOverrides::default(),
+            zooms: PageZooms::default(),
+            recent: Recent::default(),
+            playlist,
+            series_position: None,
+
             finalize: Some(current.clone()),
             downscale: Some(current.clone()),
             load: Some(current.clone()),
             upscale: modes.upscaling.then(|| current.clone()),
             scan: Some(current.clone()),
             current,
+            upscale_archive: None,
+            trashing: Rc::default(),
+            watcher: None,
+            series_watcher: None,
+
+            clock: 0,
+            over_budget: false,
+            work_finished: Cell::new(false),
 
             downscale_delay: DownscaleDelay::Cleared,
         };
@@ -216,6 +337,15 @@ impl Manager {
     }
 
     async fn run(mut self, receiver: Receiver<MAWithResponse>) {
+        let archives = self.archives.clone();
+        crash::set_thread_snapshot(move || match archives.try_borrow() {
+            Ok(archives) => archives
+                .iter()
+                .map(|a| format!("{:?}\n{}", a, a.debug_pages()))
+                .collect(),
+            Err(_) => "Archives were borrowed".to_string(),
+        });
+
         if self.modes.manga {
             self.maybe_open_new_archives();
         }
@@ -223,10 +353,18 @@ impl Manager {
         'main: loop {
             use ManagerWork::*;
 
+            self.apply_overrides();
+            self.apply_page_zoom();
+            self.update_series_position();
             // TODO -- this only costs ~10us but can be skipped in many cases
             self.maybe_send_gui_state();
+            self.run_hooks();
+            self.recent.record(&self.current.archive());
+            self.update_watchers();
 
+            self.enforce_memory_budget();
             self.find_next_work();
+            crash::set_state(self.crash_state());
 
             // Check and start any extractions synchronously.
             // This will never block.
@@ -271,6 +409,8 @@ impl Manager {
                     _ = self.do_work(Load, current_work), if load_work => {},
                     _ = self.do_work(Upscale, current_work), if upscale_work => {},
                     _ = self.do_work(Scan, current_work), if scan_work => {},
+                    _ = watcher::changed(&self.watcher) => self.refresh_directory(),
+                    _ = watcher::changed(&self.series_watcher) => self.refresh_series(),
                     _ = self.downscale_delay.wait_delay(), if delay_downscale => {
                         self.downscale_delay.clear();
                     },
@@ -295,6 +435,21 @@ impl Manager {
         self.join().await
     }
 
+    fn crash_state(&self) -> String {
+        format!(
+            "modes: {:?}\ntarget_res: {:?}\ncurrent: {:?}\nfinalize: {:?}\ndownscale: {:?}\nload: \
+             {:?}\nupscale: {:?}\nscan: {:?}\n",
+            self.modes,
+            self.target_res,
+            self.current,
+            self.finalize,
+            self.downscale,
+            self.load,
+            self.upscale,
+            self.scan
+        )
+    }
+
     fn handle_action(&mut self, ma: ManagerAction, resp: Option<CommandResponder>) {
         use ManagerAction::*;
 
@@ -305,33 +460,89 @@ impl Manager {
                 self.reset_indices();
             }
             MovePages(d, n) => self.move_pages(d, n),
+            RandomPage => self.move_random_page(),
+            RetryPage => self.retry_page(),
+            TrashArchive => self.trash_archive(resp),
             NextArchive => self.move_next_archive(),
             PreviousArchive => self.move_previous_archive(),
+            FirstOfSeries => self.move_series_end(Direction::Backwards),
+            LastOfSeries => self.move_series_end(Direction::Forwards),
+            Open(path) => self.open_path(path, resp),
             Status => self.handle_command(Action::Status, resp),
             ListPages => self.handle_command(Action::ListPages, resp),
-            Execute(s) => self.handle_command(Action::Execute(s), resp),
+            PageInfo => self.handle_command(Action::PageInfo, resp),
+            ListSiblings => self.handle_command(Action::ListSiblings, resp),
+            ListRecent => self.handle_command(Action::ListRecent, resp),
+            SetWallpaper => self.handle_command(Action::SetWallpaper, resp),
+            ExportArchive(path) => self.handle_command(Action::ExportArchive(path), resp),
+            Execute(s, args) => self.handle_command(Action::Execute(s, args), resp),
             ToggleUpscaling => {
+                let old = self.modes;
                 self.modes.upscaling = !self.modes.upscaling;
                 self.reset_indices();
                 self.maybe_open_new_archives();
+                self.cleanup_after_mode_change(old);
+            }
+            UpscaleArchive => self.upscale_archive(),
+            ToggleComparison => {
+                self.comparing = !self.comparing;
+                self.reset_indices();
             }
+            ShowOriginal(show) => self.showing_original = show,
             ToggleManga => {
+                let old = self.modes;
                 self.modes.manga = !self.modes.manga;
                 self.reset_indices();
                 self.maybe_open_new_archives();
+                self.cleanup_after_mode_change(old);
             }
+            ToggleLowMemory => {
+                self.modes.low_memory = !self.modes.low_memory;
+                if self.modes.low_memory {
+                    self.idle_unload();
+                }
+                self.reset_indices();
+            }
+            NewTab(path) => self.new_tab(path, resp),
+            SwitchTab(i) => self.switch_tab(i),
+            CloseTab => self.close_tab(),
+            ToggleSortByTime => self.toggle_sort_by_time(),
+            ToggleReverseSort => self.toggle_reverse_sort(),
             FitStrategy(s) => {
                 self.modes.fit = s;
                 self.reset_indices();
             }
+            Zoom(z) => self.zoom(z),
             Display(dm) => {
                 self.modes.display = dm;
             }
+            Annotate(a) => self.annotate(a, resp),
+            ClearAnnotations => self.clear_annotations(resp),
+            ListAnnotations => self.handle_command(Action::ListAnnotations, resp),
         }
     }
 
     fn target_res(&self) -> TargetRes {
-        (self.target_res, self.modes.fit, self.modes.display).into()
+        TargetRes::from((self.target_res, self.modes.fit, self.display_mode()))
+            .zoomed(self.modes.zoom)
+    }
+
+    const fn comparing(&self) -> bool {
+        self.comparing && self.modes.upscaling
+    }
+
+    // Whether the current page is shown upscaled.
+    const fn upscaled_current(&self) -> bool {
+        self.modes.upscaling && (self.comparing() || !self.showing_original)
+    }
+
+    // Comparisons are laid out as dual pages, with the original first.
+    const fn display_mode(&self) -> DisplayMode {
+        match self.modes.display {
+            _ if !self.comparing() => self.modes.display,
+            DisplayMode::DualPageReversed => DisplayMode::DualPageReversed,
+            _ => DisplayMode::DualPage,
+        }
     }
 
     // TODO -- this really could use a refactor
@@ -340,9 +551,12 @@ impl Manager {
         let manga = self.modes.manga && archive.allow_multiple_archives();
         let p = self.current.p();
 
-        let (displayable, page_name) = archive.get_displayable(p, self.modes.upscaling);
+        let (displayable, page_name) = archive.get_displayable(p, self.upscaled_current());
         let page_num = p.map_or(0, |p| p.0 + 1);
         let target_res = self.target_res();
+        let annotations = p.map_or_else(Vec::new, |p| {
+            self.annotations.get(archive.path(), &archive.page_rel_path(p))
+        });
 
         let move_page = |p: &PageIndices, d| {
             if manga {
@@ -387,6 +601,30 @@ impl Manager {
             };
 
         let content = match (self.modes.display, displayable.layout_res()) {
+            (_, layout_res) if self.comparing() => {
+                let original = archive.get_displayable(p, false).0;
+                let mut visible = vec![displayable];
+                if layout_res.is_some()
+                    && original.layout_res().is_some()
+                    && original != visible[0]
+                {
+                    visible.insert(0, original);
+                }
+
+                // Neighbouring pages are never shown alongside a comparison.
+                let offscreen = |d| match move_page(&self.current, d) {
+                    Some(_) => OffscreenContent::LayoutIncompatible,
+                    None if manga => OffscreenContent::Unknown,
+                    None => OffscreenContent::Nothing,
+                };
+
+                GuiContent::Multiple {
+                    prev: offscreen(Direction::Backwards),
+                    current_index: 0,
+                    visible,
+                    next: offscreen(Direction::Forwards),
+                }
+            }
             (DisplayMode::Single, _)
             | (DisplayMode::VerticalStrip | DisplayMode::HorizontalStrip, None) => {
                 GuiContent::Single(displayable)
@@ -408,7 +646,7 @@ impl Manager {
                 while let Some(p) = move_page(&c, Direction::Backwards) {
                     let d = p.archive().get_displayable(p.p(), self.modes.upscaling).0;
                     let res = if let Some(res) = d.layout_res() {
-                        res.fit_inside(target_res)
+                        res.display_inside(target_res)
                     } else {
                         break;
                     };
@@ -435,7 +673,7 @@ impl Manager {
                 while let Some(n) = move_page(&c, Direction::Forwards) {
                     let d = n.archive().get_displayable(n.p(), self.modes.upscaling).0;
                     let res = if let Some(res) = d.layout_res() {
-                        res.fit_inside(target_res)
+                        res.display_inside(target_res)
                     } else {
                         break;
                     };
@@ -453,7 +691,7 @@ impl Manager {
                 let next = get_offscreen_content(
                     &c,
                     Direction::Forwards,
-                    CONFIG.preload_ahead.saturating_sub(forward_pages),
+                    preload_ahead(self.modes).saturating_sub(forward_pages),
                     false,
                 );
 
@@ -467,13 +705,17 @@ impl Manager {
             (DisplayMode::DualPage | DisplayMode::DualPageReversed, current) => {
                 let mut c = self.current.clone();
 
-                let prev =
-                    get_offscreen_content(&c, Direction::Backwards, CONFIG.preload_behind, true);
+                let prev = get_offscreen_content(
+                    &c,
+                    Direction::Backwards,
+                    preload_behind(self.modes),
+                    true,
+                );
 
                 let mut visible = Vec::with_capacity(2);
                 visible.push(displayable);
 
-                let mut preload_ahead = CONFIG.preload_ahead;
+                let mut preload_ahead = preload_ahead(self.modes);
 
                 if current.is_some() {
                     if let Some(next) = move_page(&c, Direction::Forwards) {
@@ -494,6 +736,8 @@ impl Manager {
             }
         };
 
+        let errors = content.errors();
+        let error = if errors.is_empty() { None } else { Some(errors.join("\n")) };
 
         GuiState {
             content,
@@ -501,9 +745,52 @@ impl Manager {
             page_name,
             archive_len: archive.page_count(),
             archive_name: archive.name(),
-            modes: self.modes,
+            archive_path: archive.path().to_owned(),
+            modes: Modes { display: self.display_mode(), ..self.modes },
             target_res,
+            annotations,
+            error,
+            progress: self.reading_progress(),
+            comparing: self.comparing(),
+        }
+    }
+
+    // Listing the directory is too slow to do on every update, so it's only done when the archive
+    // changes.
+    fn update_series_position(&mut self) {
+        let archive = self.current.archive();
+        if !self.modes.manga || !archive.allow_multiple_archives() {
+            return;
         }
+
+        let path = archive.path();
+        if matches!(&self.series_position, Some((p, _)) if p == path) {
+            return;
+        }
+
+        let siblings = find_next::siblings(path);
+        let position = siblings.iter().position(|s| s == path).map(|i| (i, siblings.len()));
+        self.series_position = Some((path.to_path_buf(), position));
+    }
+
+    fn reading_progress(&self) -> ReadingProgress {
+        let archive = self.current.archive();
+        let len = archive.page_count();
+        let page = self.current.p().map_or(0, |p| p.0 + 1);
+        let percent = |n: usize, d: usize| if d == 0 { 0 } else { (n * 100 / d) as u8 };
+
+        let series = match &self.series_position {
+            Some((p, Some((i, count))))
+                if self.modes.manga && archive.allow_multiple_archives() && p == archive.path() =>
+            {
+                // Every archive counts the same, however many pages it has.
+                let len = max(len, 1);
+                Some(percent(i * len + page, count * len))
+            }
+            _ => None,
+        };
+
+        ReadingProgress { archive: percent(page, len), series }
     }
 
     fn maybe_send_gui_state(&mut self) {
@@ -538,10 +825,13 @@ impl Manager {
         }
     }
 
-    async fn join(self) {
+    async fn join(mut self) {
         for a in self.archives.take() {
             a.join().await;
         }
+        for t in self.tabs.take_all() {
+            t.join().await;
+        }
         self.temp_dir
             .close()
             .unwrap_or_else(|e| error!("Error dropping manager temp dir: {:?}", e));
@@ -565,10 +855,20 @@ impl Manager {
 
             let (_, work) = self.get_work_for_type(w, false);
 
+            let range = match w {
+                ManagerWork::Finalize | ManagerWork::Downscale | ManagerWork::Load
+                    if self.over_budget =>
+                {
+                    let (behind, ahead) = self.visible_pages();
+                    -(behind as isize)..=ahead as isize
+                }
+                _ => get_range(w, self.modes),
+            };
+
             let range = if self.modes.manga {
-                self.current.wrapping_range(get_range(w))
+                self.current.wrapping_range(range)
             } else {
-                self.current.wrapping_range_in_archive(get_range(w))
+                self.current.wrapping_range_in_archive(range)
             };
 
             // TODO -- this is a bit wasteful, we don't consider "pi" here and usually we could end
@@ -582,6 +882,13 @@ impl Manager {
                     }
                 }
             }
+
+            if w == ManagerWork::Upscale {
+                if let Some(npi) = self.next_batch_upscale(work) {
+                    new_values.push((w, Some(npi)));
+                    continue;
+                }
+            }
             new_values.push((w, None));
         }
 
@@ -590,6 +897,25 @@ impl Manager {
         }
     }
 
+    // Finds the next page of upscale_archive to upscale, starting from the current page.
+    fn next_batch_upscale(&self, work: Work) -> Option<PageIndices> {
+        let path = self.upscale_archive.as_ref()?;
+        let archives = self.archives.borrow();
+        let a = archives.iter().position(|a| a.path() == path)?;
+        let archive = &archives[a];
+
+        let start = match self.current.p() {
+            Some(p) if self.current.a().0 == a => p.0,
+            _ => 0,
+        };
+        let p = (start..archive.page_count())
+            .chain(0..start)
+            .find(|p| archive.has_work(PI(*p), work))?;
+        drop(archives);
+
+        Some(PageIndices::new(a, Some(p), self.archives.clone()))
+    }
+
     fn set_next(&mut self, work: ManagerWork, npi: Option<PageIndices>) {
         use ManagerWork::*;
 
@@ -618,7 +944,8 @@ impl Manager {
 
         if let Some(pi) = pi {
             if let Some(p) = pi.p() {
-                pi.archive().do_work(p, w).await
+                pi.archive().do_work(p, w).await;
+                self.work_finished.set(true);
             } else {
                 unreachable!();
             }
@@ -635,18 +962,30 @@ impl Manager {
         use ManagerWork::*;
 
         match work {
-            Current => (
-                Some(&self.current),
-                Work::Finalize(
-                    self.modes.upscaling,
-                    WorkParams {
-                        park_before_scale: false,
-                        jump_downscaling_queue: true,
-                        extract_early: true,
-                        target_res: self.target_res(),
-                    },
-                ),
-            ),
+            Current => {
+                let params = WorkParams {
+                    park_before_scale: false,
+                    jump_downscaling_queue: true,
+                    extract_early: true,
+                    low_memory: self.modes.low_memory,
+                    target_res: self.target_res(),
+                    distance: 0,
+                };
+                let upscaled = self.upscaled_current();
+                let mut w = Work::Finalize(upscaled, params);
+
+                // Comparing or flipping between versions needs both, once the one being shown is
+                // done.
+                if self.modes.upscaling && (self.comparing() || self.showing_original) {
+                    if let Some(p) = self.current.p() {
+                        if !self.current.archive().has_work(p, w) {
+                            w = Work::Finalize(!upscaled, params);
+                        }
+                    }
+                }
+
+                (Some(&self.current), w)
+            }
             Finalize => (
                 self.finalize.as_ref(),
                 Work::Finalize(
@@ -655,7 +994,9 @@ impl Manager {
                         park_before_scale: current_work,
                         jump_downscaling_queue: false,
                         extract_early: false,
+                        low_memory: self.modes.low_memory,
                         target_res: self.target_res(),
+                        distance: self.finalize.as_ref().map_or(0, |pi| self.current.distance(pi)),
                     },
                 ),
             ),
@@ -667,7 +1008,9 @@ impl Manager {
                         park_before_scale: current_work,
                         jump_downscaling_queue: false,
                         extract_early: false,
+                        low_memory: self.modes.low_memory,
                         target_res: self.target_res(),
+                        distance: self.downscale.as_ref().map_or(0, |pi| self.current.distance(pi)),
                     },
                 ),
             ),
@@ -679,7 +1022,9 @@ impl Manager {
                         park_before_scale: current_work,
                         jump_downscaling_queue: false,
                         extract_early: false,
+                        low_memory: self.modes.low_memory,
                         target_res: self.target_res(),
+                        distance: self.load.as_ref().map_or(0, |pi| self.current.distance(pi)),
                     },
                 ),
             ),
@@ -688,71 +1033,163 @@ impl Manager {
         }
     }
 
-    fn idle_unload(&self) {
-        let scroll_dim = if self.modes.display.vertical_pagination() {
-            |r: Res| r.h
-        } else {
-            |r: Res| r.w
+    // Only the current archive is watched, and only when it's a directory. In manga mode the
+    // directory containing it is also watched since new chapters can be downloaded at any time.
+    fn update_watchers(&mut self) {
+        let archive = self.current.archive();
+        let dir = archive.is_directory().then(|| archive.path());
+        let series = archive
+            .path()
+            .parent()
+            .filter(|_| self.modes.manga && archive.allow_multiple_archives());
+
+        watcher::watch(&mut self.watcher, dir);
+        watcher::watch(&mut self.series_watcher, series);
+    }
+
+    // Evicts the least recently used pages until the loaded images fit within memory_budget.
+    // Pages that could be visible are never evicted.
+    fn enforce_memory_budget(&mut self) {
+        let budget = match CONFIG.memory_budget {
+            Some(b) => b.get().saturating_mul(1024 * 1024),
+            None => return,
         };
 
-        let min_pages = match self.modes.display {
-            DisplayMode::Single | DisplayMode::VerticalStrip | DisplayMode::HorizontalStrip => {
-                (1, 1)
+        self.clock += 1;
+        if let Some(p) = self.current.p() {
+            self.current.archive().touch(p, self.clock);
+        }
+
+        if !self.work_finished.take() {
+            return;
+        }
+
+        let (behind, ahead) = self.visible_pages();
+        let kept: Vec<_> = self
+            .current
+            .wrapping_range(-(behind as isize)..=ahead as isize)
+            .map(|pi| (pi.a(), pi.p()))
+            .collect();
+
+        let archives = self.archives.borrow();
+        let mut total = 0;
+        let mut candidates = Vec::new();
+        for (a, archive) in archives.iter().enumerate() {
+            for p in (0..archive.page_count()).map(PI) {
+                let (size, mut last_used) = match archive.memory_usage(p) {
+                    Some((0, _)) | None => continue,
+                    Some(u) => u,
+                };
+
+                if last_used == 0 {
+                    archive.touch(p, self.clock);
+                    last_used = self.clock;
+                }
+
+                total += size as u64;
+                if !kept.contains(&(AI(a), Some(p))) {
+                    candidates.push((last_used, a, p, size as u64));
+                }
             }
-            DisplayMode::DualPage | DisplayMode::DualPageReversed => (2, 3),
-        };
+        }
+
+        if total <= budget {
+            return;
+        }
+
+        self.over_budget = true;
+        candidates.sort_unstable();
+        for (_, a, p, size) in candidates {
+            if total <= budget {
+                break;
+            }
+            trace!("Evicting {:?} page {} to stay within memory_budget", archives[a], p.0 + 1);
+            archives[a].unload(p);
+            total -= size;
+        }
+        debug!("Evicted pages, {}MB of images are loaded", total / 1024 / 1024);
+        trim::schedule();
+    }
 
-        // At least for single and strip modes keeping one backwards is likely to be enough even if
-        // it's smaller than the scroll size.
-        // Worst case the user sees a visible gap for a bit.
-        let mut unload = self.current.try_move_pages(Direction::Backwards, 1);
-        for i in 1..=CONFIG.preload_behind {
+    fn idle_unload(&self) {
+        let (behind, ahead) = self.visible_pages();
+
+        let mut unload = self.current.try_move_pages(Direction::Backwards, behind + 1);
+        for _ in behind..preload_behind(self.modes) {
             match unload.take() {
                 Some(pi) => {
-                    if i > min_pages.0 {
-                        pi.unload();
-                    }
+                    pi.unload();
                     unload = pi.try_move_pages(Direction::Backwards, 1);
                 }
                 None => break,
             }
         }
 
-        let target_res = self.target_res();
+        let mut unload = self.current.try_move_pages(Direction::Forwards, ahead + 1);
+        for _ in ahead..preload_ahead(self.modes) {
+            match unload.take() {
+                Some(pi) => {
+                    pi.unload();
+                    unload = pi.try_move_pages(Direction::Forwards, 1);
+                }
+                None => break,
+            }
+        }
+
+        trim::schedule();
+    }
+
+    // How many pages behind and ahead of the current page the layout may be showing. In the strip
+    // modes this depends on the sizes of the following pages.
+    // Keeping one backwards is likely to be enough even if it's smaller than the scroll size.
+    // Worst case the user sees a visible gap for a bit.
+    fn visible_pages(&self) -> (usize, usize) {
+        let (behind, min_ahead) = kept_pages(self.modes.display);
+
+        let scroll_dim = if self.modes.display.vertical_pagination() {
+            |r: Res| r.h
+        } else {
+            |r: Res| r.w
+        };
+
         let mut remaining = match self.modes.display {
-            DisplayMode::Single | DisplayMode::DualPage | DisplayMode::DualPageReversed => 0,
+            DisplayMode::Single | DisplayMode::DualPage | DisplayMode::DualPageReversed => {
+                return (behind, min_ahead);
+            }
             DisplayMode::VerticalStrip | DisplayMode::HorizontalStrip => {
                 scroll_dim(self.target_res) + CONFIG.scroll_amount.get()
             }
         };
 
-        let mut unload = self.current.try_move_pages(Direction::Forwards, 1);
-        for i in 1..=CONFIG.preload_ahead {
-            match unload.take() {
-                Some(pi) => {
-                    let consumed = if remaining == 0 {
-                        0
-                    } else if let Some(res) =
-                        pi.archive().get_displayable(pi.p(), self.modes.upscaling).0.layout_res()
-                    {
-                        scroll_dim(res.fit_inside(target_res))
-                    } else {
-                        remaining = 0;
-                        0
-                    };
-
-                    if i > min_pages.1 && remaining == 0 {
-                        pi.unload();
-                    } else {
-                        remaining = remaining.saturating_sub(consumed);
-                    }
-
+        let target_res = self.target_res();
+        let mut ahead = 0;
+        let mut pi = self.current.clone();
+        while remaining > 0 && ahead < preload_ahead(self.modes) {
+            pi = match pi.try_move_pages(Direction::Forwards, 1) {
+                Some(pi) => pi,
+                None => break,
+            };
 
-                    unload = pi.try_move_pages(Direction::Forwards, 1);
-                }
+            let displayable = pi.archive().get_displayable(pi.p(), self.modes.upscaling).0;
+            let res = match displayable.layout_res() {
+                Some(res) => res,
                 None => break,
-            }
+            };
+
+            ahead += 1;
+            remaining = remaining.saturating_sub(scroll_dim(res.display_inside(target_res)));
         }
+
+        (behind, max(ahead, min_ahead))
+    }
+}
+
+// How many pages behind and ahead of the current page to keep loaded, at minimum, since they may
+// be visible.
+const fn kept_pages(display: DisplayMode) -> (usize, usize) {
+    match display {
+        DisplayMode::Single | DisplayMode::VerticalStrip | DisplayMode::HorizontalStrip => (1, 1),
+        DisplayMode::DualPage | DisplayMode::DualPageReversed => (2, 3),
     }
 }
 
@@ -760,15 +1197,47 @@ async fn idle_sleep() {
     tokio::time::sleep(Duration::from_secs(CONFIG.idle_timeout.unwrap().get())).await
 }
 
-fn get_range(work: ManagerWork) -> RangeInclusive<isize> {
+// The upscaling and then the manga mode overrides are used when set and enabled, and low memory
+// mode only keeps the adjacent pages loaded.
+fn preload(modes: Modes, upscaling: Option<usize>, manga: Option<usize>, default: usize) -> usize {
+    let n = upscaling
+        .filter(|_| modes.upscaling)
+        .or_else(|| manga.filter(|_| modes.manga))
+        .unwrap_or(default);
+
+    if modes.low_memory { min(n, 1) } else { n }
+}
+
+fn preload_ahead(modes: Modes) -> usize {
+    preload(
+        modes,
+        CONFIG.upscaling_preload_ahead,
+        CONFIG.manga_preload_ahead,
+        CONFIG.preload_ahead,
+    )
+}
+
+fn preload_behind(modes: Modes) -> usize {
+    preload(
+        modes,
+        CONFIG.upscaling_preload_behind,
+        CONFIG.manga_preload_behind,
+        CONFIG.preload_behind,
+    )
+}
+
+fn get_range(work: ManagerWork, modes: Modes) -> RangeInclusive<isize> {
     use ManagerWork::*;
 
-    let behind = CONFIG.preload_behind.try_into().map_or(isize::MIN, isize::saturating_neg);
+    let behind = preload_behind(modes).try_into().map_or(isize::MIN, isize::saturating_neg);
 
     let ahead = match work {
         Current => unreachable!(),
-        Finalize | Downscale | Load | Scan => CONFIG.preload_ahead.try_into().unwrap_or(isize::MAX),
-        Upscale => max(CONFIG.preload_ahead, CONFIG.prescale).try_into().unwrap_or(isize::MAX),
+        Finalize | Downscale | Load | Scan => {
+            preload_ahead(modes).try_into().unwrap_or(isize::MAX)
+        }
+        // Upscaled images live on disk, so there's no reason to upscale less.
+        Upscale => max(preload_ahead(modes), CONFIG.prescale).try_into().unwrap_or(isize::MAX),
     };
     behind..=ahead
 }
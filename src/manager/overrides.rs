@@ -0,0 +1,195 @@
+// Per-series overrides for modes and sort rules, since webtoons and 4-koma collections need very
+// different settings from regular manga. They come from directory_overrides in the config and from
+// a .aw-man.toml file in the directory containing the archive, which takes precedence.
+
+use std::cell::RefCell;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::SystemTime;
+
+use ahash::AHashMap;
+use once_cell::sync::Lazy;
+use regex::Regex;
+
+use super::Manager;
+use crate::com::{DisplayMode, Fit, Modes};
+use crate::config::{ModeOverrides, CONFIG};
+
+const FILE_NAME: &str = ".aw-man.toml";
+
+#[derive(Debug, Default, Clone)]
+pub struct Overrides {
+    manga: Option<bool>,
+    upscale: Option<bool>,
+    fit: Option<Fit>,
+    display: Option<DisplayMode>,
+    resume: Option<bool>,
+    sort_rules: Option<Arc<Vec<Regex>>>,
+}
+
+impl Overrides {
+    fn compile(mo: &ModeOverrides) -> Result<Self, regex::Error> {
+        let sort_rules = mo
+            .sort_rules
+            .as_ref()
+            .map(|rules| rules.iter().map(|r| Regex::new(r)).collect::<Result<Vec<_>, _>>())
+            .transpose()?
+            .map(Arc::new);
+
+        Ok(Self {
+            manga: mo.manga,
+            upscale: mo.upscale,
+            fit: mo.fit,
+            display: mo.display,
+            resume: mo.resume,
+            sort_rules,
+        })
+    }
+
+    // Anything set in other takes precedence.
+    fn merge(&mut self, other: Self) {
+        self.manga = other.manga.or(self.manga);
+        self.upscale = other.upscale.or(self.upscale);
+        self.fit = other.fit.or(self.fit);
+        self.display = other.display.or(self.display);
+        self.resume = other.resume.or(self.resume);
+        self.sort_rules = other.sort_rules.or_else(|| self.sort_rules.take());
+    }
+
+    // Applies the overrides to modes, returning the values they replaced so they can be restored.
+    fn apply(&self, modes: &mut Modes) -> Self {
+        Self {
+            manga: self.manga.map(|m| std::mem::replace(&mut modes.manga, m)),
+            upscale: self.upscale.map(|u| std::mem::replace(&mut modes.upscaling, u)),
+            fit: self.fit.map(|f| std::mem::replace(&mut modes.fit, f)),
+            display: self.display.map(|d| std::mem::replace(&mut modes.display, d)),
+            resume: None,
+            sort_rules: None,
+        }
+    }
+}
+
+// Matched against the full path of the archive, the first match wins.
+pub static CONFIGURED: Lazy<Vec<(Regex, Overrides)>> = Lazy::new(|| {
+    CONFIG
+        .directory_overrides
+        .iter()
+        .map(|d| {
+            let pattern = match Regex::new(&d.pattern) {
+                Ok(r) => r,
+                Err(e) => panic!("Invalid directory override pattern {:?}: {}", d.pattern, e),
+            };
+            match Overrides::compile(&d.overrides) {
+                Ok(o) => (pattern, o),
+                Err(e) => panic!("Invalid sort rule in directory override {:?}: {}", d.pattern, e),
+            }
+        })
+        .collect()
+});
+
+thread_local! {
+    // Overrides files by directory, along with the modification time when they were read.
+    static FILES: RefCell<AHashMap<PathBuf, (Option<SystemTime>, Option<Overrides>)>> =
+        RefCell::default();
+}
+
+fn from_file(dir: &Path) -> Option<Overrides> {
+    let file = dir.join(FILE_NAME);
+    let modified = fs::metadata(&file).and_then(|m| m.modified()).ok();
+
+    FILES.with(|files| {
+        let mut files = files.borrow_mut();
+        if let Some((m, o)) = files.get(dir) {
+            if *m == modified {
+                return o.clone();
+            }
+        }
+
+        let o = modified.and_then(|_| read(&file));
+        files.insert(dir.to_path_buf(), (modified, o.clone()));
+        o
+    })
+}
+
+fn read(file: &Path) -> Option<Overrides> {
+    let contents = match fs::read_to_string(file) {
+        Ok(c) => c,
+        Err(e) => {
+            error!("Failed to read {:?}: {}", file, e);
+            return None;
+        }
+    };
+
+    let mo: ModeOverrides = match toml::from_str(&contents) {
+        Ok(mo) => mo,
+        Err(e) => {
+            error!("Failed to parse {:?}: {}", file, e);
+            return None;
+        }
+    };
+
+    match Overrides::compile(&mo) {
+        Ok(o) => Some(o),
+        Err(e) => {
+            error!("Invalid sort rule in {:?}: {}", file, e);
+            None
+        }
+    }
+}
+
+fn for_path(path: &Path) -> Overrides {
+    let s = path.to_string_lossy();
+    let mut out = CONFIGURED
+        .iter()
+        .find(|(r, _)| r.is_match(&s))
+        .map(|(_, o)| o.clone())
+        .unwrap_or_default();
+
+    if let Some(o) = path.parent().and_then(from_file) {
+        out.merge(o);
+    }
+    out
+}
+
+pub(super) fn sort_rules(path: &Path) -> Option<Arc<Vec<Regex>>> {
+    for_path(path).sort_rules
+}
+
+pub(super) fn resume(path: &Path) -> Option<bool> {
+    for_path(path).resume
+}
+
+#[derive(Debug, Default)]
+pub(super) struct AppliedOverrides {
+    // The archive the overrides were last checked for.
+    archive: Option<PathBuf>,
+    // The modes replaced by the current overrides, restored when moving to an archive without them.
+    replaced: Overrides,
+}
+
+impl Manager {
+    // Applies the overrides for the current archive if it changed since the last call.
+    pub(super) fn apply_overrides(&mut self) {
+        let path = self.current.archive().path().to_path_buf();
+        if self.overrides.archive.as_ref() == Some(&path) {
+            return;
+        }
+
+        let overrides = for_path(&path);
+        self.overrides.archive = Some(path);
+
+        let mut modes = self.modes;
+        std::mem::take(&mut self.overrides.replaced).apply(&mut modes);
+        self.overrides.replaced = overrides.apply(&mut modes);
+
+        if modes == self.modes {
+            return;
+        }
+
+        debug!("Applying overrides, {} -> {}", self.modes.gui_str(), modes.gui_str());
+        self.modes = modes;
+        self.reset_indices();
+        self.maybe_open_new_archives();
+    }
+}
@@ -0,0 +1,139 @@
+// An explicit, ordered list of archives and directories, such as several given on the command
+// line. While the current archive is in the list, the next and previous archives come from the
+// list instead of from whatever happens to be next to it on disk.
+
+use std::cmp::Ordering;
+use std::fs::{self, canonicalize};
+use std::io;
+use std::path::{Path, PathBuf};
+
+use flume::Receiver;
+use once_cell::sync::Lazy;
+
+use crate::config::OPTIONS;
+use crate::spawn_thread;
+
+// With --stdin-paths the first path is read before anything is opened. The rest are read in the
+// background and added to the end of the playlist as they arrive.
+pub static STDIN_PATHS: Lazy<Option<(PathBuf, Receiver<PathBuf>)>> = Lazy::new(|| {
+    if !OPTIONS.stdin_paths {
+        return None;
+    }
+
+    let first = read_stdin_path()?;
+    let (s, r) = flume::unbounded();
+
+    spawn_thread("stdin", move || {
+        while let Some(p) = read_stdin_path() {
+            if s.send(p).is_err() {
+                break;
+            }
+        }
+    });
+
+    Some((first, r))
+});
+
+// The next non-empty line, or None once stdin is closed.
+fn read_stdin_path() -> Option<PathBuf> {
+    loop {
+        let mut line = String::new();
+        match io::stdin().read_line(&mut line) {
+            Ok(0) => return None,
+            Ok(_) => {}
+            Err(e) => {
+                error!("Error reading paths from stdin: {:?}", e);
+                return None;
+            }
+        }
+
+        let line = line.trim_end_matches(|c| c == '\n' || c == '\r');
+        if !line.trim().is_empty() {
+            return Some(line.into());
+        }
+    }
+}
+
+// Playlist files list one archive or directory per line. Blank lines and lines starting with # are
+// skipped, and relative paths are relative to the directory containing the playlist.
+pub fn read_file(file: &Path) -> Result<Vec<PathBuf>, String> {
+    let data = fs::read_to_string(file)
+        .map_err(|e| format!("Failed to read playlist {:?}: {:?}", file, e))?;
+    let dir = file.parent().unwrap_or_else(|| Path::new(""));
+
+    Ok(data
+        .lines()
+        .filter(|l| !l.trim().is_empty() && !l.starts_with('#'))
+        .map(|l| dir.join(l))
+        .collect())
+}
+
+#[derive(Debug, Default)]
+pub(super) struct Playlist {
+    // Absolute paths, so they can be compared against the paths of opened archives.
+    paths: Vec<PathBuf>,
+    incoming: Option<Receiver<PathBuf>>,
+}
+
+impl Playlist {
+    pub(super) fn new(paths: &[PathBuf]) -> Self {
+        let mut playlist = Self {
+            paths: Vec::new(),
+            incoming: STDIN_PATHS.as_ref().map(|(_, r)| r.clone()),
+        };
+        for p in paths {
+            playlist.push(p);
+        }
+        playlist
+    }
+
+    // Adds any paths that have been read from stdin since the last time.
+    fn receive(&mut self) {
+        let new: Vec<_> = match &self.incoming {
+            Some(r) => r.try_iter().collect(),
+            None => return,
+        };
+
+        for p in new {
+            self.push(&p);
+        }
+    }
+
+    pub(super) fn push(&mut self, path: &Path) {
+        match canonicalize(path) {
+            Ok(p) => self.paths.push(p),
+            Err(e) => error!("Skipping {:?} in playlist: {:?}", path, e),
+        }
+    }
+
+    pub(super) fn contains(&self, path: &Path) -> bool {
+        self.paths.iter().any(|p| p == path)
+    }
+
+    // None if the path isn't in the playlist and the usual rules apply, otherwise the next entry
+    // in the playlist, if there is one.
+    pub(super) fn next(&mut self, path: &Path, ord: Ordering) -> Option<Option<&PathBuf>> {
+        self.receive();
+        let i = self.paths.iter().position(|p| p == path)?;
+
+        Some(match ord {
+            Ordering::Greater => self.paths.get(i + 1),
+            Ordering::Less => i.checked_sub(1).and_then(|i| self.paths.get(i)),
+            Ordering::Equal => unreachable!(),
+        })
+    }
+
+    // The first or last entry, if the path is in the playlist.
+    pub(super) fn end(&mut self, path: &Path, ord: Ordering) -> Option<&PathBuf> {
+        self.receive();
+        if !self.contains(path) {
+            return None;
+        }
+
+        match ord {
+            Ordering::Greater => self.paths.last(),
+            Ordering::Less => self.paths.first(),
+            Ordering::Equal => unreachable!(),
+        }
+    }
+}
@@ -0,0 +1,287 @@
+// The last page read in each archive is stored as one small JSON file per archive in the state
+// directory, named the same way as annotations, so reopening an archive can resume from there.
+// Pages are remembered by their path inside the archive, not their index, so adding or removing
+// pages doesn't shift the saved position.
+//
+// The same files double as the reading history, which can be searched with `aw-man history`.
+
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use ahash::AHashMap;
+use gtk::glib;
+use once_cell::sync::Lazy;
+use serde::{Deserialize, Serialize};
+
+use super::annotations::path_hash;
+use super::archive::Archive;
+use super::files::is_supported_page_extension;
+use super::indices::PI;
+use super::{overrides, Manager};
+use crate::com::GuiAction;
+use crate::config::{CONFIG, OPTIONS};
+use crate::write_atomically;
+
+#[derive(Debug, Serialize, Deserialize)]
+struct ArchiveProgress {
+    archive: PathBuf,
+    page: String,
+    // The rest are only used for the history and are missing from older files.
+    // The page number starting from 1 and the number of pages when it was saved.
+    #[serde(default)]
+    number: usize,
+    #[serde(default)]
+    pages: usize,
+    // Seconds since the epoch.
+    #[serde(default)]
+    first_read: u64,
+    #[serde(default)]
+    last_read: u64,
+}
+
+#[derive(Debug, Default)]
+pub(super) struct Progress {
+    // The last page saved, to avoid rewriting the same file.
+    last: Option<(PathBuf, String)>,
+    // When the archive in last was first read, so it's only looked up once.
+    first_read: u64,
+}
+
+fn now() -> u64 {
+    SystemTime::now().duration_since(UNIX_EPOCH).map_or(0, |d| d.as_secs())
+}
+
+fn progress_path(state_dir: &Path, archive: &Path) -> PathBuf {
+    state_dir.join("progress").join(format!("{:016x}.json", path_hash(archive)))
+}
+
+fn load(state_dir: &Path, archive: &Path) -> Option<ArchiveProgress> {
+    let file = progress_path(state_dir, archive);
+    let data = fs::read(&file).ok()?;
+
+    match serde_json::from_slice::<ArchiveProgress>(&data) {
+        Ok(p) if p.archive == archive => Some(p),
+        Ok(p) => {
+            error!("Progress file {:?} belongs to {:?}, not {:?}", file, p.archive, archive);
+            None
+        }
+        Err(e) => {
+            error!("Failed to parse progress file {:?}: {:?}", file, e);
+            None
+        }
+    }
+}
+
+fn save(state_dir: &Path, progress: &ArchiveProgress) -> Result<(), String> {
+    let file = progress_path(state_dir, &progress.archive);
+    let dir = file.parent().expect("Impossible");
+    fs::create_dir_all(dir)
+        .map_err(|e| format!("Failed to create progress directory {:?}: {:?}", dir, e))?;
+
+    let data = serde_json::to_vec(progress)
+        .map_err(|e| format!("Failed to serialize progress: {:?}", e))?;
+
+    write_atomically(&file, &data)
+        .map_err(|e| format!("Failed to write progress file {:?}: {:?}", file, e))
+}
+
+#[derive(Debug, Default)]
+struct Pending {
+    progress: AHashMap<PathBuf, ArchiveProgress>,
+    saving: bool,
+}
+
+// Progress is saved on a blocking thread so turning pages never waits on the disk. Only the
+// newest progress for each archive is kept while waiting, and only one save runs at a time so
+// they can't finish out of order.
+static PENDING: Lazy<Mutex<Pending>> = Lazy::new(Mutex::default);
+
+fn save_in_background(state_dir: &Path, progress: ArchiveProgress) {
+    let mut pending = PENDING.lock().expect("Poisoned");
+    pending.progress.insert(progress.archive.clone(), progress);
+    if pending.saving {
+        return;
+    }
+    pending.saving = true;
+    drop(pending);
+
+    let state_dir = state_dir.to_path_buf();
+    tokio::task::spawn_blocking(move || loop {
+        let progress = {
+            let mut pending = PENDING.lock().expect("Poisoned");
+            let next = pending.progress.keys().next().cloned();
+            match next.and_then(|k| pending.progress.remove(&k)) {
+                Some(p) => p,
+                None => {
+                    pending.saving = false;
+                    return;
+                }
+            }
+        };
+
+        if let Err(e) = save(&state_dir, &progress) {
+            error!("{}", e);
+        }
+    });
+}
+
+// Whether progress is saved and resumed for this archive. Overrides can turn it off for series
+// that should always start from the first page, or on for only some series.
+fn enabled(archive: &Archive) -> bool {
+    archive.remembers_progress() && overrides::resume(archive.path()).unwrap_or(CONFIG.resume)
+}
+
+// Returns the page to start on after opening `opened`. That's the saved page if there is saved
+// progress for the archive and no specific image was requested, otherwise it's `page`. Resuming
+// is announced, since starting partway through an archive can be surprising.
+// Archives opened from the history with `aw-man history --open` always resume, unless
+// --no-resume was passed.
+pub(super) fn resume(
+    opened: &Path,
+    archive: &Archive,
+    page: Option<usize>,
+    from_history: bool,
+    gui_sender: &glib::Sender<GuiAction>,
+) -> Option<usize> {
+    let enabled = enabled(archive) || from_history && archive.remembers_progress();
+    if OPTIONS.no_resume || !enabled {
+        return page;
+    }
+
+    // Opening a specific image always starts on that image.
+    if is_supported_page_extension(opened) {
+        return page;
+    }
+
+    let state_dir = match &CONFIG.state_directory {
+        Some(d) => d,
+        None => return page,
+    };
+
+    load(state_dir, archive.path())
+        .and_then(|saved| archive.find_page(&saved.page))
+        .map_or(page, |p| {
+            debug!("Resuming {:?} on page {}", archive.path(), p + 1);
+            if Some(p) != page {
+                let msg = format!("Resumed at page {}", p + 1);
+                Manager::send_gui(gui_sender, GuiAction::Osd(msg));
+            }
+            Some(p)
+        })
+}
+
+impl Progress {
+    // Saves the current page of the archive, if it's a kind of archive that can be resumed and
+    // either resume or the history is enabled for it.
+    pub(super) fn record(&mut self, archive: &Archive, p: PI) {
+        if !archive.remembers_progress() || !CONFIG.history && !enabled(archive) {
+            return;
+        }
+
+        let state_dir = match &CONFIG.state_directory {
+            Some(d) => d,
+            None => return,
+        };
+
+        let page = archive.page_rel_path(p);
+        let now = now();
+        match &self.last {
+            Some((a, p)) if a == archive.path() && *p == page => return,
+            Some((a, _)) if a == archive.path() => {}
+            _ => {
+                self.first_read = load(state_dir, archive.path())
+                    .map(|saved| saved.first_read)
+                    .filter(|t| *t != 0)
+                    .unwrap_or(now);
+            }
+        }
+
+        self.last = Some((archive.path().to_path_buf(), page.clone()));
+        let progress = ArchiveProgress {
+            archive: archive.path().to_path_buf(),
+            page,
+            number: p.0 + 1,
+            pages: archive.page_count(),
+            first_read: self.first_read,
+            last_read: now,
+        };
+        save_in_background(state_dir, progress);
+    }
+}
+
+// How far through an archive the saved progress is, for showing whether it has been read.
+// Returns None when there's no state directory to read it from.
+pub fn read_status(archive: &Path) -> Option<String> {
+    let state_dir = CONFIG.state_directory.as_ref()?;
+    let status = match load(state_dir, archive) {
+        None => "Unread".to_string(),
+        Some(p) if p.pages == 0 => "Started".to_string(),
+        Some(p) if p.number >= p.pages => "Read".to_string(),
+        Some(p) => format!("{}/{}", p.number, p.pages),
+    };
+    Some(status)
+}
+
+// Everything in the history with all of the words in its path, ignoring case, most recently read
+// first.
+fn search(state_dir: &Path, query: &[String]) -> Vec<ArchiveProgress> {
+    let words: Vec<_> = query.iter().map(|w| w.to_lowercase()).collect();
+
+    let entries = match fs::read_dir(state_dir.join("progress")) {
+        Ok(entries) => entries,
+        Err(_) => return Vec::new(),
+    };
+
+    let mut found: Vec<_> = entries
+        .filter_map(|e| e.ok())
+        .filter(|e| e.path().extension().map_or(false, |ext| ext == "json"))
+        .filter_map(|e| serde_json::from_slice::<ArchiveProgress>(&fs::read(e.path()).ok()?).ok())
+        .filter(|p| {
+            let path = p.archive.to_string_lossy().to_lowercase();
+            words.iter().all(|w| path.contains(w))
+        })
+        .collect();
+
+    found.sort_by_key(|p| std::cmp::Reverse(p.last_read));
+    found
+}
+
+fn age(secs: u64) -> String {
+    let elapsed = now().saturating_sub(secs);
+    match elapsed {
+        _ if secs == 0 => "unknown".to_string(),
+        0..=59 => "just now".to_string(),
+        60..=3599 => format!("{} minutes ago", elapsed / 60),
+        3600..=86399 => format!("{} hours ago", elapsed / 3600),
+        _ => format!("{} days ago", elapsed / 86400),
+    }
+}
+
+// Prints the matching history for `aw-man history`. Always returns false, so aw-man exits.
+pub fn print_history(query: &[String]) -> bool {
+    let state_dir = match &CONFIG.state_directory {
+        Some(d) => d,
+        None => {
+            eprintln!("state_directory must be set to keep a history");
+            return false;
+        }
+    };
+
+    for p in search(state_dir, query) {
+        let page = if p.pages == 0 {
+            p.page.clone()
+        } else {
+            format!("{}/{}", p.number, p.pages)
+        };
+        println!("{:<16} {:>9}  {}", age(p.last_read), page, p.archive.to_string_lossy());
+    }
+    false
+}
+
+// The most recently read match that still exists, for `aw-man history --open`.
+pub fn most_recent_match(query: &[String]) -> Option<PathBuf> {
+    let state_dir = CONFIG.state_directory.as_ref()?;
+    search(state_dir, query).into_iter().map(|p| p.archive).find(|a| a.exists())
+}
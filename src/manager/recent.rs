@@ -0,0 +1,83 @@
+// A list of the most recently read archives and directories, newest first, stored in the state
+// directory. It's shared by every running instance, so it's reread before each update.
+
+use std::fs;
+use std::path::{Path, PathBuf};
+
+use super::archive::Archive;
+use crate::config::CONFIG;
+use crate::write_atomically;
+
+const MAX_ENTRIES: usize = 50;
+
+#[derive(Debug, Default)]
+pub(super) struct Recent {
+    // The last archive recorded, to avoid rewriting the file on every page.
+    last: Option<PathBuf>,
+}
+
+fn recent_path(state_dir: &Path) -> PathBuf {
+    state_dir.join("recent.json")
+}
+
+fn load(state_dir: &Path) -> Vec<PathBuf> {
+    let file = recent_path(state_dir);
+    let data = match fs::read(&file) {
+        Ok(data) => data,
+        Err(_) => return Vec::new(),
+    };
+
+    serde_json::from_slice(&data).unwrap_or_else(|e| {
+        error!("Failed to parse recent files {:?}: {:?}", file, e);
+        Vec::new()
+    })
+}
+
+fn save(state_dir: &Path, recent: &[PathBuf]) -> Result<(), String> {
+    fs::create_dir_all(state_dir)
+        .map_err(|e| format!("Failed to create state directory {:?}: {:?}", state_dir, e))?;
+
+    let file = recent_path(state_dir);
+    let data = serde_json::to_vec_pretty(recent)
+        .map_err(|e| format!("Failed to serialize recent files: {:?}", e))?;
+
+    write_atomically(&file, &data)
+        .map_err(|e| format!("Failed to write recent files {:?}: {:?}", file, e))
+}
+
+// Recently read archives that still exist, newest first.
+pub fn list() -> Vec<PathBuf> {
+    match &CONFIG.state_directory {
+        Some(d) => load(d).into_iter().filter(|p| p.exists()).collect(),
+        None => Vec::new(),
+    }
+}
+
+pub fn most_recent() -> Option<PathBuf> {
+    list().into_iter().next()
+}
+
+impl Recent {
+    pub(super) fn record(&mut self, archive: &Archive) {
+        if !archive.remembers_progress() || self.last.as_deref() == Some(archive.path()) {
+            return;
+        }
+
+        let state_dir = match &CONFIG.state_directory {
+            Some(d) => d,
+            None => return,
+        };
+
+        let path = archive.path().to_path_buf();
+        let mut recent = load(state_dir);
+        recent.retain(|p| *p != path);
+        recent.insert(0, path.clone());
+        recent.truncate(MAX_ENTRIES);
+
+        if let Err(e) = save(state_dir, &recent) {
+            error!("{}", e);
+        }
+        // Even on failure, don't retry on every page.
+        self.last = Some(path);
+    }
+}
@@ -0,0 +1,220 @@
+// Parsing for commands run by the Execute action, so they can be given arguments.
+//
+// Commands are split into words the way a shell would, with single quotes, double quotes, and
+// backslash escapes, but nothing is expanded except the substitutions below. Substitution happens
+// after splitting, so a path containing spaces is still passed as a single argument.
+//   %f - the current file, AWMAN_CURRENT_FILE
+//   %p - the current page number, AWMAN_PAGE_NUMBER
+//   %a - the current archive or directory, AWMAN_ARCHIVE
+//   %% - a literal %
+
+use std::ffi::{OsStr, OsString};
+
+// Backslashes only escape characters that would otherwise be special, so Windows paths like
+// C:\bin\tool.exe don't need to be doubled up.
+const fn escapable(c: char) -> bool {
+    matches!(c, '\\' | '"' | '\'' | ' ' | '\t' | '\n')
+}
+
+pub(super) fn split(s: &str) -> Result<Vec<String>, String> {
+    let mut words = Vec::new();
+    let mut word = String::new();
+    // Distinguishes an empty quoted word, like '', from no word at all.
+    let mut in_word = false;
+    let mut chars = s.chars().peekable();
+
+    while let Some(c) = chars.next() {
+        match c {
+            c if c.is_whitespace() => {
+                if in_word {
+                    words.push(std::mem::take(&mut word));
+                    in_word = false;
+                }
+            }
+            '\'' => {
+                in_word = true;
+                loop {
+                    match chars.next() {
+                        Some('\'') => break,
+                        Some(c) => word.push(c),
+                        None => return Err(format!("Unterminated single quote in {:?}", s)),
+                    }
+                }
+            }
+            '"' => {
+                in_word = true;
+                loop {
+                    match chars.next() {
+                        Some('"') => break,
+                        Some('\\') if matches!(chars.peek(), Some('"' | '\\')) => {
+                            word.push(chars.next().expect("Impossible"));
+                        }
+                        Some(c) => word.push(c),
+                        None => return Err(format!("Unterminated double quote in {:?}", s)),
+                    }
+                }
+            }
+            '\\' if chars.peek().map_or(false, |c| escapable(*c)) => {
+                in_word = true;
+                word.push(chars.next().expect("Impossible"));
+            }
+            c => {
+                in_word = true;
+                word.push(c);
+            }
+        }
+    }
+
+    if in_word {
+        words.push(word);
+    }
+    Ok(words)
+}
+
+// Quotes a word so that split() returns it unchanged, for arguments that are already separate.
+pub fn quote(word: &str) -> String {
+    format!("'{}'", word.replace('\'', r"'\''"))
+}
+
+// Quotes an argument and escapes anything substitute() would replace, so it reaches the executable
+// exactly as given.
+pub fn quote_literal(word: &str) -> String {
+    quote(&word.replace('%', "%%"))
+}
+
+// Splits a shortcut into the actions chained with semicolons. Quotes and escapes are tracked the
+// same way as in split() so semicolons inside quoted arguments stay part of their action, but
+// they're left in place for each action to be parsed as usual.
+pub fn split_actions(s: &str) -> Vec<&str> {
+    let mut actions = Vec::new();
+    let mut start = 0;
+    let mut quote = None;
+    let mut chars = s.char_indices().peekable();
+
+    while let Some((i, c)) = chars.next() {
+        match (quote, c) {
+            (Some(q), c) if c == q => quote = None,
+            (Some('"'), '\\') if matches!(chars.peek(), Some((_, '"' | '\\'))) => {
+                chars.next();
+            }
+            (Some(_), _) => {}
+            (None, '\'' | '"') => quote = Some(c),
+            (None, '\\') if chars.peek().map_or(false, |(_, c)| escapable(*c)) => {
+                chars.next();
+            }
+            (None, ';') => {
+                actions.push(s[start..i].trim());
+                start = i + 1;
+            }
+            _ => {}
+        }
+    }
+
+    actions.push(s[start..].trim());
+    actions.retain(|a| !a.is_empty());
+    actions
+}
+
+// Replaces the substitutions in a single word. `env` is the same set of variables passed to the
+// executable.
+pub(super) fn substitute(word: &str, env: &[(String, OsString)]) -> Result<OsString, String> {
+    let lookup = |name: &str| {
+        env.iter()
+            .find(|(k, _)| k == name)
+            .map(|(_, v)| v.as_os_str())
+            .ok_or_else(|| format!("{} is not available for {:?}", name, word))
+    };
+
+    let mut out = OsString::new();
+    let mut chars = word.chars();
+    while let Some(c) = chars.next() {
+        if c != '%' {
+            out.push(c.encode_utf8(&mut [0; 4]) as &str);
+            continue;
+        }
+
+        let value: &OsStr = match chars.next() {
+            Some('f') => lookup("AWMAN_CURRENT_FILE")?,
+            Some('p') => lookup("AWMAN_PAGE_NUMBER")?,
+            Some('a') => lookup("AWMAN_ARCHIVE")?,
+            Some('%') => OsStr::new("%"),
+            Some(c) => {
+                // Unknown substitutions are left alone.
+                out.push("%");
+                out.push(c.encode_utf8(&mut [0; 4]) as &str);
+                continue;
+            }
+            None => OsStr::new("%"),
+        };
+        out.push(value);
+    }
+
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn words(s: &str) -> Vec<String> {
+        split(s).unwrap()
+    }
+
+    #[test]
+    fn splitting() {
+        assert_eq!(words("  save.sh  -d  /tmp "), ["save.sh", "-d", "/tmp"]);
+        assert_eq!(words(r#"tag 'a b' "c \"d\"" e\ f"#), ["tag", "a b", "c \"d\"", "e f"]);
+        assert_eq!(words(r#"x '' "" y"#), ["x", "", "", "y"]);
+        assert_eq!(words(r"C:\bin\tool.exe --out=a'b c'"), [r"C:\bin\tool.exe", "--out=ab c"]);
+        assert_eq!(words(""), Vec::<String>::new());
+
+        assert!(split("echo 'a").is_err());
+        assert!(split("echo \"a").is_err());
+    }
+
+    #[test]
+    fn quoting() {
+        let args = ["a b", "it's", "", r#"C:\bin "x"\"#, "%f"];
+        let quoted: Vec<_> = args.iter().map(|a| quote(a)).collect();
+        assert_eq!(words(&quoted.join(" ")), args);
+    }
+
+    #[test]
+    fn literal_quoting() {
+        let env = vec![("AWMAN_CURRENT_FILE".to_string(), OsString::from("/tmp/a.png"))];
+        for arg in ["%f", "100%", "%%f", "it's 50%"] {
+            let word = words(&quote_literal(arg)).remove(0);
+            assert_eq!(substitute(&word, &env).unwrap(), arg);
+        }
+    }
+
+    #[test]
+    fn action_splitting() {
+        assert_eq!(split_actions("ToggleUpscaling; NextPage;"), ["ToggleUpscaling", "NextPage"]);
+        assert_eq!(split_actions("NextPage"), ["NextPage"]);
+        assert_eq!(split_actions(" ; "), Vec::<&str>::new());
+        assert_eq!(
+            split_actions("Execute sh -c 'a; b'; NextPage"),
+            ["Execute sh -c 'a; b'", "NextPage"]
+        );
+        assert_eq!(
+            split_actions(r#"Execute tag "x;\"y;" z\'; Quit"#),
+            [r#"Execute tag "x;\"y;" z\'"#, "Quit"]
+        );
+    }
+
+    #[test]
+    fn substitution() {
+        let env = vec![
+            ("AWMAN_CURRENT_FILE".to_string(), OsString::from("/tmp/a b.png")),
+            ("AWMAN_PAGE_NUMBER".to_string(), OsString::from("7")),
+            ("AWMAN_ARCHIVE".to_string(), OsString::from("/c.zip")),
+        ];
+
+        assert_eq!(substitute("%f", &env).unwrap(), "/tmp/a b.png");
+        assert_eq!(substitute("--page=%p", &env).unwrap(), "--page=7");
+        assert_eq!(substitute("%a:%p", &env).unwrap(), "/c.zip:7");
+        assert_eq!(substitute("100%% %x %", &env).unwrap(), "100% %x %");
+        assert!(substitute("%f", &[]).is_err());
+    }
+}
@@ -0,0 +1,42 @@
+// Sort options shared by directories and sibling archives. They start from the config and can be
+// toggled at runtime, but only take effect when archives are reopened.
+
+use std::fs;
+use std::path::Path;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::SystemTime;
+
+use once_cell::sync::Lazy;
+
+use crate::config::CONFIG;
+
+static BY_TIME: Lazy<AtomicBool> =
+    Lazy::new(|| AtomicBool::new(CONFIG.sort_by_modification_time));
+static REVERSED: Lazy<AtomicBool> = Lazy::new(|| AtomicBool::new(CONFIG.reverse_sort));
+
+pub(super) fn by_time() -> bool {
+    BY_TIME.load(Ordering::Relaxed)
+}
+
+// Returns whether sorting by modification time is now enabled.
+pub(super) fn toggle_by_time() -> bool {
+    !BY_TIME.fetch_xor(true, Ordering::Relaxed)
+}
+
+// The modification time to sort path by, if sorting by time is enabled. Files that can't be read
+// sort as if they're the oldest.
+pub(super) fn modified(path: &Path) -> Option<SystemTime> {
+    if !by_time() {
+        return None;
+    }
+    Some(fs::metadata(path).and_then(|m| m.modified()).unwrap_or(SystemTime::UNIX_EPOCH))
+}
+
+pub(super) fn reversed() -> bool {
+    REVERSED.load(Ordering::Relaxed)
+}
+
+// Returns whether sorting is now reversed.
+pub(super) fn toggle_reversed() -> bool {
+    !REVERSED.fetch_xor(true, Ordering::Relaxed)
+}
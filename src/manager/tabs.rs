@@ -0,0 +1,127 @@
+// Every tab has its own chain of open archives and its own place in them. Only the active tab's
+// archives live in Manager::archives, the others are kept open here with their images unloaded,
+// so switching back doesn't need to open or extract anything again. All tabs share the same
+// workers and temp directory.
+
+use std::cell::RefCell;
+use std::collections::VecDeque;
+use std::path::PathBuf;
+use std::rc::Rc;
+
+use super::actions::respond_error;
+use super::archive::Archive;
+use super::files::{is_archive_path, is_supported_page_extension};
+use super::indices::{PageIndices, PI};
+use super::{progress, Archives, Manager};
+use crate::com::CommandResponder;
+
+#[derive(Debug)]
+pub(super) struct Tab {
+    archives: Archives,
+    current: PageIndices,
+}
+
+impl Tab {
+    fn unload(&self) {
+        for a in self.archives.borrow().iter() {
+            for p in 0..a.page_count() {
+                a.unload(PI(p));
+            }
+        }
+    }
+
+    pub(super) async fn join(self) {
+        drop(self.current);
+        for a in self.archives.take() {
+            a.join().await;
+        }
+    }
+}
+
+#[derive(Debug, Default)]
+pub(super) struct Tabs {
+    // The active tab is None, since its state is in the Manager.
+    tabs: Vec<Option<Tab>>,
+    active: usize,
+}
+
+impl Tabs {
+    pub(super) fn take_all(&mut self) -> impl Iterator<Item = Tab> {
+        std::mem::take(&mut self.tabs).into_iter().flatten()
+    }
+}
+
+impl Manager {
+    // Opens path, or the current archive at the current page, in a new tab after the others.
+    pub(super) fn new_tab(&mut self, path: Option<PathBuf>, resp: Option<CommandResponder>) {
+        let resume = path.is_some();
+        let path = match path {
+            Some(p) => p,
+            None => self.current.archive().path().to_path_buf(),
+        };
+
+        if !path.exists() {
+            return respond_error(format!("{:?} does not exist", path), resp);
+        }
+
+        if !path.is_dir() && !is_archive_path(&path) && !is_supported_page_extension(&path) {
+            let e = format!("{:?} is not a supported archive, directory, or file", path);
+            return respond_error(e, resp);
+        }
+
+        let (a, p) = Archive::open(path.clone(), &self.temp_dir);
+        let p = if resume {
+            progress::resume(&path, &a, p, false, &self.gui_sender)
+        } else {
+            self.current.p().map(|p| p.0).filter(|p| *p < a.page_count()).or(p)
+        };
+
+        let archives = Rc::new(RefCell::new(VecDeque::from([a])));
+        let current = PageIndices::new(0, p, archives.clone());
+
+        if self.tabs.tabs.is_empty() {
+            self.tabs.tabs.push(None);
+        }
+        self.tabs.tabs.push(Some(Tab { archives, current }));
+        self.activate_tab(self.tabs.tabs.len() - 1);
+    }
+
+    pub(super) fn switch_tab(&mut self, i: usize) {
+        if i == self.tabs.active || i >= self.tabs.tabs.len() {
+            return;
+        }
+        self.activate_tab(i);
+    }
+
+    // Closes the active tab and switches to the one that takes its place.
+    pub(super) fn close_tab(&mut self) {
+        if self.tabs.tabs.len() <= 1 {
+            return;
+        }
+
+        let closing = self.tabs.active;
+        let next = if closing + 1 < self.tabs.tabs.len() { closing + 1 } else { closing - 1 };
+        self.activate_tab(next);
+
+        let tab = self.tabs.tabs.remove(closing).expect("Closed the active tab");
+        if self.tabs.active > closing {
+            self.tabs.active -= 1;
+        }
+        debug!("Closing tab {:?}", tab);
+        tokio::task::spawn_local(tab.join());
+    }
+
+    fn activate_tab(&mut self, i: usize) {
+        let next = self.tabs.tabs[i].take().expect("Switched to the active tab");
+        let old = Tab {
+            archives: std::mem::replace(&mut self.archives, next.archives),
+            current: std::mem::replace(&mut self.current, next.current),
+        };
+        old.unload();
+        self.tabs.tabs[self.tabs.active] = Some(old);
+        self.tabs.active = i;
+
+        self.reset_indices();
+        self.maybe_open_new_archives();
+    }
+}
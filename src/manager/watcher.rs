@@ -0,0 +1,134 @@
+// Watches a directory for files being added, removed, or finished, using GIO's file monitors.
+// The manager thread has no GLib main loop, so each watcher runs one on its own thread.
+
+use std::cell::Cell;
+use std::future;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use flume::Receiver;
+use gtk::gio::{self, FileMonitorEvent, FileMonitorFlags};
+use gtk::glib;
+use gtk::prelude::*;
+use tokio::time::{sleep_until, Instant};
+
+use crate::spawn_thread;
+
+// Downloads and copies produce bursts of events, so wait for them to settle before rereading.
+const SETTLE: Duration = Duration::from_millis(500);
+
+#[derive(Debug)]
+pub(super) struct Watcher {
+    path: PathBuf,
+    ctx: glib::MainContext,
+    main_loop: glib::MainLoop,
+    changes: Receiver<()>,
+    // When the current burst of changes is considered settled, pushed back by every change.
+    deadline: Cell<Option<Instant>>,
+}
+
+impl Drop for Watcher {
+    fn drop(&mut self) {
+        // Invoked on the watcher's own context so it still works if the loop hasn't started yet.
+        let ml = self.main_loop.clone();
+        self.ctx.invoke(move || ml.quit());
+    }
+}
+
+impl Watcher {
+    pub(super) fn new(path: PathBuf) -> Self {
+        let ctx = glib::MainContext::new();
+        let main_loop = glib::MainLoop::new(Some(&ctx), false);
+        let (sender, changes) = flume::unbounded();
+
+        let ml = main_loop.clone();
+        let p = path.clone();
+        let thread_ctx = ctx.clone();
+        spawn_thread("watcher", move || {
+            let r = thread_ctx.with_thread_default(|| {
+                let monitor = match gio::File::for_path(&p)
+                    .monitor_directory(FileMonitorFlags::WATCH_MOVES, gio::Cancellable::NONE)
+                {
+                    Ok(m) => m,
+                    Err(e) => return error!("Failed to watch {:?}: {}", p, e),
+                };
+
+                monitor.connect_changed(move |_, _, _, event| match event {
+                    FileMonitorEvent::Created
+                    | FileMonitorEvent::Deleted
+                    | FileMonitorEvent::ChangesDoneHint
+                    | FileMonitorEvent::Renamed
+                    | FileMonitorEvent::MovedIn
+                    | FileMonitorEvent::MovedOut => drop(sender.send(())),
+                    _ => (),
+                });
+
+                trace!("Watching {:?}", p);
+                ml.run();
+            });
+
+            if let Err(e) = r {
+                error!("Failed to start watching {:?}: {}", p, e);
+            }
+        });
+
+        Self {
+            path,
+            ctx,
+            main_loop,
+            changes,
+            deadline: Cell::default(),
+        }
+    }
+
+    // Resolves once a burst of changes has settled. Safe to cancel and call again.
+    pub(super) async fn changed(&self) {
+        loop {
+            match self.deadline.get() {
+                None => {
+                    if self.changes.recv_async().await.is_err() {
+                        // The watcher failed to start, so nothing will ever change.
+                        return future::pending().await;
+                    }
+                    self.deadline.set(Some(Instant::now() + SETTLE));
+                }
+                Some(deadline) => {
+                    tokio::select! {
+                        _ = sleep_until(deadline) => {}
+                        r = self.changes.recv_async() => {
+                            if r.is_ok() {
+                                // Still changing, so wait until it's been quiet for a while.
+                                self.deadline.set(Some(Instant::now() + SETTLE));
+                                continue;
+                            }
+                            sleep_until(deadline).await;
+                        }
+                    };
+
+                    self.deadline.set(None);
+                    self.changes.drain();
+                    return;
+                }
+            }
+        }
+    }
+}
+
+// Starts watching path if it isn't already being watched, or stops watching if there's no path.
+pub(super) fn watch(watcher: &mut Option<Watcher>, path: Option<&Path>) {
+    match path {
+        Some(p) if watcher.as_ref().map_or(true, |w| w.path != p) => {
+            *watcher = Some(Watcher::new(p.to_path_buf()));
+        }
+        Some(_) => {}
+        None => *watcher = None,
+    }
+}
+
+// Waits for changes from the watcher, if there is one.
+pub(super) async fn changed(watcher: &Option<Watcher>) {
+    match watcher {
+        Some(w) => w.changed().await,
+        None => future::pending().await,
+    }
+}
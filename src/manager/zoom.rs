@@ -0,0 +1,62 @@
+// Manual zoom belongs to the page it was set on, so zooming in to read small text on one page
+// doesn't carry over to every page after it. Going back to a zoomed page restores its zoom.
+
+use std::path::PathBuf;
+
+use ahash::AHashMap;
+
+use super::Manager;
+use crate::com::{Zoom, ZoomChange};
+
+#[derive(Debug, Default)]
+pub(super) struct PageZooms {
+    // The page the current zoom was last set for.
+    page: Option<(PathBuf, usize)>,
+    // Only pages that aren't at the default zoom are kept.
+    zooms: AHashMap<(PathBuf, usize), Zoom>,
+}
+
+impl Manager {
+    fn zoom_page(&self) -> Option<(PathBuf, usize)> {
+        self.current.p().map(|p| (self.current.archive().path().to_path_buf(), p.0))
+    }
+
+    // Restores the zoom of the current page if the page changed since the last call.
+    pub(super) fn apply_page_zoom(&mut self) {
+        let changed = match (&self.zooms.page, self.current.p()) {
+            (Some((a, i)), Some(p)) => *i != p.0 || a != self.current.archive().path(),
+            (None, None) => false,
+            _ => true,
+        };
+        if !changed {
+            return;
+        }
+
+        let page = self.zoom_page();
+        let zoom = page.as_ref().and_then(|p| self.zooms.zooms.get(p)).copied().unwrap_or_default();
+        self.zooms.page = page;
+
+        if zoom != self.modes.zoom {
+            self.modes.zoom = zoom;
+            self.reset_indices();
+        }
+    }
+
+    pub(super) fn zoom(&mut self, z: ZoomChange) {
+        self.modes.zoom = match z {
+            ZoomChange::In => self.modes.zoom.zoom_in(),
+            ZoomChange::Out => self.modes.zoom.zoom_out(),
+            ZoomChange::Reset => Zoom::default(),
+        };
+
+        if let Some(page) = self.zoom_page() {
+            if self.modes.zoom == Zoom::default() {
+                self.zooms.zooms.remove(&page);
+            } else {
+                self.zooms.zooms.insert(page.clone(), self.modes.zoom);
+            }
+            self.zooms.page = Some(page);
+        }
+        self.reset_indices();
+    }
+}
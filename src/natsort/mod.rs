@@ -1,5 +1,6 @@
 use std::cmp::Ordering;
 use std::ffi::{OsStr, OsString};
+use std::sync::atomic::{self, AtomicBool};
 
 use once_cell::sync::Lazy;
 use ouroboros::self_referencing;
@@ -8,6 +9,157 @@ use Segment::*;
 
 static SEGMENT_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"([^\d.]*)((\d+(\.\d+)?)|\.)").unwrap());
 
+static COLLATION: AtomicBool = AtomicBool::new(false);
+
+// Sort accented letters with their base letters and treat full-width and katakana forms like their
+// ASCII and hiragana equivalents, which is closer to how most locales order names than comparing
+// code points. Should only be called once, before anything is sorted.
+pub fn enable_collation() {
+    COLLATION.store(true, atomic::Ordering::Relaxed);
+}
+
+// Expects an already lowercase string.
+fn collate(s: &str) -> String {
+    let mut out = String::with_capacity(s.len());
+    for c in s.chars() {
+        let base = match c {
+            'à'..='å' | 'ā' | 'ă' | 'ą' => 'a',
+            'æ' => {
+                out.push_str("ae");
+                continue;
+            }
+            'ç' | 'ć' | 'ĉ' | 'ċ' | 'č' => 'c',
+            'ď' | 'đ' => 'd',
+            'è'..='ë' | 'ē' | 'ĕ' | 'ė' | 'ę' | 'ě' => 'e',
+            'ĝ' | 'ğ' | 'ġ' | 'ģ' => 'g',
+            'ì'..='ï' | 'ī' | 'į' | 'ı' => 'i',
+            'ĺ' | 'ļ' | 'ľ' | 'ł' => 'l',
+            'ñ' | 'ń' | 'ņ' | 'ň' => 'n',
+            'ò'..='ö' | 'ø' | 'ō' | 'ő' => 'o',
+            'œ' => {
+                out.push_str("oe");
+                continue;
+            }
+            'ŕ' | 'ř' => 'r',
+            'ś' | 'ŝ' | 'ş' | 'š' => 's',
+            'ß' => {
+                out.push_str("ss");
+                continue;
+            }
+            'ţ' | 'ť' => 't',
+            'ù'..='ü' | 'ū' | 'ů' | 'ű' | 'ų' => 'u',
+            'ý' | 'ÿ' => 'y',
+            'ź' | 'ż' | 'ž' => 'z',
+            // Full-width ASCII
+            '\u{ff01}'..='\u{ff5e}' => char::from_u32(c as u32 - 0xfee0).unwrap_or(c),
+            // Katakana to hiragana
+            '\u{30a1}'..='\u{30f6}' => char::from_u32(c as u32 - 0x60).unwrap_or(c),
+            _ => c,
+        };
+        out.push(base);
+    }
+    out
+}
+
+static VOLUME_NUMBERS: AtomicBool = AtomicBool::new(false);
+
+static ROMAN_RE: Lazy<Regex> = Lazy::new(|| {
+    Regex::new(r"\b(vol(?:ume)?|part|book|tome|act|season)(\.?\s*)([ivxlcdm]+)\b").unwrap()
+});
+static KANJI_VOLUME_RE: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"([〇一二三四五六七八九十百]+)巻").unwrap());
+static HALF_VOLUME_RE: Lazy<Regex> =
+    Lazy::new(|| Regex::new(r"(^|[^\p{L}])([上中下])(巻|[^\p{L}]|$)").unwrap());
+
+// Read roman numerals after keywords like "Volume", kanji volume numbers, and 上/中/下 as
+// numbers so multi-volume series sort in order. Should only be called once, before anything is sorted.
+pub fn enable_volume_numbers() {
+    VOLUME_NUMBERS.store(true, atomic::Ordering::Relaxed);
+}
+
+fn roman_value(s: &str) -> Option<u32> {
+    static STRICT: Lazy<Regex> = Lazy::new(|| {
+        Regex::new(r"^m{0,3}(cm|cd|d?c{0,3})(xc|xl|l?x{0,3})(ix|iv|v?i{0,3})$").unwrap()
+    });
+    if s.is_empty() || !STRICT.is_match(s) {
+        return None;
+    }
+
+    let value = |c| match c {
+        'i' => 1,
+        'v' => 5,
+        'x' => 10,
+        'l' => 50,
+        'c' => 100,
+        'd' => 500,
+        'm' => 1000,
+        _ => unreachable!(),
+    };
+
+    let mut total = 0;
+    let mut chars = s.chars().map(value).peekable();
+    while let Some(v) = chars.next() {
+        match chars.peek() {
+            Some(next) if *next > v => total -= v,
+            _ => total += v,
+        }
+    }
+    u32::try_from(total).ok()
+}
+
+fn kanji_value(s: &str) -> u32 {
+    let mut total = 0;
+    let mut current = 0;
+    for c in s.chars() {
+        match c {
+            '十' => {
+                total += current.max(1) * 10;
+                current = 0;
+            }
+            '百' => {
+                total += current.max(1) * 100;
+                current = 0;
+            }
+            _ => {
+                let d = "〇一二三四五六七八九".chars().position(|k| k == c).unwrap_or(0);
+                current = current * 10 + d as u32;
+            }
+        }
+    }
+    total + current
+}
+
+fn volume_numbers(s: &str) -> String {
+    let s = ROMAN_RE.replace_all(s, |c: &regex::Captures| match roman_value(&c[3]) {
+        Some(n) => format!("{}{}{}", &c[1], &c[2], n),
+        None => c[0].to_string(),
+    });
+    let s = KANJI_VOLUME_RE.replace_all(&s, |c: &regex::Captures| {
+        format!("{}巻", kanji_value(&c[1]))
+    });
+    let s = HALF_VOLUME_RE.replace_all(&s, |c: &regex::Captures| {
+        let n = match &c[2] {
+            "上" => 1,
+            "中" => 2,
+            _ => 3,
+        };
+        format!("{}{}{}", &c[1], n, &c[3])
+    });
+    s.into_owned()
+}
+
+fn normalize(s: &OsStr) -> String {
+    let lowercase = s.to_string_lossy().to_lowercase();
+    let collated =
+        if COLLATION.load(atomic::Ordering::Relaxed) { collate(&lowercase) } else { lowercase };
+
+    if VOLUME_NUMBERS.load(atomic::Ordering::Relaxed) {
+        volume_numbers(&collated)
+    } else {
+        collated
+    }
+}
+
 #[derive(PartialEq, Debug)]
 enum Segment<'a> {
     Seg(&'a str, f64),
@@ -82,14 +234,14 @@ impl ParsedString {
 #[must_use]
 pub fn key(s: &OsStr) -> ParsedString {
     let original = s.to_owned();
-    let lowercase = original.to_string_lossy().to_lowercase();
+    let lowercase = normalize(&original);
 
     ParsedString::from_strings(original, lowercase)
 }
 
 impl From<OsString> for ParsedString {
     fn from(original: OsString) -> Self {
-        let lowercase = original.to_string_lossy().to_lowercase();
+        let lowercase = normalize(&original);
 
         Self::from_strings(original, lowercase)
     }
@@ -126,7 +278,7 @@ mod tests {
     use std::cmp::Ordering;
     use std::ffi::OsStr;
 
-    use super::key;
+    use super::{collate, key, volume_numbers, ParsedString};
 
     fn compare(a: &str, b: &str) -> Ordering {
         let a = key(OsStr::new(a));
@@ -214,6 +366,49 @@ mod tests {
         // lt("あ", "ア");
     }
 
+    fn collated_lt(a: &str, b: &str) {
+        let k = |s: &str| ParsedString::from_strings(s.into(), collate(&s.to_lowercase()));
+        assert_eq!(k(a).cmp(&k(b)), Ordering::Less);
+        assert_eq!(k(b).cmp(&k(a)), Ordering::Greater);
+    }
+
+    #[test]
+    fn collation() {
+        assert_eq!(collate("ärger straße"), "arger strasse");
+        assert_eq!(collate("ｖｏｌ１"), "vol1");
+        assert_eq!(collate("アイ"), "あい");
+
+        collated_lt("Äpfel", "Birnen");
+        collated_lt("Ecole", "École");
+        collated_lt("École", "Etude");
+        collated_lt("ア", "い");
+        collated_lt("ｖｏｌ２", "vol10");
+    }
+
+    fn volume_lt(a: &str, b: &str) {
+        let k = |s: &str| ParsedString::from_strings(s.into(), volume_numbers(&s.to_lowercase()));
+        assert_eq!(k(a).cmp(&k(b)), Ordering::Less);
+        assert_eq!(k(b).cmp(&k(a)), Ordering::Greater);
+    }
+
+    #[test]
+    fn volumes() {
+        assert_eq!(volume_numbers("volume ii"), "volume 2");
+        assert_eq!(volume_numbers("vol.xiv"), "vol.14");
+        assert_eq!(volume_numbers("part iiii"), "part iiii");
+        assert_eq!(volume_numbers("i vol"), "i vol");
+        assert_eq!(volume_numbers("第二十三巻"), "第23巻");
+        assert_eq!(volume_numbers("title 上.zip"), "title 1.zip");
+        assert_eq!(volume_numbers("上下"), "上下");
+
+        volume_lt("Volume II", "Volume X");
+        volume_lt("Part IX", "Part X");
+        volume_lt("Vol. IV", "Vol. 5");
+        volume_lt("第九巻", "第十巻");
+        volume_lt("Title 上巻", "Title 中巻");
+        volume_lt("Title (中)", "Title (下)");
+    }
+
     #[test]
     fn sort_no_number_before_number() {
         lt("m.png", "m2.png")
@@ -0,0 +1,120 @@
+// Trims uniform white or black borders, like the margins on scanned pages, from decoded images.
+// Cropping happens on every decode so the scanned resolution always matches the loaded image.
+
+use image::{DynamicImage, GenericImageView, Rgba};
+
+use crate::com::Res;
+use crate::config::CONFIG;
+
+// Borders are only trimmed if at least this fraction of each dimension is left.
+const MIN_REMAINING: f64 = 0.5;
+
+fn near(a: u8, b: u8, threshold: u8) -> bool {
+    a.max(b) - a.min(b) <= threshold
+}
+
+fn is_blank(p: Rgba<u8>, threshold: u8) -> bool {
+    let [r, g, b, _] = p.0;
+    [r, g, b].iter().all(|c| *c <= threshold) || [r, g, b].iter().all(|c| *c >= 255 - threshold)
+}
+
+// Returns the (x, y, width, height) of the area inside the borders, if there are any to remove.
+fn crop_bounds(img: &DynamicImage, threshold: u8) -> Option<(u32, u32, u32, u32)> {
+    let (w, h) = img.dimensions();
+    if w < 3 || h < 3 {
+        return None;
+    }
+
+    let bg = img.get_pixel(0, 0);
+    if !is_blank(bg, threshold) {
+        return None;
+    }
+
+    let matches = |x, y| {
+        let p = img.get_pixel(x, y);
+        (0..3).all(|c| near(p.0[c], bg.0[c], threshold))
+    };
+    let row_uniform = |y| (0..w).all(|x| matches(x, y));
+
+    // Entirely blank images are left alone.
+    let top = (0..h).find(|y| !row_uniform(*y))?;
+    let bottom = (top..h).rev().find(|y| !row_uniform(*y))? + 1;
+
+    let col_uniform = |x| (top..bottom).all(|y| matches(x, y));
+    let left = (0..w).find(|x| !col_uniform(*x))?;
+    let right = (left..w).rev().find(|x| !col_uniform(*x))? + 1;
+
+    let (cw, ch) = (right - left, bottom - top);
+    if (cw, ch) == (w, h)
+        || f64::from(cw) < f64::from(w) * MIN_REMAINING
+        || f64::from(ch) < f64::from(h) * MIN_REMAINING
+    {
+        return None;
+    }
+
+    Some((left, top, cw, ch))
+}
+
+pub fn enabled() -> bool {
+    CONFIG.autocrop_threshold != 0
+}
+
+pub fn autocrop(img: DynamicImage) -> DynamicImage {
+    if !enabled() {
+        return img;
+    }
+
+    match crop_bounds(&img, CONFIG.autocrop_threshold) {
+        Some((x, y, w, h)) => img.crop_imm(x, y, w, h),
+        None => img,
+    }
+}
+
+// The resolution the image will have after cropping, without copying it.
+pub fn cropped_res(img: &DynamicImage) -> Res {
+    if !enabled() {
+        return img.dimensions().into();
+    }
+
+    crop_bounds(img, CONFIG.autocrop_threshold)
+        .map_or_else(|| img.dimensions().into(), |(_, _, w, h)| (w, h).into())
+}
+
+#[cfg(test)]
+mod tests {
+    use image::RgbImage;
+
+    use super::*;
+
+    fn page(w: u32, h: u32, bg: u8, content: (u32, u32, u32, u32)) -> DynamicImage {
+        let (x, y, cw, ch) = content;
+        let img = RgbImage::from_fn(w, h, |px, py| {
+            if px >= x && px < x + cw && py >= y && py < y + ch {
+                image::Rgb([120, 60, 30])
+            } else {
+                image::Rgb([bg, bg, bg])
+            }
+        });
+        DynamicImage::ImageRgb8(img)
+    }
+
+    #[test]
+    fn crops_margins() {
+        assert_eq!(crop_bounds(&page(100, 100, 255, (10, 5, 80, 85)), 16), Some((10, 5, 80, 85)));
+        assert_eq!(crop_bounds(&page(100, 100, 0, (0, 20, 100, 60)), 16), Some((0, 20, 100, 60)));
+        // Slightly off-white scans still count.
+        assert_eq!(crop_bounds(&page(100, 100, 245, (10, 10, 80, 80)), 16), Some((10, 10, 80, 80)));
+    }
+
+    #[test]
+    fn leaves_pages_alone() {
+        // No borders
+        assert_eq!(crop_bounds(&page(100, 100, 255, (0, 0, 100, 100)), 16), None);
+        // Coloured backgrounds aren't margins.
+        assert_eq!(crop_bounds(&page(100, 100, 128, (10, 10, 80, 80)), 16), None);
+        // Blank pages
+        assert_eq!(crop_bounds(&page(100, 100, 255, (0, 0, 0, 0)), 16), None);
+        // Too much would be removed
+        assert_eq!(crop_bounds(&page(100, 100, 255, (40, 40, 20, 20)), 16), None);
+    }
+}
@@ -0,0 +1,144 @@
+// Writes exported archives as uncompressed zip files. Images are already compressed, so storing
+// them as-is is nearly as small and much faster.
+
+use std::convert::TryInto;
+use std::fs::{self, File};
+use std::io::{self, BufWriter, Write};
+use std::path::{Path, PathBuf};
+
+use super::verify::crc32;
+
+const LOCAL_HEADER_SIG: u32 = 0x0403_4b50;
+const CDFH_SIG: u32 = 0x0201_4b50;
+const EOCD_SIG: u32 = 0x0605_4b50;
+
+fn too_large() -> io::Error {
+    io::Error::new(io::ErrorKind::Other, "Too large for a zip file without zip64")
+}
+
+// The fields shared by local and central directory headers: version needed, flags, compression
+// method, DOS time and date, CRC, and sizes.
+fn zip_entry_fields(buf: &mut Vec<u8>, crc: u32, size: u32, name_len: u16) {
+    buf.extend_from_slice(&10_u16.to_le_bytes());
+    // Names are always UTF-8.
+    buf.extend_from_slice(&0x0800_u16.to_le_bytes());
+    // Stored
+    buf.extend_from_slice(&0_u16.to_le_bytes());
+    // Midnight on 1980-01-01, the earliest representable time.
+    buf.extend_from_slice(&0_u16.to_le_bytes());
+    buf.extend_from_slice(&0x0021_u16.to_le_bytes());
+    buf.extend_from_slice(&crc.to_le_bytes());
+    buf.extend_from_slice(&size.to_le_bytes());
+    buf.extend_from_slice(&size.to_le_bytes());
+    buf.extend_from_slice(&name_len.to_le_bytes());
+    // Extra field length
+    buf.extend_from_slice(&0_u16.to_le_bytes());
+}
+
+// Writes each file to a new zip at dest under its name. Fails if dest already exists. Like
+// reading, zip64 isn't supported; no realistic archive of images needs it.
+pub fn write(files: &[(PathBuf, PathBuf)], dest: &Path) -> io::Result<()> {
+    let entries: u16 = files.len().try_into().map_err(|_| too_large())?;
+    let file = File::options().write(true).create_new(true).open(dest)?;
+    let mut out = BufWriter::new(file);
+
+    let mut central = Vec::new();
+    let mut offset = 0_u32;
+
+    for (src, name) in files {
+        // Zip files always use forward slashes.
+        let name: Vec<_> = name.iter().map(|c| c.to_string_lossy()).collect();
+        let name = name.join("/");
+        let name_len: u16 = name.len().try_into().map_err(|_| too_large())?;
+
+        let data = fs::read(src)
+            .map_err(|e| io::Error::new(e.kind(), format!("Failed to read {:?}: {}", src, e)))?;
+        let size: u32 = data.len().try_into().map_err(|_| too_large())?;
+        let crc = crc32(&data);
+
+        let mut local = Vec::with_capacity(30 + name.len());
+        local.extend_from_slice(&LOCAL_HEADER_SIG.to_le_bytes());
+        zip_entry_fields(&mut local, crc, size, name_len);
+        local.extend_from_slice(name.as_bytes());
+        out.write_all(&local)?;
+        out.write_all(&data)?;
+
+        central.extend_from_slice(&CDFH_SIG.to_le_bytes());
+        // Version made by
+        central.extend_from_slice(&10_u16.to_le_bytes());
+        zip_entry_fields(&mut central, crc, size, name_len);
+        // Comment length, disk number, and internal and external attributes
+        central.extend_from_slice(&[0; 10]);
+        central.extend_from_slice(&offset.to_le_bytes());
+        central.extend_from_slice(name.as_bytes());
+
+        offset = offset
+            .checked_add(local.len() as u32)
+            .and_then(|o| o.checked_add(size))
+            .ok_or_else(too_large)?;
+    }
+
+    let cd_size: u32 = central.len().try_into().map_err(|_| too_large())?;
+    out.write_all(&central)?;
+
+    let mut eocd = Vec::with_capacity(22);
+    eocd.extend_from_slice(&EOCD_SIG.to_le_bytes());
+    // This disk and the disk with the central directory
+    eocd.extend_from_slice(&[0; 4]);
+    eocd.extend_from_slice(&entries.to_le_bytes());
+    eocd.extend_from_slice(&entries.to_le_bytes());
+    eocd.extend_from_slice(&cd_size.to_le_bytes());
+    eocd.extend_from_slice(&offset.to_le_bytes());
+    // Comment length
+    eocd.extend_from_slice(&0_u16.to_le_bytes());
+    out.write_all(&eocd)?;
+
+    out.flush()
+}
+
+#[cfg(test)]
+mod tests {
+    use std::fs::{self, File};
+    use std::io::BufReader;
+    use std::path::PathBuf;
+
+    use super::write;
+
+    #[test]
+    fn round_trip() {
+        let dir = tempfile::tempdir().unwrap();
+        let pages = [("001.jpg", &b"first page"[..]), ("sub/002.png", &[0, 1, 2, 255][..])];
+
+        let mut files = Vec::new();
+        for (i, (name, data)) in pages.iter().enumerate() {
+            let src = dir.path().join(i.to_string());
+            fs::write(&src, data).unwrap();
+            files.push((src, PathBuf::from(name)));
+        }
+
+        let dest = dir.path().join("out.cbz");
+        write(&files, &dest).unwrap();
+
+        let names =
+            compress_tools::list_archive_files(BufReader::new(File::open(&dest).unwrap())).unwrap();
+        assert_eq!(names, ["001.jpg", "sub/002.png"]);
+
+        for (name, data) in pages {
+            let mut out = Vec::new();
+            let file = BufReader::new(File::open(&dest).unwrap());
+            compress_tools::uncompress_archive_file(file, &mut out, name).unwrap();
+            assert_eq!(out, data);
+        }
+    }
+
+    #[test]
+    fn existing_destination() {
+        let dir = tempfile::tempdir().unwrap();
+        let dest = dir.path().join("out.cbz");
+        fs::write(&dest, b"existing").unwrap();
+
+        let err = write(&[], &dest).unwrap_err();
+        assert_eq!(err.kind(), std::io::ErrorKind::AlreadyExists);
+        assert_eq!(fs::read(&dest).unwrap(), b"existing");
+    }
+}
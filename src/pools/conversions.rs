@@ -0,0 +1,100 @@
+// A persistent cache of images converted to PNG through pixbuf, keyed by the contents of the
+// original file so that renamed or re-extracted files still hit the cache.
+// Formats like HEIC are slow enough to convert that revisiting a directory is otherwise painful.
+
+use std::fs;
+use std::path::PathBuf;
+use std::sync::Mutex;
+
+use once_cell::sync::Lazy;
+
+use crate::config::CONFIG;
+use crate::pools::verify::crc32;
+use crate::write_atomically;
+
+// Only one thread should be evicting at once.
+static EVICTION: Lazy<Mutex<()>> = Lazy::new(Mutex::default);
+
+// FNV-1a, so keys are stable across versions and machines.
+pub fn fnv64(data: &[u8]) -> u64 {
+    data.iter()
+        .fold(0xcbf2_9ce4_8422_2325, |h, b| (h ^ u64::from(*b)).wrapping_mul(0x0100_0000_01b3))
+}
+
+fn cache_path(data: &[u8]) -> Option<PathBuf> {
+    let dir = CONFIG.conversion_cache.as_ref()?;
+    Some(dir.join(format!("{:016x}{:08x}-{}.png", fnv64(data), crc32(data), data.len())))
+}
+
+pub fn get(data: &[u8]) -> Option<Vec<u8>> {
+    let path = cache_path(data)?;
+    let png = fs::read(&path).ok()?;
+    trace!("Found cached conversion {:?}", path);
+    Some(png)
+}
+
+pub fn put(data: &[u8], png: &[u8]) {
+    let path = match cache_path(data) {
+        Some(p) => p,
+        None => return,
+    };
+
+    let written = fs::create_dir_all(path.parent().expect("Cache path has no parent"))
+        .and_then(|_| write_atomically(&path, png));
+
+    if let Err(e) = written {
+        error!("Failed to cache converted image {:?}: {:?}", path, e);
+        return;
+    }
+
+    evict();
+}
+
+// Removes the oldest entries until the cache fits within conversion_cache_size.
+fn evict() {
+    let dir = match &CONFIG.conversion_cache {
+        Some(d) => d,
+        None => return,
+    };
+    let limit = CONFIG.conversion_cache_size.saturating_mul(1024 * 1024);
+
+    let _guard = match EVICTION.try_lock() {
+        Ok(g) => g,
+        // Someone else is already evicting.
+        Err(_) => return,
+    };
+
+    let entries = match fs::read_dir(dir) {
+        Ok(e) => e,
+        Err(e) => return error!("Failed to read conversion cache {:?}: {:?}", dir, e),
+    };
+
+    let mut files: Vec<_> = entries
+        .filter_map(|e| {
+            let e = e.ok()?;
+            let m = e.metadata().ok()?;
+            if !m.is_file() || e.path().extension()? != "png" {
+                return None;
+            }
+            Some((m.modified().ok()?, m.len(), e.path()))
+        })
+        .collect();
+
+    let mut total: u64 = files.iter().map(|f| f.1).sum();
+    if total <= limit {
+        return;
+    }
+
+    files.sort_unstable();
+    for (_, len, path) in files {
+        if total <= limit {
+            break;
+        }
+
+        match fs::remove_file(&path) {
+            Ok(_) => total -= len,
+            Err(e) => error!("Failed to evict cached conversion {:?}: {:?}", path, e),
+        }
+    }
+    debug!("Evicted old conversions, cache is now {} bytes", total);
+}
@@ -9,9 +9,10 @@ use rayon::{ThreadPool, ThreadPoolBuilder};
 use tokio::sync::{oneshot, OwnedSemaphorePermit, Semaphore};
 
 use crate::com::{Image, WorkParams};
-use crate::config::CONFIG;
-use crate::pools::handle_panic;
+use crate::config::{DownscalingFilter, CONFIG};
+use crate::pools::{handle_panic, stats};
 use crate::pools::loading::UnscaledImage;
+use crate::resample::FilterType;
 use crate::{Fut, Result};
 
 static DOWNSCALING: Lazy<ThreadPool> = Lazy::new(|| {
@@ -113,6 +114,17 @@ where
     DownscaleFuture { fut, cancel_flag, extra_info: params }
 }
 
+pub fn filter(params: WorkParams) -> FilterType {
+    match CONFIG.downscaling_filter {
+        DownscalingFilter::Nearest => FilterType::Nearest,
+        DownscalingFilter::Linear => FilterType::Triangle,
+        _ if params.low_memory => FilterType::Triangle,
+        DownscalingFilter::CatmullRom => FilterType::CatmullRom,
+        DownscalingFilter::Gaussian => FilterType::Gaussian,
+        DownscalingFilter::Lanczos3 => FilterType::Lanczos3,
+    }
+}
+
 pub mod static_image {
 
     use super::*;
@@ -158,8 +170,9 @@ pub mod static_image {
 
         let start = Instant::now();
 
-        let resized = img.downscale(resize_res);
+        let resized = img.downscale(resize_res, filter(params));
 
+        stats::SCALE.record(start.elapsed());
         trace!("Finished scaling image in {}ms", start.elapsed().as_millis());
         Ok(resized)
     }
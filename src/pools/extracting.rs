@@ -1,20 +1,24 @@
-use std::fs::File;
+use std::fs::{self, File};
+use std::future::Future;
 use std::io::{BufReader, Write};
 use std::path::{Path, PathBuf};
 use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::Arc;
 use std::time::Instant;
 
+use ahash::AHashMap;
 use compress_tools::ArchiveContents;
 use flume::{Receiver, Sender};
+use futures_util::FutureExt;
 use once_cell::sync::Lazy;
 use rayon::{ThreadPool, ThreadPoolBuilder};
-use tokio::sync::Semaphore;
+use tokio::sync::{oneshot, Semaphore};
 
 use crate::config::CONFIG;
 use crate::manager::archive::{PageExtraction, PendingExtraction};
-use crate::pools::handle_panic;
-use crate::{unrar, Result};
+use crate::pools::{handle_panic, stats};
+use crate::pools::verify::{self, Expected};
+use crate::{unrar, Fut, Result};
 
 static EXTRACTION: Lazy<ThreadPool> = Lazy::new(|| {
     ThreadPoolBuilder::new()
@@ -47,23 +51,40 @@ impl OngoingExtraction {
         self.cancel_flag.store(true, Ordering::Relaxed);
         drop(self.sem.acquire_many(PERMITS as u32).await);
     }
+
+    // Resolves once every file has been extracted and written out, or extraction has stopped.
+    pub fn finished(&self) -> impl Future<Output = ()> + 'static {
+        let sem = self.sem.clone();
+        async move {
+            drop(sem.acquire_many(PERMITS as u32).await);
+        }
+    }
 }
 
-pub fn extract(source: PathBuf, jobs: PendingExtraction) -> OngoingExtraction {
+pub fn extract(source: PathBuf, mut jobs: PendingExtraction) -> OngoingExtraction {
     let sem = Arc::new(Semaphore::new(PERMITS));
     let cancel_flag = Arc::new(AtomicBool::new(false));
 
+    // Every page was found in the extraction cache.
+    if jobs.ext_map.is_empty() {
+        return OngoingExtraction { cancel_flag, sem };
+    }
+
     // Allow two files per writer thread to be queued for writing.
     let (s, receiver) = flume::bounded((PERMITS - 1) * 2);
 
     let cancel = cancel_flag.clone();
     let permit = sem.clone().try_acquire_owned().expect("Impossible");
+    stats::enqueue_extractions(jobs.ext_map.len());
     EXTRACTION.spawn_fifo(move || {
         let _p = permit;
-        match reader(source, jobs, s, cancel) {
+        let hint = unrar::libarchive_failure_hint(&source);
+        match reader(source, &mut jobs, s, cancel) {
             Ok(_) => (),
-            Err(e) => error!("Error extracting archive: {}", e),
+            Err(e) => error!("Error extracting archive: {}.{}", e, hint),
         }
+        // Anything left over was cancelled or missing from the archive.
+        stats::dequeue_extractions(jobs.ext_map.len());
     });
 
     for _ in 0..PERMITS - 1 {
@@ -78,21 +99,184 @@ pub fn extract(source: PathBuf, jobs: PendingExtraction) -> OngoingExtraction {
     OngoingExtraction { cancel_flag, sem }
 }
 
+// Extracts a single file again after it failed, trying every extractor that might be able to
+// read it.
+pub fn extract_again(
+    source: PathBuf,
+    relpath: String,
+    ext_path: PathBuf,
+) -> Fut<Result<(), String>> {
+    let (completion, r) = oneshot::channel();
+    let (s, receiver) = flume::unbounded();
+    let (jump_sender, jump_receiver) = flume::unbounded();
+
+    let mut jobs = PendingExtraction {
+        ext_map: AHashMap::from([(relpath, PageExtraction { ext_path, completion, data: None })]),
+        jump_receiver,
+        jump_sender,
+    };
+
+    stats::enqueue_extractions(1);
+    EXTRACTION.spawn_fifo(move || {
+        let hint = unrar::libarchive_failure_hint(&source);
+        if let Err(e) = retry_individually(&source, &mut jobs, &s, &AtomicBool::new(false)) {
+            error!("Error extracting archive: {}.{}", e, hint);
+        }
+        stats::dequeue_extractions(jobs.ext_map.len());
+        drop(s);
+        writer(receiver);
+    });
+
+    r.map(|outer| match outer {
+        Ok(inner) => inner,
+        Err(e) => Err("Unexpected error extracting page: ".to_string() + &e.to_string()),
+    })
+    .boxed()
+}
+
 fn reader(
     source: PathBuf,
-    mut jobs: PendingExtraction,
+    jobs: &mut PendingExtraction,
     completed_jobs: Sender<(PageExtraction, Vec<u8>)>,
     cancel: Arc<AtomicBool>,
 ) -> Result<()> {
-    if let Some(ext) = source.extension() {
-        let ext = ext.to_ascii_lowercase();
-        if (ext == "rar" || ext == "cbr") && CONFIG.allow_external_extractors && *unrar::HAS_UNRAR {
-            return unrar::reader(source, jobs, completed_jobs, cancel);
+    let (backend, result) = if unrar::can_use(&source) {
+        ("unrar", unrar::reader(source.clone(), jobs, completed_jobs.clone(), cancel.clone()))
+    } else {
+        ("libarchive", libarchive_reader(&source, jobs, &completed_jobs, &cancel))
+    };
+
+    match result {
+        Ok(_) => {
+            debug!("Extracted {:?} with {}", source, backend);
+            return Ok(());
         }
+        Err(e) if cancel.load(Ordering::Relaxed) || jobs.ext_map.is_empty() => return Err(e),
+        Err(e) => warn!(
+            "{} failed extracting {:?}: {}. Retrying {} remaining files individually.",
+            backend,
+            source,
+            e,
+            jobs.ext_map.len()
+        ),
+    }
+
+    retry_individually(&source, jobs, &completed_jobs, &cancel)
+}
+
+// After the primary extractor fails partway through an archive, try each remaining file with every
+// extractor that might be able to read it. A single corrupt entry shouldn't fail every page after
+// it.
+// Files that aren't extracted are left in jobs.ext_map for the caller to account for.
+fn retry_individually(
+    source: &Path,
+    jobs: &mut PendingExtraction,
+    completed_jobs: &Sender<(PageExtraction, Vec<u8>)>,
+    cancel: &AtomicBool,
+) -> Result<()> {
+    let index = zip_index(source);
+    let try_unrar = unrar::can_use(source);
+
+    // The archive is listed once so that files missing from it fail immediately instead of being
+    // searched for by every extractor, and the rest are extracted in archive order.
+    let listing: Option<AHashMap<_, _>> = match list_files(source, try_unrar) {
+        Ok(files) => Some(files.into_iter().enumerate().map(|(i, (n, s))| (n, (i, s))).collect()),
+        Err(e) => {
+            warn!("Failed to list {:?}, trying every file anyway: {:?}", source, e);
+            None
+        }
+    };
+
+    let mut remaining: Vec<_> = jobs.ext_map.keys().cloned().collect();
+    remaining.sort();
+    if let Some(listing) = &listing {
+        remaining.sort_by_key(|r| listing.get(r).map(|(i, _)| *i));
+    }
+
+    for relpath in remaining {
+        if cancel.load(Ordering::Relaxed) {
+            return Ok(());
+        }
+        let job = jobs.ext_map.remove(&relpath).expect("Impossible");
+        stats::dequeue_extractions(1);
+
+        let size = match listing.as_ref().map(|l| l.get(&relpath)) {
+            Some(Some((_, size))) => *size,
+            Some(None) => {
+                fail_job(job, format!("{} is not in the archive", relpath));
+                continue;
+            }
+            None => None,
+        };
+
+        let mut errors = Vec::new();
+        let mut data = match libarchive_file(source, &relpath) {
+            Ok(d) => Some(("libarchive", d)),
+            Err(e) => {
+                errors.push(format!("libarchive: {}", e));
+                None
+            }
+        };
+
+        if data.is_none() && try_unrar {
+            match unrar::extract_file(source, &relpath) {
+                Ok(d) => data = Some(("unrar", d)),
+                Err(e) => errors.push(format!("unrar: {}", e)),
+            }
+        }
+
+        match data {
+            Some((backend, d)) => {
+                debug!("Extracted {} from {:?} with {}", relpath, source, backend);
+                let mut expected = index.get(&relpath).copied().unwrap_or_default();
+                expected.size = expected.size.or(size);
+                send_verified(job, d, expected, &relpath, completed_jobs)?;
+            }
+            None => {
+                let e = format!("All extractors failed for {}: {}", relpath, errors.join(", "));
+                fail_job(job, e);
+            }
+        }
+    }
+
+    Ok(())
+}
+
+// Lists the files in the archive along with their sizes, if the listing includes them.
+fn list_files(source: &Path, try_unrar: bool) -> Result<Vec<(String, Option<u64>)>> {
+    if try_unrar {
+        let files = unrar::read_files(source)?;
+        return Ok(files.into_iter().map(|(n, s)| (n, Some(s as u64))).collect());
     }
 
+    let names = compress_tools::list_archive_files(BufReader::new(File::open(source)?))?;
+    Ok(names.into_iter().map(|n| (n, None)).collect())
+}
+
+fn fail_job(job: PageExtraction, e: String) {
+    error!("{}", e);
+    let _ = job
+        .completion
+        .send(Err(e))
+        .map_err(|e| error!("Failed sending to oneshot channel {:?}", e));
+}
+
+fn libarchive_file(source: &Path, relpath: &str) -> Result<Vec<u8>> {
+    let mut target = Vec::new();
+    let file = BufReader::new(File::open(source)?);
+    compress_tools::uncompress_archive_file(file, &mut target, relpath)?;
+    Ok(target)
+}
+
+fn libarchive_reader(
+    source: &Path,
+    jobs: &mut PendingExtraction,
+    completed_jobs: &Sender<(PageExtraction, Vec<u8>)>,
+    cancel: &AtomicBool,
+) -> Result<()> {
     let start = Instant::now();
-    let file = BufReader::new(File::open(&source)?);
+    let index = zip_index(source);
+    let file = BufReader::new(File::open(source)?);
 
     let iter = compress_tools::ArchiveIterator::from_read(file)?;
 
@@ -109,12 +293,13 @@ fn reader(
         if !in_file {
             if let Ok(path) = jobs.jump_receiver.try_recv() {
                 if let Some(page_ext) = jobs.ext_map.remove(&path) {
-                    extract_single_file(&source, path, page_ext, &completed_jobs)?;
+                    stats::dequeue_extractions(1);
+                    let expected = index.get(&path).copied().unwrap_or_default();
+                    extract_single_file(source, path, page_ext, expected, completed_jobs)?;
                 }
             }
         }
 
-
         match cont {
             ArchiveContents::StartOfEntry(s) => {
                 relpath = s;
@@ -125,7 +310,9 @@ fn reader(
                 let current_file = data;
                 data = Vec::with_capacity(1_048_576);
                 if let Some((_, job)) = jobs.ext_map.remove_entry(&relpath) {
-                    completed_jobs.send((job, current_file))?;
+                    stats::dequeue_extractions(1);
+                    let expected = index.get(&relpath).copied().unwrap_or_default();
+                    send_verified(job, current_file, expected, &relpath, completed_jobs)?;
                 }
                 in_file = false;
             }
@@ -137,21 +324,63 @@ fn reader(
     Ok(())
 }
 
+// Only zip files have an index that can be cheaply read ahead of time.
+fn zip_index(source: &Path) -> AHashMap<String, Expected> {
+    let is_zip = source
+        .extension()
+        .map_or(false, |e| e.eq_ignore_ascii_case("zip") || e.eq_ignore_ascii_case("cbz"));
+    if !is_zip {
+        return AHashMap::new();
+    }
+
+    match verify::read_zip_index(source) {
+        Ok(index) => index,
+        Err(e) => {
+            warn!("Unable to read zip index for {:?}, files won't be verified: {:?}", source, e);
+            AHashMap::new()
+        }
+    }
+}
+
+// Fails the page instead of writing it out if it doesn't match what the archive claims.
+pub fn send_verified(
+    job: PageExtraction,
+    data: Vec<u8>,
+    expected: Expected,
+    relpath: &str,
+    completed_jobs: &Sender<(PageExtraction, Vec<u8>)>,
+) -> Result<()> {
+    match expected.check(&data) {
+        Ok(_) => completed_jobs.send((job, data))?,
+        Err(e) => {
+            error!("Failed to verify {}: {}", relpath, e);
+            let _ = job
+                .completion
+                .send(Err(e))
+                .map_err(|e| error!("Failed sending to oneshot channel {:?}", e));
+        }
+    }
+    Ok(())
+}
+
 fn extract_single_file<P: AsRef<Path>>(
     source: P,
     relpath: String,
-    job: PageExtraction,
+    mut job: PageExtraction,
+    expected: Expected,
     completed_jobs: &Sender<(PageExtraction, Vec<u8>)>,
 ) -> Result<()> {
     debug!("Extracting {} early", relpath);
 
-    let mut target = Vec::new();
-
-    let file = BufReader::new(File::open(&source)?);
-
-    match compress_tools::uncompress_archive_file(file, &mut target, &relpath) {
-        Ok(_) => {
-            completed_jobs.send((job, target))?;
+    match libarchive_file(source.as_ref(), &relpath) {
+        Ok(target) => {
+            // The page is wanted now, so let it start decoding before it's written.
+            if let Some(data) = job.data.take() {
+                if expected.check(&target).is_ok() {
+                    drop(data.send(target.clone()));
+                }
+            }
+            send_verified(job, target, expected, &relpath, completed_jobs)?;
         }
         Err(e) => {
             // A file that's missing from an archive is not a fatal error.
@@ -164,32 +393,26 @@ fn extract_single_file<P: AsRef<Path>>(
 
 fn writer(completed_jobs: Receiver<(PageExtraction, Vec<u8>)>) {
     for (job, data) in completed_jobs {
-        let mut file = match File::create(&job.ext_path) {
-            Ok(f) => f,
-            Err(e) => {
-                error!("Failed to create file {:?}: {:?}", job.ext_path, e);
-                let _ = job
-                    .completion
-                    .send(Err(e.to_string()))
-                    .map_err(|e| error!("Failed sending to oneshot channel {:?}", e));
-                continue;
-            }
-        };
+        let written = write_page(&job.ext_path, &data).map_err(|e| {
+            error!("Failed to write file {:?}: {:?}", job.ext_path, e);
+            e.to_string()
+        });
 
-        match file.write_all(&data) {
-            Ok(_) => {
-                let _ = job
-                    .completion
-                    .send(Ok(()))
-                    .map_err(|e| error!("Failed sending to oneshot channel {:?}", e));
-            }
-            Err(e) => {
-                error!("Failed to write file {:?}: {:?}", job.ext_path, e);
-                let _ = job
-                    .completion
-                    .send(Err(e.to_string()))
-                    .map_err(|e| error!("Failed sending to oneshot channel {:?}", e));
-            }
-        }
+        let _ = job
+            .completion
+            .send(written)
+            .map_err(|e| error!("Failed sending to oneshot channel {:?}", e));
+    }
+}
+
+// Written under a temporary name first so an interrupted write can't leave a truncated page in
+// the extraction cache.
+fn write_page(path: &Path, data: &[u8]) -> std::io::Result<()> {
+    let part = path.with_extension("part");
+    let written = File::create(&part).and_then(|mut f| f.write_all(data));
+    if let Err(e) = written {
+        drop(fs::remove_file(&part));
+        return Err(e);
     }
+    fs::rename(&part, path)
 }
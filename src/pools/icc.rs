@@ -0,0 +1,213 @@
+// Converts images with embedded ICC profiles to sRGB with lcms2. Digital releases often embed
+// profiles for wide gamut or print colour spaces, and those pages look wrong when their pixels are
+// treated as sRGB.
+//
+// Only JPEG and PNG files are checked, and only RGB profiles are applied.
+
+use std::ffi::c_void;
+use std::fs::File;
+use std::io::{self, BufReader, Cursor, Read};
+use std::path::Path;
+
+use image::{DynamicImage, ImageBuffer, ImageFormat, Pixel};
+use rayon::iter::ParallelIterator;
+use rayon::slice::ParallelSliceMut;
+
+use crate::config::CONFIG;
+use crate::pools::jpeg;
+
+type Handle = *mut c_void;
+
+#[link(name = "lcms2")]
+extern "C" {
+    fn cmsOpenProfileFromMem(mem: *const c_void, size: u32) -> Handle;
+    fn cmsCreate_sRGBProfile() -> Handle;
+    fn cmsCloseProfile(profile: Handle) -> i32;
+    fn cmsGetColorSpace(profile: Handle) -> u32;
+    fn cmsCreateTransform(
+        input: Handle,
+        in_format: u32,
+        output: Handle,
+        out_format: u32,
+        intent: u32,
+        flags: u32,
+    ) -> Handle;
+    fn cmsDoTransform(transform: Handle, input: *const c_void, output: *mut c_void, size: u32);
+    fn cmsDeleteTransform(transform: Handle);
+}
+
+// From lcms2.h
+const SIG_RGB_DATA: u32 = 0x5247_4220;
+const TYPE_RGB_8: u32 = 0x40019;
+const TYPE_RGBA_8: u32 = 0x40099;
+const INTENT_PERCEPTUAL: u32 = 0;
+// The transform is shared between threads, which isn't safe with its single pixel cache.
+const FLAGS_NOCACHE: u32 = 0x40;
+const FLAGS_COPY_ALPHA: u32 = 0x0400_0000;
+
+const ROWS_PER_CHUNK: usize = 64;
+
+struct Transform(Handle);
+
+// lcms2 transforms can be used from multiple threads when created without a cache.
+unsafe impl Send for Transform {}
+unsafe impl Sync for Transform {}
+
+impl Transform {
+    fn new(icc: &[u8], format: u32) -> Option<Self> {
+        let size = u32::try_from(icc.len()).ok()?;
+
+        unsafe {
+            let input = cmsOpenProfileFromMem(icc.as_ptr().cast(), size);
+            if input.is_null() {
+                error!("Failed to parse embedded ICC profile");
+                return None;
+            }
+
+            if cmsGetColorSpace(input) != SIG_RGB_DATA {
+                debug!("Skipping embedded ICC profile for a colour space other than RGB");
+                cmsCloseProfile(input);
+                return None;
+            }
+
+            let srgb = cmsCreate_sRGBProfile();
+            let transform = cmsCreateTransform(
+                input,
+                format,
+                srgb,
+                format,
+                INTENT_PERCEPTUAL,
+                FLAGS_NOCACHE | FLAGS_COPY_ALPHA,
+            );
+            cmsCloseProfile(input);
+            cmsCloseProfile(srgb);
+
+            if transform.is_null() {
+                error!("Failed to create colour transform for embedded ICC profile");
+                return None;
+            }
+            Some(Self(transform))
+        }
+    }
+
+    fn apply<P: Pixel<Subpixel = u8>>(&self, buf: &mut ImageBuffer<P, Vec<u8>>) {
+        let row = buf.width() as usize * P::CHANNEL_COUNT as usize;
+        if row == 0 {
+            return;
+        }
+
+        buf.par_chunks_mut(row * ROWS_PER_CHUNK).for_each(|chunk| {
+            let pixels = (chunk.len() / P::CHANNEL_COUNT as usize) as u32;
+            unsafe {
+                cmsDoTransform(self.0, chunk.as_ptr().cast(), chunk.as_mut_ptr().cast(), pixels);
+            }
+        });
+    }
+}
+
+impl Drop for Transform {
+    fn drop(&mut self) {
+        unsafe { cmsDeleteTransform(self.0) }
+    }
+}
+
+pub fn from_file(path: &Path, img: DynamicImage) -> DynamicImage {
+    if !CONFIG.color_management {
+        return img;
+    }
+
+    let icc = match File::open(path) {
+        Ok(f) => read_profile(path, BufReader::new(f)),
+        Err(e) => {
+            error!("Failed to open {:?} to read its ICC profile: {}", path, e);
+            return img;
+        }
+    };
+
+    convert(path, icc, img)
+}
+
+pub fn from_memory(path: &Path, data: &[u8], img: DynamicImage) -> DynamicImage {
+    if !CONFIG.color_management {
+        return img;
+    }
+
+    convert(path, read_profile(path, Cursor::new(data)), img)
+}
+
+fn convert(path: &Path, icc: Option<Vec<u8>>, img: DynamicImage) -> DynamicImage {
+    let icc = match icc {
+        Some(icc) => icc,
+        None => return img,
+    };
+
+    if !img.color().has_color() {
+        return img;
+    }
+
+    let format = if img.color().has_alpha() { TYPE_RGBA_8 } else { TYPE_RGB_8 };
+    let transform = match Transform::new(&icc, format) {
+        Some(t) => t,
+        None => return img,
+    };
+
+    trace!("Converting {:?} to sRGB", path);
+    match img {
+        DynamicImage::ImageRgb8(mut buf) => {
+            transform.apply(&mut buf);
+            buf.into()
+        }
+        DynamicImage::ImageRgba8(mut buf) => {
+            transform.apply(&mut buf);
+            buf.into()
+        }
+        img if img.color().has_alpha() => {
+            let mut buf = img.into_rgba8();
+            transform.apply(&mut buf);
+            buf.into()
+        }
+        img => {
+            let mut buf = img.into_rgb8();
+            transform.apply(&mut buf);
+            buf.into()
+        }
+    }
+}
+
+fn read_profile(path: &Path, reader: impl Read) -> Option<Vec<u8>> {
+    let result = match ImageFormat::from_path(path) {
+        Ok(ImageFormat::Jpeg) => jpeg_profile(reader),
+        Ok(ImageFormat::Png) => png_profile(reader),
+        _ => return None,
+    };
+
+    match result {
+        Ok(icc) => icc,
+        Err(e) => {
+            error!("Failed to read ICC profile from {:?}: {}", path, e);
+            None
+        }
+    }
+}
+
+fn png_profile(reader: impl Read) -> io::Result<Option<Vec<u8>>> {
+    let reader = png::Decoder::new(reader)
+        .read_info()
+        .map_err(|e| io::Error::new(io::ErrorKind::InvalidData, e))?;
+    Ok(reader.info().icc_profile.as_ref().map(|icc| icc.to_vec()))
+}
+
+// Profiles are split across any number of APP2 segments before the image data.
+fn jpeg_profile(reader: impl Read) -> io::Result<Option<Vec<u8>>> {
+    let mut chunks: Vec<_> = jpeg::segments(reader, jpeg::APP2, b"ICC_PROFILE\0")?
+        .into_iter()
+        .filter(|s| s.len() >= 2)
+        .collect();
+
+    if chunks.is_empty() {
+        return Ok(None);
+    }
+
+    chunks.sort_by_key(|s| s[0]);
+    Ok(Some(chunks.into_iter().flat_map(|s| s.into_iter().skip(2)).collect()))
+}
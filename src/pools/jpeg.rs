@@ -0,0 +1,46 @@
+// Reads the application segments at the start of JPEG files, where metadata like ICC profiles and
+// EXIF tags are stored.
+
+use std::io::{self, Read};
+
+const SOI: u8 = 0xD8;
+const EOI: u8 = 0xD9;
+const SOS: u8 = 0xDA;
+pub const APP1: u8 = 0xE1;
+pub const APP2: u8 = 0xE2;
+
+// Returns the contents of every segment with the marker that starts with the header, without the
+// header. Nothing after the start of the image data is read.
+pub fn segments(mut reader: impl Read, marker: u8, header: &[u8]) -> io::Result<Vec<Vec<u8>>> {
+    let mut m = [0; 2];
+    reader.read_exact(&mut m)?;
+    if m != [0xFF, SOI] {
+        return Ok(Vec::new());
+    }
+
+    let mut out = Vec::new();
+    loop {
+        reader.read_exact(&mut m)?;
+        // Fill bytes aren't worth handling, they don't appear before metadata in practice.
+        if m[0] != 0xFF || [SOS, EOI, 0xFF].contains(&m[1]) {
+            break;
+        }
+
+        let mut len = [0; 2];
+        reader.read_exact(&mut len)?;
+        let len = u16::from_be_bytes(len).saturating_sub(2) as usize;
+
+        if m[1] != marker || len < header.len() {
+            io::copy(&mut (&mut reader).take(len as u64), &mut io::sink())?;
+            continue;
+        }
+
+        let mut segment = vec![0; len];
+        reader.read_exact(&mut segment)?;
+        if let Some(rest) = segment.strip_prefix(header) {
+            out.push(rest.to_vec());
+        }
+    }
+
+    Ok(out)
+}
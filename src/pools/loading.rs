@@ -1,15 +1,19 @@
+use std::cmp::Ordering as CmpOrdering;
+use std::collections::BinaryHeap;
 use std::fmt;
 use std::fs::{self, File};
-use std::io::Write;
-use std::path::PathBuf;
+use std::io::{BufReader, Cursor, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
 use std::rc::Rc;
 use std::sync::atomic::{AtomicBool, Ordering};
-use std::sync::Arc;
-use std::time::Duration;
+use std::sync::{Arc, Mutex, Weak};
+use std::time::{Duration, Instant};
 
 use derive_more::From;
 use futures_util::FutureExt;
 use image::codecs::gif::GifDecoder;
+use image::codecs::jpeg::JpegDecoder;
 use image::codecs::png::PngDecoder;
 use image::io::{Limits, Reader};
 use image::{AnimationDecoder, DynamicImage, ImageDecoder, ImageFormat};
@@ -17,19 +21,32 @@ use jpegxl_rs::image::ToDynamic;
 use once_cell::sync::Lazy;
 use rayon::iter::{IntoParallelIterator, ParallelIterator};
 use rayon::{ThreadPool, ThreadPoolBuilder};
-use tokio::sync::{oneshot, OwnedSemaphorePermit, Semaphore};
+use tokio::sync::oneshot;
 
 use crate::com::{AnimatedImage, Image, Res, WorkParams};
 use crate::config::{CONFIG, MINIMUM_RES, TARGET_RES};
 use crate::manager::files::{
-    is_gif, is_jxl, is_natively_supported_image, is_pixbuf_extension, is_png, is_video_extension,
-    is_webp,
+    is_gif, is_jpeg, is_jxl, is_natively_supported_image, is_pixbuf_extension, is_png,
+    is_raw_extension, is_subprocess_extension, is_video_extension, is_webp,
 };
-use crate::pools::handle_panic;
+use crate::pools::{autocrop, conversions, downscaling, handle_panic, icc, orientation, stats};
 use crate::{closing, Fut, Result};
 
-static LOADING_SEM: Lazy<Arc<Semaphore>> =
-    Lazy::new(|| Arc::new(Semaphore::new(CONFIG.loading_threads.get())));
+static SCHEDULER: Lazy<Mutex<Scheduler>> = Lazy::new(|| {
+    Mutex::new(Scheduler {
+        available: CONFIG.loading_threads.get(),
+        waiting: BinaryHeap::new(),
+        next_seq: 0,
+    })
+});
+
+// Distances and cancellation flags for loads of pages other than the current page, so they can be
+// preempted when the current page needs a thread.
+static BACKGROUND_LOADS: Lazy<Mutex<Vec<(usize, Weak<AtomicBool>)>>> = Lazy::new(Mutex::default);
+
+// The error returned by a load that was cancelled to make room for the current page.
+// It should be retried later, not treated as a failure.
+pub const PREEMPTED: &str = "Preempted";
 
 static LOADING: Lazy<ThreadPool> = Lazy::new(|| {
     ThreadPoolBuilder::new()
@@ -40,6 +57,91 @@ static LOADING: Lazy<ThreadPool> = Lazy::new(|| {
         .expect("Error creating loading threadpool")
 });
 
+// Hands out loading threads to the waiting pages closest to the current page first, instead of in
+// the order they were requested. Ties go to whichever asked first.
+struct Scheduler {
+    available: usize,
+    waiting: BinaryHeap<Waiter>,
+    next_seq: u64,
+}
+
+struct Waiter {
+    distance: usize,
+    seq: u64,
+    sender: oneshot::Sender<Permit>,
+}
+
+impl PartialEq for Waiter {
+    fn eq(&self, other: &Self) -> bool {
+        self.cmp(other) == CmpOrdering::Equal
+    }
+}
+
+impl Eq for Waiter {}
+
+impl PartialOrd for Waiter {
+    fn partial_cmp(&self, other: &Self) -> Option<CmpOrdering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Ord for Waiter {
+    // BinaryHeap is a max-heap, so the closest and oldest waiter has to compare as the greatest.
+    fn cmp(&self, other: &Self) -> CmpOrdering {
+        other.distance.cmp(&self.distance).then_with(|| other.seq.cmp(&self.seq))
+    }
+}
+
+// Returns its thread to the scheduler when dropped.
+#[derive(Debug)]
+struct Permit(());
+
+impl Drop for Permit {
+    fn drop(&mut self) {
+        let waiter = {
+            let mut sched = SCHEDULER.lock().expect("Poisoned");
+            match sched.waiting.pop() {
+                Some(w) => w,
+                None => {
+                    sched.available += 1;
+                    return;
+                }
+            }
+        };
+
+        // If the waiter has given up, most likely because the manager moved on to other work, the
+        // new permit is dropped right away and goes to the next waiter instead.
+        drop(waiter.sender.send(Self(())));
+    }
+}
+
+fn try_acquire() -> Option<Permit> {
+    let mut sched = SCHEDULER.lock().expect("Poisoned");
+    if sched.available > 0 {
+        sched.available -= 1;
+        return Some(Permit(()));
+    }
+    None
+}
+
+async fn acquire(distance: usize) -> Permit {
+    let r = {
+        let mut sched = SCHEDULER.lock().expect("Poisoned");
+        if sched.available > 0 {
+            sched.available -= 1;
+            return Permit(());
+        }
+
+        let (sender, r) = oneshot::channel();
+        let seq = sched.next_seq;
+        sched.next_seq += 1;
+        sched.waiting.push(Waiter { distance, seq, sender });
+        r
+    };
+
+    r.await.expect("Loading scheduler dropped a waiter")
+}
+
 static LIMITS: Lazy<Limits> = Lazy::new(|| {
     let mut limits = Limits::default();
     limits.max_alloc = Some(10 * 1024 * 1024 * 1024); // 10GB
@@ -52,7 +154,7 @@ pub struct UnscaledImage(pub Image);
 
 impl From<DynamicImage> for UnscaledImage {
     fn from(img: DynamicImage) -> Self {
-        Self(img.into())
+        Self(autocrop::autocrop(img).into())
     }
 }
 
@@ -141,12 +243,8 @@ impl ScanFuture {
     }
 }
 
-pub async fn scan(path: PathBuf, conv: PathBuf, load: bool) -> ScanFuture {
-    let permit = LOADING_SEM
-        .clone()
-        .acquire_owned()
-        .await
-        .expect("Error acquiring scanning permit");
+pub async fn scan(path: PathBuf, conv: PathBuf, load: bool, distance: usize) -> ScanFuture {
+    let permit = acquire(distance).await;
 
 
     let (s, r) = oneshot::channel();
@@ -179,6 +277,84 @@ pub async fn scan(path: PathBuf, conv: PathBuf, load: bool) -> ScanFuture {
     }))
 }
 
+// Static images the image crate can decode can be scanned before they've been written to disk.
+pub fn can_scan_data(path: &Path) -> bool {
+    is_natively_supported_image(path) && !is_gif(path)
+}
+
+// Scans a page from memory while it's being written out. The result isn't available until the
+// file has been written, since everything after scanning reads it from disk. If the image can't be
+// decoded this way the file is scanned normally, which can also try other decoders.
+pub fn scan_data(
+    path: PathBuf,
+    data: Vec<u8>,
+    conv: PathBuf,
+    load: bool,
+    distance: usize,
+    written: Fut<std::result::Result<(), String>>,
+) -> ScanFuture {
+    ScanFuture(Box::pin(async move {
+        let permit = acquire(distance).await;
+
+        let (s, r) = oneshot::channel();
+        let p = path.clone();
+        LOADING.spawn_fifo(move || {
+            let result = scan_memory(&p, &data, load).map_err(|e| e.to_string());
+            drop(data);
+
+            if let Err(e) = s.send(result) {
+                error!("Unexpected error scanning file {:?}", e);
+            };
+            drop(permit)
+        });
+
+        let result = r.await;
+        if let Err(e) = written.await {
+            error!("Failed to extract page {:?}: {}", path, e);
+            return ScanResult::Invalid(format!("Failed to extract page: {}", e));
+        }
+
+        match result {
+            Ok(Ok(sr)) => sr,
+            Ok(Err(e)) => {
+                warn!("Error {} while trying to read {:?} from memory, trying again.", e, path);
+                scan(path, conv, load, distance).await.0.await
+            }
+            Err(e) => {
+                let e = format!("Error scanning file {:?}", e);
+                error!("{}", e);
+                ScanResult::Invalid(e)
+            }
+        }
+    }))
+}
+
+fn scan_memory(path: &Path, data: &[u8], load: bool) -> Result<ScanResult> {
+    use ScanResult::*;
+
+    let format = ImageFormat::from_path(path)?;
+    if format == ImageFormat::Png {
+        let mut decoder = PngDecoder::new(data)?;
+        decoder.set_limits(LIMITS.clone())?;
+        if decoder.is_apng() {
+            return Ok(Animation(decoder.dimensions().into()));
+        }
+
+        let img = DynamicImage::from_decoder(decoder)?;
+        let img = icc::from_memory(path, data, img);
+        return Ok(Image(UnscaledImage::from(img).into()));
+    }
+
+    let mut reader = Reader::with_format(Cursor::new(data), format);
+    reader.limits(LIMITS.clone());
+    let img = orientation::from_memory(path, data, reader.decode()?);
+    if load {
+        let img = icc::from_memory(path, data, img);
+        return Ok(Image(UnscaledImage::from(img).into()));
+    }
+    Ok(Image(autocrop::cropped_res(&img).into()))
+}
+
 fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
     use ScanResult::*;
 
@@ -193,11 +369,11 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
 
         match (first_frame, second_frame) {
             (Some(Ok(first)), None) => {
+                let img = DynamicImage::ImageRgba8(first.into_buffer());
                 if load {
-                    let img = DynamicImage::ImageRgba8(first.into_buffer());
                     return Ok(Image(UnscaledImage::from(img).into()));
                 }
-                return Ok(Image(Res::from(first.buffer().dimensions()).into()));
+                return Ok(Image(autocrop::cropped_res(&img).into()));
             }
             (Some(Ok(first)), Some(Ok(_))) => {
                 return Ok(Animation(first.buffer().dimensions().into()));
@@ -218,6 +394,7 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
                 }
 
                 let img = DynamicImage::from_decoder(decoder)?;
+                let img = icc::from_file(&path, img);
                 return Ok(Image(UnscaledImage::from(img).into()));
             }
             Err(e) => {
@@ -231,10 +408,12 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
 
         match img {
             Ok(img) => {
+                let img = orientation::from_file(&path, img);
                 if load {
+                    let img = icc::from_file(&path, img);
                     return Ok(Image(UnscaledImage::from(img).into()));
                 }
-                return Ok(Image(Res::from(img).into()));
+                return Ok(Image(autocrop::cropped_res(&img).into()));
             }
             Err(e) => {
                 error!("Error {:?} while trying to read {:?}, trying again with pixbuf.", e, path)
@@ -254,7 +433,7 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
         if load {
             return Ok(Image(UnscaledImage::from(img).into()));
         }
-        return Ok(Image(Res::from(img).into()));
+        return Ok(Image(autocrop::cropped_res(&img).into()));
     }
 
     if is_webp(&path) {
@@ -263,34 +442,43 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
         let features = webp::BitstreamFeatures::new(&data).ok_or("Could not read webp.")?;
         if features.has_animation() {
             return Ok(Animation((features.width(), features.height()).into()));
-        } else if load {
+        } else if load || autocrop::enabled() {
+            // Cropping needs the decoded image even if it won't be kept.
             let decoded = webp::Decoder::new(&data).decode().ok_or("Could not decode webp")?;
-            return Ok(Image(UnscaledImage::from(decoded.to_image()).into()));
+            let img = decoded.to_image();
+            if load {
+                return Ok(Image(UnscaledImage::from(img).into()));
+            }
+            return Ok(Image(autocrop::cropped_res(&img).into()));
         }
         return Ok(Image(Res::from((features.width(), features.height())).into()));
     }
 
-    if is_pixbuf_extension(&path) {
-        let pb = gtk::gdk_pixbuf::Pixbuf::from_file(&path)?;
-        let pngvec = pb.save_to_bufferv("png", &[("compression", "1")])?;
-        let (w, h) = (pb.width(), pb.height());
-
-        // TODO -- remove once https://github.com/strukturag/libheif/issues/509 is in a libheif
-        // release.
-        unsafe {
-            let pb: gtk::glib::Object = gtk::glib::Cast::upcast(pb);
-            if gtk::glib::ObjectExt::ref_count(&pb) == 2 {
-                error!(
-                    "Newly allocated Pixbuf for {path:?} has a refcount of 2. Manually \
-                     decrementing to avoid leaks."
-                );
-                // This _will_ leak if we don't unref it manually.
-                // SAFETY: We created the pixbuf, we hold one reference to it.
-                // If another reference exists it means it has been leaked, so we must clean it up.
-                gtk::glib::gobject_ffi::g_object_unref(gtk::glib::ObjectType::as_ptr(&pb));
+    if is_pixbuf_extension(&path) || is_subprocess_extension(&path) || is_raw_extension(&path) {
+        let original =
+            if CONFIG.conversion_cache.is_some() { Some(fs::read(&path)?) } else { None };
+
+        let (pngvec, res) = match original.as_deref().and_then(conversions::get) {
+            Some(png) => {
+                let res: Res = PngDecoder::new(png.as_slice())?.dimensions().into();
+                (png, res)
             }
-            drop(pb);
-        }
+            None => {
+                let (png, res) = if is_raw_extension(&path) {
+                    convert_raw(&path, &conv)?
+                } else if is_subprocess_extension(&path) {
+                    let converter = CONFIG.heif_converter.as_deref();
+                    let converter = converter.unwrap_or_else(|| Path::new("heif-convert"));
+                    convert_in_subprocess(converter, &path, &conv)?
+                } else {
+                    convert_with_pixbuf(&path)?
+                };
+                if let Some(original) = &original {
+                    conversions::put(original, &png);
+                }
+                (png, res)
+            }
+        };
 
         if closing::closed() {
             return Ok(Invalid("closed".to_string()));
@@ -303,7 +491,13 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
         debug!("Converted {:?} to {:?}", path, conv);
 
         if !load {
-            return Ok(ConvertedImage(conv, Res::from((w, h)).into()));
+            let res = if autocrop::enabled() {
+                let img = image::load_from_memory_with_format(&pngvec, ImageFormat::Png)?;
+                autocrop::cropped_res(&img)
+            } else {
+                res
+            };
+            return Ok(ConvertedImage(conv, res.into()));
         }
 
         if closing::closed() {
@@ -322,6 +516,78 @@ fn scan_file(path: PathBuf, conv: PathBuf, load: bool) -> Result<ScanResult> {
     Ok(ScanResult::Invalid("not yet implemented".to_string()))
 }
 
+fn convert_with_pixbuf(path: &Path) -> Result<(Vec<u8>, Res)> {
+    let pb = gtk::gdk_pixbuf::Pixbuf::from_file(path)?;
+    let pngvec = pb.save_to_bufferv("png", &[("compression", "1")])?;
+    let (w, h) = (pb.width(), pb.height());
+
+    // TODO -- remove once https://github.com/strukturag/libheif/issues/509 is in a libheif
+    // release.
+    unsafe {
+        let pb: gtk::glib::Object = gtk::glib::Cast::upcast(pb);
+        if gtk::glib::ObjectExt::ref_count(&pb) == 2 {
+            error!(
+                "Newly allocated Pixbuf for {path:?} has a refcount of 2. Manually \
+                 decrementing to avoid leaks."
+            );
+            // This _will_ leak if we don't unref it manually.
+            // SAFETY: We created the pixbuf, we hold one reference to it.
+            // If another reference exists it means it has been leaked, so we must clean it up.
+            gtk::glib::gobject_ffi::g_object_unref(gtk::glib::ObjectType::as_ptr(&pb));
+        }
+        drop(pb);
+    }
+
+    Ok((pngvec, Res::from((w, h))))
+}
+
+// Runs a converter, like heif-convert from libheif, as "converter <input> <output.png>".
+// Decoding in another process means a crash in the decoder only fails this one page.
+fn convert_in_subprocess(converter: &Path, path: &Path, conv: &Path) -> Result<(Vec<u8>, Res)> {
+    let out = conv.with_extension("subprocess.png");
+
+    let status = Command::new(converter)
+        .arg(path)
+        .arg(&out)
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .status()?;
+
+    let pngvec = fs::read(&out);
+    drop(fs::remove_file(&out));
+
+    if !status.success() {
+        return Err(format!("{:?} failed to convert {:?}: {}", converter, path, status).into());
+    }
+
+    let pngvec = pngvec?;
+    let res: Res = PngDecoder::new(pngvec.as_slice())?.dimensions().into();
+    Ok((pngvec, res))
+}
+
+// Develops camera RAW files with dcraw_emu from LibRaw, using the camera's white balance, unless
+// raw_converter is set. dcraw_emu writes a PPM to stdout, which is re-encoded as a PNG.
+fn convert_raw(path: &Path, conv: &Path) -> Result<(Vec<u8>, Res)> {
+    if let Some(converter) = &CONFIG.raw_converter {
+        return convert_in_subprocess(converter, path, conv);
+    }
+
+    let output = Command::new("dcraw_emu")
+        .args(["-w", "-Z", "-"])
+        .arg(path)
+        .stdin(Stdio::null())
+        .stderr(Stdio::null())
+        .output()?;
+
+    if !output.status.success() {
+        return Err(format!("dcraw_emu failed to convert {:?}: {}", path, output.status).into());
+    }
+
+    let img = image::load_from_memory_with_format(&output.stdout, ImageFormat::Pnm)?;
+    let mut pngvec = Vec::new();
+    img.write_to(&mut Cursor::new(&mut pngvec), ImageFormat::Png)?;
+    Ok((pngvec, Res::from((img.width(), img.height()))))
+}
 
 // This is so we can unload and drop a load while it's happening.
 pub struct LoadFuture<T, R>
@@ -349,17 +615,46 @@ impl<T: Send, R: Clone> LoadFuture<T, R> {
     }
 }
 
+impl<T> LoadFuture<T, WorkParams> {
+    pub const fn params(&self) -> WorkParams {
+        self.extra_info
+    }
+}
+
 impl<T, R: Clone + fmt::Debug> fmt::Debug for LoadFuture<T, R> {
     fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
         write!(f, "[LoadFuture {:?}]", self.extra_info)
     }
 }
 
+// Loads for the current page skip the queue entirely. If no thread is free the most distant load
+// occupying one is cancelled, and it will be restarted by the manager once it's needed again.
+async fn acquire_permit(params: WorkParams) -> Option<Permit> {
+    if !params.jump_downscaling_queue {
+        return Some(acquire(params.distance).await);
+    }
+
+    if let Some(permit) = try_acquire() {
+        return Some(permit);
+    }
+
+    let mut bg = BACKGROUND_LOADS.lock().expect("Poisoned");
+    bg.retain(|(_, w)| w.upgrade().map_or(false, |f| !f.load(Ordering::Relaxed)));
+    if let Some(i) = bg.iter().enumerate().max_by_key(|(_, (d, _))| *d).map(|(i, _)| i) {
+        let (distance, weak) = bg.swap_remove(i);
+        if let Some(flag) = weak.upgrade() {
+            flag.store(true, Ordering::Relaxed);
+            debug!("Preempted a background load {} pages away for the current page", distance);
+        }
+    }
+    None
+}
+
 fn spawn_task<F, T>(
     closure: F,
     params: WorkParams,
     cancel_flag: Arc<AtomicBool>,
-    permit: OwnedSemaphorePermit,
+    permit: Option<Permit>,
 ) -> LoadFuture<T, WorkParams>
 where
     F: FnOnce() -> Result<T> + Send + 'static,
@@ -367,10 +662,25 @@ where
 {
     let (s, r) = oneshot::channel();
 
+    let background = (!params.jump_downscaling_queue).then(|| {
+        let weak = Arc::downgrade(&cancel_flag);
+        BACKGROUND_LOADS.lock().expect("Poisoned").push((params.distance, weak.clone()));
+        weak
+    });
+    let cancelled = cancel_flag.clone();
+
     LOADING.spawn_fifo(move || {
         let result = closure();
+
+        if let Some(weak) = background {
+            BACKGROUND_LOADS.lock().expect("Poisoned").retain(|(_, w)| !w.ptr_eq(&weak));
+        }
+
         let result = match result {
             Ok(sr) => Ok(sr),
+            // Cancellation by the manager drops the result, so the only way this is seen is if
+            // it was preempted.
+            Err(_) if cancelled.load(Ordering::Relaxed) => Err(PREEMPTED.to_string()),
             Err(e) => {
                 let e = format!("Error loading file {:?}", e);
                 error!("{}", e);
@@ -404,11 +714,7 @@ pub mod static_image {
         path: Rc<PathBuf>,
         params: WorkParams,
     ) -> LoadFuture<UnscaledImage, WorkParams> {
-        let permit = LOADING_SEM
-            .clone()
-            .acquire_owned()
-            .await
-            .expect("Error acquiring loading permit");
+        let permit = acquire_permit(params).await;
 
         let path = (*path).clone();
         let cancel_flag = Arc::new(AtomicBool::new(false));
@@ -418,15 +724,87 @@ pub mod static_image {
         spawn_task(closure, params, cancel_flag, permit)
     }
 
-    fn load_image(
+    // Large JPEGs on the current page get a cheap, low resolution decode that can be shown while
+    // the full image is still being decoded and scaled. The JPEG decoder can skip most of the work
+    // by scaling down by a factor of up to 8 during the IDCT.
+    pub fn preview(
+        path: &Rc<PathBuf>,
+        params: WorkParams,
+    ) -> Option<LoadFuture<Option<Image>, WorkParams>> {
+        if !params.jump_downscaling_queue || !is_jpeg(&**path) {
+            return None;
+        }
+
+        let path = (**path).clone();
+        let cancel_flag = Arc::new(AtomicBool::new(false));
+        let cancel = cancel_flag.clone();
+        let closure = move || load_preview(path, params, cancel);
+
+        Some(spawn_task(closure, params, cancel_flag, None))
+    }
+
+    fn load_preview(
         path: PathBuf,
-        _params: WorkParams,
+        params: WorkParams,
+        cancel: Arc<AtomicBool>,
+    ) -> Result<Option<Image>> {
+        if cancel.load(Ordering::Relaxed) {
+            return Err(String::from("Cancelled").into());
+        }
+
+        let start = Instant::now();
+        let mut decoder = JpegDecoder::new(BufReader::new(File::open(&path)?))?;
+        let res = Res::from(decoder.dimensions());
+        let target = res.fit_inside(params.target_res);
+        // Not worth it unless the decoder can scale by at least half.
+        if target.w * 2 > res.w || target.h * 2 > res.h {
+            return Ok(None);
+        }
+
+        // The decoder picks the smallest scale that is at least this large, so the preview will be
+        // between a half and a quarter of the final resolution.
+        decoder.scale((target.w / 2).max(1) as u16, (target.h / 2).max(1) as u16)?;
+        let img = DynamicImage::from_decoder(decoder)?;
+        let img = icc::from_file(&path, orientation::from_file(&path, img));
+        trace!("Decoded preview for {:?} in {:?}", path, start.elapsed());
+
+        if cancel.load(Ordering::Relaxed) {
+            return Err(String::from("Cancelled").into());
+        }
+
+        Ok(Some(UnscaledImage::from(img).0))
+    }
+
+    // In low memory mode JPEGs are decoded at a reduced scale, so the full resolution image is
+    // never held in memory. Other formats have to be decoded in full and scaled afterwards.
+    fn low_memory_jpeg(path: &Path, params: WorkParams) -> Result<Option<DynamicImage>> {
+        if !params.low_memory || !is_jpeg(path) {
+            return Ok(None);
+        }
+
+        let mut decoder = JpegDecoder::new(BufReader::new(File::open(path)?))?;
+        let res = Res::from(decoder.dimensions());
+        let target = res.fit_inside(params.target_res);
+        if target == res {
+            return Ok(None);
+        }
+
+        // The image may still be rotated, so ask for enough pixels to cover the target either way.
+        let side = target.w.max(target.h).max(1) as u16;
+        decoder.scale(side, side)?;
+        Ok(Some(DynamicImage::from_decoder(decoder)?))
+    }
+
+    pub fn load_image(
+        path: PathBuf,
+        params: WorkParams,
         cancel: Arc<AtomicBool>,
     ) -> Result<UnscaledImage> {
         if cancel.load(Ordering::Relaxed) {
             return Err(String::from("Cancelled").into());
         }
 
+        let start = Instant::now();
         let img = if is_webp(&path) {
             let data = fs::read(&path)?;
 
@@ -439,20 +817,38 @@ pub mod static_image {
                 .decode(&data)?
                 .into_dynamic_image()
                 .ok_or("Failed to convert jpeg-xl to DynamicImage")?
+        } else if let Some(img) = low_memory_jpeg(&path, params)? {
+            icc::from_file(&path, orientation::from_file(&path, img))
         } else if is_natively_supported_image(&path) {
             let mut reader = Reader::open(&path)?;
             reader.limits(LIMITS.clone());
-            reader.decode()?
+            icc::from_file(&path, orientation::from_file(&path, reader.decode()?))
         } else {
             unreachable!();
         };
-
+        stats::DECODE.record(start.elapsed());
 
         if cancel.load(Ordering::Relaxed) {
             return Err(String::from("Cancelled").into());
         }
 
-        Ok(UnscaledImage::from(img))
+        let uimg = UnscaledImage::from(img);
+        if !params.low_memory {
+            return Ok(uimg);
+        }
+
+        // Drop the full size image immediately rather than keeping it around for later downscaling.
+        // The page keeps the result as a scaled image and reloads it from disk if it has to grow.
+        let res = uimg.0.res.fit_inside(params.target_res);
+        if res == uimg.0.res {
+            return Ok(uimg);
+        }
+
+        let start = Instant::now();
+        let scaled = uimg.0.downscale(res, downscaling::filter(params));
+        stats::SCALE.record(start.elapsed());
+
+        Ok(UnscaledImage(scaled))
     }
 }
 
@@ -469,11 +865,7 @@ pub mod animation {
         path: Rc<PathBuf>,
         params: WorkParams,
     ) -> LoadFuture<AnimatedImage, WorkParams> {
-        let permit = LOADING_SEM
-            .clone()
-            .acquire_owned()
-            .await
-            .expect("Error acquiring loading permit");
+        let permit = acquire_permit(params).await;
 
         let path = (*path).clone();
         let cancel_flag = Arc::new(AtomicBool::new(false));
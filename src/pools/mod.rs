@@ -3,10 +3,20 @@ use std::thread;
 
 use crate::closing;
 
+pub mod autocrop;
+pub mod cbz;
+pub mod conversions;
 pub mod downscaling;
 pub mod extracting;
+pub mod icc;
+mod jpeg;
 pub mod loading;
+pub mod orientation;
+mod realesrgan;
+pub mod stats;
+pub mod trim;
 pub mod upscaling;
+pub mod verify;
 
 fn handle_panic(_e: Box<dyn Any + Send>) {
     error!("Unexpected panic in thread {}", thread::current().name().unwrap_or("unnamed"));
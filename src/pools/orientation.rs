@@ -0,0 +1,108 @@
+// Applies the EXIF orientation of JPEGs. Phones and cameras usually save photos as the sensor saw
+// them and only record how they should be rotated, so without this they show up sideways.
+
+use std::fs::File;
+use std::io::{self, BufReader, Cursor, Read};
+use std::path::Path;
+
+use image::{DynamicImage, ImageFormat};
+
+use crate::pools::jpeg;
+
+const ORIENTATION_TAG: u16 = 0x0112;
+
+pub fn from_file(path: &Path, img: DynamicImage) -> DynamicImage {
+    match read(path) {
+        Some(o) => apply(path, o, img),
+        None => img,
+    }
+}
+
+pub fn from_memory(path: &Path, data: &[u8], img: DynamicImage) -> DynamicImage {
+    if !is_jpeg(path) {
+        return img;
+    }
+
+    match checked(path, read_orientation(Cursor::new(data))) {
+        Some(o) => apply(path, o, img),
+        None => img,
+    }
+}
+
+// Returns the orientation of the file, if it needs to be rotated or flipped.
+pub fn read(path: &Path) -> Option<u16> {
+    if !is_jpeg(path) {
+        return None;
+    }
+
+    match File::open(path) {
+        Ok(f) => checked(path, read_orientation(BufReader::new(f))),
+        Err(e) => {
+            error!("Failed to open {:?} to read its orientation: {}", path, e);
+            None
+        }
+    }
+}
+
+fn is_jpeg(path: &Path) -> bool {
+    matches!(ImageFormat::from_path(path), Ok(ImageFormat::Jpeg))
+}
+
+fn checked(path: &Path, orientation: io::Result<Option<u16>>) -> Option<u16> {
+    match orientation {
+        Ok(Some(o)) if (2..=8).contains(&o) => Some(o),
+        Ok(_) => None,
+        Err(e) => {
+            error!("Failed to read EXIF orientation from {:?}: {}", path, e);
+            None
+        }
+    }
+}
+
+pub fn apply(path: &Path, orientation: u16, img: DynamicImage) -> DynamicImage {
+    trace!("Applying EXIF orientation {} to {:?}", orientation, path);
+    match orientation {
+        2 => img.fliph(),
+        3 => img.rotate180(),
+        4 => img.flipv(),
+        5 => img.rotate90().fliph(),
+        6 => img.rotate90(),
+        7 => img.rotate270().fliph(),
+        8 => img.rotate270(),
+        _ => img,
+    }
+}
+
+fn read_orientation(reader: impl Read) -> io::Result<Option<u16>> {
+    let segments = jpeg::segments(reader, jpeg::APP1, b"Exif\0\0")?;
+    Ok(segments.first().and_then(|tiff| orientation_tag(tiff)))
+}
+
+// Only the first IFD is checked, which is where the orientation of the main image is.
+fn orientation_tag(tiff: &[u8]) -> Option<u16> {
+    let big_endian = match tiff.get(0..2)? {
+        b"II" => false,
+        b"MM" => true,
+        _ => return None,
+    };
+
+    let u16_at = |i: usize| {
+        let b = tiff.get(i..i + 2)?.try_into().ok()?;
+        Some(if big_endian { u16::from_be_bytes(b) } else { u16::from_le_bytes(b) })
+    };
+    let u32_at = |i: usize| {
+        let b = tiff.get(i..i + 4)?.try_into().ok()?;
+        Some(if big_endian { u32::from_be_bytes(b) } else { u32::from_le_bytes(b) })
+    };
+
+    if u16_at(2)? != 42 {
+        return None;
+    }
+
+    let ifd = u32_at(4)? as usize;
+    let entries = u16_at(ifd)? as usize;
+    (0..entries)
+        .map(|i| ifd + 2 + i * 12)
+        .find(|&entry| u16_at(entry) == Some(ORIENTATION_TAG))
+        .and_then(|entry| u16_at(entry + 8))
+}
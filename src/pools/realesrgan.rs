@@ -0,0 +1,87 @@
+// Runs realesrgan-ncnn-vulkan directly. Unlike waifu2x it can reach 3x or 4x in a single pass, so
+// the scale is picked up front from the target and minimum resolutions.
+
+use std::path::Path;
+use std::process::{Command, Stdio};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use crate::com::Res;
+use crate::config::{CONFIG, MINIMUM_RES, TARGET_RES};
+
+const DEFAULT_BINARY: &str = "realesrgan-ncnn-vulkan";
+const POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+// Scale factor needed along one axis to reach `target`, or 0 if that axis is unconstrained.
+fn ratio(target: u32, original: u32) -> f64 {
+    if target == 0 || original == 0 { 0.0 } else { f64::from(target) / f64::from(original) }
+}
+
+// The smallest supported scale that fits the image to target_resolution and fills
+// minimum_resolution, the same way the default upscaler does.
+fn scale_for(original: Res) -> u32 {
+    if let Some(s) = CONFIG.realesrgan_scale {
+        return s.get();
+    }
+
+    // The x4plus models only support 4x.
+    if CONFIG.realesrgan_model.contains("x4plus") {
+        return 4;
+    }
+
+    let (wr, hr) = (ratio(TARGET_RES.w, original.w), ratio(TARGET_RES.h, original.h));
+    let fit = match (wr > 0.0, hr > 0.0) {
+        (true, true) => wr.min(hr),
+        _ => wr.max(hr),
+    };
+    let fill = ratio(MINIMUM_RES.w, original.w).max(ratio(MINIMUM_RES.h, original.h));
+
+    (fit.max(fill).ceil() as u32).clamp(2, 4)
+}
+
+pub(super) fn upscale(source: &Path, dest: &Path) -> crate::Result<Res> {
+    let original: Res = image::image_dimensions(source)?.into();
+    let scale = scale_for(original);
+
+    let binary = CONFIG.realesrgan_binary.as_deref().unwrap_or_else(|| Path::new(DEFAULT_BINARY));
+    let mut cmd = Command::new(binary);
+    cmd.arg("-i")
+        .arg(source)
+        .arg("-o")
+        .arg(dest)
+        .arg("-n")
+        .arg(&CONFIG.realesrgan_model)
+        .arg("-s")
+        .arg(scale.to_string())
+        .arg("-t")
+        .arg(CONFIG.realesrgan_tile_size.to_string())
+        .args(["-f", "png"])
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        // It prints progress for every tile, which would fill a pipe nobody reads.
+        .stderr(Stdio::null());
+
+    trace!("Upscaling {:?} {}x with {:?}", source, scale, cmd);
+    let mut child = cmd.spawn()?;
+
+    let timeout = CONFIG.upscale_timeout.map(|s| Duration::from_secs(s.get()));
+    let start = Instant::now();
+    let status = loop {
+        if let Some(status) = child.try_wait()? {
+            break status;
+        }
+
+        if timeout.map_or(false, |t| start.elapsed() > t) {
+            drop(child.kill());
+            drop(child.wait());
+            return Err(format!("Upscaling {:?} timed out", source).into());
+        }
+        thread::sleep(POLL_INTERVAL);
+    };
+
+    if !status.success() {
+        return Err(format!("{:?} failed on {:?} with {}", binary, source, status).into());
+    }
+
+    Ok(image::image_dimensions(dest)?.into())
+}
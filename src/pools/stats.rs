@@ -0,0 +1,50 @@
+// Recent timings and queue depths for the performance overlay.
+// These are only approximate and are never used to make decisions.
+
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::time::Duration;
+
+#[derive(Debug, Default)]
+pub struct Timing(AtomicU64);
+
+impl Timing {
+    pub fn record(&self, d: Duration) {
+        self.0.store(d.as_micros() as u64, Ordering::Relaxed);
+    }
+
+    pub fn last(&self) -> Duration {
+        Duration::from_micros(self.0.load(Ordering::Relaxed))
+    }
+}
+
+pub static DECODE: Timing = Timing(AtomicU64::new(0));
+pub static SCALE: Timing = Timing(AtomicU64::new(0));
+// Pages that are waiting to be extracted from any archive.
+static EXTRACTION_QUEUE: AtomicUsize = AtomicUsize::new(0);
+
+pub fn enqueue_extractions(n: usize) {
+    EXTRACTION_QUEUE.fetch_add(n, Ordering::Relaxed);
+}
+
+pub fn dequeue_extractions(n: usize) {
+    EXTRACTION_QUEUE.fetch_sub(n, Ordering::Relaxed);
+}
+
+pub fn extraction_queue() -> usize {
+    EXTRACTION_QUEUE.load(Ordering::Relaxed)
+}
+
+// The resident set size of this process, in bytes.
+#[cfg(target_os = "linux")]
+pub fn resident_memory() -> Option<u64> {
+    let statm = std::fs::read_to_string("/proc/self/statm").ok()?;
+    let pages: u64 = statm.split_whitespace().nth(1)?.parse().ok()?;
+    let page_size = unsafe { libc::sysconf(libc::_SC_PAGESIZE) };
+
+    Some(pages * u64::try_from(page_size).ok()?)
+}
+
+#[cfg(not(target_os = "linux"))]
+pub const fn resident_memory() -> Option<u64> {
+    None
+}
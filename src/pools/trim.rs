@@ -0,0 +1,54 @@
+// Hands memory freed by unloaded pages back to the OS promptly. Both allocators hold on to freed
+// pages for a while in case they're reused, which keeps the resident set high long after large
+// images have been dropped.
+
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+
+use crate::config::CONFIG;
+use crate::spawn_thread;
+
+// Images are often still referenced by the GUI or in-flight work for a little while after being
+// unloaded, so wait a moment and trim once for a burst of unloads.
+const DELAY: Duration = Duration::from_secs(1);
+
+static PENDING: AtomicBool = AtomicBool::new(false);
+
+pub fn schedule() {
+    if !CONFIG.trim_memory || PENDING.swap(true, Ordering::Relaxed) {
+        return;
+    }
+
+    spawn_thread("trim", || {
+        std::thread::sleep(DELAY);
+        PENDING.store(false, Ordering::Relaxed);
+        trim();
+    });
+}
+
+fn trim() {
+    // Rust allocations go through jemalloc.
+    #[cfg(not(target_env = "msvc"))]
+    unsafe {
+        // 4096 is MALLCTL_ARENAS_ALL.
+        let name = b"arena.4096.purge\0";
+        let r = tikv_jemalloc_sys::mallctl(
+            name.as_ptr().cast(),
+            std::ptr::null_mut(),
+            std::ptr::null_mut(),
+            std::ptr::null_mut(),
+            0,
+        );
+        if r != 0 {
+            error!("Failed to purge jemalloc arenas: {}", r);
+        }
+    }
+
+    // GTK and the C libraries use the system allocator.
+    #[cfg(target_env = "gnu")]
+    unsafe {
+        libc::malloc_trim(0);
+    }
+
+    trace!("Trimmed freed memory");
+}
@@ -9,8 +9,8 @@ use rayon::{ThreadPool, ThreadPoolBuilder};
 use tokio::sync::{oneshot, Semaphore};
 
 use crate::com::Res;
-use crate::config::{CONFIG, MINIMUM_RES, TARGET_RES};
-use crate::pools::handle_panic;
+use crate::config::{UpscalerKind, CONFIG, MINIMUM_RES, TARGET_RES};
+use crate::pools::{autocrop, handle_panic, orientation, realesrgan};
 use crate::Fut;
 
 static UPSCALING: Lazy<ThreadPool> = Lazy::new(|| {
@@ -67,5 +67,29 @@ pub async fn upscale<P: AsRef<Path>>(source: P, dest: P) -> Fut<Result<Res, Stri
 }
 
 fn do_upscale(source: PathBuf, dest: PathBuf) -> crate::Result<Res> {
-    Ok(Res::from(UPSCALER.run(source, dest)?))
+    let res = match CONFIG.upscaler {
+        UpscalerKind::Waifu2x => Res::from(UPSCALER.run(source, dest.clone())?),
+        UpscalerKind::RealEsrgan => realesrgan::upscale(&source, &dest)?,
+    };
+
+    // Upscalers ignore EXIF orientation, so rotate the upscaled file to match the original.
+    let res = match orientation::read(&source) {
+        Some(o) => {
+            let img = orientation::apply(&source, o, image::open(&dest)?);
+            img.save(&dest)?;
+            Res::from((img.width(), img.height()))
+        }
+        None => res,
+    };
+
+    // The upscaled image will be cropped when it's loaded, so report the cropped resolution.
+    if autocrop::enabled() {
+        return Ok(autocrop::cropped_res(&image::open(&dest)?));
+    }
+    Ok(res)
+}
+
+// Upscales on the current thread, bypassing the pool, for benchmarking.
+pub fn upscale_blocking(source: PathBuf, dest: PathBuf) -> crate::Result<Res> {
+    do_upscale(source, dest)
 }
@@ -0,0 +1,156 @@
+// Integrity checks for extracted files.
+// libarchive treats bad CRCs as warnings and unrar will happily output truncated files, so without
+// these a corrupt download is rendered as a partially grey image instead of failing.
+
+use std::convert::TryInto;
+use std::fs::File;
+use std::io::{self, Read, Seek, SeekFrom};
+use std::path::Path;
+
+use ahash::AHashMap;
+use once_cell::sync::Lazy;
+
+#[derive(Debug, Default, Clone, Copy)]
+pub struct Expected {
+    pub crc: Option<u32>,
+    pub size: Option<u64>,
+}
+
+impl Expected {
+    pub fn check(&self, data: &[u8]) -> Result<(), String> {
+        if let Some(size) = self.size {
+            if data.len() as u64 != size {
+                return Err(format!(
+                    "Extracted file is the wrong size: expected {} bytes, got {}. The archive is \
+                     likely corrupt or truncated.",
+                    size,
+                    data.len()
+                ));
+            }
+        }
+
+        if let Some(crc) = self.crc {
+            let actual = crc32(data);
+            if actual != crc {
+                return Err(format!(
+                    "CRC mismatch: expected {:08x}, got {:08x}. The archive is likely corrupt.",
+                    crc, actual
+                ));
+            }
+        }
+
+        Ok(())
+    }
+}
+
+static CRC_TABLE: Lazy<[u32; 256]> = Lazy::new(|| {
+    let mut table = [0; 256];
+    for (i, v) in table.iter_mut().enumerate() {
+        let mut c = i as u32;
+        for _ in 0..8 {
+            c = if c & 1 == 1 { 0xedb8_8320 ^ (c >> 1) } else { c >> 1 };
+        }
+        *v = c;
+    }
+    table
+});
+
+pub fn crc32(data: &[u8]) -> u32 {
+    !data
+        .iter()
+        .fold(!0, |c, b| CRC_TABLE[((c ^ u32::from(*b)) & 0xff) as usize] ^ (c >> 8))
+}
+
+const EOCD_SIG: u32 = 0x0605_4b50;
+const CDFH_SIG: u32 = 0x0201_4b50;
+const EOCD_LEN: usize = 22;
+// The end of central directory record is followed by a comment of up to 64KB.
+const MAX_EOCD_SEARCH: u64 = EOCD_LEN as u64 + 0xffff;
+
+fn u16_at(b: &[u8], i: usize) -> u16 {
+    u16::from_le_bytes(b[i..i + 2].try_into().expect("Impossible"))
+}
+
+fn u32_at(b: &[u8], i: usize) -> u32 {
+    u32::from_le_bytes(b[i..i + 4].try_into().expect("Impossible"))
+}
+
+fn invalid(msg: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, msg)
+}
+
+// Reads the expected CRCs and sizes of every file in a zip archive from its central directory.
+// Zip64 archives are not handled, since there's no realistic need to support them for images.
+pub fn read_zip_index(path: &Path) -> io::Result<AHashMap<String, Expected>> {
+    let mut file = File::open(path)?;
+    let len = file.metadata()?.len();
+
+    let tail_len = len.min(MAX_EOCD_SEARCH);
+    file.seek(SeekFrom::Start(len - tail_len))?;
+    let mut tail = vec![0; tail_len as usize];
+    file.read_exact(&mut tail)?;
+
+    let eocd = (0..=tail.len().saturating_sub(EOCD_LEN))
+        .rev()
+        .find(|i| u32_at(&tail, *i) == EOCD_SIG)
+        .ok_or_else(|| invalid("Missing end of central directory"))?;
+
+    let entries = u16_at(&tail, eocd + 10) as usize;
+    let cd_size = u32_at(&tail, eocd + 12);
+    let cd_offset = u32_at(&tail, eocd + 16);
+    if cd_size == u32::MAX || cd_offset == u32::MAX {
+        return Err(invalid("Zip64 archives are not supported"));
+    }
+
+    let mut cd = vec![0; cd_size as usize];
+    file.seek(SeekFrom::Start(cd_offset.into()))?;
+    file.read_exact(&mut cd)?;
+
+    let mut out = AHashMap::with_capacity(entries);
+    let mut i = 0;
+
+    while i + 46 <= cd.len() && u32_at(&cd, i) == CDFH_SIG {
+        let crc = u32_at(&cd, i + 16);
+        let size = u32_at(&cd, i + 24);
+        let name_len = u16_at(&cd, i + 28) as usize;
+        let extra_len = u16_at(&cd, i + 30) as usize;
+        let comment_len = u16_at(&cd, i + 32) as usize;
+
+        let name_end = i + 46 + name_len;
+        if name_end > cd.len() {
+            return Err(invalid("Truncated central directory"));
+        }
+        let name = String::from_utf8_lossy(&cd[i + 46..name_end]).to_string();
+
+        out.insert(name, Expected {
+            crc: Some(crc),
+            // Zip64 sizes are stored in the extra field.
+            size: (size != u32::MAX).then(|| size.into()),
+        });
+
+        i = name_end + extra_len + comment_len;
+    }
+
+    Ok(out)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn crc() {
+        assert_eq!(crc32(b""), 0);
+        assert_eq!(crc32(b"123456789"), 0xcbf4_3926);
+        assert_eq!(crc32(b"The quick brown fox jumps over the lazy dog"), 0x414f_a339);
+    }
+
+    #[test]
+    fn check() {
+        let e = Expected { crc: Some(0xcbf4_3926), size: Some(9) };
+        assert!(e.check(b"123456789").is_ok());
+        assert!(e.check(b"12345678").is_err());
+        assert!(e.check(b"123456780").is_err());
+        assert!(Expected::default().check(b"anything").is_ok());
+    }
+}
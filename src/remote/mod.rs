@@ -0,0 +1,126 @@
+// A small client for the socket, so scripts can run `aw-man remote Status` instead of piping
+// commands through socat or nc.
+//
+// Running instances are found by their sockets in socket_dir. Sockets left behind by instances
+// that crashed can't be connected to and are ignored.
+
+#[cfg(target_family = "unix")]
+use std::fs;
+#[cfg(target_family = "unix")]
+use std::io::{Read, Write};
+#[cfg(target_family = "unix")]
+use std::net::Shutdown;
+#[cfg(target_family = "unix")]
+use std::os::unix::net::UnixStream;
+#[cfg(target_family = "unix")]
+use std::path::Path;
+
+#[cfg(target_family = "unix")]
+use serde_json::Value;
+
+#[cfg(target_family = "unix")]
+use crate::config::CONFIG;
+#[cfg(target_family = "unix")]
+use crate::socket::socket_path;
+
+// The process IDs of every instance with a socket in `dir` that is accepting connections.
+#[cfg(target_family = "unix")]
+fn instances(dir: &Path) -> Vec<u32> {
+    let rd = match fs::read_dir(dir) {
+        Ok(rd) => rd,
+        Err(e) => {
+            eprintln!("Failed to read socket_dir {:?}: {:?}", dir, e);
+            return Vec::new();
+        }
+    };
+
+    let mut pids: Vec<u32> = rd
+        .filter_map(|e| e.ok())
+        .filter_map(|e| {
+            let name = e.file_name();
+            let name = name.to_str()?;
+            name.strip_prefix("aw-man")?.strip_suffix(".sock")?.parse().ok()
+        })
+        .filter(|pid| UnixStream::connect(socket_path(dir, *pid)).is_ok())
+        .collect();
+
+    pids.sort_unstable();
+    pids
+}
+
+#[cfg(target_family = "unix")]
+fn send(sock: &Path, command: &str) -> std::io::Result<String> {
+    let mut stream = UnixStream::connect(sock)?;
+    stream.write_all(command.as_bytes())?;
+    // Closing our half tells aw-man there are no more commands, so it closes the connection once
+    // it has responded.
+    stream.shutdown(Shutdown::Write)?;
+
+    let mut resp = String::new();
+    stream.read_to_string(&mut resp)?;
+    Ok(resp)
+}
+
+// Returns false so aw-man exits without opening a window.
+#[cfg(target_family = "unix")]
+pub fn run(pid: Option<u32>, list: bool, command: &[String]) -> bool {
+    let dir = match &CONFIG.socket_dir {
+        Some(d) => d,
+        None => {
+            eprintln!("socket_dir must be set to use remote");
+            std::process::exit(1);
+        }
+    };
+
+    if list {
+        for pid in instances(dir) {
+            println!("{}", pid);
+        }
+        return false;
+    }
+
+    let command = command.join(" ");
+    if command.trim().is_empty() {
+        eprintln!("No command given");
+        std::process::exit(1);
+    }
+
+    let pid = match (pid, &instances(dir)[..]) {
+        (Some(pid), _) => pid,
+        (None, [pid]) => *pid,
+        (None, []) => {
+            eprintln!("No running instances of aw-man found in {:?}", dir);
+            std::process::exit(1);
+        }
+        (None, pids) => {
+            eprintln!("Multiple instances of aw-man are running, pick one with --pid: {:?}", pids);
+            std::process::exit(1);
+        }
+    };
+
+    let sock = socket_path(dir, pid);
+    let resp = match send(&sock, &command) {
+        Ok(r) => r,
+        Err(e) => {
+            eprintln!("Failed to send command to {:?}: {:?}", sock, e);
+            std::process::exit(1);
+        }
+    };
+
+    println!("{}", resp);
+
+    let failed = match serde_json::from_str::<Value>(&resp) {
+        Ok(Value::Object(m)) => m.contains_key("error"),
+        _ => false,
+    };
+    if failed {
+        std::process::exit(1);
+    }
+    false
+}
+
+#[cfg(target_family = "windows")]
+pub fn run(_pid: Option<u32>, _list: bool, _command: &[String]) -> bool {
+    eprintln!("remote is not supported on Windows");
+    false
+}
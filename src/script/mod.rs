@@ -0,0 +1,81 @@
+// Runs a fixed sequence of commands from a file or stdin, as if they were sent over the socket.
+// Useful for reproducing bugs or taking repeatable screenshots without a human at the keyboard.
+//
+// Each line is a single command. Empty lines and lines starting with # are ignored, and
+// "Sleep <milliseconds>" waits before running the next command.
+
+use std::io::{self, Read};
+use std::path::{Path, PathBuf};
+use std::thread;
+use std::time::Duration;
+
+use gtk::glib::Sender;
+use once_cell::sync::Lazy;
+use regex::Regex;
+use serde_json::Value;
+use tokio::select;
+
+use crate::com::GuiAction;
+use crate::config::OPTIONS;
+use crate::socket::handle_command;
+use crate::{closing, spawn_thread};
+
+static SLEEP_RE: Lazy<Regex> = Lazy::new(|| Regex::new(r"^Sleep (\d+)$").unwrap());
+
+pub(super) fn init(gui_sender: &Sender<GuiAction>) -> Option<thread::JoinHandle<()>> {
+    let path = OPTIONS.script.clone()?;
+    let gui_sender = gui_sender.clone();
+
+    Some(spawn_thread("script", move || run(path, gui_sender)))
+}
+
+fn read_script(path: &Path) -> io::Result<String> {
+    if path == Path::new("-") {
+        let mut s = String::new();
+        io::stdin().read_to_string(&mut s)?;
+        Ok(s)
+    } else {
+        std::fs::read_to_string(path)
+    }
+}
+
+#[tokio::main(flavor = "current_thread")]
+async fn run(path: PathBuf, gui_sender: Sender<GuiAction>) {
+    let script = match read_script(&path) {
+        Ok(s) => s,
+        Err(e) => {
+            error!("Failed to read script {:?}: {:?}", path, e);
+            return;
+        }
+    };
+
+    for (n, line) in script.lines().enumerate().map(|(n, l)| (n + 1, l.trim())) {
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+
+        if let Some(c) = SLEEP_RE.captures(line) {
+            let ms = c[1].parse().unwrap_or(u64::MAX);
+            select! {
+                _ = tokio::time::sleep(Duration::from_millis(ms)) => continue,
+                _ = closing::closed_fut() => return,
+            }
+        }
+
+        debug!("Running script line {}: {}", n, line);
+        let resp = select! {
+            resp = handle_command(line.to_string(), &gui_sender) => resp,
+            _ = closing::closed_fut() => return,
+        };
+
+        match resp {
+            Value::Object(m) if m.contains_key("error") => {
+                error!("Script line {} ({}) failed: {}", n, line, Value::Object(m));
+            }
+            Value::String(s) if s == "done" => {}
+            v => println!("{}", v),
+        }
+    }
+
+    info!("Finished running script {:?}", path);
+}
@@ -1,3 +1,6 @@
+#[cfg(target_family = "unix")]
+mod protocol;
+
 use std::fs::remove_file;
 use std::path::{Path, PathBuf};
 use std::{io, process, thread};
@@ -10,6 +13,8 @@ use tokio::net::{UnixListener, UnixStream};
 use tokio::select;
 use tokio::sync::oneshot;
 
+#[cfg(target_family = "unix")]
+use self::protocol::Message;
 use crate::com::GuiAction;
 use crate::{closing, config, spawn_thread};
 
@@ -25,12 +30,15 @@ impl Drop for RemoveOnDrop {
     }
 }
 
+#[cfg(target_family = "unix")]
+pub fn socket_path(dir: &Path, pid: u32) -> PathBuf {
+    dir.join(format!("aw-man{}.sock", pid))
+}
+
 pub(super) fn init(gui_sender: &Sender<GuiAction>) -> Option<thread::JoinHandle<()>> {
     #[cfg(target_family = "unix")]
     if let Some(d) = &config::CONFIG.socket_dir {
-        SOCKET_PATH
-            .set(PathBuf::from(d).join(format!("aw-man{}.sock", process::id())))
-            .expect("Failed to set socket path");
+        SOCKET_PATH.set(socket_path(d, process::id())).expect("Failed to set socket path");
 
         let sock = SOCKET_PATH.get().expect("Impossible");
         let gui_sender = gui_sender.clone();
@@ -45,20 +53,39 @@ pub(super) fn init(gui_sender: &Sender<GuiAction>) -> Option<thread::JoinHandle<
     None
 }
 
-async fn handle_command(cmd: String, gui_sender: &Sender<GuiAction>) -> Value {
+async fn send_command(cmd: String, gui_sender: &Sender<GuiAction>) -> Result<Value, String> {
     let (s, r) = oneshot::channel();
     let ga = GuiAction::Action(cmd, s);
 
     if let Err(e) = gui_sender.send(ga) {
         let e = format!("Error sending socket commend to Gui: {:?}", e);
         error!("{}", e);
-        return Value::String(e);
+        return Err(e);
     };
 
     // An error will most likely mean the value was dropped.
     match r.await {
-        Ok(v) => v,
-        Err(_) => Value::String("done".to_string()),
+        Ok(v) => Ok(v),
+        Err(_) => Ok(Value::String("done".to_string())),
+    }
+}
+
+pub(super) async fn handle_command(cmd: String, gui_sender: &Sender<GuiAction>) -> Value {
+    send_command(cmd, gui_sender).await.unwrap_or_else(Value::String)
+}
+
+#[cfg(target_family = "unix")]
+async fn handle_message(msg: &str, gui_sender: &Sender<GuiAction>) -> Value {
+    match protocol::parse(msg) {
+        Ok(Message::Plain(cmd)) => handle_command(cmd, gui_sender).await,
+        Ok(Message::Json { id, command }) => match send_command(command, gui_sender).await {
+            Ok(v) => protocol::respond(id, v),
+            Err(e) => protocol::internal_error(id, e),
+        },
+        Err(e) => {
+            error!("Invalid socket request: {}", e);
+            e
+        }
     }
 }
 
@@ -78,9 +105,8 @@ async fn handle_stream(stream: UnixStream, gui_sender: Sender<GuiAction>) {
            _ = closing::closed_fut() => return,
         }
 
-        // Any realistic command (for now) will be under 1KB.
-        // This will most likely change in the future.
-        let mut msg = vec![0; 1024];
+        // Any realistic command, even a JSON request with long paths, will be under 16KB.
+        let mut msg = vec![0; 16 * 1024];
         match stream.try_read(&mut msg) {
             Ok(n) => {
                 msg.truncate(n);
@@ -100,10 +126,7 @@ async fn handle_stream(stream: UnixStream, gui_sender: Sender<GuiAction>) {
         }
 
         let resp = match std::str::from_utf8(&msg) {
-            Ok(cmd) => {
-                let cmd = cmd.trim();
-                handle_command(cmd.to_string(), &gui_sender).await
-            }
+            Ok(msg) => handle_message(msg, &gui_sender).await,
             Err(e) => {
                 let e = format!("Unable to parse command {:?}", e);
                 error!("{}", e);
@@ -0,0 +1,204 @@
+// The versioned JSON protocol spoken over the socket.
+//
+// A request is a single JSON object:
+//   {"version": 1, "id": <any>, "command": "Open", "args": ["/path/to/file.zip"]}
+// Only "command" is required. Args are appended to the command, separated by spaces, so the same
+// commands work as in shortcuts. Args to Execute are quoted first, since it's the only command
+// that splits its arguments, and escaped so substitutions like %f aren't applied to them.
+// Responses echo the id and hold either "result" or "error":
+//   {"version": 1, "id": <any>, "result": <value>}
+//   {"version": 1, "id": <any>, "error": {"code": "command_failed", "message": "..."}}
+//
+// Anything that doesn't start with "{" is treated as a plain command, like "Status", and gets the
+// same unstructured response as before the protocol existed. The one breaking change is that
+// failures from the Gui are objects with an "error" field, like those from the manager, instead
+// of bare strings.
+
+use serde::Deserialize;
+use serde_json::{json, Value};
+
+use crate::manager::shell;
+
+pub const VERSION: u64 = 1;
+
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+struct Request {
+    #[serde(default = "default_version")]
+    version: u64,
+    #[serde(default)]
+    id: Value,
+    command: String,
+    #[serde(default)]
+    args: Vec<Value>,
+}
+
+const fn default_version() -> u64 {
+    VERSION
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub(super) enum ErrorCode {
+    // The request could not be parsed or used an unsupported version.
+    InvalidRequest,
+    // The command ran and failed, or wasn't a recognized command.
+    CommandFailed,
+    // aw-man could not run the command at all, such as while shutting down.
+    Internal,
+}
+
+impl ErrorCode {
+    const fn as_str(self) -> &'static str {
+        match self {
+            Self::InvalidRequest => "invalid_request",
+            Self::CommandFailed => "command_failed",
+            Self::Internal => "internal",
+        }
+    }
+}
+
+#[derive(Debug, PartialEq)]
+pub(super) enum Message {
+    Plain(String),
+    Json { id: Value, command: String },
+}
+
+pub(super) fn error_response(id: Value, code: ErrorCode, message: String) -> Value {
+    json!({
+        "version": VERSION,
+        "id": id,
+        "error": { "code": code.as_str(), "message": message },
+    })
+}
+
+fn arg_string(v: Value) -> Result<String, String> {
+    match v {
+        Value::String(s) => Ok(s),
+        Value::Number(n) => Ok(n.to_string()),
+        Value::Bool(b) => Ok(b.to_string()),
+        v => Err(format!("Unsupported argument {}, expected a string, number or boolean", v)),
+    }
+}
+
+// Parses a message from the socket. Errors are returned as complete responses, ready to send.
+pub(super) fn parse(msg: &str) -> Result<Message, Value> {
+    let msg = msg.trim();
+    if !msg.starts_with('{') {
+        return Ok(Message::Plain(msg.to_string()));
+    }
+
+    let req: Request = serde_json::from_str(msg).map_err(|e| {
+        error_response(Value::Null, ErrorCode::InvalidRequest, format!("Invalid request: {}", e))
+    })?;
+
+    if req.version != VERSION {
+        return Err(error_response(
+            req.id,
+            ErrorCode::InvalidRequest,
+            format!("Unsupported protocol version {}, expected {}", req.version, VERSION),
+        ));
+    }
+
+    let command = req.command.trim();
+    if command.is_empty() {
+        return Err(error_response(req.id, ErrorCode::InvalidRequest, "Empty command".into()));
+    }
+
+    // Other commands take everything after their name as a single argument.
+    let quote = command == "Execute";
+
+    let mut parts = vec![command.to_string()];
+    for (i, a) in req.args.into_iter().enumerate() {
+        match arg_string(a) {
+            // Substitutions are never applied to the executable itself.
+            Ok(a) if quote && i == 0 => parts.push(shell::quote(&a)),
+            Ok(a) if quote => parts.push(shell::quote_literal(&a)),
+            Ok(a) => parts.push(a),
+            Err(e) => return Err(error_response(req.id, ErrorCode::InvalidRequest, e)),
+        }
+    }
+
+    Ok(Message::Json { id: req.id, command: parts.join(" ") })
+}
+
+// Wraps the response to a command. Failures from the manager or Gui are sent as objects with an
+// "error" field; any other fields, like the output of a failed executable, are kept as details.
+pub(super) fn respond(id: Value, resp: Value) -> Value {
+    let mut m = match resp {
+        Value::Object(m) if m.contains_key("error") => m,
+        v => return json!({ "version": VERSION, "id": id, "result": v }),
+    };
+
+    let message = match m.remove("error").expect("Impossible") {
+        Value::String(s) => s,
+        v => v.to_string(),
+    };
+
+    let mut err = error_response(id, ErrorCode::CommandFailed, message);
+    if !m.is_empty() {
+        err["error"]["details"] = Value::Object(m);
+    }
+    err
+}
+
+pub(super) fn internal_error(id: Value, message: String) -> Value {
+    error_response(id, ErrorCode::Internal, message)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn plain_commands() {
+        assert_eq!(parse(" Status\n"), Ok(Message::Plain("Status".into())));
+        assert_eq!(parse("Open /a b.zip"), Ok(Message::Plain("Open /a b.zip".into())));
+    }
+
+    #[test]
+    fn json_commands() {
+        assert_eq!(
+            parse(r#"{"id": 3, "command": "Open", "args": ["/a b.zip"]}"#),
+            Ok(Message::Json { id: json!(3), command: "Open /a b.zip".into() })
+        );
+        assert_eq!(
+            parse(r#"{"version": 1, "command": "Jump", "args": [5]}"#),
+            Ok(Message::Json { id: Value::Null, command: "Jump 5".into() })
+        );
+        assert_eq!(
+            parse(r#"{"command": "Execute", "args": ["/s%.sh", "a b", "it's", 1, "%f"]}"#),
+            Ok(Message::Json {
+                id: Value::Null,
+                command: r"Execute '/s%.sh' 'a b' 'it'\''s' '1' '%%f'".into()
+            })
+        );
+    }
+
+    #[test]
+    fn invalid_requests() {
+        let code = |r: Result<Message, Value>| r.unwrap_err()["error"]["code"].clone();
+
+        assert_eq!(code(parse(r#"{"command": "#)), "invalid_request");
+        assert_eq!(code(parse(r#"{"version": 2, "command": "Status"}"#)), "invalid_request");
+        assert_eq!(code(parse(r#"{"command": "Jump", "args": [[1]]}"#)), "invalid_request");
+        assert_eq!(code(parse(r#"{"command": " "}"#)), "invalid_request");
+        assert_eq!(code(parse(r#"{"command": "Status", "extra": 1}"#)), "invalid_request");
+        assert_eq!(parse(r#"{"id": "a", "version": 2, "command": "x"}"#).unwrap_err()["id"], "a");
+    }
+
+    #[test]
+    fn responses() {
+        assert_eq!(
+            respond(json!(1), json!("done")),
+            json!({"version": 1, "id": 1, "result": "done"})
+        );
+        assert_eq!(
+            respond(json!(1), json!({"error": "bad", "stderr": "x"})),
+            json!({
+                "version": 1,
+                "id": 1,
+                "error": {"code": "command_failed", "message": "bad", "details": {"stderr": "x"}},
+            })
+        );
+    }
+}
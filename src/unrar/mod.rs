@@ -2,14 +2,18 @@ use std::io::{BufRead, BufReader, Read};
 use std::path::{Path, PathBuf};
 use std::process::{Command, Stdio};
 use std::sync::atomic::{AtomicBool, Ordering};
-use std::sync::Arc;
+use std::sync::{Arc, Mutex};
 
+use ahash::AHashMap;
 use flume::Sender;
-use once_cell::sync::Lazy;
+use once_cell::sync::{Lazy, OnceCell};
 use regex::Regex;
 
 use crate::config::CONFIG;
 use crate::manager::archive::{PageExtraction, PendingExtraction};
+use crate::pools::extracting::send_verified;
+use crate::pools::stats;
+use crate::pools::verify::Expected;
 use crate::Result;
 
 pub static HAS_UNRAR: Lazy<bool> = Lazy::new(|| {
@@ -25,20 +29,109 @@ pub static HAS_UNRAR: Lazy<bool> = Lazy::new(|| {
         .is_ok()
 });
 
+fn is_rar(path: &Path) -> bool {
+    path.extension()
+        .map_or(false, |e| e.eq_ignore_ascii_case("rar") || e.eq_ignore_ascii_case("cbr"))
+}
+
+// unrar is preferred over libarchive for rar files when it's available.
+pub fn can_use(path: &Path) -> bool {
+    is_rar(path) && *HAS_UNRAR
+}
+
+// libarchive handles RAR5 and most RAR4 files on its own, but not encrypted files or some older
+// compression methods. When it fails on a rar file, point the user at unrar.
+pub fn libarchive_failure_hint(path: &Path) -> &'static str {
+    if !is_rar(path) {
+        ""
+    } else if !CONFIG.allow_external_extractors {
+        " Enabling allow_external_extractors to use unrar may help."
+    } else if !*HAS_UNRAR {
+        " Installing unrar may help."
+    } else {
+        ""
+    }
+}
+
 static FILE_LINE_RE: Lazy<Regex> =
     Lazy::new(|| Regex::new(r"^ *[^ ]+ +(\d+) +[^ ]+ +[^ ]+ +(.*)\n").unwrap());
 
+pub static PASSWORD_PATTERNS: Lazy<Vec<Regex>> = Lazy::new(|| {
+    CONFIG
+        .archive_passwords
+        .iter()
+        .map(|ap| match Regex::new(&ap.pattern) {
+            Ok(r) => r,
+            Err(e) => panic!("Invalid archive password pattern {:?}: {}", ap.pattern, e),
+        })
+        .collect()
+});
+
+// Password commands may be slow or interactive, so only run them once per archive.
+static PASSWORD_CACHE: Lazy<Mutex<AHashMap<PathBuf, Arc<OnceCell<Option<String>>>>>> =
+    Lazy::new(Mutex::default);
+
+fn find_password(source: &Path) -> Option<String> {
+    let s = source.to_string_lossy();
+    let i = PASSWORD_PATTERNS.iter().position(|r| r.is_match(&s))?;
+    let ap = &CONFIG.archive_passwords[i];
+
+    if let Some(pw) = &ap.password {
+        return Some(pw.clone());
+    }
+
+    let cmd = ap.command.as_ref()?;
+    let output = match Command::new(cmd).arg(source).stderr(Stdio::inherit()).output() {
+        Ok(o) if o.status.success() => o,
+        Ok(o) => {
+            error!("Password command {:?} for {:?} failed: {}", cmd, source, o.status);
+            return None;
+        }
+        Err(e) => {
+            error!("Failed to run password command {:?} for {:?}: {:?}", cmd, source, e);
+            return None;
+        }
+    };
+
+    String::from_utf8_lossy(&output.stdout).lines().next().map(str::to_string)
+}
+
+fn password(source: &Path) -> Option<String> {
+    let cell = PASSWORD_CACHE
+        .lock()
+        .expect("Password cache poisoned")
+        .entry(source.to_path_buf())
+        .or_default()
+        .clone();
+
+    // Only extractions of this archive wait on the password command.
+    cell.get_or_init(|| find_password(source)).clone()
+}
+
+// Always pass a password, otherwise unrar will try to prompt on stdin for encrypted archives and
+// hang forever. Real passwords go through the environment, which unlike the command line can't be
+// read by other users.
+fn unrar_command(source: &Path, command: &str) -> Command {
+    let mut cmd = Command::new("unrar");
+    cmd.arg(command).stdin(Stdio::null());
+    match password(source) {
+        Some(pw) => cmd.env("RARINISWITCHES", format!("-p\"{}\"", pw)),
+        None => cmd.arg("-p-"),
+    };
+    cmd
+}
 
 pub fn reader(
     source: PathBuf,
-    mut jobs: PendingExtraction,
+    jobs: &mut PendingExtraction,
     completed_jobs: Sender<(PageExtraction, Vec<u8>)>,
     cancel: Arc<AtomicBool>,
 ) -> Result<()> {
     let files = read_files(&source)?;
 
-    let mut process = Command::new("unrar")
-        .args(&["p", "-inul", "--"])
+    let mut process = unrar_command(&source, "p")
+        .arg("-inul")
+        .arg("--")
         .arg(&source)
         .stdout(Stdio::piped())
         .spawn()?;
@@ -58,15 +151,20 @@ pub fn reader(
         // Allow the file the user is currently viewing to jump ahead of the archive order.
         if let Ok(path) = jobs.jump_receiver.try_recv() {
             if let Some(page_ext) = jobs.ext_map.remove(&path) {
-                extract_single_file(&source, path, page_ext, &completed_jobs)?;
+                stats::dequeue_extractions(1);
+                let size = files.iter().find(|(n, _)| *n == path).map(|(_, s)| *s as u64);
+                extract_single_file(&source, path, page_ext, size, &completed_jobs)?;
             }
         }
 
         let mut data = Vec::with_capacity(*size);
         reader.take(*size as u64).read_to_end(&mut data)?;
 
+        // unrar stops writing early on corrupt or truncated archives.
         if let Some((_, job)) = jobs.ext_map.remove_entry(name) {
-            completed_jobs.send((job, data))?;
+            stats::dequeue_extractions(1);
+            let expected = Expected { crc: None, size: Some(*size as u64) };
+            send_verified(job, data, expected, name, &completed_jobs)?;
         }
     }
 
@@ -75,25 +173,19 @@ pub fn reader(
     Ok(())
 }
 
-
 fn extract_single_file<P: AsRef<Path>>(
     source: P,
     relpath: String,
     job: PageExtraction,
+    size: Option<u64>,
     completed_jobs: &Sender<(PageExtraction, Vec<u8>)>,
 ) -> Result<()> {
     debug!("Extracting {} early", relpath);
 
-    let process = Command::new("unrar")
-        .args(&["p", "-inul", "--"])
-        .arg(source.as_ref())
-        .arg(&relpath)
-        .stdout(Stdio::piped())
-        .spawn()?;
-
-    match process.wait_with_output() {
-        Ok(output) => {
-            completed_jobs.send((job, output.stdout))?;
+    match extract_file(source.as_ref(), &relpath) {
+        Ok(data) => {
+            let expected = Expected { crc: None, size };
+            send_verified(job, data, expected, &relpath, completed_jobs)?;
         }
         Err(e) => {
             // A file that's missing from an archive is not a fatal error.
@@ -104,9 +196,25 @@ fn extract_single_file<P: AsRef<Path>>(
     Ok(())
 }
 
+pub fn extract_file(source: &Path, relpath: &str) -> Result<Vec<u8>> {
+    let output = unrar_command(source, "p")
+        .arg("-inul")
+        .arg("--")
+        .arg(source)
+        .arg(relpath)
+        .stdout(Stdio::piped())
+        .output()?;
+
+    // unrar still writes out whatever it managed to extract from a corrupt file.
+    if !output.status.success() {
+        return Err(format!("unrar exited with {}", output.status).into());
+    }
+    Ok(output.stdout)
+}
+
 pub fn read_files<P: AsRef<Path>>(source: P) -> Result<Vec<(String, usize)>> {
-    let mut process = Command::new("unrar")
-        .args(&["l", "--"])
+    let mut process = unrar_command(source.as_ref(), "l")
+        .arg("--")
         .arg(source.as_ref())
         .stdout(Stdio::piped())
         .spawn()?;
@@ -0,0 +1,231 @@
+// A minimal HTTP server for reading the current archive from another device.
+// This only needs to serve a single page and the images themselves, so it doesn't justify pulling
+// in a full HTTP stack.
+
+use std::net::SocketAddr;
+use std::path::Path;
+use std::{io, thread};
+
+use gtk::glib::Sender;
+use serde_json::Value;
+use tokio::net::{TcpListener, TcpStream};
+use tokio::select;
+
+use crate::com::GuiAction;
+use crate::socket::handle_command;
+use crate::{closing, config, spawn_thread};
+
+static INDEX: &str = include_str!("index.html");
+
+// Requests are only ever simple GETs, anything larger than this is not a client we care about.
+const MAX_REQUEST_SIZE: usize = 8 * 1024;
+
+struct Response {
+    status: &'static str,
+    content_type: &'static str,
+    body: Vec<u8>,
+}
+
+impl Response {
+    fn error(status: &'static str) -> Self {
+        Self {
+            status,
+            content_type: "text/plain; charset=utf-8",
+            body: status.as_bytes().to_vec(),
+        }
+    }
+}
+
+pub(super) fn init(gui_sender: &Sender<GuiAction>) -> Option<thread::JoinHandle<()>> {
+    let addr = config::CONFIG.web_server?;
+    let gui_sender = gui_sender.clone();
+
+    Some(spawn_thread("web", move || listen(addr, gui_sender)))
+}
+
+fn content_type(path: &Path) -> &'static str {
+    let ext = path.extension().map(|e| e.to_string_lossy().to_lowercase());
+    match ext.as_deref() {
+        Some("jpg" | "jpeg") => "image/jpeg",
+        Some("png") => "image/png",
+        Some("gif") => "image/gif",
+        Some("webp") => "image/webp",
+        Some("avif") => "image/avif",
+        Some("jxl") => "image/jxl",
+        Some("bmp") => "image/bmp",
+        Some("svg") => "image/svg+xml",
+        Some("mp4" | "m4v") => "video/mp4",
+        Some("webm") => "video/webm",
+        _ => "application/octet-stream",
+    }
+}
+
+fn json(v: &Value) -> Response {
+    Response {
+        status: "200 OK",
+        content_type: "application/json",
+        body: v.to_string().into_bytes(),
+    }
+}
+
+async fn route(path: &str, gui_sender: &Sender<GuiAction>) -> Response {
+    match path {
+        "/" | "/index.html" => Response {
+            status: "200 OK",
+            content_type: "text/html; charset=utf-8",
+            body: INDEX.as_bytes().to_vec(),
+        },
+        "/status" => {
+            // Only expose what the client needs rather than the full set of environment variables.
+            let status = handle_command("Status".to_string(), gui_sender).await;
+            let page = status.get("AWMAN_PAGE_NUMBER").cloned().unwrap_or(Value::Null);
+            json(&serde_json::json!({ "page": page }))
+        }
+        "/pages" => json(&handle_command("ListPages".to_string(), gui_sender).await),
+        _ => {
+            let n = match path.strip_prefix("/page/").map(str::parse::<usize>) {
+                Some(Ok(n)) => n,
+                _ => return Response::error("404 Not Found"),
+            };
+
+            // Look the page up each time, the archive may have changed since the last request.
+            // Only files that belong to the current archive can ever be served.
+            let pages = handle_command("ListPages".to_string(), gui_sender).await;
+            let abs_path = match pages.get(n) {
+                Some(p) => p.get("abs_path").and_then(Value::as_str),
+                None => return Response::error("404 Not Found"),
+            };
+
+            // Not extracted yet, the client will retry.
+            let abs_path = match abs_path {
+                Some(p) => Path::new(p),
+                None => return Response::error("503 Service Unavailable"),
+            };
+
+            match tokio::fs::read(abs_path).await {
+                Ok(body) => Response {
+                    status: "200 OK",
+                    content_type: content_type(abs_path),
+                    body,
+                },
+                Err(e) => {
+                    error!("Failed to read {:?} for web server: {:?}", abs_path, e);
+                    Response::error("500 Internal Server Error")
+                }
+            }
+        }
+    }
+}
+
+async fn read_request(stream: &TcpStream) -> io::Result<Option<String>> {
+    let mut buf = Vec::new();
+
+    loop {
+        select! {
+            r = stream.readable() => r?,
+            _ = closing::closed_fut() => return Ok(None),
+        }
+
+        let mut chunk = [0; 1024];
+        match stream.try_read(&mut chunk) {
+            Ok(0) => return Ok(None),
+            Ok(n) => buf.extend_from_slice(&chunk[..n]),
+            Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => continue,
+            Err(e) => return Err(e),
+        }
+
+        if buf.windows(4).any(|w| w == b"\r\n\r\n") {
+            break;
+        }
+
+        if buf.len() > MAX_REQUEST_SIZE {
+            return Ok(None);
+        }
+    }
+
+    let req = String::from_utf8_lossy(&buf);
+    let mut first = req.lines().next().unwrap_or_default().split(' ');
+
+    match (first.next(), first.next()) {
+        (Some("GET"), Some(path)) => Ok(Some(path.to_string())),
+        _ => Ok(None),
+    }
+}
+
+async fn write_all(stream: &TcpStream, data: &[u8]) -> io::Result<()> {
+    let mut i = 0;
+
+    while i < data.len() {
+        select! {
+            r = stream.writable() => r?,
+            _ = closing::closed_fut() => return Ok(()),
+        }
+
+        match stream.try_write(&data[i..]) {
+            Ok(n) => i += n,
+            Err(ref e) if e.kind() == io::ErrorKind::WouldBlock => continue,
+            Err(e) => return Err(e),
+        }
+    }
+
+    Ok(())
+}
+
+async fn handle_stream(stream: TcpStream, gui_sender: Sender<GuiAction>) {
+    let resp = match read_request(&stream).await {
+        Ok(Some(path)) => route(&path, &gui_sender).await,
+        Ok(None) => Response::error("400 Bad Request"),
+        Err(e) => {
+            error!("Web server stream error {:?}", e);
+            return;
+        }
+    };
+
+    let header = format!(
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nCache-Control: no-cache\r\n\
+         Connection: close\r\n\r\n",
+        resp.status,
+        resp.content_type,
+        resp.body.len()
+    );
+
+    if let Err(e) = write_all(&stream, header.as_bytes()).await {
+        error!("Web server stream error {:?}", e);
+        return;
+    }
+
+    if let Err(e) = write_all(&stream, &resp.body).await {
+        error!("Web server stream error {:?}", e);
+    }
+}
+
+#[tokio::main(flavor = "current_thread")]
+async fn listen(addr: SocketAddr, gui_sender: Sender<GuiAction>) {
+    let listener = match TcpListener::bind(addr).await {
+        Ok(l) => l,
+        Err(e) => {
+            error!("Failed to start web server on {:?}: {:?}", addr, e);
+            return;
+        }
+    };
+    info!("Web server listening on http://{}", addr);
+
+    loop {
+        select! {
+            conn = listener.accept() => {
+                match conn {
+                    Ok((stream, _addr)) => {
+                        let gui_sender = gui_sender.clone();
+                        tokio::spawn(async {
+                            handle_stream(stream, gui_sender).await
+                        });
+                    }
+                    Err(e) => {
+                        error!("Web server listener error {:?}", e);
+                    }
+                }
+            }
+            _ = closing::closed_fut() => break,
+        }
+    }
+}